@@ -5,26 +5,58 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/urfave/cli/v2"
 	"github.com/vitalvas/gokit/xcmd"
 	"github.com/vitalvas/oneauth/cmd/oneauth/config"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcclient"
 	"github.com/vitalvas/oneauth/cmd/oneauth/rpcserver"
 	"github.com/vitalvas/oneauth/cmd/oneauth/service"
 	"github.com/vitalvas/oneauth/cmd/oneauth/sshagent"
+	"github.com/vitalvas/oneauth/internal/audit"
 	"github.com/vitalvas/oneauth/internal/buildinfo"
 	"github.com/vitalvas/oneauth/internal/logger"
+	"github.com/vitalvas/oneauth/internal/netutil"
+	"github.com/vitalvas/oneauth/internal/policy"
 	"github.com/vitalvas/oneauth/internal/tools"
 	"golang.org/x/sync/errgroup"
 )
 
+// names of the sockets passed by systemd socket activation, other names are the names of the agents
+const (
+	activatedMainSocket    = "main"
+	activatedControlSocket = "control"
+)
+
 var agentCmd = &cli.Command{
 	Name:        "agent",
 	Usage:       "SSH Agent",
 	Description: "All configuration options can be set in the config file",
-	Before: func(_ *cli.Context) error {
+	Subcommands: []*cli.Command{
+		agentStatusCmd,
+		agentKeysCmd,
+		agentLockCmd,
+		agentUnlockCmd,
+		agentForgetCmd,
+		agentReloadCmd,
+	},
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "handoff",
+			Usage: "Take over the sockets and keys of the running agent",
+		},
+	},
+	Before: func(c *cli.Context) error {
+		// subcommands talk to a running agent
+		if c.Args().Present() {
+			return nil
+		}
+
 		version := buildinfo.Version
 
 		commit := buildinfo.Commit
@@ -37,7 +69,10 @@ var agentCmd = &cli.Command{
 		return nil
 	},
 	Action: func(c *cli.Context) error {
-		group, ctx := errgroup.WithContext(c.Context)
+		ctx, stop := context.WithCancel(c.Context)
+		defer stop()
+
+		group, ctx := errgroup.WithContext(ctx)
 
 		config, err := config.Load(c.Path("config"))
 		if err != nil {
@@ -46,43 +81,124 @@ var agentCmd = &cli.Command{
 
 		log := logger.New(config.AgentLogPath)
 
-		if config.Keyring.Yubikey.Serial == 0 {
+		if len(config.Keyring.Yubikey.AllSerials()) == 0 {
 			return fmt.Errorf("yubikey serial is required")
 		}
 
-		var agent *sshagent.SSHAgent
+		runtime := newAgentRuntime(ctx, group, log, c.Path("config"), config)
+		runtime.stop = stop
 
-		// Track all socket paths for permission fixing
-		socketPaths := []string{config.ControlSocketPath}
+		engine, err := policy.New(config.Policy)
+		if err != nil {
+			return fmt.Errorf("invalid policy: %w", err)
+		}
 
-		// Track all soft agents for shutdown
-		softAgents := make(map[string]*sshagent.SoftAgent)
+		runtime.policy = engine
+
+		if err := validateAccess(config); err != nil {
+			return err
+		}
+
+		if err := validatePersist(config); err != nil {
+			return err
+		}
+
+		if err := validateUpstreams(config); err != nil {
+			return err
+		}
+
+		if err := validateSlots(config); err != nil {
+			return err
+		}
+
+		activated, err := netutil.ActivatedListeners()
+		if err != nil {
+			return fmt.Errorf("failed to use activated sockets: %w", err)
+		}
+
+		runtime.activated = activated
+
+		var handoff *rpcclient.Handoff
+
+		if c.Bool("handoff") {
+			handoff, err = runtime.takeOver(ctx, config.ControlSocketPath)
+			if err != nil {
+				return fmt.Errorf("failed to take over the running agent: %w", err)
+			}
+
+			if handoff != nil {
+				// the running agent keeps serving when this one fails to start
+				defer func() {
+					if handoff != nil {
+						handoff.Close()
+					}
+				}()
+			}
+		}
+
+		if !config.Audit.Disabled {
+			auditLog, err := audit.New(config.Audit.Path, config.Audit.MaxSizeMB<<20, config.Audit.MaxFiles)
+			if err != nil {
+				return fmt.Errorf("failed to open audit log: %w", err)
+			}
+
+			defer auditLog.Close()
+
+			runtime.audit = auditLog
+		}
 
 		switch config.Socket.Type {
 		case "unix":
-			if _, err := os.Stat(config.Socket.Path); err == nil {
-				os.Remove(config.Socket.Path)
-			}
+			socketPath := config.Socket.Path
+
+			listener, inherited := runtime.takeListener(activatedMainSocket)
+			if inherited {
+				socketPath = listener.Addr().String()
 
-			if err := tools.MkDir(filepath.Dir(config.Socket.Path), 0700); err != nil {
-				return fmt.Errorf("failed to create directory: %w", err)
+				log.Println("using activated socket", socketPath)
+			} else {
+				if _, err := os.Stat(socketPath); err == nil {
+					os.Remove(socketPath)
+				}
+
+				if err := tools.MkDir(filepath.Dir(socketPath), 0700); err != nil {
+					return fmt.Errorf("failed to create directory: %w", err)
+				}
 			}
 
-			log.WithField("yubikey", config.Keyring.Yubikey.Serial).Println("opening yubikey:", config.Keyring.Yubikey.Serial)
+			serials := config.Keyring.Yubikey.AllSerials()
 
-			agent, err = sshagent.New(config.Keyring.Yubikey.Serial, log, config)
+			log.Println("opening yubikeys:", serials)
+
+			agent, err := sshagent.New(serials, log, config)
 			if err != nil {
 				return fmt.Errorf("failed to create agent: %w", err)
 			}
 
-			if err := service.SetSSHAuthSock(config.Socket.Path); err != nil {
+			agent.SetAuditLogger(runtime.audit)
+			agent.SetActions(runtime.agentActions())
+			agent.SetLockPolicy(runtime.lockPolicy())
+			agent.SetLockHook(runtime.lockSoftAgents)
+
+			if inherited {
+				agent.SetListener(listener)
+			}
+
+			runtime.agent = agent
+			runtime.socketPath = socketPath
+
+			runtime.adoptHandoff(rpcapi.DefaultAgent, agent.Adopt)
+
+			if err := service.SetSSHAuthSock(socketPath); err != nil {
 				log.Printf("failed to set SSH_AUTH_SOCK: %v", err)
 			}
 
-			socketPaths = append(socketPaths, config.Socket.Path)
+			group.Go(func() error {
+				return agent.ListenAndServe(ctx, socketPath)
+			})
 
 			group.Go(func() error {
-				return agent.ListenAndServe(ctx, config.Socket.Path)
+				return agent.WatchYubikeys(ctx)
 			})
 
 		case "dummy":
@@ -92,33 +208,78 @@ var agentCmd = &cli.Command{
 			return fmt.Errorf("socket type %s is not supported", config.Socket.Type)
 		}
 
+		// the control socket is taken first, so an agent with the same name does not take it
+		controlListener, _ := runtime.takeListener(activatedControlSocket)
+
 		// Start additional soft-key agents
-		for name, agentConfig := range config.Agents {
-			if _, err := os.Stat(agentConfig.SocketPath); err == nil {
-				os.Remove(agentConfig.SocketPath)
-			}
+		if err := runtime.startSoftAgents(); err != nil {
+			return err
+		}
 
-			if err := tools.MkDir(filepath.Dir(agentConfig.SocketPath), 0700); err != nil {
-				return fmt.Errorf("failed to create directory for agent %s: %w", name, err)
-			}
+		runtime.closeActivated()
+		runtime.handoff = nil
 
-			softAgent := sshagent.NewSoftAgent(name, agentConfig.KeepKeySeconds, log)
-			softAgents[name] = softAgent
-			socketPaths = append(socketPaths, agentConfig.SocketPath)
+		rpcServer := rpcserver.New(runtime.agent, log)
+		rpcServer.SetAgentID(config.AgentID.String())
+		rpcServer.SetSoftAgents(runtime.SoftAgents())
+		rpcServer.SetReloader(runtime.Reload)
+		rpcServer.SetHandoffer(runtime)
+		rpcServer.SetProber(runtime.doctorProbes)
+		rpcServer.SetAccess(config.ControlSocketAccess())
+		rpcServer.SetAuditLogger(runtime.audit)
 
-			group.Go(func() error {
-				return softAgent.ListenAndServe(ctx, agentConfig.SocketPath)
-			})
+		runtime.rpcServer = rpcServer
+
+		controlSocketPath := config.ControlSocketPath
+		if controlListener != nil {
+			controlSocketPath = controlListener.Addr().String()
+			rpcServer.SetListener(controlListener)
 		}
 
-		rpcServer := rpcserver.New(agent, log)
+		group.Go(func() error {
+			return rpcServer.ListenAndServe(ctx, controlSocketPath)
+		})
+
+		if handoff != nil {
+			if err := handoff.Ready(); err != nil {
+				log.Warnln("failed to confirm the handoff:", err)
+			}
+
+			handoff = nil
+
+			if runtime.serviceHandoff {
+				if err := runtime.writeHandoffToken(config.ControlSocketPath); err != nil {
+					log.Warnln("failed to leave a handoff token for the service:", err)
+				}
+			}
+		}
 
 		group.Go(func() error {
-			return rpcServer.ListenAndServe(ctx, config.ControlSocketPath)
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			defer signal.Stop(hup)
+
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+
+				case <-hup:
+					log.Println("reloading config on SIGHUP")
+
+					// errors are logged by Reload, the agent keeps the previous config
+					runtime.Reload(ctx)
+				}
+			}
 		})
 
 		group.Go(func() error {
 			err := xcmd.WaitInterrupted(ctx)
+			if ctx.Err() != nil {
+				// stopped after a handoff or a failed agent, the error of the latter is returned by the group
+				err = nil
+			}
+
 			log.Println("shutting down agent")
 
 			go func() {
@@ -127,25 +288,15 @@ var agentCmd = &cli.Command{
 				os.Exit(0)
 			}()
 
-			if agent != nil {
-				agent.Shutdown()
-			}
-
-			// Shutdown all soft agents
-			for _, softAgent := range softAgents {
-				softAgent.Shutdown()
-			}
-
-			if rpcServer != nil {
-				rpcServer.Shutdown()
-			}
+			runtime.shutdown()
+			rpcServer.Shutdown()
 
 			return err
 		})
 
 		group.Go(func() error {
 			return xcmd.PeriodicRun(ctx, func(_ context.Context) error {
-				for _, path := range socketPaths {
+				for _, path := range runtime.socketPaths() {
 					if stat, err := os.Stat(path); err == nil {
 						if perm := stat.Mode().Perm(); perm != 0600 {
 							log.Printf("fixing permissions on %s from %d", path, perm)
@@ -0,0 +1,53 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/vitalvas/oneauth/cmd/oneauth/doctor"
+	"github.com/vitalvas/oneauth/internal/yubikey"
+)
+
+// doctorProbes are the probes of the doctor endpoint, the YubiKeys are read through the agent that holds them
+func (r *agentRuntime) doctorProbes() []doctor.Probe {
+	r.mu.Lock()
+	serials := r.config.Keyring.Yubikey.AllSerials()
+	r.mu.Unlock()
+
+	load := doctor.LocalCards
+	if r.agent != nil {
+		load = r.agentCards
+	}
+
+	return append(doctor.CardProbes(serials, load), doctor.SocketProbe(r.socketPaths()))
+}
+
+// agentCards reads the plugged in YubiKeys of the agent
+func (r *agentRuntime) agentCards(ctx context.Context) ([]doctor.Card, error) {
+	absent := r.agent.AbsentSerials()
+
+	var cards []doctor.Card
+
+	for _, serial := range r.agent.Serials() {
+		if slices.Contains(absent, serial) {
+			continue
+		}
+
+		err := r.agent.WithYubikey(ctx, serial, func(yk *yubikey.Yubikey) error {
+			certs, err := yk.ListKeys(yubikey.AllSlots...)
+			if err != nil {
+				return fmt.Errorf("failed to list keys of yubikey %d: %w", yk.Serial, err)
+			}
+
+			cards = append(cards, doctor.Card{Serial: yk.Serial, Version: yk.Version(), Certs: certs})
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return cards, nil
+}
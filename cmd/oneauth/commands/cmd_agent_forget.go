@@ -0,0 +1,114 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcclient"
+)
+
+var agentForgetCmd = &cli.Command{
+	Name:      "forget",
+	Usage:     "Remove keys added with ssh-add from the running agent",
+	ArgsUsage: "[fingerprint...]",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "agent",
+			Usage: "remove keys only from the named agent",
+		},
+		&cli.BoolFlag{
+			Name:  "all",
+			Usage: "remove all keys added with ssh-add",
+		},
+		jsonFlag,
+	},
+	Action: func(c *cli.Context) error {
+		fingerprints := c.Args().Slice()
+		removeAll := c.Bool("all")
+
+		if len(fingerprints) == 0 && !removeAll {
+			return errors.New("fingerprint or --all is required")
+		}
+
+		if len(fingerprints) > 0 && removeAll {
+			return errors.New("fingerprints can not be used with --all")
+		}
+
+		client, err := controlClient(c)
+		if err != nil {
+			return err
+		}
+
+		removed, err := forgetKeys(c, client, c.String("agent"), fingerprints, removeAll)
+		if err != nil {
+			return err
+		}
+
+		if c.Bool("json") {
+			return printJSON(rpcapi.RemoveKeysResponse{Removed: removed})
+		}
+
+		fmt.Printf("removed %d keys\n", removed)
+
+		return nil
+	},
+}
+
+// forgetKeys removes soft keys from the agents that hold them
+func forgetKeys(c *cli.Context, client *rpcclient.Client, agentName string, fingerprints []string, removeAll bool) (int, error) {
+	keys, err := client.Keys(c.Context)
+	if err != nil {
+		return 0, err
+	}
+
+	var removed int
+
+	for _, row := range keys.Agents {
+		if agentName != "" && row.Name != agentName {
+			continue
+		}
+
+		req := rpcapi.RemoveKeysRequest{
+			Agent: row.Name,
+			All:   removeAll,
+		}
+
+		if !removeAll {
+			req.Fingerprints = agentSoftKeys(row, fingerprints)
+		}
+
+		if len(req.Fingerprints) == 0 && !req.All {
+			continue
+		}
+
+		resp, err := client.RemoveKeys(c.Context, req)
+		if err != nil {
+			return removed, fmt.Errorf("agent %s: %w", row.Name, err)
+		}
+
+		removed += resp.Removed
+	}
+
+	return removed, nil
+}
+
+// agentSoftKeys returns the fingerprints of soft keys held by the agent
+func agentSoftKeys(row rpcapi.Agent, fingerprints []string) []string {
+	var out []string
+
+	for _, key := range row.Keys {
+		if key.Source != rpcapi.KeySourceSoft {
+			continue
+		}
+
+		for _, fp := range fingerprints {
+			if key.Fingerprint == fp {
+				out = append(out, fp)
+			}
+		}
+	}
+
+	return out
+}
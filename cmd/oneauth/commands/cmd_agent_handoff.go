@@ -0,0 +1,261 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcclient"
+	"github.com/vitalvas/oneauth/cmd/oneauth/service"
+	"github.com/vitalvas/oneauth/internal/buildinfo"
+	"github.com/vitalvas/oneauth/internal/netutil"
+)
+
+// handoffDrainTimeout is how long an agent that handed off serves the connections it accepted before it stops
+const handoffDrainTimeout = 5 * time.Second
+
+// handoffTimeout bounds the wait for the state of the running agent
+const handoffTimeout = 30 * time.Second
+
+var (
+	errHandoffInProgress = errors.New("handoff is in progress")
+	errNoHandoffToken    = errors.New("an agent is running and no handoff token was passed, restart it with `oneauth service restart`")
+)
+
+// handoffTokenFile is where an agent process started by `oneauth service restart` leaves a token for the service
+func handoffTokenFile(controlSocketPath string) string {
+	return filepath.Join(filepath.Dir(controlSocketPath), "handoff.token")
+}
+
+// readHandoffToken returns the token passed by `oneauth service restart`, or left for the service in the token file.
+// The token is removed from the environment and the file is deleted, so it is read once.
+func readHandoffToken(controlSocketPath string) (string, bool, error) {
+	if token, ok := os.LookupEnv(service.HandoffTokenEnv); ok {
+		os.Unsetenv(service.HandoffTokenEnv)
+		return token, true, nil
+	}
+
+	path := handoffTokenFile(controlSocketPath)
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", false, nil
+	}
+
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read handoff token: %w", err)
+	}
+
+	if err := os.Remove(path); err != nil {
+		return "", false, fmt.Errorf("failed to remove handoff token: %w", err)
+	}
+
+	return strings.TrimSpace(string(data)), false, nil
+}
+
+// writeHandoffToken leaves a token for the service, it takes over once its supervisor starts it again
+func (r *agentRuntime) writeHandoffToken(controlSocketPath string) error {
+	token, err := r.rpcServer.NewHandoffToken()
+	if err != nil {
+		return err
+	}
+
+	path := handoffTokenFile(controlSocketPath)
+
+	// a file left by another user would keep its mode
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return os.WriteFile(path, []byte(token), 0600)
+}
+
+// takeOver asks the running agent for its sockets and keys, it returns nil when no agent is running.
+// The sockets are added to the activated ones, so the agents use them like sockets passed by systemd.
+func (r *agentRuntime) takeOver(ctx context.Context, controlSocketPath string) (*rpcclient.Handoff, error) {
+	ctx, cancel := context.WithTimeout(ctx, handoffTimeout)
+	defer cancel()
+
+	token, fromEnv, err := readHandoffToken(controlSocketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	client := rpcclient.New(controlSocketPath)
+
+	if token == "" {
+		if _, err := client.Health(ctx); errors.Is(err, rpcclient.ErrAgentNotRunning) {
+			return nil, nil
+		}
+
+		return nil, errNoHandoffToken
+	}
+
+	handoff, err := client.Handoff(ctx, token)
+	if errors.Is(err, rpcclient.ErrAgentNotRunning) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	r.serviceHandoff = fromEnv
+
+	r.log.Printf("taking over from agent %s with %d sockets", handoff.State.Version, len(handoff.Listeners))
+
+	if r.activated == nil {
+		r.activated = make(map[string]net.Listener, len(handoff.Listeners))
+	}
+
+	for name, listener := range handoff.Listeners {
+		if _, ok := r.activated[name]; ok {
+			listener.Close()
+			continue
+		}
+
+		r.activated[name] = listener
+	}
+
+	r.handoff = &handoff.State
+
+	return handoff, nil
+}
+
+// adoptHandoff adds the keys the agent that handed off had for the agent with the name
+func (r *agentRuntime) adoptHandoff(name string, adopt func(rpcapi.HandoffAgent) error) {
+	if r.handoff == nil {
+		return
+	}
+
+	state, ok := r.handoff.Agents[name]
+	if !ok {
+		return
+	}
+
+	if err := adopt(state); err != nil {
+		r.log.Warnf("failed to adopt keys of agent %s: %v", name, err)
+	}
+}
+
+// HandoffState passes the sockets and keys added with ssh-add to another agent process,
+// the sockets are served by both until HandedOff is called
+func (r *agentRuntime) HandoffState() (rpcapi.HandoffState, []*os.File, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.handingOff != nil {
+		return rpcapi.HandoffState{}, nil, errHandoffInProgress
+	}
+
+	state := rpcapi.HandoffState{
+		Version: buildinfo.Version,
+		Agents:  make(map[string]rpcapi.HandoffAgent),
+	}
+
+	var listeners []net.Listener
+
+	// an agent named like the main or control socket keeps its socket, the other process creates it again
+	addSocket := func(name string, listener net.Listener) {
+		if listener != nil && !slices.Contains(state.Sockets, name) {
+			state.Sockets = append(state.Sockets, name)
+			listeners = append(listeners, listener)
+		}
+	}
+
+	if r.agent != nil {
+		agentState, err := r.agent.Handoff()
+		if err != nil {
+			return rpcapi.HandoffState{}, nil, fmt.Errorf("agent %s: %w", rpcapi.DefaultAgent, err)
+		}
+
+		state.Agents[rpcapi.DefaultAgent] = agentState
+		addSocket(activatedMainSocket, r.agent.Listener())
+	}
+
+	if r.rpcServer != nil {
+		addSocket(activatedControlSocket, r.rpcServer.Listener())
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(r.softAgents)) {
+		softAgent := r.softAgents[name].agent
+
+		agentState, err := softAgent.Handoff()
+		if err != nil {
+			return rpcapi.HandoffState{}, nil, fmt.Errorf("agent %s: %w", name, err)
+		}
+
+		state.Agents[name] = agentState
+		addSocket(name, softAgent.Listener())
+	}
+
+	files := make([]*os.File, 0, len(listeners))
+
+	for i, listener := range listeners {
+		file, err := netutil.ListenerFile(listener)
+		if err != nil {
+			for _, file := range files {
+				file.Close()
+			}
+
+			r.restoreUnlink(listeners[:i])
+
+			return rpcapi.HandoffState{}, nil, fmt.Errorf("socket %s: %w", state.Sockets[i], err)
+		}
+
+		files = append(files, file)
+	}
+
+	r.handingOff = listeners
+
+	return state, files, nil
+}
+
+// HandedOff stops the agent once the other process serves the sockets, the agent keeps running when the handoff failed
+func (r *agentRuntime) HandedOff(err error) {
+	r.mu.Lock()
+	listeners := r.handingOff
+	r.handingOff = nil
+
+	if err != nil {
+		r.restoreUnlink(listeners)
+	}
+
+	r.mu.Unlock()
+
+	if err != nil {
+		r.log.Warnln("handoff failed, the agent keeps running:", err)
+		return
+	}
+
+	r.log.Println("handed off to the new agent process, stopping in", handoffDrainTimeout)
+
+	// new connections are accepted by the other process, the open ones are served until the agent stops
+	for _, listener := range listeners {
+		listener.Close()
+	}
+
+	if r.stop != nil {
+		time.AfterFunc(handoffDrainTimeout, r.stop)
+	}
+}
+
+// restoreUnlink removes the socket files with the listeners again after a failed handoff,
+// except for the inherited sockets, their files belong to systemd or are kept for the next handoff.
+// It must be called with the runtime lock held.
+func (r *agentRuntime) restoreUnlink(listeners []net.Listener) {
+	for _, listener := range listeners {
+		if !slices.Contains(r.inherited, listener) {
+			netutil.SetUnlinkOnClose(listener, true)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package commands
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+)
+
+var agentKeysCmd = &cli.Command{
+	Name:  "keys",
+	Usage: "List keys served by the running agent",
+	Flags: []cli.Flag{
+		jsonFlag,
+	},
+	Action: func(c *cli.Context) error {
+		client, err := controlClient(c)
+		if err != nil {
+			return err
+		}
+
+		keys, err := client.Keys(c.Context)
+		if err != nil {
+			return err
+		}
+
+		if c.Bool("json") {
+			return printJSON(keys)
+		}
+
+		for _, row := range keys.Agents {
+			printAgentKeys(row)
+		}
+
+		return nil
+	},
+}
+
+func printAgentKeys(row rpcapi.Agent) {
+	if row.Locked {
+		fmt.Printf("%s (locked)\n", row.Name)
+	} else {
+		fmt.Println(row.Name)
+	}
+
+	if row.Error != "" {
+		fmt.Println(" - error:", row.Error)
+	}
+
+	if len(row.Keys) == 0 {
+		fmt.Println(" - no keys")
+	}
+
+	for _, key := range row.Keys {
+		source := key.Source
+		if key.Slot != "" {
+			source = fmt.Sprintf("0x%s", key.Slot)
+		}
+
+		fmt.Printf(" - %s | %s %s %s\n", source, key.Type, key.Fingerprint, key.Comment)
+
+		if key.ExpiresAt != nil {
+			fmt.Printf("   - expires: %s\n", key.ExpiresAt.Local().Format(time.RFC3339))
+		}
+
+		if key.LastUsed != nil {
+			fmt.Printf("   - last used: %s\n", key.LastUsed.Local().Format(time.RFC3339))
+		}
+
+		if key.ConfirmBeforeUse {
+			fmt.Println("   - confirm before use")
+		}
+
+		if key.DestinationConstrained {
+			fmt.Println("   - destination constrained")
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+)
+
+var agentLockCmd = &cli.Command{
+	Name:  "lock",
+	Usage: "Lock the running agent",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "agent",
+			Usage: "lock only the named agent",
+		},
+		&cli.BoolFlag{
+			Name:  "pin",
+			Usage: "lock without a passphrase, the agent is unlocked with the YubiKey PIN",
+		},
+		jsonFlag,
+	},
+	Action: func(c *cli.Context) error {
+		client, err := controlClient(c)
+		if err != nil {
+			return err
+		}
+
+		req := rpcapi.LockRequest{
+			PIN:   c.Bool("pin"),
+			Agent: c.String("agent"),
+		}
+
+		if !req.PIN {
+			passphrase, err := readPassphrase("Enter lock passphrase: ")
+			if err != nil {
+				return err
+			}
+
+			if passphrase == "" {
+				return errors.New("passphrase is required")
+			}
+
+			req.Passphrase = passphrase
+		}
+
+		resp, err := client.Lock(c.Context, req)
+		if err != nil {
+			return err
+		}
+
+		if c.Bool("json") {
+			return printJSON(resp)
+		}
+
+		printLockedAgents("locked", resp.Agents)
+
+		return nil
+	},
+}
+
+var agentUnlockCmd = &cli.Command{
+	Name:  "unlock",
+	Usage: "Unlock the running agent",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "agent",
+			Usage: "unlock only the named agent",
+		},
+		jsonFlag,
+	},
+	Action: func(c *cli.Context) error {
+		client, err := controlClient(c)
+		if err != nil {
+			return err
+		}
+
+		passphrase, err := readPassphrase("Enter lock passphrase or YubiKey PIN: ")
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Unlock(c.Context, rpcapi.LockRequest{
+			Passphrase: passphrase,
+			Agent:      c.String("agent"),
+		})
+		if err != nil {
+			return err
+		}
+
+		if c.Bool("json") {
+			return printJSON(resp)
+		}
+
+		printLockedAgents("unlocked", resp.Agents)
+
+		return nil
+	},
+}
+
+func printLockedAgents(action string, agents []string) {
+	if len(agents) == 0 {
+		fmt.Printf("no agents %s\n", action)
+		return
+	}
+
+	fmt.Printf("%s agents: %s\n", action, strings.Join(agents, ", "))
+}
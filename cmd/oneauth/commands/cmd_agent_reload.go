@@ -0,0 +1,43 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+)
+
+var agentReloadCmd = &cli.Command{
+	Name:  "reload",
+	Usage: "Reload the config file in the running agent",
+	Flags: []cli.Flag{
+		jsonFlag,
+	},
+	Action: func(c *cli.Context) error {
+		client, err := controlClient(c)
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Reload(c.Context)
+		if err != nil {
+			return err
+		}
+
+		if c.Bool("json") {
+			return printJSON(resp)
+		}
+
+		if len(resp.Changes) == 0 {
+			fmt.Println("config reloaded, nothing changed")
+			return nil
+		}
+
+		fmt.Println("config reloaded:")
+
+		for _, change := range resp.Changes {
+			fmt.Println(" -", change)
+		}
+
+		return nil
+	},
+}
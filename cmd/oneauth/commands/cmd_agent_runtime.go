@@ -0,0 +1,691 @@
+package commands
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vitalvas/oneauth/cmd/oneauth/config"
+	"github.com/vitalvas/oneauth/cmd/oneauth/paths"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcserver"
+	"github.com/vitalvas/oneauth/cmd/oneauth/sshagent"
+	"github.com/vitalvas/oneauth/internal/audit"
+	"github.com/vitalvas/oneauth/internal/keyvault"
+	"github.com/vitalvas/oneauth/internal/policy"
+	"github.com/vitalvas/oneauth/internal/tools"
+	"github.com/vitalvas/oneauth/internal/yubikey"
+	"golang.org/x/sync/errgroup"
+)
+
+// agentRuntime tracks the running agents, so a changed config can be applied without a restart
+type agentRuntime struct {
+	mu sync.Mutex
+
+	ctx        context.Context
+	group      *errgroup.Group
+	log        *logrus.Logger
+	configPath string
+	config     *config.Config
+
+	// sockets opened at startup, they are not moved by a reload
+	controlSocketPath string
+
+	agent      *sshagent.SSHAgent
+	socketPath string
+	softAgents map[string]*runningSoftAgent
+	rpcServer  *rpcserver.RPCServer
+	audit      *audit.Logger
+	policy     *policy.Engine
+
+	// started is set once the initial agents are running, later failures must not stop the process
+	started bool
+
+	// activated are the sockets passed by systemd by name, they are taken by the agents while they start
+	activated map[string]net.Listener
+
+	// inherited are the activated sockets taken by the agents, their files are not removed when they are closed
+	inherited []net.Listener
+
+	// handoff is the state of the agent process this one took over from, it is adopted while the agents start
+	handoff *rpcapi.HandoffState
+
+	// handingOff are the sockets passed to another agent process while it takes over
+	handingOff []net.Listener
+
+	// serviceHandoff is set when `oneauth service restart` started this process, the service takes over from it
+	serviceHandoff bool
+
+	// stop ends the agent process
+	stop context.CancelFunc
+}
+
+type runningSoftAgent struct {
+	agent  *sshagent.SoftAgent
+	config config.AgentConfig
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newAgentRuntime(ctx context.Context, group *errgroup.Group, log *logrus.Logger, configPath string, conf *config.Config) *agentRuntime {
+	return &agentRuntime{
+		ctx:        ctx,
+		group:      group,
+		log:        log,
+		configPath: configPath,
+		config:     conf,
+
+		controlSocketPath: conf.ControlSocketPath,
+		softAgents:        make(map[string]*runningSoftAgent),
+	}
+}
+
+// agentActions returns the sign actions of the YubiKey agent
+func (r *agentRuntime) agentActions() sshagent.Actions {
+	return sshagent.Actions{
+		BeforeSignHook: r.config.Keyring.BeforeSignHook,
+		Askpass:        r.config.Askpass,
+		Policy:         r.policy,
+		Pinentry:       r.config.Pinentry.Program,
+		PINCache:       time.Duration(r.config.Pinentry.CacheSeconds) * time.Second,
+		MinPINRetries:  r.config.Keyring.Yubikey.MinPINRetries,
+	}
+}
+
+// softAgentActions drops the YubiKey before-sign hook, it is not used by soft-key agents
+func (r *agentRuntime) softAgentActions() sshagent.Actions {
+	return sshagent.Actions{
+		Askpass: r.config.Askpass,
+		Policy:  r.policy,
+	}
+}
+
+// lockPolicy returns the rules that lock the agents
+func (r *agentRuntime) lockPolicy() sshagent.LockPolicy {
+	return sshagent.LockPolicy{
+		Idle:             time.Duration(r.config.Lock.IdleMinutes) * time.Minute,
+		OnYubikeyRemoval: r.config.Lock.OnYubikeyRemoval,
+		UnlockWithPIN:    r.config.Lock.UnlockWithPIN,
+		WipeSoftKeys:     r.config.Lock.WipeSoftKeys,
+	}
+}
+
+// setPersistence must be called with the runtime lock held, it applies the persist config of a named agent
+func (r *agentRuntime) setPersistence(name string, softAgent *sshagent.SoftAgent, persist config.AgentPersist) error {
+	if !persist.Enabled {
+		softAgent.SetPersistence(nil, 0, "", nil)
+		return nil
+	}
+
+	if r.agent == nil {
+		return fmt.Errorf("persist of agent %s needs the yubikey agent", name)
+	}
+
+	path, err := paths.AgentKeys(name)
+	if err != nil {
+		return err
+	}
+
+	serial := cmp.Or(persist.Serial, r.config.Keyring.Yubikey.Serial)
+
+	softAgent.SetPersistence(keyvault.New(path), serial, persistSlot(persist), r.agent)
+
+	return nil
+}
+
+// upstreams returns the upstream agents of a named agent
+func upstreams(agentConfig config.AgentConfig) []sshagent.Upstream {
+	out := make([]sshagent.Upstream, 0, len(agentConfig.Upstreams))
+
+	for _, upstream := range agentConfig.Upstreams {
+		out = append(out, sshagent.Upstream{
+			SocketPath:   upstream.SocketPath,
+			Fingerprints: upstream.Fingerprints,
+			Comments:     upstream.Comments,
+		})
+	}
+
+	return out
+}
+
+// yubikeySlots returns the YubiKey slots a named agent serves, the slots are checked by validateSlots
+func yubikeySlots(agentConfig config.AgentConfig) []yubikey.Slot {
+	out := make([]yubikey.Slot, 0, len(agentConfig.Yubikey.Slots))
+
+	for _, name := range agentConfig.Yubikey.Slots {
+		if slot, err := yubikey.ParseSlot(name); err == nil {
+			out = append(out, slot)
+		}
+	}
+
+	return out
+}
+
+// setYubikeySlots must be called with the runtime lock held, it applies the slots a named agent serves
+func (r *agentRuntime) setYubikeySlots(name string, softAgent *sshagent.SoftAgent, agentConfig config.AgentConfig) error {
+	slots := yubikeySlots(agentConfig)
+
+	if len(slots) > 0 && r.agent == nil {
+		return fmt.Errorf("yubikey slots of agent %s need the yubikey agent", name)
+	}
+
+	softAgent.SetYubikeySlots(r.agent, slots)
+
+	return nil
+}
+
+// persistSlot returns the slot that unwraps the persisted keys, the key management slot by default
+func persistSlot(persist config.AgentPersist) string {
+	return cmp.Or(persist.Slot, "9d")
+}
+
+// lockSoftAgents locks the soft-key agents when a removed YubiKey locks the YubiKey agent
+func (r *agentRuntime) lockSoftAgents(reason string) {
+	for name, softAgent := range r.SoftAgents() {
+		if softAgent.Locked() {
+			continue
+		}
+
+		if err := softAgent.AutoLock(reason); err != nil {
+			r.log.Printf("failed to lock agent %s: %v", name, err)
+		}
+	}
+}
+
+// takeListener returns the socket systemd passed with the name, a socket is taken once
+func (r *agentRuntime) takeListener(name string) (net.Listener, bool) {
+	listener, ok := r.activated[name]
+	if ok {
+		delete(r.activated, name)
+		r.inherited = append(r.inherited, listener)
+	}
+
+	return listener, ok
+}
+
+// closeActivated closes the sockets systemd passed that no agent took
+func (r *agentRuntime) closeActivated() {
+	for _, name := range slices.Sorted(maps.Keys(r.activated)) {
+		r.log.Warnf("activated socket %s is not used by any agent", name)
+		r.activated[name].Close()
+	}
+
+	r.activated = nil
+}
+
+// startSoftAgent must be called with the runtime lock held
+func (r *agentRuntime) startSoftAgent(name string, agentConfig config.AgentConfig) error {
+	socketPath := agentConfig.SocketPath
+
+	listener, inherited := r.takeListener(name)
+	if inherited {
+		socketPath = listener.Addr().String()
+	} else {
+		if _, err := os.Stat(socketPath); err == nil {
+			os.Remove(socketPath)
+		}
+
+		if err := tools.MkDir(filepath.Dir(socketPath), 0700); err != nil {
+			return fmt.Errorf("failed to create directory for agent %s: %w", name, err)
+		}
+	}
+
+	softAgent := sshagent.NewSoftAgent(name, agentConfig.KeepKeySeconds, r.log)
+	if inherited {
+		softAgent.SetListener(listener)
+	}
+
+	softAgent.SetActions(r.softAgentActions())
+	softAgent.SetAuditLogger(r.audit)
+	softAgent.SetAccess(agentConfig.Access)
+	softAgent.SetLockPolicy(r.lockPolicy())
+	softAgent.SetUpstreams(upstreams(agentConfig))
+
+	if r.agent != nil {
+		softAgent.SetPINVerifier(r.agent.VerifyPIN)
+	}
+
+	if err := r.setPersistence(name, softAgent, agentConfig.Persist); err != nil {
+		r.log.Warnln("keys of agent", name, "are not persisted:", err)
+	}
+
+	if err := r.setYubikeySlots(name, softAgent, agentConfig); err != nil {
+		r.log.Warnln(err)
+	}
+
+	r.adoptHandoff(name, softAgent.Adopt)
+
+	ctx, cancel := context.WithCancel(r.ctx)
+
+	running := &runningSoftAgent{
+		agent:  softAgent,
+		config: agentConfig,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	r.softAgents[name] = running
+
+	fatal := !r.started
+
+	r.group.Go(func() error {
+		defer close(running.done)
+
+		err := softAgent.ListenAndServe(ctx, socketPath)
+		if err != nil && !fatal {
+			r.log.Printf("agent %s stopped: %v", name, err)
+			return nil
+		}
+
+		return err
+	})
+
+	return nil
+}
+
+// startSoftAgents starts the named agents from the config
+func (r *agentRuntime) startSoftAgents() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, name := range slices.Sorted(maps.Keys(r.config.Agents)) {
+		if err := r.startSoftAgent(name, r.config.Agents[name]); err != nil {
+			return err
+		}
+	}
+
+	r.started = true
+
+	return nil
+}
+
+// stopSoftAgent must be called with the runtime lock held
+func (r *agentRuntime) stopSoftAgent(name string) {
+	running, ok := r.softAgents[name]
+	if !ok {
+		return
+	}
+
+	delete(r.softAgents, name)
+
+	running.cancel()
+	running.agent.Shutdown()
+
+	<-running.done
+}
+
+// SoftAgents returns the named agents that are running
+func (r *agentRuntime) SoftAgents() map[string]*sshagent.SoftAgent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := make(map[string]*sshagent.SoftAgent, len(r.softAgents))
+	for name, running := range r.softAgents {
+		out[name] = running.agent
+	}
+
+	return out
+}
+
+// socketPaths returns the sockets whose permissions are kept at 0600
+func (r *agentRuntime) socketPaths() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	paths := []string{r.controlSocketPath}
+
+	if r.socketPath != "" {
+		paths = append(paths, r.socketPath)
+	}
+
+	for _, running := range r.softAgents {
+		paths = append(paths, running.config.SocketPath)
+	}
+
+	return paths
+}
+
+// Reload loads the config file and applies it to the running agents
+func (r *agentRuntime) Reload(_ context.Context) ([]string, error) {
+	conf, err := config.Load(r.configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	changes, err := r.apply(conf)
+
+	if r.rpcServer != nil {
+		r.rpcServer.SetSoftAgents(r.SoftAgents())
+	}
+
+	for _, change := range changes {
+		r.log.Println("reload:", change)
+	}
+
+	if err != nil {
+		r.log.Println("reload failed:", err)
+	}
+
+	return changes, err
+}
+
+func (r *agentRuntime) apply(conf *config.Config) ([]string, error) {
+	if len(conf.Keyring.Yubikey.AllSerials()) == 0 {
+		return nil, errors.New("yubikey serial is required")
+	}
+
+	engine, err := policy.New(conf.Policy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy: %w", err)
+	}
+
+	if err := validateAccess(conf); err != nil {
+		return nil, err
+	}
+
+	if err := validatePersist(conf); err != nil {
+		return nil, err
+	}
+
+	if err := validateUpstreams(conf); err != nil {
+		return nil, err
+	}
+
+	if err := validateSlots(conf); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	prev := r.config
+	r.config = conf
+
+	var changes []string
+
+	actionsChanged := conf.Keyring.BeforeSignHook != prev.Keyring.BeforeSignHook || conf.Askpass != prev.Askpass ||
+		conf.Pinentry != prev.Pinentry || conf.Keyring.Yubikey.MinPINRetries != prev.Keyring.Yubikey.MinPINRetries
+
+	// the engine is kept when the policy did not change, so rate limits keep counting
+	if !reflect.DeepEqual(conf.Policy, prev.Policy) {
+		r.policy = engine
+		actionsChanged = true
+		changes = append(changes, "updated signing policy")
+	}
+
+	if conf.Socket.Type != prev.Socket.Type || conf.Socket.Path != prev.Socket.Path {
+		changes = append(changes, "socket changed, restart the agent to apply it")
+	}
+
+	if conf.ControlSocketPath != prev.ControlSocketPath {
+		changes = append(changes, "control socket changed, restart the agent to apply it")
+	}
+
+	if access := conf.ControlSocketAccess(); !reflect.DeepEqual(access, prev.ControlSocketAccess()) {
+		if r.rpcServer != nil {
+			r.rpcServer.SetAccess(access)
+		}
+
+		changes = append(changes, "updated access rules of the control socket")
+	}
+
+	if conf.AgentLogPath != prev.AgentLogPath {
+		changes = append(changes, "log path changed, restart the agent to apply it")
+	}
+
+	if conf.Audit != prev.Audit {
+		changes = append(changes, "audit log changed, restart the agent to apply it")
+	}
+
+	if r.agent != nil {
+		if actionsChanged {
+			r.agent.SetActions(r.agentActions())
+			changes = append(changes, "updated sign actions")
+		}
+
+		if !reflect.DeepEqual(conf.Socket.Access, prev.Socket.Access) {
+			r.agent.SetAccess(conf.Socket.Access)
+			changes = append(changes, "updated access rules")
+		}
+
+		if conf.Keyring.KeepKeySeconds != prev.Keyring.KeepKeySeconds {
+			r.agent.SetKeepKeySeconds(conf.Keyring.KeepKeySeconds)
+			changes = append(changes, fmt.Sprintf("updated keep_key_seconds to %d", conf.Keyring.KeepKeySeconds))
+		}
+
+		if conf.Keyring.SignTimeoutSeconds != prev.Keyring.SignTimeoutSeconds {
+			r.agent.SetSignTimeout(conf.Keyring.SignTimeoutSeconds)
+			changes = append(changes, fmt.Sprintf("updated sign_timeout_seconds to %d", conf.Keyring.SignTimeoutSeconds))
+		}
+
+		if conf.Lock != prev.Lock {
+			r.agent.SetLockPolicy(r.lockPolicy())
+			changes = append(changes, "updated lock policy")
+		}
+
+		if !slices.Equal(conf.Keyring.Yubikey.LocalOnlySlots, prev.Keyring.Yubikey.LocalOnlySlots) {
+			r.agent.SetLocalOnlySlots(conf.Keyring.Yubikey.LocalOnlySlots)
+			changes = append(changes, "updated local only slots")
+		}
+
+		changes = append(changes, r.updateYubikeys(conf.Keyring.Yubikey.AllSerials(), prev.Keyring.Yubikey.AllSerials())...)
+	}
+
+	names := slices.Sorted(maps.Keys(r.softAgents))
+
+	for _, name := range names {
+		running := r.softAgents[name]
+
+		agentConfig, ok := conf.Agents[name]
+		if !ok {
+			r.stopSoftAgent(name)
+			changes = append(changes, fmt.Sprintf("stopped agent %s", name))
+			continue
+		}
+
+		if agentConfig.SocketPath != running.config.SocketPath {
+			r.stopSoftAgent(name)
+
+			if err := r.startSoftAgent(name, agentConfig); err != nil {
+				return changes, err
+			}
+
+			changes = append(changes, fmt.Sprintf("restarted agent %s on %s", name, agentConfig.SocketPath))
+			continue
+		}
+
+		if agentConfig.KeepKeySeconds != running.config.KeepKeySeconds {
+			running.agent.SetKeepKeySeconds(agentConfig.KeepKeySeconds)
+			changes = append(changes, fmt.Sprintf("updated keep_key_seconds of agent %s to %d", name, agentConfig.KeepKeySeconds))
+		}
+
+		if !reflect.DeepEqual(agentConfig.Access, running.config.Access) {
+			running.agent.SetAccess(agentConfig.Access)
+			changes = append(changes, fmt.Sprintf("updated access rules of agent %s", name))
+		}
+
+		if !reflect.DeepEqual(agentConfig.Upstreams, running.config.Upstreams) {
+			running.agent.SetUpstreams(upstreams(agentConfig))
+			changes = append(changes, fmt.Sprintf("updated upstreams of agent %s", name))
+		}
+
+		if !slices.Equal(agentConfig.Yubikey.Slots, running.config.Yubikey.Slots) {
+			if err := r.setYubikeySlots(name, running.agent, agentConfig); err != nil {
+				changes = append(changes, fmt.Sprintf("failed to update yubikey slots of agent %s: %v", name, err))
+			} else {
+				changes = append(changes, fmt.Sprintf("updated yubikey slots of agent %s", name))
+			}
+		}
+
+		if agentConfig.Persist != running.config.Persist {
+			if err := r.setPersistence(name, running.agent, agentConfig.Persist); err != nil {
+				changes = append(changes, fmt.Sprintf("failed to update persist of agent %s: %v", name, err))
+			} else {
+				changes = append(changes, fmt.Sprintf("updated persist of agent %s", name))
+			}
+		}
+
+		running.config = agentConfig
+
+		if actionsChanged {
+			running.agent.SetActions(r.softAgentActions())
+		}
+
+		if conf.Lock != prev.Lock {
+			running.agent.SetLockPolicy(r.lockPolicy())
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(conf.Agents)) {
+		if _, ok := r.softAgents[name]; ok {
+			continue
+		}
+
+		if err := r.startSoftAgent(name, conf.Agents[name]); err != nil {
+			return changes, err
+		}
+
+		changes = append(changes, fmt.Sprintf("started agent %s on %s", name, conf.Agents[name].SocketPath))
+	}
+
+	return changes, nil
+}
+
+// updateYubikeys attaches added serials and detaches removed ones, cards attached with `ssh-add -s` are kept.
+// Added cards that are not plugged in are opened when they are plugged in.
+func (r *agentRuntime) updateYubikeys(serials, prev []uint32) []string {
+	var changes []string
+
+	for _, serial := range prev {
+		if slices.Contains(serials, serial) {
+			continue
+		}
+
+		if err := r.agent.DetachYubikey(serial); err != nil {
+			changes = append(changes, fmt.Sprintf("failed to detach yubikey %d: %v", serial, err))
+			continue
+		}
+
+		changes = append(changes, fmt.Sprintf("detached yubikey %d", serial))
+	}
+
+	for _, serial := range serials {
+		if slices.Contains(prev, serial) {
+			continue
+		}
+
+		if err := r.agent.ExpectYubikey(serial); err != nil {
+			changes = append(changes, fmt.Sprintf("failed to attach yubikey %d: %v", serial, err))
+			continue
+		}
+
+		changes = append(changes, fmt.Sprintf("attached yubikey %d", serial))
+	}
+
+	return changes
+}
+
+// validateAccess checks the access rules of every socket
+func validateAccess(conf *config.Config) error {
+	if err := conf.Socket.Access.Validate(); err != nil {
+		return fmt.Errorf("invalid access rules: %w", err)
+	}
+
+	if err := conf.ControlAccess.Validate(); err != nil {
+		return fmt.Errorf("invalid access rules of the control socket: %w", err)
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(conf.Agents)) {
+		if err := conf.Agents[name].Access.Validate(); err != nil {
+			return fmt.Errorf("invalid access rules of agent %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// validatePersist checks the slots that unwrap the persisted keys of the named agents
+func validatePersist(conf *config.Config) error {
+	for _, name := range slices.Sorted(maps.Keys(conf.Agents)) {
+		persist := conf.Agents[name].Persist
+		if !persist.Enabled {
+			continue
+		}
+
+		if _, err := yubikey.ParseSlot(persistSlot(persist)); err != nil {
+			return fmt.Errorf("invalid persist of agent %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// validateUpstreams checks the comment patterns of the upstream agents, an agent can not be its own upstream
+func validateUpstreams(conf *config.Config) error {
+	for _, name := range slices.Sorted(maps.Keys(conf.Agents)) {
+		agentConfig := conf.Agents[name]
+
+		for _, upstream := range agentConfig.Upstreams {
+			if upstream.SocketPath == "" {
+				return fmt.Errorf("invalid upstream of agent %s: socket_path is required", name)
+			}
+
+			if upstream.SocketPath == agentConfig.SocketPath {
+				return fmt.Errorf("invalid upstream of agent %s: the agent can not be its own upstream", name)
+			}
+
+			for _, pattern := range upstream.Comments {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("invalid comment pattern %q of agent %s: %w", pattern, name, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateSlots checks the YubiKey slots the named agents serve
+func validateSlots(conf *config.Config) error {
+	for _, agentName := range slices.Sorted(maps.Keys(conf.Agents)) {
+		for _, name := range conf.Agents[agentName].Yubikey.Slots {
+			slot, err := yubikey.ParseSlot(name)
+			if err != nil {
+				return fmt.Errorf("invalid yubikey slots of agent %s: %w", agentName, err)
+			}
+
+			if !slices.Contains(yubikey.AllSSHSlots, slot) {
+				return fmt.Errorf("invalid yubikey slots of agent %s: slot %s is not an ssh slot", agentName, slot.String())
+			}
+		}
+	}
+
+	return nil
+}
+
+// shutdown stops every agent
+func (r *agentRuntime) shutdown() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.agent != nil {
+		r.agent.Shutdown()
+	}
+
+	for name, running := range r.softAgents {
+		running.cancel()
+		running.agent.Shutdown()
+		delete(r.softAgents, name)
+	}
+}
@@ -0,0 +1,478 @@
+package commands
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vitalvas/oneauth/cmd/oneauth/config"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcserver"
+	"github.com/vitalvas/oneauth/cmd/oneauth/service"
+	"github.com/vitalvas/oneauth/internal/netutil"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/sync/errgroup"
+)
+
+// newTestRuntime starts a runtime with a dummy socket and returns it with a function that rewrites its config
+func newTestRuntime(t *testing.T, agents map[string]string) (*agentRuntime, string, func(agents map[string]string, extra string)) {
+	t.Helper()
+
+	tmpHome := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(tmpHome, ".oneauth"), 0700))
+	t.Setenv("HOME", tmpHome)
+
+	// unix socket paths are limited in length, so keep it short
+	socketDir, err := os.MkdirTemp("", "oneauth")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(socketDir) })
+
+	configPath := filepath.Join(tmpHome, "config.yaml")
+
+	writeConfig := func(agents map[string]string, extra string) {
+		data := "socket:\n  type: dummy\nkeyring:\n  yubikey:\n    serial: 1\n" + extra
+
+		if len(agents) > 0 {
+			data += "agents:\n"
+			for name, socket := range agents {
+				data += fmt.Sprintf("  %s:\n    socket_path: %s\n", name, filepath.Join(socketDir, socket))
+			}
+		}
+
+		require.NoError(t, os.WriteFile(configPath, []byte(data), 0600))
+	}
+
+	writeConfig(agents, "")
+
+	conf, err := config.Load(configPath)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	group, ctx := errgroup.WithContext(ctx)
+
+	runtime := newAgentRuntime(ctx, group, logrus.New(), configPath, conf)
+	require.NoError(t, runtime.startSoftAgents())
+
+	t.Cleanup(func() {
+		runtime.shutdown()
+		cancel()
+		group.Wait()
+	})
+
+	return runtime, socketDir, writeConfig
+}
+
+func waitSocket(t *testing.T, path string) {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestAgentRuntime_Reload(t *testing.T) {
+	t.Run("NoChanges", func(t *testing.T) {
+		runtime, _, _ := newTestRuntime(t, map[string]string{"work": "work.sock"})
+
+		changes, err := runtime.Reload(context.Background())
+		require.NoError(t, err)
+		assert.Empty(t, changes)
+		assert.Contains(t, runtime.SoftAgents(), "work")
+	})
+
+	t.Run("StartAndStopAgents", func(t *testing.T) {
+		runtime, socketDir, writeConfig := newTestRuntime(t, map[string]string{"work": "work.sock"})
+		waitSocket(t, filepath.Join(socketDir, "work.sock"))
+
+		writeConfig(map[string]string{"personal": "personal.sock"}, "")
+
+		changes, err := runtime.Reload(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, []string{
+			"stopped agent work",
+			"started agent personal on " + filepath.Join(socketDir, "personal.sock"),
+		}, changes)
+
+		agents := runtime.SoftAgents()
+		assert.Contains(t, agents, "personal")
+		assert.NotContains(t, agents, "work")
+
+		waitSocket(t, filepath.Join(socketDir, "personal.sock"))
+
+		_, err = os.Stat(filepath.Join(socketDir, "work.sock"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("MoveAgentSocket", func(t *testing.T) {
+		runtime, socketDir, writeConfig := newTestRuntime(t, map[string]string{"work": "work.sock"})
+		waitSocket(t, filepath.Join(socketDir, "work.sock"))
+
+		writeConfig(map[string]string{"work": "work2.sock"}, "")
+
+		changes, err := runtime.Reload(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, []string{"restarted agent work on " + filepath.Join(socketDir, "work2.sock")}, changes)
+
+		waitSocket(t, filepath.Join(socketDir, "work2.sock"))
+		assert.Contains(t, runtime.socketPaths(), filepath.Join(socketDir, "work2.sock"))
+	})
+
+	t.Run("RestartRequired", func(t *testing.T) {
+		runtime, _, writeConfig := newTestRuntime(t, nil)
+
+		writeConfig(nil, "control_socket_path: /tmp/other.sock\n")
+
+		changes, err := runtime.Reload(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, []string{"control socket changed, restart the agent to apply it"}, changes)
+		assert.NotContains(t, runtime.socketPaths(), "/tmp/other.sock")
+	})
+
+	t.Run("UpdatePolicy", func(t *testing.T) {
+		runtime, _, writeConfig := newTestRuntime(t, map[string]string{"work": "work.sock"})
+		assert.Nil(t, runtime.policy)
+
+		writeConfig(map[string]string{"work": "work.sock"}, "policy:\n  rules:\n    - action: deny\n      exe: [node]\n")
+
+		changes, err := runtime.Reload(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, []string{"updated signing policy"}, changes)
+		require.NotNil(t, runtime.policy)
+
+		engine := runtime.policy
+
+		// an unchanged policy keeps the engine and its rate limit counters
+		changes, err = runtime.Reload(context.Background())
+		require.NoError(t, err)
+		assert.Empty(t, changes)
+		assert.Same(t, engine, runtime.policy)
+	})
+
+	t.Run("InvalidPolicy", func(t *testing.T) {
+		runtime, _, writeConfig := newTestRuntime(t, nil)
+
+		writeConfig(nil, "policy:\n  rules:\n    - action: maybe\n")
+
+		_, err := runtime.Reload(context.Background())
+		assert.ErrorContains(t, err, "invalid policy")
+		assert.Empty(t, runtime.config.Policy.Rules)
+	})
+
+	t.Run("UpdateAccess", func(t *testing.T) {
+		runtime, _, writeConfig := newTestRuntime(t, map[string]string{"work": "work.sock"})
+
+		writeConfig(nil, "agents:\n  work:\n    socket_path: "+runtime.config.Agents["work"].SocketPath+"\n    access:\n      allow_exe: [/usr/bin/ssh, /usr/bin/git]\n")
+
+		changes, err := runtime.Reload(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, []string{"updated access rules of agent work"}, changes)
+		assert.Equal(t, []string{"/usr/bin/ssh", "/usr/bin/git"}, runtime.config.Agents["work"].Access.AllowExe)
+	})
+
+	t.Run("InvalidAccess", func(t *testing.T) {
+		runtime, _, writeConfig := newTestRuntime(t, nil)
+
+		writeConfig(nil, "agents:\n  work:\n    socket_path: /tmp/work.sock\n    access:\n      deny_exe: [\"[node\"]\n")
+
+		_, err := runtime.Reload(context.Background())
+		assert.ErrorContains(t, err, "invalid access rules of agent work")
+		assert.Empty(t, runtime.SoftAgents())
+	})
+
+	t.Run("UpdateUpstreams", func(t *testing.T) {
+		runtime, _, writeConfig := newTestRuntime(t, map[string]string{"work": "work.sock"})
+
+		writeConfig(nil, "agents:\n  work:\n    socket_path: "+runtime.config.Agents["work"].SocketPath+"\n    upstreams:\n      - socket_path: /tmp/ssh-agent.sock\n        comments: [\"*@ci\"]\n")
+
+		changes, err := runtime.Reload(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, []string{"updated upstreams of agent work"}, changes)
+	})
+
+	t.Run("InvalidUpstream", func(t *testing.T) {
+		runtime, _, writeConfig := newTestRuntime(t, nil)
+
+		writeConfig(nil, "agents:\n  work:\n    socket_path: /tmp/work.sock\n    upstreams:\n      - socket_path: /tmp/work.sock\n")
+
+		_, err := runtime.Reload(context.Background())
+		assert.ErrorContains(t, err, "the agent can not be its own upstream")
+		assert.Empty(t, runtime.SoftAgents())
+	})
+
+	t.Run("InvalidSlots", func(t *testing.T) {
+		runtime, _, writeConfig := newTestRuntime(t, nil)
+
+		writeConfig(nil, "agents:\n  work:\n    socket_path: /tmp/work.sock\n    yubikey:\n      slots: [\"9a\"]\n")
+
+		_, err := runtime.Reload(context.Background())
+		assert.ErrorContains(t, err, "invalid yubikey slots of agent work: slot 9a is not an ssh slot")
+		assert.Empty(t, runtime.SoftAgents())
+	})
+
+	t.Run("InvalidPersist", func(t *testing.T) {
+		runtime, _, writeConfig := newTestRuntime(t, nil)
+
+		writeConfig(nil, "agents:\n  work:\n    socket_path: /tmp/work.sock\n    persist:\n      enabled: true\n      slot: 9z\n")
+
+		_, err := runtime.Reload(context.Background())
+		assert.ErrorContains(t, err, "invalid persist of agent work")
+		assert.Empty(t, runtime.SoftAgents())
+	})
+
+	t.Run("InvalidConfig", func(t *testing.T) {
+		runtime, _, _ := newTestRuntime(t, map[string]string{"work": "work.sock"})
+
+		require.NoError(t, os.WriteFile(runtime.configPath, []byte("unknown_field: true\n"), 0600))
+
+		_, err := runtime.Reload(context.Background())
+		assert.Error(t, err)
+		assert.Contains(t, runtime.SoftAgents(), "work")
+	})
+
+	t.Run("MissingSerial", func(t *testing.T) {
+		runtime, _, _ := newTestRuntime(t, nil)
+
+		require.NoError(t, os.WriteFile(runtime.configPath, []byte("socket:\n  type: dummy\n"), 0600))
+
+		_, err := runtime.Reload(context.Background())
+		assert.EqualError(t, err, "yubikey serial is required")
+	})
+}
+
+func TestAgentRuntime_Shutdown(t *testing.T) {
+	runtime, socketDir, _ := newTestRuntime(t, map[string]string{"work": "work.sock"})
+	waitSocket(t, filepath.Join(socketDir, "work.sock"))
+
+	runtime.shutdown()
+
+	assert.Empty(t, runtime.SoftAgents())
+}
+
+func TestAgentRuntime_Activated(t *testing.T) {
+	t.Run("AgentSocket", func(t *testing.T) {
+		runtime, socketDir, _ := newTestRuntime(t, nil)
+
+		listener, err := net.Listen("unix", filepath.Join(socketDir, "activated.sock"))
+		require.NoError(t, err)
+
+		runtime.activated = map[string]net.Listener{"work": listener}
+
+		runtime.mu.Lock()
+		err = runtime.startSoftAgent("work", config.AgentConfig{SocketPath: filepath.Join(socketDir, "work.sock")})
+		runtime.mu.Unlock()
+		require.NoError(t, err)
+
+		assert.Empty(t, runtime.activated)
+
+		conn, err := net.Dial("unix", filepath.Join(socketDir, "activated.sock"))
+		require.NoError(t, err)
+		defer conn.Close()
+
+		keys, err := agent.NewClient(conn).List()
+		require.NoError(t, err)
+		assert.Empty(t, keys)
+
+		_, err = os.Stat(filepath.Join(socketDir, "work.sock"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("Unused", func(t *testing.T) {
+		runtime, socketDir, _ := newTestRuntime(t, nil)
+
+		listener, err := net.Listen("unix", filepath.Join(socketDir, "unused.sock"))
+		require.NoError(t, err)
+
+		runtime.activated = map[string]net.Listener{"unused": listener}
+		runtime.closeActivated()
+
+		assert.Nil(t, runtime.activated)
+
+		_, err = listener.Accept()
+		assert.ErrorIs(t, err, net.ErrClosed)
+	})
+}
+
+func TestAgentRuntime_Handoff(t *testing.T) {
+	t.Run("TakeOver", func(t *testing.T) {
+		oldRuntime, socketDir, _ := newTestRuntime(t, map[string]string{"work": "work.sock"})
+		socketPath := filepath.Join(socketDir, "work.sock")
+		waitSocket(t, socketPath)
+
+		conn, err := net.Dial("unix", socketPath)
+		require.NoError(t, err)
+
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		require.NoError(t, agent.NewClient(conn).Add(agent.AddedKey{PrivateKey: priv, Comment: "added"}))
+		conn.Close()
+
+		state, files, err := oldRuntime.HandoffState()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"work"}, state.Sockets)
+		require.Len(t, state.Agents["work"].Keys, 1)
+		require.Len(t, files, 1)
+
+		_, _, err = oldRuntime.HandoffState()
+		assert.ErrorIs(t, err, errHandoffInProgress)
+
+		listener, err := net.FileListener(files[0])
+		require.NoError(t, err)
+		files[0].Close()
+
+		newRuntime, _, _ := newTestRuntime(t, nil)
+		newRuntime.activated = map[string]net.Listener{"work": listener}
+		newRuntime.handoff = &state
+
+		newRuntime.mu.Lock()
+		err = newRuntime.startSoftAgent("work", config.AgentConfig{SocketPath: socketPath})
+		newRuntime.mu.Unlock()
+		require.NoError(t, err)
+
+		oldRuntime.HandedOff(nil)
+
+		// the old process closed its socket, the file stays for the new one
+		assert.FileExists(t, socketPath)
+
+		conn, err = net.Dial("unix", socketPath)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		keys, err := agent.NewClient(conn).List()
+		require.NoError(t, err)
+		require.Len(t, keys, 1)
+		assert.Equal(t, "added", keys[0].Comment)
+	})
+
+	t.Run("Failed", func(t *testing.T) {
+		runtime, socketDir, _ := newTestRuntime(t, map[string]string{"work": "work.sock"})
+		socketPath := filepath.Join(socketDir, "work.sock")
+		waitSocket(t, socketPath)
+
+		_, files, err := runtime.HandoffState()
+		require.NoError(t, err)
+		files[0].Close()
+
+		runtime.HandedOff(fmt.Errorf("did not take over"))
+
+		conn, err := net.Dial("unix", socketPath)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = agent.NewClient(conn).List()
+		require.NoError(t, err)
+
+		// a failed handoff can be retried
+		_, files, err = runtime.HandoffState()
+		require.NoError(t, err)
+		files[0].Close()
+
+		runtime.HandedOff(fmt.Errorf("did not take over"))
+
+		// the socket file is removed with the listener again
+		require.NoError(t, runtime.softAgents["work"].agent.Listener().Close())
+		assert.NoFileExists(t, socketPath)
+	})
+
+	t.Run("FailedInherited", func(t *testing.T) {
+		runtime, socketDir, _ := newTestRuntime(t, nil)
+		socketPath := filepath.Join(socketDir, "work.sock")
+
+		// a socket passed by systemd keeps its file
+		listener, err := net.Listen("unix", socketPath)
+		require.NoError(t, err)
+
+		inherited, err := netutil.ListenerFile(listener)
+		require.NoError(t, err)
+		listener.Close()
+
+		passed, err := net.FileListener(inherited)
+		require.NoError(t, err)
+		inherited.Close()
+
+		runtime.activated = map[string]net.Listener{"work": passed}
+
+		runtime.mu.Lock()
+		err = runtime.startSoftAgent("work", config.AgentConfig{SocketPath: socketPath})
+		runtime.mu.Unlock()
+		require.NoError(t, err)
+
+		_, files, err := runtime.HandoffState()
+		require.NoError(t, err)
+		files[0].Close()
+
+		runtime.HandedOff(fmt.Errorf("did not take over"))
+
+		require.NoError(t, passed.Close())
+		assert.FileExists(t, socketPath)
+	})
+}
+
+func TestReadHandoffToken(t *testing.T) {
+	controlSocketPath := filepath.Join(t.TempDir(), "control.sock")
+
+	t.Run("Env", func(t *testing.T) {
+		t.Setenv(service.HandoffTokenEnv, "from-env")
+
+		token, fromEnv, err := readHandoffToken(controlSocketPath)
+		require.NoError(t, err)
+		assert.Equal(t, "from-env", token)
+		assert.True(t, fromEnv)
+
+		// the token is not passed on to other processes
+		_, ok := os.LookupEnv(service.HandoffTokenEnv)
+		assert.False(t, ok)
+	})
+
+	t.Run("File", func(t *testing.T) {
+		path := handoffTokenFile(controlSocketPath)
+		require.NoError(t, os.WriteFile(path, []byte("from-file\n"), 0600))
+
+		token, fromEnv, err := readHandoffToken(controlSocketPath)
+		require.NoError(t, err)
+		assert.Equal(t, "from-file", token)
+		assert.False(t, fromEnv)
+
+		// the token is read once
+		assert.NoFileExists(t, path)
+	})
+
+	t.Run("None", func(t *testing.T) {
+		token, _, err := readHandoffToken(controlSocketPath)
+		require.NoError(t, err)
+		assert.Empty(t, token)
+	})
+}
+
+func TestAgentRuntime_TakeOver(t *testing.T) {
+	t.Run("NotRunning", func(t *testing.T) {
+		runtime, socketDir, _ := newTestRuntime(t, nil)
+
+		handoff, err := runtime.takeOver(context.Background(), filepath.Join(socketDir, "control.sock"))
+		require.NoError(t, err)
+		assert.Nil(t, handoff)
+	})
+
+	t.Run("WithoutToken", func(t *testing.T) {
+		runtime, socketDir, _ := newTestRuntime(t, nil)
+		controlPath := filepath.Join(socketDir, "control.sock")
+
+		server := rpcserver.New(nil, logrus.New())
+		server.SetHandoffer(runtime)
+
+		go server.ListenAndServe(context.Background(), controlPath)
+		t.Cleanup(server.Shutdown)
+		waitSocket(t, controlPath)
+
+		_, err := runtime.takeOver(context.Background(), controlPath)
+		assert.ErrorIs(t, err, errNoHandoffToken)
+	})
+}
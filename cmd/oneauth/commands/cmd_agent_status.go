@@ -0,0 +1,87 @@
+package commands
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+)
+
+var agentStatusCmd = &cli.Command{
+	Name:  "status",
+	Usage: "Show the state of the running agent",
+	Flags: []cli.Flag{
+		jsonFlag,
+	},
+	Action: func(c *cli.Context) error {
+		client, err := controlClient(c)
+		if err != nil {
+			return err
+		}
+
+		status, err := client.Status(c.Context)
+		if err != nil {
+			return err
+		}
+
+		health, err := client.Health(c.Context)
+		if err != nil {
+			return err
+		}
+
+		if c.Bool("json") {
+			return printJSON(struct {
+				Status *rpcapi.Status `json:"status"`
+				Health *rpcapi.Health `json:"health"`
+			}{status, health})
+		}
+
+		fmt.Println("OneAuth agent is running")
+		fmt.Println(" - Version:", status.Version)
+		fmt.Println(" - Agent ID:", status.AgentID)
+
+		serials := status.Serials
+		if len(serials) == 0 && status.Serial > 0 {
+			serials = []uint32{status.Serial}
+		}
+
+		if len(serials) == 0 {
+			fmt.Println(" - YubiKey: not available")
+		}
+
+		for _, serial := range serials {
+			switch {
+			case slices.Contains(status.Absent, serial):
+				fmt.Printf(" - YubiKey: #%d (not plugged in)\n", serial)
+
+			case slices.Contains(status.PINBlocked, serial):
+				fmt.Printf(" - YubiKey: #%d (PIN blocked, use `oneauth yubikey unblock-pin`)\n", serial)
+
+			default:
+				fmt.Printf(" - YubiKey: #%d\n", serial)
+			}
+		}
+
+		fmt.Println(" - Locked:", formatBool(status.Locked))
+		fmt.Println(" - Agents:", strings.Join(status.Agents, ", "))
+		fmt.Println(" - Health:", health.Status)
+
+		for _, check := range health.Checks {
+			if check.Status != rpcapi.HealthOK {
+				fmt.Printf("   - %s: %s\n", check.Name, check.Message)
+			}
+		}
+
+		return nil
+	},
+}
+
+func formatBool(value bool) string {
+	if value {
+		return "yes"
+	}
+
+	return "no"
+}
@@ -0,0 +1,178 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"github.com/vitalvas/oneauth/cmd/oneauth/config"
+	"github.com/vitalvas/oneauth/cmd/oneauth/paths"
+	"github.com/vitalvas/oneauth/internal/audit"
+)
+
+var auditCmd = &cli.Command{
+	Name:  "audit",
+	Usage: "Query the audit log of agent requests",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "since",
+			Usage: "show events newer than a duration (24h) or a time (RFC3339)",
+		},
+		&cli.StringFlag{
+			Name:  "until",
+			Usage: "show events older than a duration (24h) or a time (RFC3339)",
+		},
+		&cli.StringFlag{
+			Name:  "op",
+			Usage: "operation: list, sign, add, remove, remove_all, lock or unlock",
+		},
+		&cli.StringFlag{
+			Name:  "agent",
+			Usage: "agent name",
+		},
+		&cli.StringFlag{
+			Name:  "fingerprint",
+			Usage: "key fingerprint (SHA256:...)",
+		},
+		&cli.IntFlag{
+			Name:  "pid",
+			Usage: "client process ID",
+		},
+		&cli.BoolFlag{
+			Name:  "failed",
+			Usage: "show only refused or failed requests",
+		},
+		&cli.IntFlag{
+			Name:  "limit",
+			Usage: "show only the newest events, 0 shows all",
+			Value: 100,
+		},
+		jsonFlag,
+	},
+	Action: func(c *cli.Context) error {
+		path, err := auditLogPath(c)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+
+		filter := audit.Filter{
+			Operation:   audit.Operation(c.String("op")),
+			Agent:       c.String("agent"),
+			Fingerprint: c.String("fingerprint"),
+			PID:         c.Int("pid"),
+			FailedOnly:  c.Bool("failed"),
+			Limit:       c.Int("limit"),
+		}
+
+		if filter.Since, err = parseAuditTime(c.String("since"), now); err != nil {
+			return fmt.Errorf("invalid since: %w", err)
+		}
+
+		if filter.Until, err = parseAuditTime(c.String("until"), now); err != nil {
+			return fmt.Errorf("invalid until: %w", err)
+		}
+
+		events, err := audit.Read(path, filter)
+		if err != nil {
+			return err
+		}
+
+		if c.Bool("json") {
+			if events == nil {
+				events = []audit.Event{}
+			}
+
+			return printJSON(events)
+		}
+
+		for _, event := range events {
+			fmt.Println(formatAuditEvent(event))
+		}
+
+		return nil
+	},
+}
+
+// auditLogPath returns the audit log from the config, or the default path when there is no config file
+func auditLogPath(c *cli.Context) (string, error) {
+	if configPath := c.Path("config"); configPath != "" {
+		conf, err := config.Load(configPath)
+		if err == nil {
+			return conf.Audit.Path, nil
+		}
+
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("failed to load config: %w", err)
+		}
+	}
+
+	return paths.AuditLog()
+}
+
+// parseAuditTime accepts a duration before now or an RFC3339 time
+func parseAuditTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if duration, err := time.ParseDuration(value); err == nil {
+		return now.Add(-duration), nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+func formatAuditEvent(event audit.Event) string {
+	result := "ok"
+	if !event.Success {
+		result = "failed"
+	}
+
+	parts := []string{
+		event.Time.Local().Format(time.RFC3339),
+		string(event.Operation),
+		event.Agent,
+		result,
+	}
+
+	if event.Slot != "" {
+		parts = append(parts, fmt.Sprintf("slot=0x%s", event.Slot))
+	}
+
+	if event.Fingerprint != "" {
+		parts = append(parts, event.Fingerprint)
+	}
+
+	if event.Operation == audit.OpList {
+		parts = append(parts, fmt.Sprintf("keys=%d", event.Keys))
+	}
+
+	parts = append(parts, fmt.Sprintf("pid=%d", event.PID), fmt.Sprintf("uid=%d", event.UID))
+
+	if event.Exe != "" {
+		parts = append(parts, fmt.Sprintf("exe=%s", event.Exe))
+	}
+
+	if event.Forwarded {
+		parts = append(parts, "forwarded")
+	}
+
+	if event.DestinationUser != "" || event.DestinationHostKey != "" {
+		parts = append(parts, fmt.Sprintf("destination=%s@%s", event.DestinationUser, event.DestinationHostKey))
+	}
+
+	if event.Policy != "" {
+		parts = append(parts, fmt.Sprintf("policy=%q", event.Policy))
+	}
+
+	if event.Error != "" {
+		parts = append(parts, fmt.Sprintf("error=%q", event.Error))
+	}
+
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,121 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+	"github.com/vitalvas/oneauth/internal/audit"
+)
+
+func runAuditCmd(configPath string, args ...string) error {
+	app := &cli.App{
+		Flags: []cli.Flag{
+			&cli.PathFlag{
+				Name:  "config",
+				Value: configPath,
+			},
+		},
+		Commands: []*cli.Command{auditCmd},
+	}
+
+	return app.Run(append([]string{"app", "audit"}, args...))
+}
+
+func TestAuditCmd(t *testing.T) {
+	tmpHome := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(tmpHome, ".oneauth"), 0700))
+	t.Setenv("HOME", tmpHome)
+
+	auditPath := filepath.Join(tmpHome, "audit.log")
+	configPath := filepath.Join(tmpHome, "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte("audit:\n  path: "+auditPath+"\n"), 0600))
+
+	logger, err := audit.New(auditPath, 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, logger.Log(audit.Event{Operation: audit.OpSign, Agent: "default", Success: true, Slot: "9a", PID: 1}))
+	require.NoError(t, logger.Close())
+
+	t.Run("Text", func(t *testing.T) {
+		assert.NoError(t, runAuditCmd(configPath, "--op", "sign"))
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		assert.NoError(t, runAuditCmd(configPath, "--json", "--since", "1h"))
+	})
+
+	t.Run("InvalidSince", func(t *testing.T) {
+		assert.ErrorContains(t, runAuditCmd(configPath, "--since", "yesterday"), "invalid since")
+	})
+
+	t.Run("AuditLogPath", func(t *testing.T) {
+		ctx := newTestContext(t, configPath)
+
+		path, err := auditLogPath(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, auditPath, path)
+	})
+
+	t.Run("AuditLogPathWithoutConfig", func(t *testing.T) {
+		ctx := newTestContext(t, filepath.Join(tmpHome, "missing.yaml"))
+
+		path, err := auditLogPath(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(tmpHome, ".oneauth", "log", "audit.log"), path)
+	})
+}
+
+func TestParseAuditTime(t *testing.T) {
+	now := time.Date(2026, 1, 2, 12, 0, 0, 0, time.UTC)
+
+	t.Run("Empty", func(t *testing.T) {
+		value, err := parseAuditTime("", now)
+		require.NoError(t, err)
+		assert.True(t, value.IsZero())
+	})
+
+	t.Run("Duration", func(t *testing.T) {
+		value, err := parseAuditTime("2h", now)
+		require.NoError(t, err)
+		assert.Equal(t, now.Add(-2*time.Hour), value)
+	})
+
+	t.Run("RFC3339", func(t *testing.T) {
+		value, err := parseAuditTime("2026-01-01T00:00:00Z", now)
+		require.NoError(t, err)
+		assert.Equal(t, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), value)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := parseAuditTime("yesterday", now)
+		assert.Error(t, err)
+	})
+}
+
+func TestFormatAuditEvent(t *testing.T) {
+	event := audit.Event{
+		Time:               time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		Operation:          audit.OpSign,
+		Agent:              "default",
+		Slot:               "9a",
+		Fingerprint:        "SHA256:key",
+		PID:                42,
+		UID:                1000,
+		Exe:                "/usr/bin/ssh",
+		Forwarded:          true,
+		DestinationUser:    "alice",
+		DestinationHostKey: "SHA256:host",
+		Policy:             "deny (rule npm)",
+		Error:              "denied",
+	}
+
+	line := formatAuditEvent(event)
+
+	assert.Contains(t, line, "sign default failed slot=0x9a SHA256:key pid=42 uid=1000 exe=/usr/bin/ssh forwarded")
+	assert.Contains(t, line, "destination=alice@SHA256:host")
+	assert.Contains(t, line, `policy="deny (rule npm)" error="denied"`)
+}
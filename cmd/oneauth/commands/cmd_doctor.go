@@ -0,0 +1,135 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/urfave/cli/v2"
+	"github.com/vitalvas/oneauth/cmd/oneauth/config"
+	"github.com/vitalvas/oneauth/cmd/oneauth/doctor"
+	"github.com/vitalvas/oneauth/cmd/oneauth/paths"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcclient"
+)
+
+var doctorCmd = &cli.Command{
+	Name:        "doctor",
+	Usage:       "Check the YubiKeys, the agent and the shell environment",
+	Description: "The YubiKeys are checked through the running agent, or directly when no agent runs",
+	Flags: []cli.Flag{
+		jsonFlag,
+	},
+	Action: func(c *cli.Context) error {
+		setup, configCheck := doctorSetup(c)
+
+		result := runDoctor(c.Context, setup, configCheck)
+
+		if c.Bool("json") {
+			if err := printJSON(result); err != nil {
+				return err
+			}
+		} else {
+			printDoctor(result)
+		}
+
+		if result.Status == rpcapi.DoctorFail {
+			return errors.New("some checks failed")
+		}
+
+		return nil
+	},
+}
+
+// doctorConfig is what the client side probes need to know about the agent
+type doctorConfig struct {
+	serials           []uint32
+	socketPaths       []string
+	controlSocketPath string
+}
+
+// doctorSetup loads the config, the agent also runs without a config file
+func doctorSetup(c *cli.Context) (doctorConfig, rpcapi.DoctorCheck) {
+	configPath := c.Path("config")
+
+	conf, err := config.Load(configPath)
+	if err == nil {
+		setup := doctorConfig{
+			serials:           conf.Keyring.Yubikey.AllSerials(),
+			controlSocketPath: conf.ControlSocketPath,
+		}
+
+		if conf.Socket.Type == "unix" {
+			setup.socketPaths = append(setup.socketPaths, conf.Socket.Path)
+		}
+
+		for _, agentConf := range conf.Agents {
+			setup.socketPaths = append(setup.socketPaths, agentConf.SocketPath)
+		}
+
+		setup.socketPaths = append(setup.socketPaths, conf.ControlSocketPath)
+
+		return setup, doctor.Pass("loaded %s", configPath)
+	}
+
+	var setup doctorConfig
+
+	if socketPath, err := paths.AgentSocket(); err == nil {
+		setup.socketPaths = append(setup.socketPaths, socketPath)
+	}
+
+	if socketPath, err := paths.ControlSocket(); err == nil {
+		setup.controlSocketPath = socketPath
+		setup.socketPaths = append(setup.socketPaths, socketPath)
+	}
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return setup, doctor.Warn("create it with `oneauth setup new`", "%s does not exist, the defaults are used", configPath)
+	}
+
+	return setup, doctor.Fail("fix the config file, the agent does not start with it", "failed to load %s: %v", configPath, err)
+}
+
+// runDoctor asks the running agent for the checks of the YubiKeys and sockets, and runs them locally when
+// no agent answers. The shell environment is always checked locally.
+func runDoctor(ctx context.Context, setup doctorConfig, configCheck rpcapi.DoctorCheck) rpcapi.Doctor {
+	configCheck.Name = "config"
+
+	control := doctor.Run(ctx, []doctor.Probe{doctor.ControlProbe(setup.controlSocketPath)})
+
+	checks := append([]rpcapi.DoctorCheck{configCheck}, control.Checks...)
+
+	var agentChecks []rpcapi.DoctorCheck
+
+	if control.Status != rpcapi.DoctorFail {
+		agentResult, err := rpcclient.New(setup.controlSocketPath).Doctor(ctx)
+		if err == nil {
+			agentChecks = agentResult.Checks
+		}
+	}
+
+	if agentChecks == nil {
+		// no agent holds the YubiKeys, or it does not support the checks
+		probes := append(doctor.CardProbes(setup.serials, doctor.LocalCards), doctor.SocketProbe(setup.socketPaths))
+		agentChecks = doctor.Run(ctx, probes).Checks
+	}
+
+	checks = append(checks, agentChecks...)
+	checks = append(checks, doctor.Run(ctx, []doctor.Probe{doctor.AuthSockProbe(setup.socketPaths)}).Checks...)
+
+	return rpcapi.Doctor{
+		Status: doctor.Worst(checks),
+		Checks: checks,
+	}
+}
+
+func printDoctor(result rpcapi.Doctor) {
+	for _, check := range result.Checks {
+		fmt.Printf("[%s] %s: %s\n", check.Status, check.Name, check.Message)
+
+		if check.Hint != "" && check.Status != rpcapi.DoctorPass {
+			fmt.Printf("       hint: %s\n", check.Hint)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package commands
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"github.com/vitalvas/oneauth/cmd/oneauth/config"
+	"github.com/vitalvas/oneauth/cmd/oneauth/paths"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+)
+
+const (
+	// agentFileName names the agent to use in a directory and its subdirectories
+	agentFileName = ".oneauth"
+
+	// envAgent is the agent selected by an agent file, envPrevSocket is SSH_AUTH_SOCK before it was selected
+	envAgent      = "ONEAUTH_AGENT"
+	envPrevSocket = "ONEAUTH_PREV_SSH_AUTH_SOCK"
+	envAuthSock   = "SSH_AUTH_SOCK"
+)
+
+var shells = []string{"bash", "zsh", "fish", "posix"}
+
+var shellFlag = &cli.StringFlag{
+	Name:  "shell",
+	Usage: "shell syntax: bash, zsh, fish or posix, detected from $SHELL by default",
+}
+
+var envCmd = &cli.Command{
+	Name:        "env",
+	Usage:       "Print the shell commands that point SSH_AUTH_SOCK at an agent",
+	Description: `Use it as eval "$(oneauth env --agent work)", or "oneauth env --shell fish | source" in fish`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "agent",
+			Usage: "name of the agent from the config, the YubiKey agent by default",
+			Value: rpcapi.DefaultAgent,
+		},
+		&cli.StringFlag{
+			Name:  "dir",
+			Usage: "take the agent from the " + agentFileName + " file in the directory or its parents, used by `oneauth hook`",
+		},
+		shellFlag,
+	},
+	Action: func(c *cli.Context) error {
+		shell, err := shellName(c.String("shell"))
+		if err != nil {
+			return err
+		}
+
+		sockets, err := agentSockets(c)
+		if err != nil {
+			return err
+		}
+
+		var vars []envVar
+
+		if dir := c.String("dir"); dir != "" {
+			if c.IsSet("agent") {
+				return errors.New("--agent and --dir can not be used together")
+			}
+
+			vars, err = dirEnv(dir, sockets)
+		} else {
+			vars, err = agentEnv(c.String("agent"), sockets)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		warnDeadSocket(vars)
+
+		fmt.Print(renderEnv(shell, vars))
+
+		return nil
+	},
+}
+
+// envVar is a variable to set, or to unset when the value is nil
+type envVar struct {
+	name  string
+	value *string
+}
+
+func setVar(name, value string) envVar {
+	return envVar{name: name, value: &value}
+}
+
+func unsetVar(name string) envVar {
+	return envVar{name: name}
+}
+
+// shellName returns the shell from the flag or $SHELL, shells without a known syntax use posix
+func shellName(name string) (string, error) {
+	if name == "" {
+		name = filepath.Base(os.Getenv("SHELL"))
+		if !slices.Contains(shells, name) {
+			name = "posix"
+		}
+	}
+
+	if !slices.Contains(shells, name) {
+		return "", fmt.Errorf("unsupported shell %s, use one of: %s", name, strings.Join(shells, ", "))
+	}
+
+	return name, nil
+}
+
+// agentSockets returns the sockets of the agents by name, the YubiKey agent is the default one
+func agentSockets(c *cli.Context) (map[string]string, error) {
+	sockets := make(map[string]string)
+
+	if configPath := c.Path("config"); configPath != "" {
+		conf, err := config.Load(configPath)
+		if err == nil {
+			if conf.Socket.Type == "unix" {
+				sockets[rpcapi.DefaultAgent] = conf.Socket.Path
+			}
+
+			for name, agentConf := range conf.Agents {
+				sockets[name] = agentConf.SocketPath
+			}
+
+			return sockets, nil
+		}
+
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("failed to load config: %w", err)
+		}
+	}
+
+	// the agent also runs without a config file
+	socketPath, err := paths.AgentSocket()
+	if err != nil {
+		return nil, err
+	}
+
+	sockets[rpcapi.DefaultAgent] = socketPath
+
+	return sockets, nil
+}
+
+func agentSocket(name string, sockets map[string]string) (string, error) {
+	socketPath, ok := sockets[name]
+	if !ok {
+		return "", fmt.Errorf("unknown agent %s, the agents are: %s", name, strings.Join(slices.Sorted(maps.Keys(sockets)), ", "))
+	}
+
+	return socketPath, nil
+}
+
+func agentEnv(name string, sockets map[string]string) ([]envVar, error) {
+	socketPath, err := agentSocket(name, sockets)
+	if err != nil {
+		return nil, err
+	}
+
+	return []envVar{setVar(envAuthSock, socketPath)}, nil
+}
+
+// dirEnv switches to the agent of the agent file of the directory, and back to the previous socket outside of it.
+// Nothing is printed while the selected agent stays the same.
+func dirEnv(dir string, sockets map[string]string) ([]envVar, error) {
+	current := os.Getenv(envAgent)
+
+	name, agentFile, err := findAgentFile(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if agentFile == "" {
+		if current == "" {
+			return nil, nil
+		}
+
+		prev := unsetVar(envAuthSock)
+		if prevSocket := os.Getenv(envPrevSocket); prevSocket != "" {
+			prev = setVar(envAuthSock, prevSocket)
+		}
+
+		return []envVar{prev, unsetVar(envAgent), unsetVar(envPrevSocket)}, nil
+	}
+
+	socketPath, err := agentSocket(name, sockets)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", agentFile, err)
+	}
+
+	if current == name && os.Getenv(envAuthSock) == socketPath {
+		return nil, nil
+	}
+
+	vars := []envVar{setVar(envAuthSock, socketPath), setVar(envAgent, name)}
+
+	if current == "" {
+		vars = append(vars, setVar(envPrevSocket, os.Getenv(envAuthSock)))
+	}
+
+	return vars, nil
+}
+
+// findAgentFile returns the agent named by the closest agent file, the file is empty when there is none
+func findAgentFile(dir string) (string, string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", "", err
+	}
+
+	for {
+		agentFile := filepath.Join(dir, agentFileName)
+
+		// ~/.oneauth is the directory of the agent, it does not select one
+		stat, err := os.Stat(agentFile)
+
+		switch {
+		case err == nil && !stat.IsDir():
+			name, err := readAgentFile(agentFile)
+			if err != nil {
+				return "", "", err
+			}
+
+			return name, agentFile, nil
+
+		case err != nil && !errors.Is(err, fs.ErrNotExist):
+			return "", "", err
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", "", nil
+		}
+
+		dir = parent
+	}
+}
+
+// readAgentFile returns the first line of the file that is not empty or a # comment
+func readAgentFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			return line, nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	return "", fmt.Errorf("%s does not name an agent", path)
+}
+
+// warnDeadSocket warns on stderr when SSH_AUTH_SOCK is left pointing at a socket no agent listens on
+func warnDeadSocket(vars []envVar) {
+	socketPath := os.Getenv(envAuthSock)
+
+	for _, v := range vars {
+		if v.name == envAuthSock {
+			socketPath = ""
+			if v.value != nil {
+				socketPath = *v.value
+			}
+		}
+	}
+
+	if socketPath != "" && !socketAlive(socketPath) {
+		fmt.Fprintf(os.Stderr, "oneauth: SSH_AUTH_SOCK points at %s, but no agent listens on it\n", socketPath)
+	}
+}
+
+func socketAlive(socketPath string) bool {
+	conn, err := net.DialTimeout("unix", socketPath, time.Second)
+	if err != nil {
+		return false
+	}
+
+	conn.Close()
+
+	return true
+}
+
+func renderEnv(shell string, vars []envVar) string {
+	var out strings.Builder
+
+	for _, v := range vars {
+		switch {
+		case shell == "fish" && v.value == nil:
+			fmt.Fprintf(&out, "set -e %s;\n", v.name)
+
+		case shell == "fish":
+			fmt.Fprintf(&out, "set -gx %s %s;\n", v.name, fishQuote(*v.value))
+
+		case v.value == nil:
+			fmt.Fprintf(&out, "unset %s;\n", v.name)
+
+		case shell == "posix":
+			fmt.Fprintf(&out, "%s=%s; export %s;\n", v.name, shellQuote(*v.value), v.name)
+
+		default:
+			fmt.Fprintf(&out, "export %s=%s;\n", v.name, shellQuote(*v.value))
+		}
+	}
+
+	return out.String()
+}
+
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+func fishQuote(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(value) + "'"
+}
@@ -0,0 +1,156 @@
+package commands
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShellName(t *testing.T) {
+	t.Run("Flag", func(t *testing.T) {
+		shell, err := shellName("fish")
+		require.NoError(t, err)
+		assert.Equal(t, "fish", shell)
+	})
+
+	t.Run("FromEnv", func(t *testing.T) {
+		t.Setenv("SHELL", "/usr/bin/zsh")
+
+		shell, err := shellName("")
+		require.NoError(t, err)
+		assert.Equal(t, "zsh", shell)
+	})
+
+	t.Run("UnknownEnv", func(t *testing.T) {
+		t.Setenv("SHELL", "/bin/tcsh")
+
+		shell, err := shellName("")
+		require.NoError(t, err)
+		assert.Equal(t, "posix", shell)
+	})
+
+	t.Run("Unsupported", func(t *testing.T) {
+		_, err := shellName("tcsh")
+		assert.ErrorContains(t, err, "unsupported shell tcsh")
+	})
+}
+
+func TestRenderEnv(t *testing.T) {
+	vars := []envVar{setVar("SSH_AUTH_SOCK", "/tmp/it's.sock"), unsetVar("ONEAUTH_AGENT")}
+
+	assert.Equal(t, "export SSH_AUTH_SOCK='/tmp/it'\\''s.sock';\nunset ONEAUTH_AGENT;\n", renderEnv("bash", vars))
+	assert.Equal(t, "SSH_AUTH_SOCK='/tmp/it'\\''s.sock'; export SSH_AUTH_SOCK;\nunset ONEAUTH_AGENT;\n", renderEnv("posix", vars))
+	assert.Equal(t, "set -gx SSH_AUTH_SOCK '/tmp/it\\'s.sock';\nset -e ONEAUTH_AGENT;\n", renderEnv("fish", vars))
+}
+
+func TestFindAgentFile(t *testing.T) {
+	root := t.TempDir()
+	nested := filepath.Join(root, "repo", "src", "pkg")
+	require.NoError(t, os.MkdirAll(nested, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "repo", agentFileName), []byte("# work repositories\n\n  work  \n"), 0600))
+
+	t.Run("Parent", func(t *testing.T) {
+		name, agentFile, err := findAgentFile(nested)
+		require.NoError(t, err)
+		assert.Equal(t, "work", name)
+		assert.Equal(t, filepath.Join(root, "repo", agentFileName), agentFile)
+	})
+
+	t.Run("None", func(t *testing.T) {
+		_, agentFile, err := findAgentFile(root)
+		require.NoError(t, err)
+		assert.Empty(t, agentFile)
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		dir := filepath.Join(root, "empty")
+		require.NoError(t, os.MkdirAll(dir, 0700))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, agentFileName), []byte("# nothing\n"), 0600))
+
+		_, _, err := findAgentFile(dir)
+		assert.ErrorContains(t, err, "does not name an agent")
+	})
+
+	t.Run("SkipsDirectory", func(t *testing.T) {
+		home := filepath.Join(root, "home")
+		project := filepath.Join(home, "project")
+		require.NoError(t, os.MkdirAll(filepath.Join(home, agentFileName), 0700))
+		require.NoError(t, os.MkdirAll(project, 0700))
+
+		_, agentFile, err := findAgentFile(project)
+		require.NoError(t, err)
+		assert.Empty(t, agentFile)
+	})
+}
+
+func TestDirEnv(t *testing.T) {
+	root := t.TempDir()
+	repo := filepath.Join(root, "repo")
+	require.NoError(t, os.MkdirAll(repo, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(repo, agentFileName), []byte("work\n"), 0600))
+
+	sockets := map[string]string{"default": "/tmp/default.sock", "work": "/tmp/work.sock"}
+
+	t.Run("Enter", func(t *testing.T) {
+		t.Setenv(envAuthSock, "/tmp/system.sock")
+		t.Setenv(envAgent, "")
+
+		vars, err := dirEnv(repo, sockets)
+		require.NoError(t, err)
+		assert.Equal(t, "export SSH_AUTH_SOCK='/tmp/work.sock';\nexport ONEAUTH_AGENT='work';\nexport ONEAUTH_PREV_SSH_AUTH_SOCK='/tmp/system.sock';\n", renderEnv("bash", vars))
+	})
+
+	t.Run("Stay", func(t *testing.T) {
+		t.Setenv(envAuthSock, "/tmp/work.sock")
+		t.Setenv(envAgent, "work")
+
+		vars, err := dirEnv(repo, sockets)
+		require.NoError(t, err)
+		assert.Empty(t, vars)
+	})
+
+	t.Run("Leave", func(t *testing.T) {
+		t.Setenv(envAuthSock, "/tmp/work.sock")
+		t.Setenv(envAgent, "work")
+		t.Setenv(envPrevSocket, "/tmp/system.sock")
+
+		vars, err := dirEnv(root, sockets)
+		require.NoError(t, err)
+		assert.Equal(t, "export SSH_AUTH_SOCK='/tmp/system.sock';\nunset ONEAUTH_AGENT;\nunset ONEAUTH_PREV_SSH_AUTH_SOCK;\n", renderEnv("bash", vars))
+	})
+
+	t.Run("LeaveWithoutPrevious", func(t *testing.T) {
+		t.Setenv(envAgent, "work")
+		t.Setenv(envPrevSocket, "")
+
+		vars, err := dirEnv(root, sockets)
+		require.NoError(t, err)
+		assert.Equal(t, "unset SSH_AUTH_SOCK;\nunset ONEAUTH_AGENT;\nunset ONEAUTH_PREV_SSH_AUTH_SOCK;\n", renderEnv("bash", vars))
+	})
+
+	t.Run("UnknownAgent", func(t *testing.T) {
+		t.Setenv(envAgent, "")
+
+		_, err := dirEnv(repo, map[string]string{"default": "/tmp/default.sock"})
+		assert.ErrorContains(t, err, "unknown agent work, the agents are: default")
+	})
+}
+
+func TestSocketAlive(t *testing.T) {
+	socketDir, err := os.MkdirTemp("", "oneauth")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(socketDir) })
+
+	socketPath := filepath.Join(socketDir, "agent.sock")
+	assert.False(t, socketAlive(socketPath))
+
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	assert.True(t, socketAlive(socketPath))
+}
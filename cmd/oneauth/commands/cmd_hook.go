@@ -0,0 +1,85 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/urfave/cli/v2"
+)
+
+// hookScripts run `oneauth env --dir` when the shell changes to another directory
+var hookScripts = map[string]string{
+	"bash": `_oneauth_hook() {
+  local status=$?
+  if [[ "${_oneauth_pwd-}" != "$PWD" ]]; then
+    _oneauth_pwd=$PWD
+    eval "$({{.Command}} --shell bash --dir "$PWD")"
+  fi
+  return $status
+}
+if [[ ";${PROMPT_COMMAND[*]:-};" != *";_oneauth_hook;"* ]]; then
+  PROMPT_COMMAND="_oneauth_hook${PROMPT_COMMAND:+;$PROMPT_COMMAND}"
+fi
+`,
+	"zsh": `_oneauth_hook() {
+  eval "$({{.Command}} --shell zsh --dir "$PWD")"
+}
+typeset -ag chpwd_functions
+if (( ! ${chpwd_functions[(I)_oneauth_hook]} )); then
+  chpwd_functions=(_oneauth_hook $chpwd_functions)
+fi
+_oneauth_hook
+`,
+	"fish": `function _oneauth_hook --on-variable PWD
+    {{.Command}} --shell fish --dir "$PWD" | source
+end
+_oneauth_hook
+`,
+}
+
+var hookCmd = &cli.Command{
+	Name:  "hook",
+	Usage: "Print the shell hook that selects the agent named in " + agentFileName + " files",
+	Description: `Add it to the shell startup file:
+   bash: eval "$(oneauth hook --shell bash)" in ~/.bashrc
+   zsh:  eval "$(oneauth hook --shell zsh)" in ~/.zshrc
+   fish: oneauth hook --shell fish | source in ~/.config/fish/config.fish`,
+	Flags: []cli.Flag{
+		shellFlag,
+	},
+	Action: func(c *cli.Context) error {
+		shell, err := shellName(c.String("shell"))
+		if err != nil {
+			return err
+		}
+
+		script, ok := hookScripts[shell]
+		if !ok {
+			return errors.New("the hook supports bash, zsh and fish")
+		}
+
+		execPath, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("failed to get executable path: %w", err)
+		}
+
+		quote := shellQuote
+		if shell == "fish" {
+			quote = fishQuote
+		}
+
+		command := []string{quote(execPath)}
+		if c.IsSet("config") {
+			command = append(command, "--config", quote(c.Path("config")))
+		}
+
+		command = append(command, "env")
+
+		return template.Must(template.New("hook").Parse(script)).Execute(os.Stdout, struct {
+			Command string
+		}{strings.Join(command, " ")})
+	},
+}
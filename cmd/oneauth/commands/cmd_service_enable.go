@@ -1,17 +1,38 @@
 package commands
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 
 	"github.com/urfave/cli/v2"
+	"github.com/vitalvas/oneauth/cmd/oneauth/config"
+	"github.com/vitalvas/oneauth/cmd/oneauth/paths"
 	"github.com/vitalvas/oneauth/cmd/oneauth/service"
 )
 
 var serviceEnableCmd = &cli.Command{
 	Name:  "enable",
 	Usage: "Enable the service",
-	Action: func(_ *cli.Context) error {
-		if err := service.Install(); err != nil {
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "socket",
+			Usage: "start the agent by socket activation on its socket (systemd only)",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		var opts service.Options
+
+		if c.Bool("socket") {
+			socketPath, err := agentSocketPath(c)
+			if err != nil {
+				return err
+			}
+
+			opts.SocketPath = socketPath
+		}
+
+		if err := service.Install(opts); err != nil {
 			return err
 		}
 
@@ -20,3 +41,23 @@ var serviceEnableCmd = &cli.Command{
 		return nil
 	},
 }
+
+// agentSocketPath returns the agent socket from the config, or the default path when there is no config file
+func agentSocketPath(c *cli.Context) (string, error) {
+	if configPath := c.Path("config"); configPath != "" {
+		conf, err := config.Load(configPath)
+		if err == nil {
+			if conf.Socket.Type != "unix" {
+				return "", fmt.Errorf("socket activation needs a unix socket, not %s", conf.Socket.Type)
+			}
+
+			return conf.Socket.Path, nil
+		}
+
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("failed to load config: %w", err)
+		}
+	}
+
+	return paths.AgentSocket()
+}
@@ -1,16 +1,42 @@
 package commands
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/urfave/cli/v2"
+	"github.com/vitalvas/oneauth/cmd/oneauth/config"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcclient"
 	"github.com/vitalvas/oneauth/cmd/oneauth/service"
 )
 
 var serviceRestartCmd = &cli.Command{
 	Name:  "restart",
 	Usage: "Restart the service",
-	Action: func(_ *cli.Context) error {
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "no-handoff",
+			Usage: "stop the running agent instead of handing off its sockets and keys",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if !c.Bool("no-handoff") {
+			token, err := handoffToken(c)
+			if err != nil {
+				return fmt.Errorf("failed to hand off the running agent, restart it with --no-handoff: %w", err)
+			}
+
+			if token != "" {
+				if err := service.Handoff(c.Path("config"), token); err != nil {
+					return err
+				}
+
+				fmt.Println("the agent hands off to the new process...")
+
+				return nil
+			}
+		}
+
 		if err := service.Restart(); err != nil {
 			return err
 		}
@@ -20,3 +46,18 @@ var serviceRestartCmd = &cli.Command{
 		return nil
 	},
 }
+
+// handoffToken asks the agent on the control socket for a handoff token, it is empty when no agent is running
+func handoffToken(c *cli.Context) (string, error) {
+	conf, err := config.Load(c.Path("config"))
+	if err != nil {
+		return "", nil
+	}
+
+	token, err := rpcclient.New(conf.ControlSocketPath).HandoffToken(c.Context)
+	if errors.Is(err, rpcclient.ErrAgentNotRunning) {
+		return "", nil
+	}
+
+	return token, err
+}
@@ -6,9 +6,10 @@ import (
 	"strings"
 	"time"
 
-	"github.com/go-piv/piv-go/v2/piv"
 	"github.com/urfave/cli/v2"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
 	"github.com/vitalvas/oneauth/internal/keyring"
+	"github.com/vitalvas/oneauth/internal/tools"
 	"github.com/vitalvas/oneauth/internal/yubikey"
 )
 
@@ -103,14 +104,33 @@ var setupPivSlotCmd = &cli.Command{
 			return fmt.Errorf("serial is required")
 		}
 
-		key, err := yubikey.OpenBySerial(serial)
+		pivSlot, err := yubikey.ParseSlot(c.String("slot"))
 		if err != nil {
 			return err
 		}
 
-		defer key.Close()
+		certReq, err := yubikey.NewInsecureCertRequest(
+			c.String("username"),
+			c.String("key-type"),
+			c.String("touch-policy"),
+			c.String("pin-policy"),
+			int(c.Uint64("valid-days")),
+		)
+		if err != nil {
+			return err
+		}
 
-		pivSlot := yubikey.MustSlotFromKeyID(uint32(c.Uint("slot")))
+		client, _, viaAgent := agentYubikeyClient(c, serial)
+
+		var key *yubikey.Yubikey
+		if !viaAgent {
+			key, err = yubikey.OpenBySerial(serial)
+			if err != nil {
+				return err
+			}
+
+			defer key.Close()
+		}
 
 		fmt.Println("Setup a PIV slot on YubiKey:", pivSlot.String())
 
@@ -121,54 +141,39 @@ var setupPivSlotCmd = &cli.Command{
 			time.Sleep(time.Duration(wait) * time.Second)
 		}
 
-		username := c.String("username")
-
-		validDays := c.Uint64("valid-days")
-
-		var touchPolicy piv.TouchPolicy
-		if policy, ok := yubikey.MapTouchPolicy(c.String("touch-policy")); ok {
-			touchPolicy = policy
-		}
-
-		var pinPolicy piv.PINPolicy
-		if policy, ok := yubikey.MapPINPolicy(c.String("pin-policy")); ok {
-			pinPolicy = policy
-		}
-
-		yubikeyPIN, err := keyring.Get(fmt.Sprintf("yubikey:%d:%s", serial, "pin"))
-		if err != nil {
-			return fmt.Errorf("failed to get YubiKey PIN: %w", err)
-		}
-
-		switch c.String("key-type") {
-		case "rsa2048":
-			key.GenCertificate(pivSlot, yubikeyPIN, yubikey.CertRequest{
-				CommonName: fmt.Sprintf("%s@%s", username, "insecure-rsa"),
-				Days:       int(validDays),
-				Key: piv.Key{
-					Algorithm:   piv.AlgorithmRSA2048,
-					PINPolicy:   pinPolicy,
-					TouchPolicy: touchPolicy,
-				},
+		if viaAgent {
+			resp, err := client.GenerateSlot(c.Context, rpcapi.GenerateSlotRequest{
+				Serial:      serial,
+				Slot:        pivSlot.String(),
+				Username:    c.String("username"),
+				ValidDays:   int(c.Uint64("valid-days")),
+				KeyType:     c.String("key-type"),
+				TouchPolicy: c.String("touch-policy"),
+				PINPolicy:   c.String("pin-policy"),
 			})
+			if err != nil {
+				return err
+			}
 
-		case "eccp256", "eccp384":
-			// default to eccp256
-			eccAlgo := piv.AlgorithmEC256
+			afterLines = append(afterLines, "generated by the running agent")
 
-			if c.String("key-type") == "eccp384" {
-				eccAlgo = piv.AlgorithmEC384
+			if resp.Slot.SSHPublicKey != "" {
+				afterLines = append(afterLines, resp.Slot.SSHPublicKey)
+			}
+		} else {
+			yubikeyPIN, err := keyring.Get(fmt.Sprintf("yubikey:%d:%s", serial, "pin"))
+			if err != nil {
+				return fmt.Errorf("failed to get YubiKey PIN: %w", err)
 			}
 
-			key.GenCertificate(pivSlot, yubikeyPIN, yubikey.CertRequest{
-				CommonName: fmt.Sprintf("%s@%s", username, "insecure-ecdsa"),
-				Days:       int(validDays),
-				Key: piv.Key{
-					Algorithm:   eccAlgo,
-					PINPolicy:   pinPolicy,
-					TouchPolicy: touchPolicy,
-				},
-			})
+			cert, err := key.GenCertificate(pivSlot, yubikeyPIN, certReq)
+			if err != nil {
+				return fmt.Errorf("failed to generate key: %w", err)
+			}
+
+			if sshKey, err := tools.GetSSHPublicKey(cert.PublicKey); err == nil {
+				afterLines = append(afterLines, strings.TrimSpace(string(sshKey)))
+			}
 		}
 
 		fmt.Println("Done")
@@ -7,6 +7,8 @@ import (
 
 	"github.com/go-piv/piv-go/v2/piv"
 	"github.com/urfave/cli/v2"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcclient"
 	"github.com/vitalvas/oneauth/internal/yubikey"
 	"golang.org/x/term"
 )
@@ -27,6 +29,10 @@ var yubikeyChangePinCmd = &cli.Command{
 			return fmt.Errorf("serial is required")
 		}
 
+		if client, _, ok := agentYubikeyClient(c, uint32(serial)); ok {
+			return changePINWithAgent(c, client, uint32(serial))
+		}
+
 		key, err := yubikey.OpenBySerial(uint32(serial))
 		if err != nil {
 			return err
@@ -80,6 +86,53 @@ var yubikeyChangePinCmd = &cli.Command{
 	},
 }
 
+// changePINWithAgent changes the PIN of the YubiKey held by the running agent
+func changePINWithAgent(c *cli.Context, client *rpcclient.Client, serial uint32) error {
+	retries, err := client.YubikeyRetries(c.Context, serial)
+	if err != nil {
+		return fmt.Errorf("failed to get PIN retries: %w", err)
+	}
+
+	fmt.Printf("YubiKey with serial %d is used by the running agent\n", retries.Serial)
+
+	if retries.PINRetries == 0 {
+		return errors.New("PIN is blocked. Unblock it with PUK code")
+	}
+
+	fmt.Print("Enter current PIN: ")
+	currentPIN, err := term.ReadPassword(int(os.Stdin.Fd()))
+	if err != nil {
+		return err
+	}
+
+	fmt.Print("\n")
+
+	if !yubikey.ValidatePin(string(currentPIN)) {
+		return fmt.Errorf("invalid PIN")
+	}
+
+	newPIN, err := readPin()
+	if err != nil {
+		return err
+	}
+
+	if string(currentPIN) == newPIN {
+		return fmt.Errorf("the new PIN can not be the same as the current one")
+	}
+
+	if err := client.ChangePIN(c.Context, rpcapi.ChangePINRequest{
+		Serial:     serial,
+		CurrentPIN: string(currentPIN),
+		NewPIN:     newPIN,
+	}); err != nil {
+		return err
+	}
+
+	fmt.Println("PIN changed successfully")
+
+	return nil
+}
+
 func readPin() (string, error) {
 	fmt.Println("The PIN code can consist of 6-8 digits (0-9)")
 
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/urfave/cli/v2"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
 	"github.com/vitalvas/oneauth/internal/tools"
 	"github.com/vitalvas/oneauth/internal/yubikey"
 )
@@ -13,7 +14,24 @@ import (
 var yubikeyListCmd = &cli.Command{
 	Name:  "list",
 	Usage: "List Yubikeys",
-	Action: func(_ *cli.Context) error {
+	Action: func(c *cli.Context) error {
+		if client, _, ok := agentYubikeyClient(c, 0); ok {
+			cards, err := client.YubikeyCards(c.Context)
+			if err != nil {
+				return err
+			}
+
+			for idx, card := range cards {
+				if idx > 0 {
+					fmt.Println(strings.Repeat("-", 24))
+				}
+
+				printYubikeyCard(fmt.Sprintf("Yubikey #%d (used by agent)", card.Serial), card)
+			}
+
+			return nil
+		}
+
 		cards, err := yubikey.Cards()
 		if err != nil {
 			return err
@@ -29,33 +47,56 @@ var yubikeyListCmd = &cli.Command{
 				fmt.Println(strings.Repeat("-", 24))
 			}
 
-			fmt.Println(card.Name)
-			fmt.Println(" - Serial:", card.Serial)
-			fmt.Println(" - Version:", card.Version)
-			fmt.Println(" - Keys:")
-
 			keys, err := yk.ListKeys(yubikey.AllSlots...)
 			if err != nil {
 				return err
 			}
 
-			if len(keys) == 0 {
-				fmt.Println("   - no keys")
+			info := rpcapi.YubikeyCard{
+				Serial:  card.Serial,
+				Version: card.Version,
 			}
 
 			for _, key := range keys {
-				fmt.Printf("   - 0x%s | %s:\n", key.Slot.PIVSlot.String(), key.Subject.CommonName)
-				fmt.Printf("     - created: %s expires: %s\n", key.NotBefore.Local().Format(time.RFC3339), key.NotAfter.Local().Format(time.RFC3339))
+				slot := rpcapi.YubikeySlot{
+					Slot:       key.Slot.PIVSlot.String(),
+					CommonName: key.Subject.CommonName,
+					NotBefore:  key.NotBefore,
+					NotAfter:   key.NotAfter,
+				}
 
 				if certSSHKey, err := tools.GetSSHPublicKey(key.PublicKey); err == nil {
-					certSSHKeyStr := strings.TrimSpace(string(certSSHKey))
-					fmt.Printf("     - SSH: %s\n", certSSHKeyStr)
+					slot.SSHPublicKey = strings.TrimSpace(string(certSSHKey))
 				}
+
+				info.Slots = append(info.Slots, slot)
 			}
 
+			printYubikeyCard(card.Name, info)
+
 			yk.Close()
 		}
 
 		return nil
 	},
 }
+
+func printYubikeyCard(name string, card rpcapi.YubikeyCard) {
+	fmt.Println(name)
+	fmt.Println(" - Serial:", card.Serial)
+	fmt.Println(" - Version:", card.Version)
+	fmt.Println(" - Keys:")
+
+	if len(card.Slots) == 0 {
+		fmt.Println("   - no keys")
+	}
+
+	for _, slot := range card.Slots {
+		fmt.Printf("   - 0x%s | %s:\n", slot.Slot, slot.CommonName)
+		fmt.Printf("     - created: %s expires: %s\n", slot.NotBefore.Local().Format(time.RFC3339), slot.NotAfter.Local().Format(time.RFC3339))
+
+		if slot.SSHPublicKey != "" {
+			fmt.Printf("     - SSH: %s\n", slot.SSHPublicKey)
+		}
+	}
+}
@@ -6,6 +6,8 @@ import (
 
 	"github.com/go-piv/piv-go/v2/piv"
 	"github.com/urfave/cli/v2"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcclient"
 	"github.com/vitalvas/oneauth/internal/yubikey"
 	"golang.org/x/term"
 )
@@ -26,6 +28,10 @@ var yubikeyUnblockPinCmd = &cli.Command{
 			return fmt.Errorf("serial is required")
 		}
 
+		if client, _, ok := agentYubikeyClient(c, uint32(serial)); ok {
+			return unblockPINWithAgent(c, client, uint32(serial))
+		}
+
 		key, err := yubikey.OpenBySerial(uint32(serial))
 		if err != nil {
 			return err
@@ -78,3 +84,47 @@ var yubikeyUnblockPinCmd = &cli.Command{
 		return nil
 	},
 }
+
+// unblockPINWithAgent unblocks the PIN of the YubiKey held by the running agent
+func unblockPINWithAgent(c *cli.Context, client *rpcclient.Client, serial uint32) error {
+	retries, err := client.YubikeyRetries(c.Context, serial)
+	if err != nil {
+		return fmt.Errorf("failed to get PIN retries: %w", err)
+	}
+
+	fmt.Printf("YubiKey with serial %d is used by the running agent\n", retries.Serial)
+
+	if retries.PINRetries > 0 {
+		return fmt.Errorf("PIN is not blocked. Retries left: %d", retries.PINRetries)
+	}
+
+	fmt.Print("Enter PUK code: ")
+
+	pukCode, err := term.ReadPassword(int(os.Stdin.Fd()))
+	if err != nil {
+		return err
+	}
+
+	fmt.Print("\n")
+
+	newPIN, err := readPin()
+	if err != nil {
+		return err
+	}
+
+	if string(pukCode) == newPIN {
+		return fmt.Errorf("PIN and PUK codes must be different")
+	}
+
+	if err := client.UnblockPIN(c.Context, rpcapi.UnblockPINRequest{
+		Serial: serial,
+		PUK:    string(pukCode),
+		NewPIN: newPIN,
+	}); err != nil {
+		return err
+	}
+
+	fmt.Println("PIN successfully unblocked")
+
+	return nil
+}
@@ -34,6 +34,10 @@ func Execute() {
 		},
 		Commands: []*cli.Command{
 			agentCmd,
+			auditCmd,
+			doctorCmd,
+			envCmd,
+			hookCmd,
 			infoCmd,
 			setupCmd,
 			serviceCmd,
@@ -0,0 +1,113 @@
+package commands
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"github.com/vitalvas/oneauth/cmd/oneauth/config"
+	"github.com/vitalvas/oneauth/cmd/oneauth/paths"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcclient"
+	"golang.org/x/term"
+)
+
+var jsonFlag = &cli.BoolFlag{
+	Name:  "json",
+	Usage: "print output as JSON",
+}
+
+// controlClient connects to the control socket of the running agent
+func controlClient(c *cli.Context) (*rpcclient.Client, error) {
+	configPath := c.Path("config")
+	if configPath == "" {
+		return defaultControlClient()
+	}
+
+	conf, err := config.Load(configPath)
+	if err == nil {
+		return rpcclient.New(conf.ControlSocketPath), nil
+	}
+
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	// the agent also runs without a config file
+	return defaultControlClient()
+}
+
+func defaultControlClient() (*rpcclient.Client, error) {
+	socketPath, err := paths.ControlSocket()
+	if err != nil {
+		return nil, err
+	}
+
+	return rpcclient.New(socketPath), nil
+}
+
+// agentYubikeyClient returns a client for the running agent when it holds the YubiKey with the serial,
+// so card operations go through the agent instead of competing with it for the card.
+// A zero serial matches any YubiKey held by the agent, the returned serial is zero when the agent holds several.
+func agentYubikeyClient(c *cli.Context, serial uint32) (*rpcclient.Client, uint32, bool) {
+	client, err := controlClient(c)
+	if err != nil {
+		return nil, 0, false
+	}
+
+	status, err := client.Status(c.Context)
+	if err != nil || status.Serial == 0 {
+		return nil, 0, false
+	}
+
+	serials := status.Serials
+	if len(serials) == 0 {
+		serials = []uint32{status.Serial}
+	}
+
+	switch {
+	case serial != 0 && !slices.Contains(serials, serial):
+		return nil, 0, false
+
+	case serial == 0 && len(serials) == 1:
+		serial = serials[0]
+	}
+
+	return client, serial, true
+}
+
+func printJSON(v any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(v)
+}
+
+// readPassphrase reads a passphrase from the terminal, or a single line when stdin is not a terminal
+func readPassphrase(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("failed to read passphrase: %w", err)
+		}
+
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprint(os.Stderr, "\n")
+
+	if err != nil {
+		return "", fmt.Errorf("failed to read passphrase: %w", err)
+	}
+
+	return string(passphrase), nil
+}
@@ -0,0 +1,213 @@
+package commands
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcserver"
+	"github.com/vitalvas/oneauth/cmd/oneauth/sshagent"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// startControlServer runs a control API with one soft agent and returns a config file pointing to it
+func startControlServer(t *testing.T) (string, *sshagent.SoftAgent) {
+	t.Helper()
+
+	tmpHome := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(tmpHome, ".oneauth"), 0700))
+	t.Setenv("HOME", tmpHome)
+
+	// unix socket paths are limited in length, so keep it short
+	socketDir, err := os.MkdirTemp("", "oneauth")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(socketDir) })
+
+	socketPath := filepath.Join(socketDir, "control.sock")
+	configPath := filepath.Join(tmpHome, "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte("control_socket_path: "+socketPath+"\n"), 0600))
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	work := sshagent.NewSoftAgent("work", 0, logrus.New())
+	require.NoError(t, work.Add(agent.AddedKey{PrivateKey: priv, Comment: "work-key"}))
+
+	server := rpcserver.New(nil, logrus.New())
+	server.SetSoftAgents(map[string]*sshagent.SoftAgent{"work": work})
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- server.ListenAndServe(context.Background(), socketPath)
+	}()
+
+	t.Cleanup(func() {
+		server.Shutdown()
+		<-errChan
+	})
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(socketPath)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	return configPath, work
+}
+
+func runAgentCmd(configPath string, args ...string) error {
+	app := &cli.App{
+		Flags: []cli.Flag{
+			&cli.PathFlag{
+				Name:  "config",
+				Value: configPath,
+			},
+		},
+		Commands: []*cli.Command{agentCmd},
+	}
+
+	return app.Run(append([]string{"app", "agent"}, args...))
+}
+
+// withStdin replaces stdin with the given input for the duration of the test
+func withStdin(t *testing.T, input string) {
+	t.Helper()
+
+	reader, writer, err := os.Pipe()
+	require.NoError(t, err)
+
+	_, err = writer.WriteString(input)
+	require.NoError(t, err)
+	writer.Close()
+
+	origStdin := os.Stdin
+	os.Stdin = reader
+
+	t.Cleanup(func() {
+		os.Stdin = origStdin
+		reader.Close()
+	})
+}
+
+func TestAgentControlCommands(t *testing.T) {
+	t.Run("Status", func(t *testing.T) {
+		configPath, _ := startControlServer(t)
+
+		assert.NoError(t, runAgentCmd(configPath, "status"))
+		assert.NoError(t, runAgentCmd(configPath, "status", "--json"))
+	})
+
+	t.Run("Keys", func(t *testing.T) {
+		configPath, _ := startControlServer(t)
+
+		assert.NoError(t, runAgentCmd(configPath, "keys"))
+		assert.NoError(t, runAgentCmd(configPath, "keys", "--json"))
+	})
+
+	t.Run("ForgetAll", func(t *testing.T) {
+		configPath, work := startControlServer(t)
+
+		assert.NoError(t, runAgentCmd(configPath, "forget", "--all"))
+		assert.Empty(t, work.SoftKeys())
+	})
+
+	t.Run("ForgetByFingerprint", func(t *testing.T) {
+		configPath, work := startControlServer(t)
+
+		fp := work.SoftKeys()[0].Fingerprint()
+
+		assert.NoError(t, runAgentCmd(configPath, "forget", "SHA256:unknown", fp))
+		assert.Empty(t, work.SoftKeys())
+	})
+
+	t.Run("ForgetWithoutArgs", func(t *testing.T) {
+		configPath, _ := startControlServer(t)
+
+		err := runAgentCmd(configPath, "forget")
+		assert.ErrorContains(t, err, "fingerprint or --all is required")
+	})
+
+	t.Run("LockAndUnlock", func(t *testing.T) {
+		configPath, work := startControlServer(t)
+
+		withStdin(t, "secret\n")
+		require.NoError(t, runAgentCmd(configPath, "lock"))
+		assert.True(t, work.Locked())
+
+		withStdin(t, "wrong\n")
+		assert.Error(t, runAgentCmd(configPath, "unlock"))
+		assert.True(t, work.Locked())
+
+		withStdin(t, "secret\n")
+		require.NoError(t, runAgentCmd(configPath, "unlock", "--agent", "work"))
+		assert.False(t, work.Locked())
+	})
+
+	t.Run("ReloadNotSupported", func(t *testing.T) {
+		configPath, _ := startControlServer(t)
+
+		err := runAgentCmd(configPath, "reload")
+		assert.ErrorContains(t, err, "reload is not supported")
+	})
+
+	t.Run("AgentNotRunning", func(t *testing.T) {
+		tmpHome := t.TempDir()
+		t.Setenv("HOME", tmpHome)
+
+		configPath := filepath.Join(tmpHome, "config.yaml")
+		require.NoError(t, os.WriteFile(configPath, []byte("control_socket_path: "+filepath.Join(tmpHome, "missing.sock")+"\n"), 0600))
+
+		err := runAgentCmd(configPath, "status")
+		assert.ErrorContains(t, err, "agent is not running")
+	})
+}
+
+func TestAgentYubikeyClient(t *testing.T) {
+	t.Run("AgentWithoutYubikey", func(t *testing.T) {
+		configPath, _ := startControlServer(t)
+
+		ctx := newTestContext(t, configPath)
+
+		_, _, ok := agentYubikeyClient(ctx, 0)
+		assert.False(t, ok)
+	})
+
+	t.Run("AgentNotRunning", func(t *testing.T) {
+		tmpHome := t.TempDir()
+		t.Setenv("HOME", tmpHome)
+
+		ctx := newTestContext(t, filepath.Join(tmpHome, "missing.yaml"))
+
+		_, _, ok := agentYubikeyClient(ctx, 12345)
+		assert.False(t, ok)
+	})
+}
+
+// newTestContext returns a cli context with the config flag set
+func newTestContext(t *testing.T, configPath string) *cli.Context {
+	t.Helper()
+
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.String("config", configPath, "")
+
+	ctx := cli.NewContext(&cli.App{}, set, nil)
+	ctx.Context = context.Background()
+
+	return ctx
+}
+
+func TestControlClientWithoutConfig(t *testing.T) {
+	tmpHome := t.TempDir()
+	t.Setenv("HOME", tmpHome)
+
+	err := runAgentCmd(filepath.Join(tmpHome, "missing.yaml"), "status")
+	assert.ErrorContains(t, err, "agent is not running")
+}
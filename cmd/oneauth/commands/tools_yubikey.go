@@ -8,6 +8,15 @@ import (
 )
 
 func selectYubiKey(c *cli.Context) error {
+	// the card held by a running agent can not be opened directly
+	if _, serial, ok := agentYubikeyClient(c, uint32(c.Uint64("serial"))); ok {
+		if serial == 0 {
+			return fmt.Errorf("the agent uses several YubiKeys, select one with --serial")
+		}
+
+		return c.Set("serial", fmt.Sprintf("%d", serial))
+	}
+
 	cards, err := yubikey.Cards()
 	if err != nil {
 		return err
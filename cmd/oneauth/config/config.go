@@ -27,6 +27,11 @@ func Load(filePath string) (*Config, error) {
 		return nil, err
 	}
 
+	auditLogPath, err := paths.AuditLog()
+	if err != nil {
+		return nil, err
+	}
+
 	conf := &Config{
 		ControlSocketPath: controlSocketPath,
 		AgentLogPath:      fmt.Sprintf("%s/agent_%d.log", agentLogDir, time.Now().Year()),
@@ -34,6 +39,9 @@ func Load(filePath string) (*Config, error) {
 			Type: "unix",
 			Path: agentSocketPath,
 		},
+		Audit: Audit{
+			Path: auditLogPath,
+		},
 	}
 
 	if err := loadYamlFile(filePath, conf); err != nil {
@@ -61,6 +69,10 @@ func expandAgentPaths(conf *Config) error {
 		return err
 	}
 
+	if strings.HasPrefix(conf.Audit.Path, "~/") {
+		conf.Audit.Path = homeDir + conf.Audit.Path[1:]
+	}
+
 	for name, agent := range conf.Agents {
 		// Set default socket path if not specified
 		if agent.SocketPath == "" {
@@ -73,6 +85,13 @@ func expandAgentPaths(conf *Config) error {
 			// Expand ~ in socket paths
 			agent.SocketPath = homeDir + agent.SocketPath[1:]
 		}
+
+		for i, upstream := range agent.Upstreams {
+			if strings.HasPrefix(upstream.SocketPath, "~/") {
+				agent.Upstreams[i].SocketPath = homeDir + upstream.SocketPath[1:]
+			}
+		}
+
 		conf.Agents[name] = agent
 	}
 
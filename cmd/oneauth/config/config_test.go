@@ -8,6 +8,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/vitalvas/oneauth/internal/netutil"
 )
 
 func TestLoadYamlFile(t *testing.T) {
@@ -186,6 +187,7 @@ keyring:
     serial: 12345
   before_sign_hook: "echo test"
   keep_key_seconds: 300
+askpass: "/usr/bin/ssh-askpass"
 `
 		_, err = tmpFile.Write([]byte(configContent))
 		require.NoError(t, err)
@@ -201,6 +203,7 @@ keyring:
 		assert.Equal(t, uint32(12345), config.Keyring.Yubikey.Serial)
 		assert.Equal(t, "echo test", config.Keyring.BeforeSignHook)
 		assert.Equal(t, int64(300), config.Keyring.KeepKeySeconds)
+		assert.Equal(t, "/usr/bin/ssh-askpass", config.Askpass)
 	})
 
 	t.Run("EmptyConfigFile", func(t *testing.T) {
@@ -238,6 +241,52 @@ keyring:
 		assert.NotEmpty(t, config.AgentLogPath)
 		assert.Equal(t, "unix", config.Socket.Type)
 		assert.NotEmpty(t, config.Socket.Path)
+		assert.Equal(t, filepath.Join(tmpHome, ".oneauth", "log", "audit.log"), config.Audit.Path)
+		assert.False(t, config.Audit.Disabled)
+	})
+
+	t.Run("AuditConfig", func(t *testing.T) {
+		tmpHome := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(tmpHome, ".oneauth"), 0755))
+		t.Setenv("HOME", tmpHome)
+
+		configPath := filepath.Join(tmpHome, "config.yaml")
+		require.NoError(t, os.WriteFile(configPath, []byte("audit:\n  path: ~/audit/agent.log\n  max_size_mb: 1\n  max_files: 3\n"), 0600))
+
+		config, err := Load(configPath)
+		require.NoError(t, err)
+
+		assert.Equal(t, filepath.Join(tmpHome, "audit", "agent.log"), config.Audit.Path)
+		assert.Equal(t, int64(1), config.Audit.MaxSizeMB)
+		assert.Equal(t, 3, config.Audit.MaxFiles)
+	})
+
+	t.Run("LockConfig", func(t *testing.T) {
+		tmpHome := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(tmpHome, ".oneauth"), 0755))
+		t.Setenv("HOME", tmpHome)
+
+		configPath := filepath.Join(tmpHome, "config.yaml")
+		require.NoError(t, os.WriteFile(configPath, []byte("lock:\n  idle_minutes: 15\n  on_yubikey_removal: true\n  unlock_with_pin: true\n  wipe_soft_keys: true\n"), 0600))
+
+		config, err := Load(configPath)
+		require.NoError(t, err)
+
+		assert.Equal(t, Lock{IdleMinutes: 15, OnYubikeyRemoval: true, UnlockWithPIN: true, WipeSoftKeys: true}, config.Lock)
+	})
+
+	t.Run("AgentPersist", func(t *testing.T) {
+		tmpHome := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(tmpHome, ".oneauth"), 0755))
+		t.Setenv("HOME", tmpHome)
+
+		configPath := filepath.Join(tmpHome, "config.yaml")
+		require.NoError(t, os.WriteFile(configPath, []byte("agents:\n  ci:\n    persist:\n      enabled: true\n      serial: 42\n      slot: 82\n"), 0600))
+
+		config, err := Load(configPath)
+		require.NoError(t, err)
+
+		assert.Equal(t, AgentPersist{Enabled: true, Serial: 42, Slot: "82"}, config.Agents["ci"].Persist)
 	})
 
 	t.Run("NonExistentConfigFile", func(t *testing.T) {
@@ -794,3 +843,58 @@ func TestLoadYamlFile_EdgeCases(t *testing.T) {
 		assert.Error(t, err)
 	})
 }
+
+func TestKeyringYubikeyAllSerials(t *testing.T) {
+	tests := []struct {
+		name    string
+		yubikey KeyringYubikey
+		want    []uint32
+	}{
+		{"Empty", KeyringYubikey{}, []uint32{}},
+		{"Serial", KeyringYubikey{Serial: 1}, []uint32{1}},
+		{"Serials", KeyringYubikey{Serials: []uint32{2, 3}}, []uint32{2, 3}},
+		{"Merged", KeyringYubikey{Serial: 1, Serials: []uint32{2, 1, 0, 2}}, []uint32{1, 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.yubikey.AllSerials())
+		})
+	}
+}
+
+func TestConfigControlSocketAccess(t *testing.T) {
+	t.Run("MainSocketRules", func(t *testing.T) {
+		conf := Config{Socket: Socket{Access: netutil.Access{
+			DenyRoot:       true,
+			DenyContainers: true,
+			AllowUIDs:      []int{1000},
+			DenyGIDs:       []int{20},
+			AllowExe:       []string{"/usr/bin/ssh"},
+		}}}
+
+		assert.Equal(t, netutil.Access{
+			DenyRoot:       true,
+			DenyContainers: true,
+			AllowUIDs:      []int{1000},
+			DenyGIDs:       []int{20},
+		}, conf.ControlSocketAccess())
+	})
+
+	t.Run("ControlRules", func(t *testing.T) {
+		conf := Config{
+			Socket: Socket{Access: netutil.Access{AllowUIDs: []int{1000}, DenyUIDs: []int{0}}},
+			ControlAccess: netutil.Access{
+				AllowUIDs: []int{1001},
+				DenyUIDs:  []int{1002},
+				AllowExe:  []string{"/usr/local/bin/oneauth"},
+			},
+		}
+
+		assert.Equal(t, netutil.Access{
+			AllowUIDs: []int{1001},
+			DenyUIDs:  []int{0, 1002},
+			AllowExe:  []string{"/usr/local/bin/oneauth"},
+		}, conf.ControlSocketAccess())
+	})
+}
@@ -1,6 +1,12 @@
 package config
 
-import "github.com/google/uuid"
+import (
+	"slices"
+
+	"github.com/google/uuid"
+	"github.com/vitalvas/oneauth/internal/netutil"
+	"github.com/vitalvas/oneauth/internal/policy"
+)
 
 type Config struct {
 	AgentID uuid.UUID `yaml:"-"`
@@ -10,27 +16,151 @@ type Config struct {
 	Socket            Socket  `yaml:"socket,omitempty"`
 	Keyring           Keyring `yaml:"keyring,omitempty"`
 
+	// ControlAccess limits which processes may connect to the control socket, see ControlSocketAccess
+	ControlAccess netutil.Access `yaml:"control_access,omitempty"`
+
+	// Askpass is the program used to confirm keys added with `ssh-add -c`
+	Askpass string `yaml:"askpass,omitempty"`
+
+	// Pinentry asks for the YubiKey PIN when it is not stored in the OS keyring
+	Pinentry Pinentry `yaml:"pinentry,omitempty"`
+
+	// Lock decides when the agents lock themselves and what unlocks them
+	Lock Lock `yaml:"lock,omitempty"`
+
 	// Agents defines additional soft-key-only SSH agents
 	Agents map[string]AgentConfig `yaml:"agents,omitempty"`
+
+	// Audit configures the log of requests made to the agents
+	Audit Audit `yaml:"audit,omitempty"`
+
+	// Policy decides which sign requests are allowed, denied or confirmed
+	Policy policy.Config `yaml:"policy,omitempty"`
+}
+
+type Pinentry struct {
+	// Program is a pinentry program, e.g. pinentry-gnome3 or pinentry-curses, empty disables the prompt
+	Program string `yaml:"program,omitempty"`
+	// CacheSeconds keeps an entered PIN in memory, zero asks for it every time
+	CacheSeconds int64 `yaml:"cache_seconds,omitempty"`
+}
+
+type Lock struct {
+	// IdleMinutes locks an agent when none of its keys was used for this long, zero never locks it
+	IdleMinutes int64 `yaml:"idle_minutes,omitempty"`
+	// OnYubikeyRemoval locks the agents when an attached YubiKey is removed
+	OnYubikeyRemoval bool `yaml:"on_yubikey_removal,omitempty"`
+	// UnlockWithPIN also accepts the YubiKey PIN for agents locked with a passphrase,
+	// agents locked automatically are always unlocked with the PIN
+	UnlockWithPIN bool `yaml:"unlock_with_pin,omitempty"`
+	// WipeSoftKeys removes the keys added with ssh-add when an agent is locked, instead of hiding them
+	WipeSoftKeys bool `yaml:"wipe_soft_keys,omitempty"`
+}
+
+type Audit struct {
+	Disabled bool   `yaml:"disabled,omitempty"`
+	Path     string `yaml:"path,omitempty"`
+	// MaxSizeMB is the size at which the log is rotated
+	MaxSizeMB int64 `yaml:"max_size_mb,omitempty"`
+	// MaxFiles is the number of rotated files kept
+	MaxFiles int `yaml:"max_files,omitempty"`
 }
 
 // AgentConfig defines configuration for an additional soft-key SSH agent
 type AgentConfig struct {
 	SocketPath     string `yaml:"socket_path"`
 	KeepKeySeconds int64  `yaml:"keep_key_seconds,omitempty"`
+	// Access limits which processes may connect to the socket
+	Access netutil.Access `yaml:"access,omitempty"`
+	// Persist keeps the keys added with ssh-add across restarts of the agent
+	Persist AgentPersist `yaml:"persist,omitempty"`
+	// Upstreams are other agents whose keys are served next to the keys added with ssh-add
+	Upstreams []AgentUpstream `yaml:"upstreams,omitempty"`
+	// Yubikey selects the YubiKey slots served next to the keys added with ssh-add
+	Yubikey AgentYubikey `yaml:"yubikey,omitempty"`
+}
+
+// AgentYubikey is the view of a named agent on the slots of the YubiKey agent
+type AgentYubikey struct {
+	// Slots are PIV slots (e.g. "94") of the YubiKeys in keyring.yubikey, they are signed with the
+	// sign actions of the YubiKey agent and the signing policy rules of the named agent
+	Slots []string `yaml:"slots,omitempty"`
+}
+
+// AgentUpstream is an agent socket, e.g. the system ssh-agent, whose keys a named agent serves
+type AgentUpstream struct {
+	SocketPath string `yaml:"socket_path"`
+	// Fingerprints and Comments limit the keys taken from the agent, empty lists take every key.
+	// Comments are glob patterns.
+	Fingerprints []string `yaml:"fingerprints,omitempty"`
+	Comments     []string `yaml:"comments,omitempty"`
+}
+
+// AgentPersist stores the keys of a soft-key agent on disk, encrypted to an EC key of a YubiKey slot
+type AgentPersist struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+	// Serial is the YubiKey that unwraps the keys, zero uses keyring.yubikey.serial
+	Serial uint32 `yaml:"serial,omitempty"`
+	// Slot is the PIV slot of the EC key, empty uses 9d (key management)
+	Slot string `yaml:"slot,omitempty"`
 }
 
 type Socket struct {
 	Type string `yaml:"type,omitempty"`
 	Path string `yaml:"path,omitempty"`
+	// Access limits which processes may connect to the socket
+	Access netutil.Access `yaml:"access,omitempty"`
 }
 
 type Keyring struct {
 	Yubikey        KeyringYubikey `yaml:"yubikey,omitempty"`
 	BeforeSignHook string         `yaml:"before_sign_hook,omitempty"`
 	KeepKeySeconds int64          `yaml:"keep_key_seconds,omitempty"`
+	// SignTimeoutSeconds limits how long a request waits for the YubiKey, the PIN and touch, zero uses 60 seconds
+	SignTimeoutSeconds int64 `yaml:"sign_timeout_seconds,omitempty"`
 }
 
 type KeyringYubikey struct {
 	Serial uint32 `yaml:"serial,omitempty"`
+	// Serials are more YubiKeys served by the agent next to Serial, e.g. a backup key
+	Serials []uint32 `yaml:"serials,omitempty"`
+	// LocalOnlySlots are PIV slots (e.g. "95") that are refused to forwarded agent connections
+	LocalOnlySlots []string `yaml:"local_only_slots,omitempty"`
+	// MinPINRetries is the number of PIN retries below which the PIN stored in the OS keyring is not used, zero uses 2
+	MinPINRetries int `yaml:"min_pin_retries,omitempty"`
+}
+
+// ControlSocketAccess returns the rules of the control socket: control_access with the root, container, UID and GID
+// rules of socket.access. The executable rules of socket.access are not used, they would refuse the oneauth command.
+func (c *Config) ControlSocketAccess() netutil.Access {
+	access := c.ControlAccess
+	main := c.Socket.Access
+
+	access.DenyRoot = access.DenyRoot || main.DenyRoot
+	access.DenyContainers = access.DenyContainers || main.DenyContainers
+	access.DenyUIDs = slices.Concat(main.DenyUIDs, access.DenyUIDs)
+	access.DenyGIDs = slices.Concat(main.DenyGIDs, access.DenyGIDs)
+
+	if len(access.AllowUIDs) == 0 {
+		access.AllowUIDs = main.AllowUIDs
+	}
+
+	if len(access.AllowGIDs) == 0 {
+		access.AllowGIDs = main.AllowGIDs
+	}
+
+	return access
+}
+
+// AllSerials returns Serial and Serials without zero and duplicate values
+func (y KeyringYubikey) AllSerials() []uint32 {
+	serials := make([]uint32, 0, len(y.Serials)+1)
+
+	for _, serial := range append([]uint32{y.Serial}, y.Serials...) {
+		if serial != 0 && !slices.Contains(serials, serial) {
+			serials = append(serials, serial)
+		}
+	}
+
+	return serials
 }
@@ -0,0 +1,141 @@
+package doctor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcclient"
+)
+
+const startAgentHint = "start the agent with `oneauth service enable`, or run `oneauth agent`"
+
+// SocketProbe checks that the sockets of the agents exist and only the user can connect to them
+func SocketProbe(socketPaths []string) Probe {
+	return Probe{
+		Name: "sockets",
+		Check: func(_ context.Context) rpcapi.DoctorCheck {
+			return checkSockets(socketPaths)
+		},
+	}
+}
+
+// ControlProbe checks that the agent answers on the control socket and reports no failed health checks
+func ControlProbe(controlSocketPath string) Probe {
+	return Probe{
+		Name: "control",
+		Check: func(ctx context.Context) rpcapi.DoctorCheck {
+			return checkControl(ctx, rpcclient.New(controlSocketPath))
+		},
+	}
+}
+
+// AuthSockProbe checks that SSH_AUTH_SOCK of the shell points at a socket of the agents that answers
+func AuthSockProbe(socketPaths []string) Probe {
+	return Probe{
+		Name: "ssh_auth_sock",
+		Check: func(_ context.Context) rpcapi.DoctorCheck {
+			return checkAuthSock(os.Getenv("SSH_AUTH_SOCK"), socketPaths)
+		},
+	}
+}
+
+func checkSockets(socketPaths []string) rpcapi.DoctorCheck {
+	var missing, open []string
+
+	for _, path := range socketPaths {
+		stat, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			missing = append(missing, path)
+			continue
+		}
+
+		if err != nil {
+			return Fail("", "failed to check %s: %v", path, err)
+		}
+
+		if stat.Mode().Type() != os.ModeSocket {
+			return Fail(fmt.Sprintf("remove %s, the agent creates the socket on start", path), "%s is not a socket", path)
+		}
+
+		if perm := stat.Mode().Perm(); perm != 0600 {
+			open = append(open, fmt.Sprintf("%s (%o)", path, perm))
+		}
+	}
+
+	switch {
+	case len(open) > 0:
+		return Fail("run `chmod 600` on the sockets, the running agent fixes them within an hour",
+			"sockets are not private to the user: %s", strings.Join(open, ", "))
+
+	case len(missing) > 0:
+		return Warn(startAgentHint, "sockets do not exist: %s", strings.Join(missing, ", "))
+	}
+
+	return Pass("%d sockets have mode 600", len(socketPaths))
+}
+
+func checkControl(ctx context.Context, client *rpcclient.Client) rpcapi.DoctorCheck {
+	health, err := client.Health(ctx)
+	if errors.Is(err, rpcclient.ErrAgentNotRunning) {
+		return Fail(startAgentHint, "the agent does not answer on the control socket")
+	}
+
+	if err != nil {
+		return Fail("restart the agent with `oneauth service restart`", "the agent failed to answer: %v", err)
+	}
+
+	if health.Status != rpcapi.HealthOK {
+		var messages []string
+
+		for _, check := range health.Checks {
+			if check.Status != rpcapi.HealthOK {
+				messages = append(messages, fmt.Sprintf("%s: %s", check.Name, check.Message))
+			}
+		}
+
+		return Warn("see `oneauth agent status`", "the agent is %s: %s", health.Status, strings.Join(messages, "; "))
+	}
+
+	return Pass("the agent answers on the control socket")
+}
+
+func checkAuthSock(authSock string, socketPaths []string) rpcapi.DoctorCheck {
+	const hint = "run `eval \"$(oneauth env)\"`, or add `oneauth hook` to the shell startup file"
+
+	if authSock == "" {
+		return Warn(hint, "SSH_AUTH_SOCK is not set")
+	}
+
+	if !slices.ContainsFunc(socketPaths, func(path string) bool { return sameFile(path, authSock) }) {
+		return Warn(hint, "SSH_AUTH_SOCK points at %s, which is not a socket of oneauth", authSock)
+	}
+
+	conn, err := net.DialTimeout("unix", authSock, time.Second)
+	if err != nil {
+		return Fail(startAgentHint, "SSH_AUTH_SOCK points at %s, but no agent listens on it", authSock)
+	}
+
+	conn.Close()
+
+	return Pass("SSH_AUTH_SOCK points at %s", authSock)
+}
+
+// sameFile compares paths after resolving symlinks, e.g. of /tmp on macOS
+func sameFile(a, b string) bool {
+	if filepath.Clean(a) == filepath.Clean(b) {
+		return true
+	}
+
+	resolvedA, errA := filepath.EvalSymlinks(a)
+	resolvedB, errB := filepath.EvalSymlinks(b)
+
+	return errA == nil && errB == nil && resolvedA == resolvedB
+}
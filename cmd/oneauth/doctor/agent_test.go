@@ -0,0 +1,70 @@
+package doctor
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcclient"
+)
+
+// listenTemp listens on a socket in a short temporary directory, unix socket paths are limited in length
+func listenTemp(t *testing.T, name string) string {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "doctor")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	socketPath := filepath.Join(dir, name)
+
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	return socketPath
+}
+
+func TestCheckSockets(t *testing.T) {
+	socketPath := listenTemp(t, "agent.sock")
+
+	require.NoError(t, os.Chmod(socketPath, 0600))
+	assert.Equal(t, rpcapi.DoctorPass, checkSockets([]string{socketPath}).Status)
+
+	check := checkSockets([]string{socketPath, filepath.Join(filepath.Dir(socketPath), "missing.sock")})
+	assert.Equal(t, rpcapi.DoctorWarn, check.Status)
+	assert.Contains(t, check.Message, "missing.sock")
+
+	require.NoError(t, os.Chmod(socketPath, 0666))
+	check = checkSockets([]string{socketPath})
+	assert.Equal(t, rpcapi.DoctorFail, check.Status)
+	assert.Contains(t, check.Message, "(666)")
+
+	regular := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(regular, nil, 0600))
+	assert.Equal(t, rpcapi.DoctorFail, checkSockets([]string{regular}).Status)
+}
+
+func TestCheckAuthSock(t *testing.T) {
+	socketPath := listenTemp(t, "agent.sock")
+	deadPath := filepath.Join(filepath.Dir(socketPath), "dead.sock")
+
+	assert.Equal(t, rpcapi.DoctorPass, checkAuthSock(socketPath, []string{socketPath}).Status)
+	assert.Equal(t, rpcapi.DoctorWarn, checkAuthSock("", []string{socketPath}).Status)
+	assert.Equal(t, rpcapi.DoctorWarn, checkAuthSock("/tmp/other.sock", []string{socketPath}).Status)
+
+	check := checkAuthSock(deadPath, []string{socketPath, deadPath})
+	assert.Equal(t, rpcapi.DoctorFail, check.Status)
+	assert.Contains(t, check.Message, "no agent listens")
+}
+
+func TestCheckControl(t *testing.T) {
+	check := checkControl(context.Background(), rpcclient.New(filepath.Join(t.TempDir(), "control.sock")))
+	assert.Equal(t, rpcapi.DoctorFail, check.Status)
+	assert.Equal(t, startAgentHint, check.Hint)
+}
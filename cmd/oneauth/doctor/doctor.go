@@ -0,0 +1,94 @@
+// Package doctor runs independent diagnostic probes of the agent setup, the same probes are run
+// by `oneauth doctor` and by the agent for its control API.
+package doctor
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+)
+
+// probeTimeout bounds a single probe, e.g. a keyring or a PC/SC service that does not answer
+const probeTimeout = 10 * time.Second
+
+// Probe is a single check, its failure does not stop the other probes
+type Probe struct {
+	Name  string
+	Check func(ctx context.Context) rpcapi.DoctorCheck
+}
+
+// Pass, Warn and Fail return the results of the probes, the name is set by Run
+func Pass(format string, args ...any) rpcapi.DoctorCheck {
+	return rpcapi.DoctorCheck{Status: rpcapi.DoctorPass, Message: fmt.Sprintf(format, args...)}
+}
+
+func Warn(hint, format string, args ...any) rpcapi.DoctorCheck {
+	return rpcapi.DoctorCheck{Status: rpcapi.DoctorWarn, Message: fmt.Sprintf(format, args...), Hint: hint}
+}
+
+func Fail(hint, format string, args ...any) rpcapi.DoctorCheck {
+	return rpcapi.DoctorCheck{Status: rpcapi.DoctorFail, Message: fmt.Sprintf(format, args...), Hint: hint}
+}
+
+// Run runs the probes in order, a probe that panics or does not finish in time fails
+func Run(ctx context.Context, probes []Probe) rpcapi.Doctor {
+	result := rpcapi.Doctor{
+		Status: rpcapi.DoctorPass,
+		Checks: make([]rpcapi.DoctorCheck, 0, len(probes)),
+	}
+
+	for _, probe := range probes {
+		check := runProbe(ctx, probe)
+		check.Name = probe.Name
+
+		result.Checks = append(result.Checks, check)
+	}
+
+	result.Status = Worst(result.Checks)
+
+	return result
+}
+
+// Worst returns the worst status of the checks, pass when there are none
+func Worst(checks []rpcapi.DoctorCheck) string {
+	status := rpcapi.DoctorPass
+
+	for _, check := range checks {
+		switch check.Status {
+		case rpcapi.DoctorFail:
+			return rpcapi.DoctorFail
+
+		case rpcapi.DoctorWarn:
+			status = rpcapi.DoctorWarn
+		}
+	}
+
+	return status
+}
+
+func runProbe(ctx context.Context, probe Probe) rpcapi.DoctorCheck {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	done := make(chan rpcapi.DoctorCheck, 1)
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- Fail("", "probe failed: %v", r)
+			}
+		}()
+
+		done <- probe.Check(ctx)
+	}()
+
+	select {
+	case check := <-done:
+		return check
+
+	case <-ctx.Done():
+		return Fail("", "probe did not finish: %v", ctx.Err())
+	}
+}
@@ -0,0 +1,61 @@
+package doctor
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+)
+
+func TestRun(t *testing.T) {
+	t.Run("Independent", func(t *testing.T) {
+		result := Run(context.Background(), []Probe{
+			{Name: "panics", Check: func(_ context.Context) rpcapi.DoctorCheck { panic("boom") }},
+			{Name: "warns", Check: func(_ context.Context) rpcapi.DoctorCheck { return Warn("fix it", "%d problems", 2) }},
+			{Name: "passes", Check: func(_ context.Context) rpcapi.DoctorCheck { return Pass("fine") }},
+		})
+
+		assert.Equal(t, rpcapi.DoctorFail, result.Status)
+		require.Len(t, result.Checks, 3)
+
+		assert.Equal(t, "panics", result.Checks[0].Name)
+		assert.Equal(t, rpcapi.DoctorFail, result.Checks[0].Status)
+		assert.Contains(t, result.Checks[0].Message, "boom")
+
+		assert.Equal(t, rpcapi.DoctorCheck{Name: "warns", Status: rpcapi.DoctorWarn, Message: "2 problems", Hint: "fix it"}, result.Checks[1])
+		assert.Equal(t, rpcapi.DoctorCheck{Name: "passes", Status: rpcapi.DoctorPass, Message: "fine"}, result.Checks[2])
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		release := make(chan struct{})
+		t.Cleanup(func() { close(release) })
+
+		result := Run(ctx, []Probe{
+			{Name: "hangs", Check: func(_ context.Context) rpcapi.DoctorCheck {
+				<-release
+				return Pass("late")
+			}},
+		})
+
+		assert.Equal(t, rpcapi.DoctorFail, result.Status)
+		assert.Contains(t, result.Checks[0].Message, "did not finish")
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		result := Run(context.Background(), nil)
+
+		assert.Equal(t, rpcapi.DoctorPass, result.Status)
+		assert.Empty(t, result.Checks)
+	})
+}
+
+func TestWorst(t *testing.T) {
+	assert.Equal(t, rpcapi.DoctorPass, Worst(nil))
+	assert.Equal(t, rpcapi.DoctorWarn, Worst([]rpcapi.DoctorCheck{Pass(""), Warn("", "")}))
+	assert.Equal(t, rpcapi.DoctorFail, Worst([]rpcapi.DoctorCheck{Fail("", ""), Warn("", "")}))
+}
@@ -0,0 +1,289 @@
+package doctor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+	"github.com/vitalvas/oneauth/internal/keyring"
+	"github.com/vitalvas/oneauth/internal/yubikey"
+)
+
+// certExpiryWarning is how long before the end of a slot certificate the certificates probe warns
+const certExpiryWarning = 30 * 24 * time.Hour
+
+// supportedMajorVersion is the YubiKey firmware major version oneauth works with
+const supportedMajorVersion = "5"
+
+var (
+	listReaders = yubikey.Readers
+	keyringGet  = keyring.Get
+)
+
+// Card is a plugged in YubiKey with the certificates of its slots
+type Card struct {
+	Serial  uint32
+	Version string
+	Certs   []yubikey.Cert
+}
+
+// CardLoader lists the plugged in YubiKeys
+type CardLoader func(ctx context.Context) ([]Card, error)
+
+// LocalCards opens the YubiKeys through PC/SC, it is used when no agent holds them.
+// The slots of a YubiKey with an unsupported firmware are not read.
+func LocalCards(_ context.Context) ([]Card, error) {
+	cards, err := yubikey.Cards()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]Card, 0, len(cards))
+
+	for _, card := range cards {
+		item := Card{Serial: card.Serial, Version: card.Version}
+
+		if majorVersion(card.Version) == supportedMajorVersion {
+			yk, err := yubikey.Open(card)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open %s: %w", card.String(), err)
+			}
+
+			item.Certs, err = yk.ListKeys(yubikey.AllSlots...)
+			yk.Close()
+
+			if err != nil {
+				return nil, fmt.Errorf("failed to list keys of %s: %w", card.String(), err)
+			}
+		}
+
+		out = append(out, item)
+	}
+
+	return out, nil
+}
+
+// CardProbes check the PC/SC service, the YubiKeys with the serials from the config, their firmware,
+// PINs and slot certificates. The cards are loaded once for the returned probes.
+func CardProbes(serials []uint32, load CardLoader) []Probe {
+	var (
+		once     sync.Once
+		cards    []Card
+		cardsErr error
+	)
+
+	loadCards := func(ctx context.Context) ([]Card, error) {
+		once.Do(func() {
+			cards, cardsErr = load(ctx)
+		})
+
+		return cards, cardsErr
+	}
+
+	return []Probe{
+		{Name: "pcsc", Check: checkPCSC},
+		{Name: "yubikey", Check: func(ctx context.Context) rpcapi.DoctorCheck {
+			cards, err := loadCards(ctx)
+			return checkYubikeys(serials, cards, err)
+		}},
+		{Name: "firmware", Check: func(ctx context.Context) rpcapi.DoctorCheck {
+			cards, err := loadCards(ctx)
+			return checkFirmware(cards, err)
+		}},
+		{Name: "pin", Check: func(ctx context.Context) rpcapi.DoctorCheck {
+			cards, _ := loadCards(ctx)
+			return checkPIN(serials, cards)
+		}},
+		{Name: "certificates", Check: func(ctx context.Context) rpcapi.DoctorCheck {
+			cards, err := loadCards(ctx)
+			return checkCertificates(cards, err, time.Now())
+		}},
+	}
+}
+
+func pcscHint() string {
+	if runtime.GOOS == "linux" {
+		return "install pcscd and start it with `systemctl enable --now pcscd.socket`"
+	}
+
+	return "reconnect the YubiKey, the smart card service of the OS does not answer"
+}
+
+func checkPCSC(_ context.Context) rpcapi.DoctorCheck {
+	readers, err := listReaders()
+	if err != nil {
+		return Fail(pcscHint(), "PC/SC service is not available: %v", err)
+	}
+
+	if len(readers) == 0 {
+		return Warn("plug in the YubiKey", "PC/SC service runs, but it sees no YubiKey")
+	}
+
+	return Pass("%d YubiKey readers: %s", len(readers), strings.Join(readers, ", "))
+}
+
+func checkYubikeys(serials []uint32, cards []Card, err error) rpcapi.DoctorCheck {
+	if err != nil {
+		return Fail(pcscHint(), "failed to read the YubiKeys: %v", err)
+	}
+
+	var plugged []uint32
+	for _, card := range cards {
+		plugged = append(plugged, card.Serial)
+	}
+
+	if len(plugged) == 0 {
+		return Fail("plug in the YubiKey", "no YubiKey is plugged in")
+	}
+
+	if len(serials) == 0 {
+		return Warn("set keyring.yubikey.serial in the config", "no YubiKey serial is configured, plugged in: %s", formatSerials(plugged))
+	}
+
+	var missing []uint32
+
+	for _, serial := range serials {
+		if !slices.Contains(plugged, serial) {
+			missing = append(missing, serial)
+		}
+	}
+
+	switch {
+	case len(missing) == len(serials):
+		return Fail("plug in a configured YubiKey, or add its serial to keyring.yubikey in the config",
+			"none of the configured YubiKeys %s is plugged in, plugged in: %s", formatSerials(serials), formatSerials(plugged))
+
+	case len(missing) > 0:
+		return Warn("plug in the YubiKey when it is needed", "YubiKeys %s are not plugged in", formatSerials(missing))
+	}
+
+	return Pass("YubiKeys %s are plugged in", formatSerials(serials))
+}
+
+func checkFirmware(cards []Card, err error) rpcapi.DoctorCheck {
+	if err != nil {
+		return Fail("", "failed to read the YubiKeys: %v", err)
+	}
+
+	if len(cards) == 0 {
+		return Warn("plug in the YubiKey", "no YubiKey to check")
+	}
+
+	var versions, unsupported []string
+
+	for _, card := range cards {
+		version := fmt.Sprintf("#%d %s", card.Serial, card.Version)
+		versions = append(versions, version)
+
+		if majorVersion(card.Version) != supportedMajorVersion {
+			unsupported = append(unsupported, version)
+		}
+	}
+
+	if len(unsupported) > 0 {
+		return Fail("use a YubiKey 5", "unsupported firmware: %s", strings.Join(unsupported, ", "))
+	}
+
+	return Pass("firmware %s", strings.Join(versions, ", "))
+}
+
+// checkPIN checks the PINs of the configured YubiKeys, or of the plugged in ones without a config
+func checkPIN(serials []uint32, cards []Card) rpcapi.DoctorCheck {
+	if len(serials) == 0 {
+		for _, card := range cards {
+			serials = append(serials, card.Serial)
+		}
+	}
+
+	if len(serials) == 0 {
+		return Warn("plug in the YubiKey", "no YubiKey to check")
+	}
+
+	var missing []uint32
+
+	for _, serial := range serials {
+		_, err := keyringGet(fmt.Sprintf("yubikey:%d:%s", serial, "pin"))
+
+		switch {
+		case errors.Is(err, keyring.ErrNotFound):
+			missing = append(missing, serial)
+
+		case err != nil:
+			return Fail("unlock the keyring of the session, e.g. GNOME Keyring, KWallet or the macOS Keychain",
+				"failed to read the keyring: %v", err)
+		}
+	}
+
+	if len(missing) > 0 {
+		return Warn("the PIN is stored by `oneauth setup new`, otherwise it is asked for with pinentry",
+			"PIN of YubiKeys %s is not in the keyring", formatSerials(missing))
+	}
+
+	return Pass("PIN of YubiKeys %s is in the keyring", formatSerials(serials))
+}
+
+func checkCertificates(cards []Card, err error, now time.Time) rpcapi.DoctorCheck {
+	if err != nil {
+		return Fail("", "failed to read the YubiKeys: %v", err)
+	}
+
+	if len(cards) == 0 {
+		return Warn("plug in the YubiKey", "no YubiKey to check")
+	}
+
+	var expired, expiring []string
+
+	count := 0
+
+	for _, card := range cards {
+		for _, cert := range card.Certs {
+			count++
+
+			name := fmt.Sprintf("#%d slot %s (%s)", card.Serial, cert.Slot.String(), cert.NotAfter.Format(time.DateOnly))
+
+			switch {
+			case now.After(cert.NotAfter):
+				expired = append(expired, name)
+
+			case cert.NotAfter.Sub(now) < certExpiryWarning:
+				expiring = append(expiring, name)
+			}
+		}
+	}
+
+	switch {
+	case len(expired) > 0:
+		return Fail("create a new key in the slot with `oneauth setup piv-slot`, the old key is wiped",
+			"expired certificates: %s", strings.Join(expired, ", "))
+
+	case len(expiring) > 0:
+		return Warn("create a new key in the slot with `oneauth setup piv-slot` before it expires, the old key is wiped",
+			"certificates expire soon: %s", strings.Join(expiring, ", "))
+
+	case count == 0:
+		return Warn("create keys with `oneauth setup new`", "no slot has a certificate")
+	}
+
+	return Pass("%d slot certificates are valid", count)
+}
+
+func majorVersion(version string) string {
+	major, _, _ := strings.Cut(version, ".")
+	return major
+}
+
+func formatSerials(serials []uint32) string {
+	out := make([]string, 0, len(serials))
+
+	for _, serial := range serials {
+		out = append(out, fmt.Sprintf("#%d", serial))
+	}
+
+	return strings.Join(out, ", ")
+}
@@ -0,0 +1,143 @@
+package doctor
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+	"github.com/vitalvas/oneauth/internal/keyring"
+	"github.com/vitalvas/oneauth/internal/yubikey"
+)
+
+func testCert(t *testing.T, slot string, notAfter time.Time) yubikey.Cert {
+	t.Helper()
+
+	parsed, err := yubikey.ParseSlot(slot)
+	require.NoError(t, err)
+
+	return yubikey.Cert{Certificate: &x509.Certificate{NotAfter: notAfter}, Slot: parsed}
+}
+
+func TestCardProbes(t *testing.T) {
+	origReaders, origKeyring := listReaders, keyringGet
+	t.Cleanup(func() { listReaders, keyringGet = origReaders, origKeyring })
+
+	listReaders = func() ([]string, error) { return []string{"Yubico YubiKey OTP+FIDO+CCID"}, nil }
+	keyringGet = func(string) (string, error) { return "123456", nil }
+
+	loads := 0
+	load := func(_ context.Context) ([]Card, error) {
+		loads++
+		return []Card{{Serial: 1, Version: "5.4.3", Certs: []yubikey.Cert{testCert(t, "9a", time.Now().AddDate(1, 0, 0))}}}, nil
+	}
+
+	result := Run(context.Background(), CardProbes([]uint32{1}, load))
+
+	assert.Equal(t, rpcapi.DoctorPass, result.Status, result.Checks)
+	assert.Len(t, result.Checks, 5)
+	assert.Equal(t, 1, loads)
+}
+
+func TestCheckPCSC(t *testing.T) {
+	origReaders := listReaders
+	t.Cleanup(func() { listReaders = origReaders })
+
+	listReaders = func() ([]string, error) { return nil, errors.New("no service") }
+	check := checkPCSC(context.Background())
+	assert.Equal(t, rpcapi.DoctorFail, check.Status)
+	assert.NotEmpty(t, check.Hint)
+
+	listReaders = func() ([]string, error) { return nil, nil }
+	assert.Equal(t, rpcapi.DoctorWarn, checkPCSC(context.Background()).Status)
+}
+
+func TestCheckYubikeys(t *testing.T) {
+	cards := []Card{{Serial: 1}, {Serial: 3}}
+
+	tests := []struct {
+		name    string
+		serials []uint32
+		cards   []Card
+		err     error
+		status  string
+		message string
+	}{
+		{name: "Plugged", serials: []uint32{1}, cards: cards, status: rpcapi.DoctorPass},
+		{name: "BackupMissing", serials: []uint32{1, 2}, cards: cards, status: rpcapi.DoctorWarn, message: "YubiKeys #2 are not plugged in"},
+		{name: "AllMissing", serials: []uint32{2}, cards: cards, status: rpcapi.DoctorFail, message: "plugged in: #1, #3"},
+		{name: "NotConfigured", cards: cards, status: rpcapi.DoctorWarn, message: "no YubiKey serial is configured"},
+		{name: "None", serials: []uint32{1}, status: rpcapi.DoctorFail, message: "no YubiKey is plugged in"},
+		{name: "Error", serials: []uint32{1}, err: errors.New("busy"), status: rpcapi.DoctorFail, message: "busy"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			check := checkYubikeys(tt.serials, tt.cards, tt.err)
+			assert.Equal(t, tt.status, check.Status)
+			assert.Contains(t, check.Message, tt.message)
+		})
+	}
+}
+
+func TestCheckFirmware(t *testing.T) {
+	check := checkFirmware([]Card{{Serial: 1, Version: "5.7.1"}}, nil)
+	assert.Equal(t, rpcapi.DoctorPass, check.Status)
+	assert.Equal(t, "firmware #1 5.7.1", check.Message)
+
+	check = checkFirmware([]Card{{Serial: 1, Version: "5.7.1"}, {Serial: 2, Version: "4.3.7"}}, nil)
+	assert.Equal(t, rpcapi.DoctorFail, check.Status)
+	assert.Equal(t, "unsupported firmware: #2 4.3.7", check.Message)
+}
+
+func TestCheckPIN(t *testing.T) {
+	origKeyring := keyringGet
+	t.Cleanup(func() { keyringGet = origKeyring })
+
+	keyringGet = func(user string) (string, error) {
+		if user == "yubikey:1:pin" {
+			return "123456", nil
+		}
+
+		return "", keyring.ErrNotFound
+	}
+
+	assert.Equal(t, rpcapi.DoctorPass, checkPIN([]uint32{1}, nil).Status)
+
+	check := checkPIN([]uint32{1, 2}, nil)
+	assert.Equal(t, rpcapi.DoctorWarn, check.Status)
+	assert.Contains(t, check.Message, "#2")
+
+	// without a config the plugged in YubiKeys are checked
+	assert.Equal(t, rpcapi.DoctorWarn, checkPIN(nil, []Card{{Serial: 2}}).Status)
+
+	keyringGet = func(string) (string, error) { return "", keyring.ErrTimeoutGetSecret }
+	assert.Equal(t, rpcapi.DoctorFail, checkPIN([]uint32{1}, nil).Status)
+}
+
+func TestCheckCertificates(t *testing.T) {
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	card := func(certs ...yubikey.Cert) []Card {
+		return []Card{{Serial: 1, Version: "5.4.3", Certs: certs}}
+	}
+
+	check := checkCertificates(card(testCert(t, "9a", now.AddDate(1, 0, 0))), nil, now)
+	assert.Equal(t, rpcapi.DoctorPass, check.Status)
+
+	check = checkCertificates(card(testCert(t, "9a", now.AddDate(0, 0, 10))), nil, now)
+	assert.Equal(t, rpcapi.DoctorWarn, check.Status)
+	assert.Contains(t, check.Message, "#1 slot")
+
+	check = checkCertificates(card(testCert(t, "9a", now.AddDate(1, 0, 0)), testCert(t, "9c", now.AddDate(0, 0, -1))), nil, now)
+	assert.Equal(t, rpcapi.DoctorFail, check.Status)
+	assert.Contains(t, check.Message, "2026-05-31")
+
+	check = checkCertificates(card(), nil, now)
+	assert.Equal(t, rpcapi.DoctorWarn, check.Status)
+	assert.Equal(t, "no slot has a certificate", check.Message)
+}
@@ -21,6 +21,11 @@ func NamedAgentSocket(name string) (string, error) {
 	return tools.InHomeDir(oneauthDir, fmt.Sprintf("ssh-agent-%s.sock", name))
 }
 
+// AgentKeys returns the file of the persisted keys of a named soft-key agent
+func AgentKeys(name string) (string, error) {
+	return tools.InHomeDir(oneauthDir, "keys", name+".json")
+}
+
 func ControlSocket() (string, error) {
 	return tools.InHomeDir(oneauthDir, "control.sock")
 }
@@ -36,3 +41,7 @@ func BinDir() (string, error) {
 func LogDir() (string, error) {
 	return tools.InHomeDir(oneauthDir, "log")
 }
+
+func AuditLog() (string, error) {
+	return tools.InHomeDir(oneauthDir, "log", "audit.log")
+}
@@ -9,3 +9,8 @@ import (
 func ServiceFile(name string) (string, error) {
 	return tools.InHomeDir(".config", "systemd", "user", fmt.Sprintf("%s.service", name))
 }
+
+// SocketFile returns the systemd socket unit that starts the service by socket activation
+func SocketFile(name string) (string, error) {
+	return tools.InHomeDir(".config", "systemd", "user", fmt.Sprintf("%s.socket", name))
+}
@@ -32,6 +32,17 @@ func TestAgentSocket(t *testing.T) {
 	assert.Equal(t, expected, actual, "Expected result: %s, got result: %s", expected, actual)
 }
 
+func TestAgentKeys(t *testing.T) {
+	home, err := os.UserHomeDir()
+	assert.Nil(t, err, "Error getting user home directory: %v", err)
+
+	actual, err := AgentKeys("work")
+	assert.Nil(t, err, "Error getting agent keys path: %v", err)
+
+	expected := filepath.Join(home, oneauthDir, "keys", "work.json")
+	assert.Equal(t, expected, actual, "Expected result: %s, got result: %s", expected, actual)
+}
+
 func TestNamedAgentSocket(t *testing.T) {
 	home, err := os.UserHomeDir()
 	assert.Nil(t, err, "Error getting user home directory: %v", err)
@@ -101,6 +112,18 @@ func TestLogDir(t *testing.T) {
 	assert.Equal(t, expected, actual, "Expected result: %s, got result: %s", expected, actual)
 }
 
+func TestAuditLog(t *testing.T) {
+	home, err := os.UserHomeDir()
+	assert.Nil(t, err, "Error getting user home directory: %v", err)
+
+	actual, err := AuditLog()
+	assert.Nil(t, err, "Error getting audit log path: %v", err)
+
+	expected := filepath.Join(home, oneauthDir, "log", "audit.log")
+
+	assert.Equal(t, expected, actual, "Expected result: %s, got result: %s", expected, actual)
+}
+
 func TestServiceFile(t *testing.T) {
 	var (
 		correctDir string
@@ -0,0 +1,262 @@
+// Package rpcapi describes the JSON API served by the agent on the control socket.
+package rpcapi
+
+import "time"
+
+const (
+	PathHealth       = "/v1/health"
+	PathStatus       = "/v1/status"
+	PathKeys         = "/v1/keys"
+	PathKeysRemove   = "/v1/keys/remove"
+	PathLock         = "/v1/lock"
+	PathUnlock       = "/v1/unlock"
+	PathReload       = "/v1/reload"
+	PathHandoff      = "/v1/handoff"
+	PathHandoffToken = "/v1/handoff/token"
+	PathDoctor       = "/v1/doctor"
+
+	PathYubikeyCards    = "/v1/yubikey/cards"
+	PathYubikeyEvents   = "/v1/yubikey/events"
+	PathYubikeyQueue    = "/v1/yubikey/queue"
+	PathYubikeyRetries  = "/v1/yubikey/retries"
+	PathYubikeyPIN      = "/v1/yubikey/pin"
+	PathYubikeyUnblock  = "/v1/yubikey/pin/unblock"
+	PathYubikeyGenerate = "/v1/yubikey/slots/generate"
+)
+
+// DefaultAgent is the name of the YubiKey backed agent listening on SSH_AUTH_SOCK
+const DefaultAgent = "default"
+
+const (
+	KeySourceYubikey = "yubikey"
+	KeySourceSoft    = "soft"
+)
+
+const (
+	HealthOK       = "ok"
+	HealthDegraded = "degraded"
+)
+
+// results of the doctor checks
+const (
+	DoctorPass = "pass"
+	DoctorWarn = "warn"
+	DoctorFail = "fail"
+)
+
+// Error is returned with every non 2xx response
+type Error struct {
+	Error string `json:"error"`
+}
+
+type Health struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+type HealthCheck struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// Doctor is the result of the diagnostic checks, Status is the worst result of the checks
+type Doctor struct {
+	Status string        `json:"status"`
+	Checks []DoctorCheck `json:"checks"`
+}
+
+type DoctorCheck struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+	// Hint tells how to fix a failed or warned check
+	Hint string `json:"hint,omitempty"`
+}
+
+type Status struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit,omitempty"`
+	AgentID string `json:"agent_id"`
+	// Serial is the first YubiKey of the agent, Serials lists every attached one
+	Serial  uint32   `json:"serial,omitempty"`
+	Serials []uint32 `json:"serials,omitempty"`
+	// Absent lists the attached YubiKeys that are not plugged in
+	Absent []uint32 `json:"absent,omitempty"`
+	// PINBlocked lists the attached YubiKeys whose PIN is blocked
+	PINBlocked []uint32 `json:"pin_blocked,omitempty"`
+	Locked     bool     `json:"locked"`
+	Agents     []string `json:"agents"`
+}
+
+type Keys struct {
+	Agents []Agent `json:"agents"`
+}
+
+type Agent struct {
+	Name   string `json:"name"`
+	Locked bool   `json:"locked"`
+	Keys   []Key  `json:"keys"`
+	// Error is set when the keys of the agent could not be listed, e.g. the YubiKey is unavailable
+	Error string `json:"error,omitempty"`
+}
+
+type Key struct {
+	Source      string `json:"source"`
+	Type        string `json:"type"`
+	Fingerprint string `json:"fingerprint"`
+	Comment     string `json:"comment,omitempty"`
+	// Algorithms are the signature algorithms the agent makes with the key, preferred first
+	Algorithms []string `json:"algorithms,omitempty"`
+	// Serial and Slot are set for keys stored in a YubiKey, e.g. "9a"
+	Serial uint32 `json:"serial,omitempty"`
+	Slot   string `json:"slot,omitempty"`
+
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	LastUsed  *time.Time `json:"last_used,omitempty"`
+
+	ConfirmBeforeUse       bool `json:"confirm_before_use,omitempty"`
+	DestinationConstrained bool `json:"destination_constrained,omitempty"`
+}
+
+type LockRequest struct {
+	Passphrase string `json:"passphrase"`
+	// PIN locks without a passphrase, e.g. from a screen-lock hook, the agents are unlocked with the YubiKey PIN
+	PIN bool `json:"pin,omitempty"`
+	// Agent limits the request to a single agent, all agents are used when empty
+	Agent string `json:"agent,omitempty"`
+}
+
+type LockResponse struct {
+	Agents []string `json:"agents"`
+}
+
+type RemoveKeysRequest struct {
+	Agent        string   `json:"agent"`
+	Fingerprints []string `json:"fingerprints,omitempty"`
+	// All removes every soft key of the agent
+	All bool `json:"all,omitempty"`
+}
+
+type RemoveKeysResponse struct {
+	Removed int `json:"removed"`
+}
+
+type ReloadResponse struct {
+	// Changes describes what was applied from the new config
+	Changes []string `json:"changes"`
+}
+
+// HandoffReady is written by the agent process that took over once it serves the passed sockets,
+// the agent that handed off stops then
+const HandoffReady = "ready"
+
+// HandoffToken is the one-time token that allows a new agent process to take over, it expires after a minute
+type HandoffToken struct {
+	Token string `json:"token"`
+}
+
+// HandoffRequest is sent by the agent process that takes over, with the token passed to it
+type HandoffRequest struct {
+	Token string `json:"token"`
+}
+
+// HandoffState is passed to the agent process that takes over, the listening sockets are attached to it
+type HandoffState struct {
+	Version string `json:"version"`
+	// Sockets names the attached sockets in their order: main, control or the name of a named agent
+	Sockets []string `json:"sockets"`
+	// Agents holds the keys added with ssh-add by agent name
+	Agents map[string]HandoffAgent `json:"agents"`
+}
+
+type HandoffAgent struct {
+	Keys []HandoffKey `json:"keys"`
+	// Loaded is set when the persisted keys of the agent are among Keys, they are not unwrapped again
+	Loaded bool `json:"loaded,omitempty"`
+}
+
+type HandoffKey struct {
+	// PrivateKey is in the OpenSSH format
+	PrivateKey       []byte              `json:"private_key"`
+	Comment          string              `json:"comment,omitempty"`
+	ConfirmBeforeUse bool                `json:"confirm_before_use,omitempty"`
+	Constraints      []HandoffConstraint `json:"constraints,omitempty"`
+	ExpiresAt        *time.Time          `json:"expires_at,omitempty"`
+}
+
+type HandoffConstraint struct {
+	Name    string `json:"name"`
+	Details []byte `json:"details,omitempty"`
+}
+
+type YubikeyCard struct {
+	Serial  uint32        `json:"serial"`
+	Version string        `json:"version"`
+	Slots   []YubikeySlot `json:"slots"`
+}
+
+type YubikeySlot struct {
+	Slot       string    `json:"slot"`
+	CommonName string    `json:"common_name"`
+	NotBefore  time.Time `json:"not_before"`
+	NotAfter   time.Time `json:"not_after"`
+	// SSHPublicKey is in authorized_keys format
+	SSHPublicKey string `json:"ssh_public_key,omitempty"`
+}
+
+// YubikeyEvent records a YubiKey of the agent being plugged in or removed
+type YubikeyEvent struct {
+	Time    time.Time `json:"time"`
+	Serial  uint32    `json:"serial"`
+	Present bool      `json:"present"`
+}
+
+// YubikeyRequest is a YubiKey operation of the agent that is queued or running
+type YubikeyRequest struct {
+	ID          uint64    `json:"id"`
+	Operation   string    `json:"operation"`
+	Serial      uint32    `json:"serial,omitempty"`
+	Slot        string    `json:"slot,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	PID         int       `json:"pid,omitempty"`
+	Exe         string    `json:"exe,omitempty"`
+	QueuedAt    time.Time `json:"queued_at"`
+	// StartedAt is not set while the request waits for the card
+	StartedAt *time.Time `json:"started_at,omitempty"`
+}
+
+type YubikeyRetries struct {
+	Serial     uint32 `json:"serial"`
+	PINRetries int    `json:"pin_retries"`
+}
+
+type UnblockPINRequest struct {
+	// Serial selects the YubiKey, zero uses the first one of the agent
+	Serial uint32 `json:"serial,omitempty"`
+	PUK    string `json:"puk"`
+	NewPIN string `json:"new_pin"`
+}
+
+type ChangePINRequest struct {
+	// Serial selects the YubiKey, zero uses the first one of the agent
+	Serial     uint32 `json:"serial,omitempty"`
+	CurrentPIN string `json:"current_pin"`
+	NewPIN     string `json:"new_pin"`
+}
+
+// GenerateSlotRequest generates a static SSH key in a PIV slot, the PIN is taken from the OS keyring
+type GenerateSlotRequest struct {
+	// Serial selects the YubiKey, zero uses the first one of the agent
+	Serial      uint32 `json:"serial,omitempty"`
+	Slot        string `json:"slot"`
+	Username    string `json:"username"`
+	ValidDays   int    `json:"valid_days"`
+	KeyType     string `json:"key_type"`
+	TouchPolicy string `json:"touch_policy"`
+	PINPolicy   string `json:"pin_policy"`
+}
+
+type GenerateSlotResponse struct {
+	Slot YubikeySlot `json:"slot"`
+}
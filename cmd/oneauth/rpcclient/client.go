@@ -0,0 +1,263 @@
+// Package rpcclient talks to a running agent over the control socket.
+package rpcclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+)
+
+const defaultTimeout = 30 * time.Second
+
+var (
+	ErrAgentNotRunning = errors.New("agent is not running")
+)
+
+// APIError is an error reported by the agent
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("agent: %s (status %d)", e.Message, e.StatusCode)
+}
+
+type Client struct {
+	socketPath string
+	http       *http.Client
+}
+
+func New(socketPath string) *Client {
+	return &Client{
+		socketPath: socketPath,
+		http: &http.Client{
+			Timeout: defaultTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+func (c *Client) Health(ctx context.Context) (*rpcapi.Health, error) {
+	var resp rpcapi.Health
+
+	err := c.do(ctx, http.MethodGet, rpcapi.PathHealth, nil, &resp)
+
+	// a degraded agent still reports which checks failed
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusServiceUnavailable && resp.Status != "" {
+		return &resp, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+// Doctor runs the diagnostic checks of the agent
+func (c *Client) Doctor(ctx context.Context) (*rpcapi.Doctor, error) {
+	var resp rpcapi.Doctor
+	if err := c.do(ctx, http.MethodGet, rpcapi.PathDoctor, nil, &resp); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+func (c *Client) Status(ctx context.Context) (*rpcapi.Status, error) {
+	var resp rpcapi.Status
+	if err := c.do(ctx, http.MethodGet, rpcapi.PathStatus, nil, &resp); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+func (c *Client) Keys(ctx context.Context) (*rpcapi.Keys, error) {
+	var resp rpcapi.Keys
+	if err := c.do(ctx, http.MethodGet, rpcapi.PathKeys, nil, &resp); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+func (c *Client) RemoveKeys(ctx context.Context, req rpcapi.RemoveKeysRequest) (*rpcapi.RemoveKeysResponse, error) {
+	var resp rpcapi.RemoveKeysResponse
+	if err := c.do(ctx, http.MethodPost, rpcapi.PathKeysRemove, req, &resp); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+func (c *Client) Lock(ctx context.Context, req rpcapi.LockRequest) (*rpcapi.LockResponse, error) {
+	var resp rpcapi.LockResponse
+	if err := c.do(ctx, http.MethodPost, rpcapi.PathLock, req, &resp); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+func (c *Client) Unlock(ctx context.Context, req rpcapi.LockRequest) (*rpcapi.LockResponse, error) {
+	var resp rpcapi.LockResponse
+	if err := c.do(ctx, http.MethodPost, rpcapi.PathUnlock, req, &resp); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+func (c *Client) Reload(ctx context.Context) (*rpcapi.ReloadResponse, error) {
+	var resp rpcapi.ReloadResponse
+	if err := c.do(ctx, http.MethodPost, rpcapi.PathReload, struct{}{}, &resp); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+func (c *Client) YubikeyCards(ctx context.Context) ([]rpcapi.YubikeyCard, error) {
+	var resp []rpcapi.YubikeyCard
+	if err := c.do(ctx, http.MethodGet, rpcapi.PathYubikeyCards, nil, &resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// YubikeyEvents returns the last YubiKeys of the agent plugged in or removed, oldest first
+func (c *Client) YubikeyEvents(ctx context.Context) ([]rpcapi.YubikeyEvent, error) {
+	var resp []rpcapi.YubikeyEvent
+	if err := c.do(ctx, http.MethodGet, rpcapi.PathYubikeyEvents, nil, &resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// YubikeyQueue returns the YubiKey requests of the agent that are queued or running, oldest first
+func (c *Client) YubikeyQueue(ctx context.Context) ([]rpcapi.YubikeyRequest, error) {
+	var resp []rpcapi.YubikeyRequest
+	if err := c.do(ctx, http.MethodGet, rpcapi.PathYubikeyQueue, nil, &resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// YubikeyRetries returns the PIN retries of the YubiKey, a zero serial uses the first one of the agent
+func (c *Client) YubikeyRetries(ctx context.Context, serial uint32) (*rpcapi.YubikeyRetries, error) {
+	path := rpcapi.PathYubikeyRetries
+	if serial != 0 {
+		path += fmt.Sprintf("?serial=%d", serial)
+	}
+
+	var resp rpcapi.YubikeyRetries
+	if err := c.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+func (c *Client) ChangePIN(ctx context.Context, req rpcapi.ChangePINRequest) error {
+	return c.do(ctx, http.MethodPost, rpcapi.PathYubikeyPIN, req, &struct{}{})
+}
+
+// UnblockPIN sets a new PIN of the YubiKey with the PUK
+func (c *Client) UnblockPIN(ctx context.Context, req rpcapi.UnblockPINRequest) error {
+	return c.do(ctx, http.MethodPost, rpcapi.PathYubikeyUnblock, req, &struct{}{})
+}
+
+func (c *Client) GenerateSlot(ctx context.Context, req rpcapi.GenerateSlotRequest) (*rpcapi.GenerateSlotResponse, error) {
+	var resp rpcapi.GenerateSlotResponse
+	if err := c.do(ctx, http.MethodPost, rpcapi.PathYubikeyGenerate, req, &resp); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, out any) error {
+	var reqBody io.Reader
+
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+
+		reqBody = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, "http://oneauth"+path, reqBody)
+	if err != nil {
+		return err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return fmt.Errorf("%w: %s", ErrAgentNotRunning, c.socketPath)
+		}
+
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+
+		return nil
+	}
+
+	return responseError(resp.StatusCode, data, out)
+}
+
+// responseError returns the error of a non 2xx response
+func responseError(statusCode int, data []byte, out any) error {
+	apiErr := &APIError{
+		StatusCode: statusCode,
+		Message:    http.StatusText(statusCode),
+	}
+
+	var errResp rpcapi.Error
+	if err := json.Unmarshal(data, &errResp); err == nil && errResp.Error != "" {
+		apiErr.Message = errResp.Error
+	} else if out != nil {
+		// endpoints like health describe failures with their regular response
+		json.Unmarshal(data, out)
+	}
+
+	return apiErr
+}
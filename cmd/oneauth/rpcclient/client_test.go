@@ -0,0 +1,112 @@
+package rpcclient
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+)
+
+func serveTestAPI(t *testing.T, handler http.Handler) string {
+	t.Helper()
+
+	socketDir, err := os.MkdirTemp("", "rpcclient")
+	require.NoError(t, err)
+
+	socketPath := filepath.Join(socketDir, "control.sock")
+
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+
+	server := &http.Server{Handler: handler}
+	go server.Serve(listener)
+
+	t.Cleanup(func() {
+		server.Close()
+		os.RemoveAll(socketDir)
+	})
+
+	return socketPath
+}
+
+func writeTestJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestClient(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+rpcapi.PathStatus, func(w http.ResponseWriter, _ *http.Request) {
+		writeTestJSON(w, http.StatusOK, rpcapi.Status{Version: "1.2.3", Serial: 42})
+	})
+	mux.HandleFunc("GET "+rpcapi.PathHealth, func(w http.ResponseWriter, _ *http.Request) {
+		writeTestJSON(w, http.StatusServiceUnavailable, rpcapi.Health{Status: rpcapi.HealthDegraded})
+	})
+	mux.HandleFunc("POST "+rpcapi.PathLock, func(w http.ResponseWriter, r *http.Request) {
+		var req rpcapi.LockRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Passphrase != "secret" {
+			writeTestJSON(w, http.StatusBadRequest, rpcapi.Error{Error: "passphrase is required"})
+			return
+		}
+
+		writeTestJSON(w, http.StatusOK, rpcapi.LockResponse{Agents: []string{"default"}})
+	})
+	mux.HandleFunc("POST "+rpcapi.PathReload, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	client := New(serveTestAPI(t, mux))
+	ctx := context.Background()
+
+	t.Run("Status", func(t *testing.T) {
+		status, err := client.Status(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, "1.2.3", status.Version)
+		assert.Equal(t, uint32(42), status.Serial)
+	})
+
+	t.Run("DegradedHealth", func(t *testing.T) {
+		health, err := client.Health(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, rpcapi.HealthDegraded, health.Status)
+	})
+
+	t.Run("Lock", func(t *testing.T) {
+		resp, err := client.Lock(ctx, rpcapi.LockRequest{Passphrase: "secret"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"default"}, resp.Agents)
+	})
+
+	t.Run("APIError", func(t *testing.T) {
+		_, err := client.Lock(ctx, rpcapi.LockRequest{})
+
+		var apiErr *APIError
+		require.ErrorAs(t, err, &apiErr)
+		assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+		assert.Equal(t, "passphrase is required", apiErr.Message)
+	})
+
+	t.Run("ErrorWithoutBody", func(t *testing.T) {
+		_, err := client.Reload(ctx)
+
+		var apiErr *APIError
+		require.ErrorAs(t, err, &apiErr)
+		assert.Equal(t, http.StatusBadGateway, apiErr.StatusCode)
+		assert.Equal(t, http.StatusText(http.StatusBadGateway), apiErr.Message)
+	})
+}
+
+func TestClientAgentNotRunning(t *testing.T) {
+	client := New(filepath.Join(t.TempDir(), "missing.sock"))
+
+	_, err := client.Status(context.Background())
+	assert.ErrorIs(t, err, ErrAgentNotRunning)
+}
@@ -0,0 +1,179 @@
+package rpcclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+	"github.com/vitalvas/oneauth/internal/netutil"
+)
+
+// Handoff is the running agent passed to this process, it keeps serving until Ready is called
+type Handoff struct {
+	State rpcapi.HandoffState
+	// Listeners are the passed sockets by name
+	Listeners map[string]net.Listener
+
+	conn *net.UnixConn
+}
+
+// Ready tells the agent that handed off that this process serves the sockets, the agent stops then
+func (h *Handoff) Ready() error {
+	defer h.conn.Close()
+
+	_, err := h.conn.Write([]byte(rpcapi.HandoffReady + "\n"))
+
+	return err
+}
+
+// Close ends the handoff without taking over, the agent keeps running
+func (h *Handoff) Close() error {
+	for _, listener := range h.Listeners {
+		listener.Close()
+	}
+
+	return h.conn.Close()
+}
+
+// HandoffToken asks the running agent for a one-time token, an agent process started with it can take over
+func (c *Client) HandoffToken(ctx context.Context) (string, error) {
+	var resp rpcapi.HandoffToken
+	if err := c.do(ctx, http.MethodPost, rpcapi.PathHandoffToken, struct{}{}, &resp); err != nil {
+		return "", err
+	}
+
+	return resp.Token, nil
+}
+
+// Handoff asks the running agent for its sockets and keys added with ssh-add, with a token from HandoffToken
+func (c *Client) Handoff(ctx context.Context, token string) (*Handoff, error) {
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, "unix", c.socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrAgentNotRunning, c.socketPath)
+	}
+
+	handoff, err := readHandoff(ctx, conn.(*net.UnixConn), token)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return handoff, nil
+}
+
+func readHandoff(ctx context.Context, conn *net.UnixConn, token string) (*Handoff, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultTimeout)
+	}
+
+	conn.SetDeadline(deadline)
+
+	body, err := json.Marshal(rpcapi.HandoffRequest{Token: token})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://oneauth"+rpcapi.PathHandoff, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 64<<10)
+	defer clear(buf)
+
+	// the sockets come with the first bytes of the response, so it is not read through a buffer
+	n, files, err := netutil.ReceiveFiles(conn, buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read handoff: %w", err)
+	}
+
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	resp, err := http.ReadResponse(bufio.NewReader(io.MultiReader(bytes.NewReader(buf[:n]), conn)), req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read handoff: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read handoff: %w", err)
+	}
+
+	defer clear(data)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp.StatusCode, data, nil)
+	}
+
+	var state rpcapi.HandoffState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to decode handoff: %w", err)
+	}
+
+	if len(files) != len(state.Sockets) {
+		return nil, fmt.Errorf("handoff passed %d sockets for %d names", len(files), len(state.Sockets))
+	}
+
+	listeners, err := handoffListeners(state.Sockets, files)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return &Handoff{
+		State:     state,
+		Listeners: listeners,
+		conn:      conn,
+	}, nil
+}
+
+func handoffListeners(names []string, files []*os.File) (map[string]net.Listener, error) {
+	listeners := make(map[string]net.Listener, len(names))
+
+	for i, name := range names {
+		listener, err := net.FileListener(files[i])
+		if err == nil {
+			if _, ok := listeners[name]; ok {
+				listener.Close()
+				err = errors.New("duplicate name")
+			}
+		}
+
+		if err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+
+			return nil, fmt.Errorf("invalid handed off socket %s: %w", name, err)
+		}
+
+		listeners[name] = listener
+	}
+
+	return listeners, nil
+}
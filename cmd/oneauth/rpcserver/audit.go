@@ -0,0 +1,56 @@
+package rpcserver
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/vitalvas/oneauth/cmd/oneauth/sshagent"
+	"github.com/vitalvas/oneauth/internal/audit"
+	"github.com/vitalvas/oneauth/internal/netutil"
+)
+
+// SetAuditLogger records the locks, unlocks and key removals requested through the control API,
+// a nil logger disables it
+func (s *RPCServer) SetAuditLogger(logger *audit.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.audit = logger
+}
+
+// requestPeer returns the client of the control socket that sent the request, PID and UID are -1 when it is unknown
+func requestPeer(r *http.Request) netutil.UnixCreds {
+	if conn, ok := r.Context().Value(connContextKey{}).(net.Conn); ok {
+		if creds, err := netutil.UnixSocketCreds(conn); err == nil {
+			return creds
+		}
+	}
+
+	return netutil.UnixCreds{PID: -1, UID: -1, GID: -1}
+}
+
+// record writes an event of the agent with the client of the control socket
+func (s *RPCServer) record(peer netutil.UnixCreds, op audit.Operation, agentName, fingerprint string, err error) {
+	s.mu.RLock()
+	logger := s.audit
+	s.mu.RUnlock()
+
+	event := audit.Event{
+		Operation:   op,
+		Agent:       agentName,
+		Success:     err == nil,
+		Fingerprint: fingerprint,
+		Reason:      sshagent.LockReasonRequest,
+		PID:         peer.PID,
+		UID:         peer.UID,
+		Exe:         peer.Exe,
+	}
+
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	if err := logger.Log(event); err != nil {
+		s.log.Warnln("failed to write audit log:", err)
+	}
+}
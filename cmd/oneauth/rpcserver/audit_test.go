@@ -0,0 +1,88 @@
+package rpcserver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcclient"
+	"github.com/vitalvas/oneauth/cmd/oneauth/sshagent"
+	"github.com/vitalvas/oneauth/internal/audit"
+)
+
+func TestControlAudit(t *testing.T) {
+	server, _, fp := newTestServer(t)
+
+	socketDir, err := os.MkdirTemp("", "audit")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(socketDir) })
+
+	auditPath := filepath.Join(socketDir, "audit.log")
+
+	logger, err := audit.New(auditPath, 0, 0)
+	require.NoError(t, err)
+	t.Cleanup(func() { logger.Close() })
+
+	server.SetAuditLogger(logger)
+
+	controlPath := filepath.Join(socketDir, "control.sock")
+
+	go server.ListenAndServe(context.Background(), controlPath)
+	t.Cleanup(server.Shutdown)
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(controlPath)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	ctx := context.Background()
+	client := rpcclient.New(controlPath)
+
+	_, err = client.Lock(ctx, rpcapi.LockRequest{Agent: "work", Passphrase: "secret"})
+	require.NoError(t, err)
+
+	_, err = client.Unlock(ctx, rpcapi.LockRequest{Agent: "work", Passphrase: "wrong"})
+	require.Error(t, err)
+
+	_, err = client.Unlock(ctx, rpcapi.LockRequest{Agent: "work", Passphrase: "secret"})
+	require.NoError(t, err)
+
+	_, err = client.RemoveKeys(ctx, rpcapi.RemoveKeysRequest{Agent: "work", Fingerprints: []string{fp}})
+	require.NoError(t, err)
+
+	_, err = client.RemoveKeys(ctx, rpcapi.RemoveKeysRequest{Agent: "personal", All: true})
+	require.NoError(t, err)
+
+	events, err := audit.Read(auditPath, audit.Filter{})
+	require.NoError(t, err)
+	require.Len(t, events, 5)
+
+	exe, err := os.Executable()
+	require.NoError(t, err)
+
+	ops := make([]audit.Operation, 0, len(events))
+	for _, event := range events {
+		ops = append(ops, event.Operation)
+
+		assert.Equal(t, sshagent.LockReasonRequest, event.Reason)
+		assert.Equal(t, os.Getpid(), event.PID)
+		assert.Equal(t, os.Getuid(), event.UID)
+		assert.Equal(t, exe, event.Exe)
+	}
+
+	assert.Equal(t, []audit.Operation{
+		audit.OpLock, audit.OpUnlock, audit.OpUnlock, audit.OpRemove, audit.OpRemoveAll,
+	}, ops)
+
+	assert.Equal(t, "work", events[0].Agent)
+	assert.True(t, events[0].Success)
+	assert.False(t, events[1].Success)
+	assert.Equal(t, "incorrect passphrase", events[1].Error)
+	assert.Equal(t, fp, events[3].Fingerprint)
+	assert.Equal(t, "personal", events[4].Agent)
+}
@@ -0,0 +1,46 @@
+package rpcserver
+
+import (
+	"net"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vitalvas/oneauth/internal/netutil"
+)
+
+// credsListener drops connections from peers that are not allowed to use the agent,
+// with the same rules as the ssh-agent sockets and the access rules of the control socket
+type credsListener struct {
+	net.Listener
+	log    *logrus.Logger
+	access func() netutil.Access
+}
+
+func (l *credsListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		creds, err := netutil.UnixSocketCreds(conn)
+		if err != nil {
+			l.log.Warnln("failed to get unix socket creds:", err)
+			conn.Close()
+			continue
+		}
+
+		if err := netutil.CheckCreds(&creds); err != nil {
+			l.log.Warnln(err)
+			conn.Close()
+			continue
+		}
+
+		if err := l.access().Check(creds); err != nil {
+			l.log.Warnln(err)
+			conn.Close()
+			continue
+		}
+
+		return conn, nil
+	}
+}
@@ -0,0 +1,102 @@
+package rpcserver
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+	"github.com/vitalvas/oneauth/internal/netutil"
+)
+
+func TestCredsListener(t *testing.T) {
+	t.Run("SameUserAccepted", func(t *testing.T) {
+		tempDir, err := os.MkdirTemp("", "rpcserver_test")
+		require.NoError(t, err)
+		defer os.RemoveAll(tempDir)
+
+		socketPath := filepath.Join(tempDir, "control.sock")
+
+		rpcServer := New(nil, logrus.New())
+
+		errChan := make(chan error)
+		go func() {
+			errChan <- rpcServer.ListenAndServe(context.Background(), socketPath)
+		}()
+
+		require.Eventually(t, func() bool {
+			_, err := os.Stat(socketPath)
+			return err == nil
+		}, 5*time.Second, 10*time.Millisecond)
+
+		client := &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		}
+
+		resp, err := client.Get("http://oneauth" + rpcapi.PathHealth)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var health rpcapi.Health
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&health))
+		assert.Equal(t, rpcapi.HealthOK, health.Status)
+
+		rpcServer.Shutdown()
+
+		select {
+		case <-errChan:
+		case <-time.After(5 * time.Second):
+			t.Fatal("ListenAndServe did not complete in time")
+		}
+	})
+
+	t.Run("AccessDenied", func(t *testing.T) {
+		socketPath := filepath.Join(t.TempDir(), "control.sock")
+
+		rpcServer := New(nil, logrus.New())
+		rpcServer.SetAccess(netutil.Access{DenyUIDs: []int{os.Getuid()}})
+
+		errChan := make(chan error)
+		go func() {
+			errChan <- rpcServer.ListenAndServe(context.Background(), socketPath)
+		}()
+
+		require.Eventually(t, func() bool {
+			_, err := os.Stat(socketPath)
+			return err == nil
+		}, 5*time.Second, 10*time.Millisecond)
+
+		client := &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		}
+
+		_, err := client.Get("http://oneauth" + rpcapi.PathHealth)
+		assert.Error(t, err)
+
+		rpcServer.Shutdown()
+
+		select {
+		case <-errChan:
+		case <-time.After(5 * time.Second):
+			t.Fatal("ListenAndServe did not complete in time")
+		}
+	})
+}
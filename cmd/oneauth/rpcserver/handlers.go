@@ -0,0 +1,496 @@
+package rpcserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/vitalvas/oneauth/cmd/oneauth/doctor"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+	"github.com/vitalvas/oneauth/cmd/oneauth/sshagent"
+	"github.com/vitalvas/oneauth/internal/agentkey"
+	"github.com/vitalvas/oneauth/internal/audit"
+	"github.com/vitalvas/oneauth/internal/buildinfo"
+	"golang.org/x/crypto/ssh"
+)
+
+const maxRequestBodySize = 1 << 20
+
+var (
+	ErrUnknownAgent = errors.New("unknown agent")
+)
+
+// keyAgent is the part of an agent managed through the control API
+type keyAgent interface {
+	Locked() bool
+	Lock(passphrase []byte) error
+	AutoLock(reason string) error
+	PINUnlock() bool
+	Unlock(passphrase []byte) error
+	SoftKeys() []*agentkey.Key
+	RemoveSoftKeys(fingerprints ...string) (int, error)
+	RemoveAllSoftKeys() (int, error)
+}
+
+type namedAgent struct {
+	name  string
+	agent keyAgent
+}
+
+func (s *RPCServer) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET "+rpcapi.PathHealth, s.handleHealth)
+	mux.HandleFunc("GET "+rpcapi.PathStatus, s.handleStatus)
+	mux.HandleFunc("GET "+rpcapi.PathDoctor, s.handleDoctor)
+	mux.HandleFunc("GET "+rpcapi.PathKeys, s.handleKeys)
+	mux.HandleFunc("POST "+rpcapi.PathKeysRemove, s.handleKeysRemove)
+	mux.HandleFunc("POST "+rpcapi.PathLock, s.handleLock)
+	mux.HandleFunc("POST "+rpcapi.PathUnlock, s.handleUnlock)
+	mux.HandleFunc("POST "+rpcapi.PathReload, s.handleReload)
+	mux.HandleFunc("POST "+rpcapi.PathHandoff, s.handleHandoff)
+	mux.HandleFunc("POST "+rpcapi.PathHandoffToken, s.handleHandoffToken)
+
+	s.yubikeyRoutes(mux)
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown endpoint %s", r.URL.Path))
+	})
+
+	return mux
+}
+
+// agents returns the default agent first, followed by the named agents sorted by name
+func (s *RPCServer) agents() []namedAgent {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	agents := make([]namedAgent, 0, len(s.softAgents)+1)
+
+	if s.SSHAgent != nil {
+		agents = append(agents, namedAgent{name: rpcapi.DefaultAgent, agent: s.SSHAgent})
+	}
+
+	names := make([]string, 0, len(s.softAgents))
+	for name := range s.softAgents {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		agents = append(agents, namedAgent{name: name, agent: s.softAgents[name]})
+	}
+
+	return agents
+}
+
+// selectAgents returns the agent with the name, or all agents when the name is empty
+func (s *RPCServer) selectAgents(name string) ([]namedAgent, error) {
+	agents := s.agents()
+
+	if name == "" {
+		return agents, nil
+	}
+
+	for _, row := range agents {
+		if row.name == name {
+			return []namedAgent{row}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrUnknownAgent, name)
+}
+
+func (s *RPCServer) handleHealth(w http.ResponseWriter, _ *http.Request) {
+	health := rpcapi.Health{
+		Status: rpcapi.HealthOK,
+		Checks: []rpcapi.HealthCheck{},
+	}
+
+	if s.SSHAgent != nil {
+		check := rpcapi.HealthCheck{
+			Name:   "yubikey",
+			Status: rpcapi.HealthOK,
+		}
+
+		absent := s.SSHAgent.AbsentSerials()
+		blocked := s.SSHAgent.PINBlockedSerials()
+
+		switch {
+		case s.SSHAgent.Serial() == 0:
+			check.Status = rpcapi.HealthDegraded
+			check.Message = sshagent.ErrNoYubikey.Error()
+
+		case len(blocked) > 0:
+			check.Status = rpcapi.HealthDegraded
+			check.Message = fmt.Sprintf("%s: %v", sshagent.ErrPINBlocked, blocked)
+
+		case len(absent) > 0:
+			check.Status = rpcapi.HealthDegraded
+			check.Message = fmt.Sprintf("%s: %v", sshagent.ErrYubikeyAbsent, absent)
+		}
+
+		health.Checks = append(health.Checks, check)
+	}
+
+	code := http.StatusOK
+
+	for _, check := range health.Checks {
+		if check.Status != rpcapi.HealthOK {
+			health.Status = rpcapi.HealthDegraded
+			code = http.StatusServiceUnavailable
+		}
+	}
+
+	writeJSON(w, code, health)
+}
+
+func (s *RPCServer) handleDoctor(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	probes := s.probes
+	s.mu.RUnlock()
+
+	if probes == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("doctor is not supported by this agent"))
+		return
+	}
+
+	// failed checks are part of the result, the request itself succeeded
+	writeJSON(w, http.StatusOK, doctor.Run(r.Context(), probes()))
+}
+
+func (s *RPCServer) handleStatus(w http.ResponseWriter, _ *http.Request) {
+	s.mu.RLock()
+	agentID := s.agentID
+	s.mu.RUnlock()
+
+	status := rpcapi.Status{
+		Version: buildinfo.Version,
+		Commit:  buildinfo.Commit,
+		AgentID: agentID,
+		Agents:  []string{},
+	}
+
+	if s.SSHAgent != nil {
+		status.Serial = s.SSHAgent.Serial()
+		status.Serials = s.SSHAgent.Serials()
+		status.Absent = s.SSHAgent.AbsentSerials()
+		status.PINBlocked = s.SSHAgent.PINBlockedSerials()
+		status.Locked = s.SSHAgent.Locked()
+	}
+
+	for _, row := range s.agents() {
+		status.Agents = append(status.Agents, row.name)
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (s *RPCServer) handleKeys(w http.ResponseWriter, _ *http.Request) {
+	resp := rpcapi.Keys{
+		Agents: []rpcapi.Agent{},
+	}
+
+	for _, row := range s.agents() {
+		item := rpcapi.Agent{
+			Name:   row.name,
+			Locked: row.agent.Locked(),
+			Keys:   []rpcapi.Key{},
+		}
+
+		// a locked agent lists no keys, like for `ssh-add -L`
+		if item.Locked {
+			resp.Agents = append(resp.Agents, item)
+			continue
+		}
+
+		if row.name == rpcapi.DefaultAgent {
+			slotKeys, err := s.SSHAgent.SlotKeys()
+			if err != nil {
+				item.Error = err.Error()
+			}
+
+			for _, key := range slotKeys {
+				item.Keys = append(item.Keys, rpcapi.Key{
+					Source:      rpcapi.KeySourceYubikey,
+					Type:        key.PublicKey.Type(),
+					Fingerprint: ssh.FingerprintSHA256(key.PublicKey),
+					Comment:     key.Comment,
+					Algorithms:  agentkey.SignatureAlgorithms(key.PublicKey),
+					Serial:      key.Serial,
+					Slot:        key.Slot.String(),
+				})
+			}
+		}
+
+		for _, key := range row.agent.SoftKeys() {
+			item.Keys = append(item.Keys, softKeyInfo(key))
+		}
+
+		resp.Agents = append(resp.Agents, item)
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func softKeyInfo(key *agentkey.Key) rpcapi.Key {
+	agentKey := key.AgentKey()
+
+	info := rpcapi.Key{
+		Source:                 rpcapi.KeySourceSoft,
+		Type:                   agentKey.Format,
+		Fingerprint:            key.Fingerprint(),
+		Comment:                agentKey.Comment,
+		Algorithms:             agentkey.SignatureAlgorithms(agentKey),
+		ConfirmBeforeUse:       key.ConfirmBeforeUse(),
+		DestinationConstrained: key.DestinationConstrained(),
+	}
+
+	if expiresAt := key.ExpiresAt(); !expiresAt.IsZero() {
+		info.ExpiresAt = timePtr(expiresAt)
+	}
+
+	if lastUsed := key.LastUsed(); !lastUsed.IsZero() {
+		info.LastUsed = timePtr(lastUsed)
+	}
+
+	return info
+}
+
+func (s *RPCServer) handleKeysRemove(w http.ResponseWriter, r *http.Request) {
+	var req rpcapi.RemoveKeysRequest
+	if err := readJSON(w, r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.Agent == "" {
+		writeError(w, http.StatusBadRequest, errors.New("agent is required"))
+		return
+	}
+
+	if len(req.Fingerprints) == 0 && !req.All {
+		writeError(w, http.StatusBadRequest, errors.New("fingerprints or all is required"))
+		return
+	}
+
+	agents, err := s.selectAgents(req.Agent)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	target := agents[0].agent
+
+	peer := requestPeer(r)
+
+	var removed int
+
+	// all keys are removed without loading the persisted ones from the vault
+	if req.All {
+		removed, err = target.RemoveAllSoftKeys()
+		s.record(peer, audit.OpRemoveAll, req.Agent, "", err)
+	} else {
+		removed, err = target.RemoveSoftKeys(req.Fingerprints...)
+
+		for _, fp := range req.Fingerprints {
+			s.record(peer, audit.OpRemove, req.Agent, fp, err)
+		}
+	}
+
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	s.log.Printf("removed %d soft keys from agent %s via control api", removed, req.Agent)
+
+	writeJSON(w, http.StatusOK, rpcapi.RemoveKeysResponse{Removed: removed})
+}
+
+func (s *RPCServer) handleLock(w http.ResponseWriter, r *http.Request) {
+	var req rpcapi.LockRequest
+	if err := readJSON(w, r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch {
+	case req.PIN && req.Passphrase != "":
+		writeError(w, http.StatusBadRequest, errors.New("passphrase can not be used with pin"))
+		return
+
+	case !req.PIN && req.Passphrase == "":
+		writeError(w, http.StatusBadRequest, errors.New("passphrase is required"))
+		return
+	}
+
+	agents, err := s.selectAgents(req.Agent)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	resp := rpcapi.LockResponse{
+		Agents: []string{},
+	}
+
+	// locking everything skips agents that are already locked
+	var lockAgents []namedAgent
+
+	for _, row := range agents {
+		if req.Agent == "" && row.agent.Locked() {
+			continue
+		}
+
+		// every agent is checked before the first one is locked, so the request locks all of them or none
+		if req.PIN && !row.agent.PINUnlock() {
+			writeError(w, errorStatus(sshagent.ErrPINUnlockUnavailable), fmt.Errorf("agent %s: %w", row.name, sshagent.ErrPINUnlockUnavailable))
+			return
+		}
+
+		lockAgents = append(lockAgents, row)
+	}
+
+	peer := requestPeer(r)
+
+	for _, row := range lockAgents {
+		lock := func() error {
+			if req.PIN {
+				return row.agent.AutoLock(sshagent.LockReasonRequest)
+			}
+
+			return row.agent.Lock([]byte(req.Passphrase))
+		}
+
+		err := lock()
+		s.record(peer, audit.OpLock, row.name, "", err)
+
+		switch {
+		case req.Agent == "" && errors.Is(err, sshagent.ErrAgentLocked):
+			// locked in the meantime, e.g. when it was idle
+			continue
+
+		case err != nil:
+			writeError(w, errorStatus(err), fmt.Errorf("agent %s: %w", row.name, err))
+			return
+		}
+
+		resp.Agents = append(resp.Agents, row.name)
+	}
+
+	s.log.Println("locked agents via control api:", resp.Agents)
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *RPCServer) handleUnlock(w http.ResponseWriter, r *http.Request) {
+	var req rpcapi.LockRequest
+	if err := readJSON(w, r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	agents, err := s.selectAgents(req.Agent)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	resp := rpcapi.LockResponse{
+		Agents: []string{},
+	}
+
+	peer := requestPeer(r)
+
+	for _, row := range agents {
+		if !row.agent.Locked() {
+			if req.Agent != "" {
+				writeError(w, http.StatusConflict, fmt.Errorf("agent %s is not locked", row.name))
+				return
+			}
+
+			continue
+		}
+
+		err := row.agent.Unlock([]byte(req.Passphrase))
+		s.record(peer, audit.OpUnlock, row.name, "", err)
+
+		if err != nil {
+			writeError(w, http.StatusForbidden, fmt.Errorf("agent %s: %w", row.name, err))
+			return
+		}
+
+		resp.Agents = append(resp.Agents, row.name)
+	}
+
+	s.log.Println("unlocked agents via control api:", resp.Agents)
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *RPCServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	reloader := s.reloader
+	s.mu.RUnlock()
+
+	if reloader == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("reload is not supported by this agent"))
+		return
+	}
+
+	changes, err := reloader(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("reload failed: %w", err))
+		return
+	}
+
+	if changes == nil {
+		changes = []string{}
+	}
+
+	writeJSON(w, http.StatusOK, rpcapi.ReloadResponse{Changes: changes})
+}
+
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, sshagent.ErrAgentLocked), errors.Is(err, sshagent.ErrPINUnlockUnavailable):
+		return http.StatusConflict
+
+	case errors.Is(err, ErrUnknownAgent):
+		return http.StatusNotFound
+
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("failed to decode request: %w", err)
+	}
+
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, rpcapi.Error{Error: err.Error()})
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
@@ -0,0 +1,411 @@
+package rpcserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vitalvas/oneauth/cmd/oneauth/doctor"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+	"github.com/vitalvas/oneauth/cmd/oneauth/sshagent"
+	"github.com/vitalvas/oneauth/internal/buildinfo"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func newTestServer(t *testing.T) (*RPCServer, *sshagent.SoftAgent, string) {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+
+	work := sshagent.NewSoftAgent("work", 0, logrus.New())
+	require.NoError(t, work.Add(agent.AddedKey{PrivateKey: priv, Comment: "work-key", LifetimeSecs: 300}))
+
+	server := New(nil, logrus.New())
+	server.SetAgentID("test-agent-id")
+	server.SetSoftAgents(map[string]*sshagent.SoftAgent{
+		"work":     work,
+		"personal": sshagent.NewSoftAgent("personal", 0, logrus.New()),
+	})
+
+	return server, work, ssh.FingerprintSHA256(signer.PublicKey())
+}
+
+func doRequest(t *testing.T, server *RPCServer, method, path string, body any, resp any) int {
+	t.Helper()
+
+	var reqBody bytes.Buffer
+	if body != nil {
+		require.NoError(t, json.NewEncoder(&reqBody).Encode(body))
+	}
+
+	req := httptest.NewRequest(method, path, &reqBody)
+	rec := httptest.NewRecorder()
+
+	server.handler().ServeHTTP(rec, req)
+
+	if resp != nil {
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), resp))
+	}
+
+	return rec.Code
+}
+
+func TestHandleHealth(t *testing.T) {
+	t.Run("WithoutYubikeyAgent", func(t *testing.T) {
+		server, _, _ := newTestServer(t)
+
+		var health rpcapi.Health
+		assert.Equal(t, http.StatusOK, doRequest(t, server, http.MethodGet, rpcapi.PathHealth, nil, &health))
+		assert.Equal(t, rpcapi.HealthOK, health.Status)
+	})
+
+	t.Run("LockedAgent", func(t *testing.T) {
+		server, work, _ := newTestServer(t)
+		require.NoError(t, work.Lock([]byte("secret")))
+
+		var keys rpcapi.Keys
+		assert.Equal(t, http.StatusOK, doRequest(t, server, http.MethodGet, rpcapi.PathKeys, nil, &keys))
+		require.Len(t, keys.Agents, 2)
+
+		assert.Equal(t, "work", keys.Agents[1].Name)
+		assert.True(t, keys.Agents[1].Locked)
+		assert.Empty(t, keys.Agents[1].Keys)
+	})
+
+	t.Run("YubikeyUnavailable", func(t *testing.T) {
+		server := New(&sshagent.SSHAgent{}, logrus.New())
+
+		var health rpcapi.Health
+		assert.Equal(t, http.StatusServiceUnavailable, doRequest(t, server, http.MethodGet, rpcapi.PathHealth, nil, &health))
+		assert.Equal(t, rpcapi.HealthDegraded, health.Status)
+		require.Len(t, health.Checks, 1)
+		assert.Equal(t, "yubikey", health.Checks[0].Name)
+	})
+}
+
+func TestHandleDoctor(t *testing.T) {
+	t.Run("Probes", func(t *testing.T) {
+		server, _, _ := newTestServer(t)
+		server.SetProber(func() []doctor.Probe {
+			return []doctor.Probe{
+				{Name: "first", Check: func(_ context.Context) rpcapi.DoctorCheck { return doctor.Pass("fine") }},
+				{Name: "second", Check: func(_ context.Context) rpcapi.DoctorCheck { return doctor.Warn("fix it", "not fine") }},
+			}
+		})
+
+		var result rpcapi.Doctor
+		code := doRequest(t, server, http.MethodGet, rpcapi.PathDoctor, nil, &result)
+		assert.Equal(t, http.StatusOK, code)
+
+		assert.Equal(t, rpcapi.DoctorWarn, result.Status)
+		require.Len(t, result.Checks, 2)
+		assert.Equal(t, rpcapi.DoctorCheck{Name: "second", Status: rpcapi.DoctorWarn, Message: "not fine", Hint: "fix it"}, result.Checks[1])
+	})
+
+	t.Run("NotSupported", func(t *testing.T) {
+		server, _, _ := newTestServer(t)
+
+		code := doRequest(t, server, http.MethodGet, rpcapi.PathDoctor, nil, nil)
+		assert.Equal(t, http.StatusNotImplemented, code)
+	})
+}
+
+func TestHandleStatus(t *testing.T) {
+	server, _, _ := newTestServer(t)
+
+	var status rpcapi.Status
+	assert.Equal(t, http.StatusOK, doRequest(t, server, http.MethodGet, rpcapi.PathStatus, nil, &status))
+
+	assert.Equal(t, buildinfo.Version, status.Version)
+	assert.Equal(t, "test-agent-id", status.AgentID)
+	assert.Zero(t, status.Serial)
+	assert.False(t, status.Locked)
+	assert.Equal(t, []string{"personal", "work"}, status.Agents)
+}
+
+func TestHandleKeys(t *testing.T) {
+	t.Run("SoftAgents", func(t *testing.T) {
+		server, _, fp := newTestServer(t)
+
+		var keys rpcapi.Keys
+		assert.Equal(t, http.StatusOK, doRequest(t, server, http.MethodGet, rpcapi.PathKeys, nil, &keys))
+		require.Len(t, keys.Agents, 2)
+
+		assert.Equal(t, "personal", keys.Agents[0].Name)
+		assert.Empty(t, keys.Agents[0].Keys)
+
+		assert.Equal(t, "work", keys.Agents[1].Name)
+		require.Len(t, keys.Agents[1].Keys, 1)
+
+		key := keys.Agents[1].Keys[0]
+		assert.Equal(t, rpcapi.KeySourceSoft, key.Source)
+		assert.Equal(t, fp, key.Fingerprint)
+		assert.Equal(t, "work-key", key.Comment)
+		assert.Equal(t, ssh.KeyAlgoED25519, key.Type)
+		assert.NotNil(t, key.ExpiresAt)
+		assert.NotNil(t, key.LastUsed)
+	})
+
+	t.Run("LockedAgent", func(t *testing.T) {
+		server, work, _ := newTestServer(t)
+		require.NoError(t, work.Lock([]byte("secret")))
+
+		var keys rpcapi.Keys
+		assert.Equal(t, http.StatusOK, doRequest(t, server, http.MethodGet, rpcapi.PathKeys, nil, &keys))
+		require.Len(t, keys.Agents, 2)
+
+		assert.Equal(t, "work", keys.Agents[1].Name)
+		assert.True(t, keys.Agents[1].Locked)
+		assert.Empty(t, keys.Agents[1].Keys)
+	})
+
+	t.Run("YubikeyUnavailable", func(t *testing.T) {
+		server := New(&sshagent.SSHAgent{}, logrus.New())
+
+		var keys rpcapi.Keys
+		assert.Equal(t, http.StatusOK, doRequest(t, server, http.MethodGet, rpcapi.PathKeys, nil, &keys))
+		require.Len(t, keys.Agents, 1)
+		assert.Equal(t, rpcapi.DefaultAgent, keys.Agents[0].Name)
+		assert.NotEmpty(t, keys.Agents[0].Error)
+	})
+}
+
+func TestHandleKeysRemove(t *testing.T) {
+	t.Run("ByFingerprint", func(t *testing.T) {
+		server, work, fp := newTestServer(t)
+
+		var resp rpcapi.RemoveKeysResponse
+		code := doRequest(t, server, http.MethodPost, rpcapi.PathKeysRemove, rpcapi.RemoveKeysRequest{
+			Agent:        "work",
+			Fingerprints: []string{fp, "SHA256:unknown"},
+		}, &resp)
+
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, 1, resp.Removed)
+		assert.Empty(t, work.SoftKeys())
+	})
+
+	t.Run("All", func(t *testing.T) {
+		server, work, _ := newTestServer(t)
+
+		var resp rpcapi.RemoveKeysResponse
+		code := doRequest(t, server, http.MethodPost, rpcapi.PathKeysRemove, rpcapi.RemoveKeysRequest{
+			Agent: "work",
+			All:   true,
+		}, &resp)
+
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, 1, resp.Removed)
+		assert.Empty(t, work.SoftKeys())
+	})
+
+	t.Run("UnknownAgent", func(t *testing.T) {
+		server, _, fp := newTestServer(t)
+
+		var resp rpcapi.Error
+		code := doRequest(t, server, http.MethodPost, rpcapi.PathKeysRemove, rpcapi.RemoveKeysRequest{
+			Agent:        "missing",
+			Fingerprints: []string{fp},
+		}, &resp)
+
+		assert.Equal(t, http.StatusNotFound, code)
+		assert.Contains(t, resp.Error, "unknown agent")
+	})
+
+	t.Run("MissingFingerprints", func(t *testing.T) {
+		server, _, _ := newTestServer(t)
+
+		var resp rpcapi.Error
+		code := doRequest(t, server, http.MethodPost, rpcapi.PathKeysRemove, rpcapi.RemoveKeysRequest{Agent: "work"}, &resp)
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("LockedAgent", func(t *testing.T) {
+		server, work, fp := newTestServer(t)
+		require.NoError(t, work.Lock([]byte("secret")))
+
+		var resp rpcapi.Error
+		code := doRequest(t, server, http.MethodPost, rpcapi.PathKeysRemove, rpcapi.RemoveKeysRequest{
+			Agent:        "work",
+			Fingerprints: []string{fp},
+		}, &resp)
+
+		assert.Equal(t, http.StatusConflict, code)
+	})
+
+	t.Run("UnknownField", func(t *testing.T) {
+		server, _, _ := newTestServer(t)
+
+		var resp rpcapi.Error
+		code := doRequest(t, server, http.MethodPost, rpcapi.PathKeysRemove, map[string]any{"agent": "work", "bogus": true}, &resp)
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+}
+
+func TestHandleLock(t *testing.T) {
+	t.Run("LockAndUnlockAll", func(t *testing.T) {
+		server, work, _ := newTestServer(t)
+
+		var resp rpcapi.LockResponse
+		code := doRequest(t, server, http.MethodPost, rpcapi.PathLock, rpcapi.LockRequest{Passphrase: "secret"}, &resp)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, []string{"personal", "work"}, resp.Agents)
+		assert.True(t, work.Locked())
+
+		var errResp rpcapi.Error
+		code = doRequest(t, server, http.MethodPost, rpcapi.PathUnlock, rpcapi.LockRequest{Passphrase: "wrong"}, &errResp)
+		assert.Equal(t, http.StatusForbidden, code)
+
+		code = doRequest(t, server, http.MethodPost, rpcapi.PathUnlock, rpcapi.LockRequest{Passphrase: "secret"}, &resp)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, []string{"personal", "work"}, resp.Agents)
+		assert.False(t, work.Locked())
+	})
+
+	t.Run("SingleAgent", func(t *testing.T) {
+		server, work, _ := newTestServer(t)
+
+		var resp rpcapi.LockResponse
+		code := doRequest(t, server, http.MethodPost, rpcapi.PathLock, rpcapi.LockRequest{Passphrase: "secret", Agent: "work"}, &resp)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, []string{"work"}, resp.Agents)
+		assert.True(t, work.Locked())
+
+		var errResp rpcapi.Error
+		code = doRequest(t, server, http.MethodPost, rpcapi.PathLock, rpcapi.LockRequest{Passphrase: "secret", Agent: "work"}, &errResp)
+		assert.Equal(t, http.StatusConflict, code)
+
+		code = doRequest(t, server, http.MethodPost, rpcapi.PathUnlock, rpcapi.LockRequest{Passphrase: "secret", Agent: "personal"}, &errResp)
+		assert.Equal(t, http.StatusConflict, code)
+	})
+
+	t.Run("EmptyPassphrase", func(t *testing.T) {
+		server, _, _ := newTestServer(t)
+
+		var resp rpcapi.Error
+		code := doRequest(t, server, http.MethodPost, rpcapi.PathLock, rpcapi.LockRequest{}, &resp)
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		code = doRequest(t, server, http.MethodPost, rpcapi.PathLock, rpcapi.LockRequest{Passphrase: "secret", PIN: true}, &resp)
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("PIN", func(t *testing.T) {
+		server, work, _ := newTestServer(t)
+
+		var errResp rpcapi.Error
+		code := doRequest(t, server, http.MethodPost, rpcapi.PathLock, rpcapi.LockRequest{PIN: true, Agent: "work"}, &errResp)
+		assert.Equal(t, http.StatusConflict, code)
+		assert.False(t, work.Locked())
+
+		work.SetPINVerifier(func(_ context.Context, pin string) error {
+			if pin != "135790" {
+				return errors.New("wrong PIN")
+			}
+
+			return nil
+		})
+
+		var resp rpcapi.LockResponse
+		code = doRequest(t, server, http.MethodPost, rpcapi.PathLock, rpcapi.LockRequest{PIN: true, Agent: "work"}, &resp)
+		assert.Equal(t, http.StatusOK, code)
+		assert.True(t, work.Locked())
+
+		code = doRequest(t, server, http.MethodPost, rpcapi.PathUnlock, rpcapi.LockRequest{Passphrase: "000000", Agent: "work"}, &errResp)
+		assert.Equal(t, http.StatusForbidden, code)
+
+		code = doRequest(t, server, http.MethodPost, rpcapi.PathUnlock, rpcapi.LockRequest{Passphrase: "135790", Agent: "work"}, &resp)
+		assert.Equal(t, http.StatusOK, code)
+		assert.False(t, work.Locked())
+	})
+
+	t.Run("PINAllOrNone", func(t *testing.T) {
+		first := sshagent.NewSoftAgent("first", 0, logrus.New())
+		first.SetPINVerifier(func(_ context.Context, _ string) error { return nil })
+
+		second := sshagent.NewSoftAgent("second", 0, logrus.New())
+
+		server := New(nil, logrus.New())
+		server.SetSoftAgents(map[string]*sshagent.SoftAgent{
+			"first":  first,
+			"second": second,
+		})
+
+		var errResp rpcapi.Error
+		code := doRequest(t, server, http.MethodPost, rpcapi.PathLock, rpcapi.LockRequest{PIN: true}, &errResp)
+		assert.Equal(t, http.StatusConflict, code)
+		assert.Contains(t, errResp.Error, "agent second")
+		assert.False(t, first.Locked())
+		assert.False(t, second.Locked())
+
+		second.SetPINVerifier(func(_ context.Context, _ string) error { return nil })
+
+		var resp rpcapi.LockResponse
+		code = doRequest(t, server, http.MethodPost, rpcapi.PathLock, rpcapi.LockRequest{PIN: true}, &resp)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, []string{"first", "second"}, resp.Agents)
+		assert.True(t, first.Locked())
+		assert.True(t, second.Locked())
+	})
+}
+
+func TestHandleReload(t *testing.T) {
+	t.Run("NotSupported", func(t *testing.T) {
+		server, _, _ := newTestServer(t)
+
+		var resp rpcapi.Error
+		assert.Equal(t, http.StatusNotImplemented, doRequest(t, server, http.MethodPost, rpcapi.PathReload, struct{}{}, &resp))
+	})
+
+	t.Run("Applied", func(t *testing.T) {
+		server, _, _ := newTestServer(t)
+		server.SetReloader(func(_ context.Context) ([]string, error) {
+			return []string{"started agent work"}, nil
+		})
+
+		var resp rpcapi.ReloadResponse
+		assert.Equal(t, http.StatusOK, doRequest(t, server, http.MethodPost, rpcapi.PathReload, struct{}{}, &resp))
+		assert.Equal(t, []string{"started agent work"}, resp.Changes)
+	})
+
+	t.Run("Failed", func(t *testing.T) {
+		server, _, _ := newTestServer(t)
+		server.SetReloader(func(_ context.Context) ([]string, error) {
+			return nil, errors.New("bad config")
+		})
+
+		var resp rpcapi.Error
+		assert.Equal(t, http.StatusInternalServerError, doRequest(t, server, http.MethodPost, rpcapi.PathReload, struct{}{}, &resp))
+		assert.Contains(t, resp.Error, "bad config")
+	})
+}
+
+func TestHandlerRouting(t *testing.T) {
+	server, _, _ := newTestServer(t)
+
+	t.Run("UnknownEndpoint", func(t *testing.T) {
+		var resp rpcapi.Error
+		assert.Equal(t, http.StatusNotFound, doRequest(t, server, http.MethodGet, "/v1/unknown", nil, &resp))
+		assert.NotEmpty(t, resp.Error)
+	})
+
+	t.Run("WrongMethod", func(t *testing.T) {
+		var resp rpcapi.Error
+		assert.Equal(t, http.StatusNotFound, doRequest(t, server, http.MethodGet, rpcapi.PathLock, nil, &resp))
+	})
+}
@@ -0,0 +1,327 @@
+package rpcserver
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/go-piv/piv-go/v2/piv"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+	"github.com/vitalvas/oneauth/cmd/oneauth/sshagent"
+	"github.com/vitalvas/oneauth/internal/keyring"
+	"github.com/vitalvas/oneauth/internal/tools"
+	"github.com/vitalvas/oneauth/internal/yubikey"
+)
+
+func (s *RPCServer) yubikeyRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET "+rpcapi.PathYubikeyCards, s.handleYubikeyCards)
+	mux.HandleFunc("GET "+rpcapi.PathYubikeyEvents, s.handleYubikeyEvents)
+	mux.HandleFunc("GET "+rpcapi.PathYubikeyQueue, s.handleYubikeyQueue)
+	mux.HandleFunc("GET "+rpcapi.PathYubikeyRetries, s.handleYubikeyRetries)
+	mux.HandleFunc("POST "+rpcapi.PathYubikeyPIN, s.handleYubikeyPIN)
+	mux.HandleFunc("POST "+rpcapi.PathYubikeyUnblock, s.handleYubikeyUnblock)
+	mux.HandleFunc("POST "+rpcapi.PathYubikeyGenerate, s.handleYubikeyGenerate)
+}
+
+// withYubikey runs fn with the YubiKey held by the agent, a zero serial selects the first one
+func (s *RPCServer) withYubikey(ctx context.Context, serial uint32, fn func(yk *yubikey.Yubikey) error) error {
+	if s.SSHAgent == nil {
+		return sshagent.ErrNoYubikey
+	}
+
+	return s.SSHAgent.WithYubikey(ctx, serial, fn)
+}
+
+func (s *RPCServer) handleYubikeyCards(w http.ResponseWriter, r *http.Request) {
+	var serials []uint32
+	if s.SSHAgent != nil {
+		absent := s.SSHAgent.AbsentSerials()
+
+		for _, serial := range s.SSHAgent.Serials() {
+			if !slices.Contains(absent, serial) {
+				serials = append(serials, serial)
+			}
+		}
+	}
+
+	if len(serials) == 0 {
+		writeError(w, http.StatusServiceUnavailable, sshagent.ErrNoYubikey)
+		return
+	}
+
+	cards := make([]rpcapi.YubikeyCard, 0, len(serials))
+
+	for _, serial := range serials {
+		err := s.withYubikey(r.Context(), serial, func(yk *yubikey.Yubikey) error {
+			certs, err := yk.ListKeys(yubikey.AllSlots...)
+			if err != nil {
+				return fmt.Errorf("failed to list keys of yubikey %d: %w", yk.Serial, err)
+			}
+
+			card := rpcapi.YubikeyCard{
+				Serial:  yk.Serial,
+				Version: yk.Version(),
+				Slots:   make([]rpcapi.YubikeySlot, 0, len(certs)),
+			}
+
+			for _, cert := range certs {
+				card.Slots = append(card.Slots, yubikeySlotInfo(cert.Slot, cert.Certificate))
+			}
+
+			cards = append(cards, card)
+
+			return nil
+		})
+		if err != nil {
+			writeError(w, yubikeyErrorStatus(err), err)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, cards)
+}
+
+func (s *RPCServer) handleYubikeyEvents(w http.ResponseWriter, _ *http.Request) {
+	events := []rpcapi.YubikeyEvent{}
+
+	if s.SSHAgent != nil {
+		for _, event := range s.SSHAgent.PresenceEvents() {
+			events = append(events, rpcapi.YubikeyEvent{
+				Time:    event.Time,
+				Serial:  event.Serial,
+				Present: event.Present,
+			})
+		}
+	}
+
+	writeJSON(w, http.StatusOK, events)
+}
+
+func (s *RPCServer) handleYubikeyQueue(w http.ResponseWriter, _ *http.Request) {
+	requests := []rpcapi.YubikeyRequest{}
+
+	if s.SSHAgent != nil {
+		for _, req := range s.SSHAgent.PendingRequests() {
+			item := rpcapi.YubikeyRequest{
+				ID:          req.ID,
+				Operation:   req.Operation,
+				Serial:      req.Serial,
+				Slot:        req.Slot,
+				Fingerprint: req.Fingerprint,
+				PID:         req.PID,
+				Exe:         req.Exe,
+				QueuedAt:    req.QueuedAt,
+			}
+
+			if !req.StartedAt.IsZero() {
+				item.StartedAt = &req.StartedAt
+			}
+
+			requests = append(requests, item)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, requests)
+}
+
+func (s *RPCServer) handleYubikeyRetries(w http.ResponseWriter, r *http.Request) {
+	var serial uint32
+
+	if value := r.URL.Query().Get("serial"); value != "" {
+		parsed, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid serial: %w", err))
+			return
+		}
+
+		serial = uint32(parsed)
+	}
+
+	var resp rpcapi.YubikeyRetries
+
+	err := s.withYubikey(r.Context(), serial, func(yk *yubikey.Yubikey) error {
+		retries, err := yk.Retries()
+		if err != nil {
+			return fmt.Errorf("failed to get PIN retries: %w", err)
+		}
+
+		resp = rpcapi.YubikeyRetries{
+			Serial:     yk.Serial,
+			PINRetries: retries,
+		}
+
+		return nil
+	})
+	if err != nil {
+		writeError(w, yubikeyErrorStatus(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *RPCServer) handleYubikeyPIN(w http.ResponseWriter, r *http.Request) {
+	var req rpcapi.ChangePINRequest
+	if err := readJSON(w, r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if !yubikey.ValidatePin(req.CurrentPIN) || !yubikey.ValidatePin(req.NewPIN) {
+		writeError(w, http.StatusBadRequest, errors.New("invalid PIN"))
+		return
+	}
+
+	if req.NewPIN == piv.DefaultPIN {
+		writeError(w, http.StatusBadRequest, errors.New("the new PIN can not be the same as the default one"))
+		return
+	}
+
+	if req.NewPIN == req.CurrentPIN {
+		writeError(w, http.StatusBadRequest, errors.New("the new PIN can not be the same as the current one"))
+		return
+	}
+
+	err := s.withYubikey(r.Context(), req.Serial, func(yk *yubikey.Yubikey) error {
+		if err := yk.VerifyPIN(req.CurrentPIN); err != nil {
+			return fmt.Errorf("failed to verify current PIN: %w", err)
+		}
+
+		if err := yk.SetPIN(req.CurrentPIN, req.NewPIN); err != nil {
+			return fmt.Errorf("failed to change PIN: %w", err)
+		}
+
+		s.log.Println("changed PIN of yubikey", yk.Serial, "via control api")
+
+		return nil
+	})
+	if err != nil {
+		writeError(w, yubikeyErrorStatus(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+func (s *RPCServer) handleYubikeyUnblock(w http.ResponseWriter, r *http.Request) {
+	var req rpcapi.UnblockPINRequest
+	if err := readJSON(w, r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if !yubikey.ValidatePuk(req.PUK) || !yubikey.ValidatePin(req.NewPIN) {
+		writeError(w, http.StatusBadRequest, errors.New("invalid PUK or PIN"))
+		return
+	}
+
+	if req.NewPIN == piv.DefaultPIN {
+		writeError(w, http.StatusBadRequest, errors.New("the new PIN can not be the same as the default one"))
+		return
+	}
+
+	if req.NewPIN == req.PUK {
+		writeError(w, http.StatusBadRequest, errors.New("PIN and PUK codes must be different"))
+		return
+	}
+
+	err := s.withYubikey(r.Context(), req.Serial, func(yk *yubikey.Yubikey) error {
+		if err := yk.Unblock(req.PUK, req.NewPIN); err != nil {
+			return fmt.Errorf("failed to unblock PIN: %w", err)
+		}
+
+		s.log.Println("unblocked PIN of yubikey", yk.Serial, "via control api")
+
+		return nil
+	})
+	if err != nil {
+		writeError(w, yubikeyErrorStatus(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+func (s *RPCServer) handleYubikeyGenerate(w http.ResponseWriter, r *http.Request) {
+	var req rpcapi.GenerateSlotRequest
+	if err := readJSON(w, r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	slot, err := yubikey.ParseSlot(req.Slot)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	certReq, err := yubikey.NewInsecureCertRequest(req.Username, req.KeyType, req.TouchPolicy, req.PINPolicy, req.ValidDays)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var resp rpcapi.GenerateSlotResponse
+
+	err = s.withYubikey(r.Context(), req.Serial, func(yk *yubikey.Yubikey) error {
+		pin, err := keyring.Get(fmt.Sprintf("yubikey:%d:%s", yk.Serial, "pin"))
+		if err != nil {
+			return fmt.Errorf("failed to get YubiKey PIN: %w", err)
+		}
+
+		cert, err := yk.GenCertificate(slot, pin, certReq)
+		if err != nil {
+			return fmt.Errorf("failed to generate key: %w", err)
+		}
+
+		resp.Slot = yubikeySlotInfo(slot, cert)
+
+		s.log.Println("generated key in slot", slot.String(), "of yubikey", yk.Serial, "via control api")
+
+		return nil
+	})
+	if err != nil {
+		writeError(w, yubikeyErrorStatus(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func yubikeySlotInfo(slot yubikey.Slot, cert *x509.Certificate) rpcapi.YubikeySlot {
+	info := rpcapi.YubikeySlot{
+		Slot:       slot.String(),
+		CommonName: cert.Subject.CommonName,
+		NotBefore:  cert.NotBefore,
+		NotAfter:   cert.NotAfter,
+	}
+
+	if sshKey, err := tools.GetSSHPublicKey(cert.PublicKey); err == nil {
+		info.SSHPublicKey = strings.TrimSpace(string(sshKey))
+	}
+
+	return info
+}
+
+func yubikeyErrorStatus(err error) int {
+	var authErr piv.AuthErr
+
+	switch {
+	case errors.Is(err, sshagent.ErrNoYubikey), errors.Is(err, sshagent.ErrYubikeyAbsent):
+		return http.StatusServiceUnavailable
+
+	case errors.Is(err, sshagent.ErrCardQueueFull):
+		return http.StatusTooManyRequests
+
+	case errors.As(err, &authErr):
+		return http.StatusForbidden
+
+	default:
+		return http.StatusInternalServerError
+	}
+}
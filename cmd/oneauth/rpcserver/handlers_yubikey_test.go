@@ -0,0 +1,149 @@
+package rpcserver
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vitalvas/oneauth/cmd/oneauth/config"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+	"github.com/vitalvas/oneauth/cmd/oneauth/sshagent"
+)
+
+func TestHandleYubikey(t *testing.T) {
+	servers := map[string]*RPCServer{
+		"WithoutAgent":   New(nil, logrus.New()),
+		"WithoutYubikey": New(&sshagent.SSHAgent{}, logrus.New()),
+	}
+
+	for name, server := range servers {
+		t.Run(name, func(t *testing.T) {
+			var resp rpcapi.Error
+
+			assert.Equal(t, http.StatusServiceUnavailable, doRequest(t, server, http.MethodGet, rpcapi.PathYubikeyCards, nil, &resp))
+			assert.Equal(t, http.StatusServiceUnavailable, doRequest(t, server, http.MethodGet, rpcapi.PathYubikeyRetries, nil, &resp))
+
+			code := doRequest(t, server, http.MethodPost, rpcapi.PathYubikeyPIN, rpcapi.ChangePINRequest{
+				CurrentPIN: "135790",
+				NewPIN:     "246802",
+			}, &resp)
+			assert.Equal(t, http.StatusServiceUnavailable, code)
+
+			code = doRequest(t, server, http.MethodPost, rpcapi.PathYubikeyGenerate, rpcapi.GenerateSlotRequest{
+				Slot:        "0x95",
+				Username:    "test",
+				ValidDays:   1,
+				KeyType:     "eccp256",
+				TouchPolicy: "cached",
+				PINPolicy:   "once",
+			}, &resp)
+			assert.Equal(t, http.StatusServiceUnavailable, code)
+		})
+	}
+
+	t.Run("AbsentYubikey", func(t *testing.T) {
+		// the card is not plugged in, so the agent serves it as absent
+		sshAgent, err := sshagent.New([]uint32{12345678}, logrus.New(), &config.Config{})
+		require.NoError(t, err)
+
+		server := New(sshAgent, logrus.New())
+
+		var status rpcapi.Status
+		assert.Equal(t, http.StatusOK, doRequest(t, server, http.MethodGet, rpcapi.PathStatus, nil, &status))
+		assert.Equal(t, []uint32{12345678}, status.Serials)
+		assert.Equal(t, []uint32{12345678}, status.Absent)
+
+		var health rpcapi.Health
+		assert.Equal(t, http.StatusServiceUnavailable, doRequest(t, server, http.MethodGet, rpcapi.PathHealth, nil, &health))
+		require.Len(t, health.Checks, 1)
+		assert.Contains(t, health.Checks[0].Message, "12345678")
+
+		var resp rpcapi.Error
+		assert.Equal(t, http.StatusServiceUnavailable, doRequest(t, server, http.MethodGet, rpcapi.PathYubikeyCards, nil, &resp))
+
+		code := doRequest(t, server, http.MethodGet, rpcapi.PathYubikeyRetries+"?serial=12345678", nil, &resp)
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+	})
+
+	t.Run("Events", func(t *testing.T) {
+		var events []rpcapi.YubikeyEvent
+
+		assert.Equal(t, http.StatusOK, doRequest(t, New(nil, logrus.New()), http.MethodGet, rpcapi.PathYubikeyEvents, nil, &events))
+		assert.Empty(t, events)
+	})
+
+	t.Run("Queue", func(t *testing.T) {
+		var requests []rpcapi.YubikeyRequest
+
+		assert.Equal(t, http.StatusOK, doRequest(t, New(nil, logrus.New()), http.MethodGet, rpcapi.PathYubikeyQueue, nil, &requests))
+		assert.NotNil(t, requests)
+		assert.Empty(t, requests)
+	})
+
+	t.Run("ChangePINValidation", func(t *testing.T) {
+		server := New(nil, logrus.New())
+
+		tests := []struct {
+			name string
+			req  rpcapi.ChangePINRequest
+		}{
+			{name: "InvalidCurrent", req: rpcapi.ChangePINRequest{CurrentPIN: "1", NewPIN: "246802"}},
+			{name: "InvalidNew", req: rpcapi.ChangePINRequest{CurrentPIN: "135790", NewPIN: "abc"}},
+			{name: "Same", req: rpcapi.ChangePINRequest{CurrentPIN: "135790", NewPIN: "135790"}},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				var resp rpcapi.Error
+				assert.Equal(t, http.StatusBadRequest, doRequest(t, server, http.MethodPost, rpcapi.PathYubikeyPIN, tt.req, &resp))
+			})
+		}
+	})
+
+	t.Run("UnblockValidation", func(t *testing.T) {
+		server := New(nil, logrus.New())
+
+		tests := []struct {
+			name string
+			req  rpcapi.UnblockPINRequest
+		}{
+			{name: "InvalidPUK", req: rpcapi.UnblockPINRequest{PUK: "1", NewPIN: "246802"}},
+			{name: "InvalidPIN", req: rpcapi.UnblockPINRequest{PUK: "13579024", NewPIN: "abc"}},
+			{name: "Same", req: rpcapi.UnblockPINRequest{PUK: "13579024", NewPIN: "13579024"}},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				var resp rpcapi.Error
+				assert.Equal(t, http.StatusBadRequest, doRequest(t, server, http.MethodPost, rpcapi.PathYubikeyUnblock, tt.req, &resp))
+			})
+		}
+
+		// without the agent there is no YubiKey to unblock
+		var resp rpcapi.Error
+		code := doRequest(t, server, http.MethodPost, rpcapi.PathYubikeyUnblock, rpcapi.UnblockPINRequest{PUK: "13579024", NewPIN: "246802"}, &resp)
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+	})
+
+	t.Run("GenerateValidation", func(t *testing.T) {
+		server := New(nil, logrus.New())
+
+		tests := []struct {
+			name string
+			req  rpcapi.GenerateSlotRequest
+		}{
+			{name: "InvalidSlot", req: rpcapi.GenerateSlotRequest{Slot: "zz", KeyType: "eccp256", TouchPolicy: "cached", PINPolicy: "once", ValidDays: 1}},
+			{name: "InvalidKeyType", req: rpcapi.GenerateSlotRequest{Slot: "95", KeyType: "dsa", TouchPolicy: "cached", PINPolicy: "once", ValidDays: 1}},
+			{name: "InvalidDays", req: rpcapi.GenerateSlotRequest{Slot: "95", KeyType: "eccp256", TouchPolicy: "cached", PINPolicy: "once"}},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				var resp rpcapi.Error
+				assert.Equal(t, http.StatusBadRequest, doRequest(t, server, http.MethodPost, rpcapi.PathYubikeyGenerate, tt.req, &resp))
+			})
+		}
+	})
+}
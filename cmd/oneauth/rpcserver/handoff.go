@@ -0,0 +1,259 @@
+package rpcserver
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+	"github.com/vitalvas/oneauth/internal/netutil"
+)
+
+// handoffReadyTimeout bounds the wait for the agent process that takes over, it opens the YubiKeys first
+const handoffReadyTimeout = time.Minute
+
+// handoffTokenTimeout is how long a handoff token can be used, the supervisor of the service restarts it in seconds
+const handoffTokenTimeout = time.Minute
+
+// handoffExecutable returns the binary the agent process that takes over must run, it is replaced in tests
+var handoffExecutable = os.Executable
+
+var errHandoffToken = errors.New("invalid or expired handoff token")
+
+// connContextKey holds the connection of a request, its peer is checked before a handoff
+type connContextKey struct{}
+
+// Handoffer passes the running agent to another agent process
+type Handoffer interface {
+	// HandoffState returns the state with the listening sockets, in the order of State.Sockets
+	HandoffState() (rpcapi.HandoffState, []*os.File, error)
+
+	// HandedOff is called once the other process serves the sockets, or with the error that ended the handoff
+	HandedOff(err error)
+}
+
+// NewHandoffToken returns the one-time token a new agent process takes over with, it replaces the previous one
+func (s *RPCServer) NewHandoffToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to create handoff token: %w", err)
+	}
+
+	token := hex.EncodeToString(buf)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.handoffToken = token
+	s.handoffTokenExpiry = time.Now().Add(handoffTokenTimeout)
+
+	return token, nil
+}
+
+// useHandoffToken checks the token of a handoff request, a valid token is used once
+func (s *RPCServer) useHandoffToken(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.handoffToken == "" || time.Now().After(s.handoffTokenExpiry) ||
+		subtle.ConstantTimeCompare([]byte(token), []byte(s.handoffToken)) != 1 {
+		return errHandoffToken
+	}
+
+	s.handoffToken = ""
+
+	return nil
+}
+
+// checkHandoffPeer allows only processes of the same oneauth binary to take over the agent,
+// the access rules of the control socket are checked when the connection is accepted
+func checkHandoffPeer(r *http.Request) error {
+	conn, ok := r.Context().Value(connContextKey{}).(net.Conn)
+	if !ok {
+		return errors.New("unknown peer")
+	}
+
+	creds, err := netutil.UnixSocketCreds(conn)
+	if err != nil {
+		return err
+	}
+
+	exe, err := handoffExecutable()
+	if err != nil {
+		return fmt.Errorf("failed to get executable path: %w", err)
+	}
+
+	if !sameExecutable(creds.Exe, exe) {
+		return fmt.Errorf("process %d runs %q, not %s", creds.PID, creds.Exe, exe)
+	}
+
+	return nil
+}
+
+// sameExecutable compares paths after resolving symlinks, os.Executable does not resolve them on macOS
+func sameExecutable(a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+
+	if filepath.Clean(a) == filepath.Clean(b) {
+		return true
+	}
+
+	resolvedA, errA := filepath.EvalSymlinks(a)
+	resolvedB, errB := filepath.EvalSymlinks(b)
+
+	return errA == nil && errB == nil && resolvedA == resolvedB
+}
+
+// handleHandoffToken returns a token for `oneauth service restart`, it passes the token to the agent process it starts
+func (s *RPCServer) handleHandoffToken(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	handoffer := s.handoffer
+	s.mu.RUnlock()
+
+	if handoffer == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("handoff is not supported by this agent"))
+		return
+	}
+
+	if err := checkHandoffPeer(r); err != nil {
+		s.log.Warnln("refused handoff token:", err)
+		writeError(w, http.StatusForbidden, fmt.Errorf("handoff refused: %w", err))
+		return
+	}
+
+	token, err := s.NewHandoffToken()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, rpcapi.HandoffToken{Token: token})
+}
+
+// handleHandoff passes the sockets and keys over the connection of the request, the response carries
+// the sockets as SCM_RIGHTS, so it is written to the connection directly
+func (s *RPCServer) handleHandoff(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	handoffer := s.handoffer
+	s.mu.RUnlock()
+
+	if handoffer == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("handoff is not supported by this agent"))
+		return
+	}
+
+	if err := checkHandoffPeer(r); err != nil {
+		s.log.Warnln("refused handoff:", err)
+		writeError(w, http.StatusForbidden, fmt.Errorf("handoff refused: %w", err))
+		return
+	}
+
+	var req rpcapi.HandoffRequest
+	if err := readJSON(w, r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := s.useHandoffToken(req.Token); err != nil {
+		s.log.Warnln("refused handoff:", err)
+		writeError(w, http.StatusForbidden, fmt.Errorf("handoff refused: %w", err))
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("connection can not be handed off"))
+		return
+	}
+
+	state, files, err := handoffer.HandoffState()
+	if err != nil {
+		writeError(w, errorStatus(err), fmt.Errorf("handoff failed: %w", err))
+		return
+	}
+
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		handoffer.HandedOff(err)
+		return
+	}
+
+	defer conn.Close()
+
+	err = sendHandoff(conn, buf.Reader, state, files)
+	if err != nil {
+		s.log.Warnln("handoff failed:", err)
+	} else {
+		s.log.Println("handed off to agent process")
+	}
+
+	handoffer.HandedOff(err)
+}
+
+func sendHandoff(conn net.Conn, reader *bufio.Reader, state rpcapi.HandoffState, files []*os.File) error {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return fmt.Errorf("can not pass sockets over %T", conn)
+	}
+
+	body, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	defer clear(body)
+
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		Close:         true,
+	}
+
+	var payload bytes.Buffer
+	if err := resp.Write(&payload); err != nil {
+		return err
+	}
+
+	defer clear(payload.Bytes())
+
+	conn.SetDeadline(time.Now().Add(handoffReadyTimeout))
+
+	if err := netutil.SendFiles(unixConn, payload.Bytes(), files); err != nil {
+		return fmt.Errorf("failed to send sockets: %w", err)
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("agent process did not take over: %w", err)
+	}
+
+	if strings.TrimSpace(line) != rpcapi.HandoffReady {
+		return fmt.Errorf("unexpected handoff reply: %q", strings.TrimSpace(line))
+	}
+
+	return nil
+}
@@ -0,0 +1,235 @@
+package rpcserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcclient"
+	"github.com/vitalvas/oneauth/cmd/oneauth/sshagent"
+	"github.com/vitalvas/oneauth/internal/netutil"
+)
+
+type testHandoffer struct {
+	listener net.Listener
+	err      error
+	done     chan error
+}
+
+func (h *testHandoffer) HandoffState() (rpcapi.HandoffState, []*os.File, error) {
+	if h.err != nil {
+		return rpcapi.HandoffState{}, nil, h.err
+	}
+
+	file, err := netutil.ListenerFile(h.listener)
+	if err != nil {
+		return rpcapi.HandoffState{}, nil, err
+	}
+
+	return rpcapi.HandoffState{
+		Version: "1.2.3",
+		Sockets: []string{"main"},
+		Agents: map[string]rpcapi.HandoffAgent{
+			rpcapi.DefaultAgent: {Keys: []rpcapi.HandoffKey{{Comment: "soft"}}},
+		},
+	}, []*os.File{file}, nil
+}
+
+func (h *testHandoffer) HandedOff(err error) {
+	h.done <- err
+}
+
+// serveTestHandoff runs the control socket with the handoffer and returns it with an agent socket to pass
+func serveTestHandoff(t *testing.T, handoffer *testHandoffer) (*RPCServer, string, string) {
+	t.Helper()
+
+	socketDir, err := os.MkdirTemp("", "handoff")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(socketDir) })
+
+	agentPath := filepath.Join(socketDir, "agent.sock")
+
+	handoffer.listener, err = net.Listen("unix", agentPath)
+	require.NoError(t, err)
+	t.Cleanup(func() { handoffer.listener.Close() })
+
+	handoffer.done = make(chan error, 1)
+
+	server := New(nil, logrus.New())
+	server.SetHandoffer(handoffer)
+
+	controlPath := filepath.Join(socketDir, "control.sock")
+
+	go server.ListenAndServe(context.Background(), controlPath)
+	t.Cleanup(server.Shutdown)
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(controlPath)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	return server, controlPath, agentPath
+}
+
+func newTestHandoffToken(t *testing.T, server *RPCServer) string {
+	t.Helper()
+
+	token, err := server.NewHandoffToken()
+	require.NoError(t, err)
+
+	return token
+}
+
+func requireAPIError(t *testing.T, err error, code int) *rpcclient.APIError {
+	t.Helper()
+
+	var apiErr *rpcclient.APIError
+	require.True(t, errors.As(err, &apiErr), "unexpected error: %v", err)
+	assert.Equal(t, code, apiErr.StatusCode)
+
+	return apiErr
+}
+
+func TestHandleHandoff(t *testing.T) {
+	t.Run("Ready", func(t *testing.T) {
+		handoffer := &testHandoffer{}
+		_, controlPath, agentPath := serveTestHandoff(t, handoffer)
+
+		client := rpcclient.New(controlPath)
+
+		token, err := client.HandoffToken(context.Background())
+		require.NoError(t, err)
+
+		handoff, err := client.Handoff(context.Background(), token)
+		require.NoError(t, err)
+
+		assert.Equal(t, "1.2.3", handoff.State.Version)
+		assert.Equal(t, "soft", handoff.State.Agents[rpcapi.DefaultAgent].Keys[0].Comment)
+		require.Contains(t, handoff.Listeners, "main")
+		defer handoff.Listeners["main"].Close()
+
+		require.NoError(t, handoff.Ready())
+		require.NoError(t, <-handoffer.done)
+
+		// the old process closes its listener, the passed one serves the same socket
+		require.NoError(t, handoffer.listener.Close())
+
+		go func() {
+			if conn, err := net.Dial("unix", agentPath); err == nil {
+				conn.Close()
+			}
+		}()
+
+		conn, err := handoff.Listeners["main"].Accept()
+		require.NoError(t, err)
+		conn.Close()
+	})
+
+	t.Run("Aborted", func(t *testing.T) {
+		handoffer := &testHandoffer{}
+		server, controlPath, _ := serveTestHandoff(t, handoffer)
+
+		handoff, err := rpcclient.New(controlPath).Handoff(context.Background(), newTestHandoffToken(t, server))
+		require.NoError(t, err)
+
+		require.NoError(t, handoff.Close())
+		assert.ErrorContains(t, <-handoffer.done, "did not take over")
+	})
+
+	t.Run("Locked", func(t *testing.T) {
+		handoffer := &testHandoffer{err: sshagent.ErrAgentLocked}
+		server, controlPath, _ := serveTestHandoff(t, handoffer)
+
+		_, err := rpcclient.New(controlPath).Handoff(context.Background(), newTestHandoffToken(t, server))
+
+		apiErr := requireAPIError(t, err, http.StatusConflict)
+		assert.Contains(t, apiErr.Message, "handoff failed")
+	})
+
+	t.Run("InvalidToken", func(t *testing.T) {
+		handoffer := &testHandoffer{}
+		server, controlPath, _ := serveTestHandoff(t, handoffer)
+
+		client := rpcclient.New(controlPath)
+
+		_, err := client.Handoff(context.Background(), "")
+		requireAPIError(t, err, http.StatusForbidden)
+
+		token := newTestHandoffToken(t, server)
+
+		_, err = client.Handoff(context.Background(), "wrong")
+		apiErr := requireAPIError(t, err, http.StatusForbidden)
+		assert.Contains(t, apiErr.Message, "invalid or expired handoff token")
+
+		// a new token replaces the previous one
+		newToken := newTestHandoffToken(t, server)
+
+		_, err = client.Handoff(context.Background(), token)
+		requireAPIError(t, err, http.StatusForbidden)
+
+		// the token is used once
+		handoff, err := client.Handoff(context.Background(), newToken)
+		require.NoError(t, err)
+		require.NoError(t, handoff.Close())
+		<-handoffer.done
+
+		_, err = client.Handoff(context.Background(), newToken)
+		requireAPIError(t, err, http.StatusForbidden)
+	})
+
+	t.Run("ExpiredToken", func(t *testing.T) {
+		handoffer := &testHandoffer{}
+		server, controlPath, _ := serveTestHandoff(t, handoffer)
+
+		token := newTestHandoffToken(t, server)
+
+		server.mu.Lock()
+		server.handoffTokenExpiry = time.Now().Add(-time.Second)
+		server.mu.Unlock()
+
+		_, err := rpcclient.New(controlPath).Handoff(context.Background(), token)
+		requireAPIError(t, err, http.StatusForbidden)
+	})
+
+	t.Run("OtherExecutable", func(t *testing.T) {
+		origExecutable := handoffExecutable
+		t.Cleanup(func() { handoffExecutable = origExecutable })
+
+		handoffExecutable = func() (string, error) {
+			return "/usr/local/bin/oneauth", nil
+		}
+
+		handoffer := &testHandoffer{}
+		server, controlPath, _ := serveTestHandoff(t, handoffer)
+
+		client := rpcclient.New(controlPath)
+
+		_, err := client.HandoffToken(context.Background())
+		requireAPIError(t, err, http.StatusForbidden)
+
+		_, err = client.Handoff(context.Background(), newTestHandoffToken(t, server))
+		apiErr := requireAPIError(t, err, http.StatusForbidden)
+		assert.Contains(t, apiErr.Message, "handoff refused")
+	})
+
+	t.Run("NotSupported", func(t *testing.T) {
+		server, _, _ := newTestServer(t)
+
+		code := doRequest(t, server, http.MethodPost, rpcapi.PathHandoff, struct{}{}, nil)
+		assert.Equal(t, http.StatusNotImplemented, code)
+	})
+
+	t.Run("NotRunning", func(t *testing.T) {
+		_, err := rpcclient.New(filepath.Join(t.TempDir(), "missing.sock")).Handoff(context.Background(), "token")
+		assert.ErrorIs(t, err, rpcclient.ErrAgentNotRunning)
+	})
+}
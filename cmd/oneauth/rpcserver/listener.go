@@ -2,7 +2,7 @@ package rpcserver
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"net"
 	"net/http"
 	"os"
@@ -10,41 +10,47 @@ import (
 )
 
 func (s *RPCServer) ListenAndServe(_ context.Context, socketPath string) error {
-	defer func() {
-		if _, err := os.Stat(socketPath); err == nil {
-			os.Remove(socketPath)
-		}
-	}()
-
 	s.log.Println("listening rpc on", socketPath)
 
-	listener, err := net.Listen("unix", socketPath)
-	if err != nil {
-		return err
-	}
+	s.mu.RLock()
+	listener := s.listener
+	s.mu.RUnlock()
 
-	defer listener.Close()
+	if listener == nil {
+		var err error
 
-	if err := os.Chmod(socketPath, 0600); err != nil {
-		return err
-	}
+		listener, err = net.Listen("unix", socketPath)
+		if err != nil {
+			return err
+		}
+
+		if err := os.Chmod(socketPath, 0600); err != nil {
+			listener.Close()
+			return err
+		}
 
-	mux := http.NewServeMux()
+		// the socket file is removed when the listener is closed, unless it was handed off to another process
+		s.mu.Lock()
+		s.listener = listener
+		s.mu.Unlock()
+	}
 
-	mux.HandleFunc("/", func(w http.ResponseWriter, _ *http.Request) {
-		fmt.Fprintf(w, "hello world from oneauth agent")
-	})
+	defer listener.Close()
 
 	server := &http.Server{
-		Handler:           mux,
+		Handler:           s.handler(),
 		ReadHeaderTimeout: 2 * time.Second,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, connContextKey{}, conn)
+		},
 	}
 
 	s.mu.Lock()
 	s.server = server
 	s.mu.Unlock()
 
-	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+	// the listener is closed when the socket was handed off to another process
+	if err := server.Serve(&credsListener{Listener: listener, log: s.log, access: s.getAccess}); err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
 		return err
 	}
 
@@ -2,12 +2,16 @@ package rpcserver
 
 import (
 	"context"
+	"net"
 	"net/http"
 	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/vitalvas/oneauth/cmd/oneauth/doctor"
 	"github.com/vitalvas/oneauth/cmd/oneauth/sshagent"
+	"github.com/vitalvas/oneauth/internal/audit"
+	"github.com/vitalvas/oneauth/internal/netutil"
 )
 
 type RPCServer struct {
@@ -15,8 +19,27 @@ type RPCServer struct {
 	server   *http.Server
 	log      *logrus.Logger
 	mu       sync.RWMutex
+
+	agentID    string
+	softAgents map[string]*sshagent.SoftAgent
+	reloader   Reloader
+	handoffer  Handoffer
+	probes     Prober
+	listener   net.Listener
+	access     netutil.Access
+	audit      *audit.Logger
+
+	// handoffToken allows one handoff until handoffTokenExpiry
+	handoffToken       string
+	handoffTokenExpiry time.Time
 }
 
+// Prober returns the diagnostic probes run by the doctor endpoint, they are created for every request
+type Prober func() []doctor.Probe
+
+// Reloader applies the config file to the running agent and describes the changes
+type Reloader func(ctx context.Context) ([]string, error)
+
 func New(sshAgent *sshagent.SSHAgent, log *logrus.Logger) *RPCServer {
 	return &RPCServer{
 		SSHAgent: sshAgent,
@@ -24,6 +47,78 @@ func New(sshAgent *sshagent.SSHAgent, log *logrus.Logger) *RPCServer {
 	}
 }
 
+// SetListener serves an inherited socket, e.g. from systemd socket activation.
+// ListenAndServe does not create or remove the socket file then.
+func (s *RPCServer) SetListener(listener net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.listener = listener
+}
+
+// SetProber sets the probes of the doctor endpoint
+func (s *RPCServer) SetProber(probes Prober) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.probes = probes
+}
+
+// SetHandoffer sets the agent passed to another agent process by the handoff endpoint
+func (s *RPCServer) SetHandoffer(handoffer Handoffer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.handoffer = handoffer
+}
+
+// SetAccess replaces the rules checked for new connections to the control socket
+func (s *RPCServer) SetAccess(access netutil.Access) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.access = access
+}
+
+func (s *RPCServer) getAccess() netutil.Access {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.access
+}
+
+// Listener returns the control socket, nil before ListenAndServe
+func (s *RPCServer) Listener() net.Listener {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.listener
+}
+
+// SetAgentID sets the agent ID reported by the status endpoint
+func (s *RPCServer) SetAgentID(agentID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.agentID = agentID
+}
+
+// SetSoftAgents sets the named soft-key agents managed through the API
+func (s *RPCServer) SetSoftAgents(softAgents map[string]*sshagent.SoftAgent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.softAgents = softAgents
+}
+
+// SetReloader sets the function called by the reload endpoint
+func (s *RPCServer) SetReloader(reloader Reloader) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reloader = reloader
+}
+
 func (s *RPCServer) Shutdown() {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -1,8 +1,76 @@
 package service
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"github.com/vitalvas/oneauth/cmd/oneauth/paths"
+)
 
 var (
 	ErrNotInstalled   = errors.New("oneauth service is not installed")
 	ErrNotImplemented = errors.New("not yet implemented for your OS")
 )
+
+// HandoffTokenEnv passes the one-time token of the handoff to the agent process started by Handoff
+const HandoffTokenEnv = "ONEAUTH_HANDOFF_TOKEN"
+
+// Options are the settings of the installed service
+type Options struct {
+	// SocketPath is the agent socket the service is started on by socket activation, none by default
+	SocketPath string
+}
+
+// executablePath returns the path of the running binary, it is replaced in tests
+var executablePath = os.Executable
+
+// serviceExecutable returns the binary the service runs, it must be installed in the app home directory
+func serviceExecutable() (string, error) {
+	execPath, err := executablePath()
+	if err != nil {
+		return "", fmt.Errorf("failed to get executable path: %w", err)
+	}
+
+	appHomeDir, err := paths.BinDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get app home directory: %w", err)
+	}
+
+	if !strings.HasPrefix(execPath, appHomeDir) {
+		return "", errors.New("service can be installed only from app home directory")
+	}
+
+	return execPath, nil
+}
+
+// startDetached starts a process that outlives the command with the env added to its environment, it is replaced in tests
+var startDetached = func(env []string, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %w", name, err)
+	}
+
+	return cmd.Process.Release()
+}
+
+// Handoff starts a new agent that takes over the sockets and keys of the running service with the one-time token
+// of the service. The service exits once it handed off, then it is started again by its supervisor and takes them back.
+func Handoff(configPath, token string) error {
+	if err := checkService(); err != nil {
+		return err
+	}
+
+	execPath, err := serviceExecutable()
+	if err != nil {
+		return err
+	}
+
+	return startDetached([]string{HandoffTokenEnv + "=" + token}, execPath, "--config", configPath, "agent", "--handoff")
+}
@@ -19,19 +19,14 @@ const serviceName = "dev.vitalvas.oneauth"
 //go:embed template/launchd.service
 var serviceTmpl string
 
-func Install() error {
-	execPath, err := os.Executable()
-	if err != nil {
-		return fmt.Errorf("failed to get executable path: %w", err)
+func Install(opts Options) error {
+	if opts.SocketPath != "" {
+		return fmt.Errorf("socket activation: %w", ErrNotImplemented)
 	}
 
-	appHomeDir, err := paths.BinDir()
+	execPath, err := serviceExecutable()
 	if err != nil {
-		return fmt.Errorf("failed to get app home directory: %w", err)
-	}
-
-	if !strings.HasPrefix(execPath, appHomeDir) {
-		return errors.New("service can be installed only from app home directory")
+		return err
 	}
 
 	servicePath, err := paths.ServiceFile(serviceName)
@@ -150,6 +145,7 @@ func writeServiceTemplate(exePath string, serviceFile *os.File) error {
 		Args: []string{
 			exePath,
 			"agent",
+			"--handoff",
 		},
 	}
 
@@ -120,7 +120,7 @@ func TestCallLaunchCtlStructure(t *testing.T) {
 func TestInstallValidation(t *testing.T) {
 	t.Run("InstallPathValidation", func(t *testing.T) {
 		// Test will fail due to path validation, but we can test the structure
-		err := Install()
+		err := Install(Options{})
 		assert.Error(t, err)
 		// Should be a meaningful error
 		assert.NotNil(t, err)
@@ -162,7 +162,7 @@ func TestServiceFunctionSignatures(t *testing.T) {
 		var err error
 
 		// Install function
-		err = Install()
+		err = Install(Options{})
 		assert.True(t, err == nil || err != nil)
 
 		// Uninstal function (note the typo in the original)
@@ -298,7 +298,7 @@ func TestCallLaunchCtlWithVariousArgs(t *testing.T) {
 
 func TestInstallFailsOutsideBinDir(t *testing.T) {
 	t.Run("InstallFromWrongDirectory", func(t *testing.T) {
-		err := Install()
+		err := Install(Options{})
 		// Should fail because the test binary is not in the BinDir
 		assert.Error(t, err)
 		assert.Contains(t, err.Error(), "service can be installed only from app home directory")
@@ -330,7 +330,7 @@ func TestUninstalBehavior(t *testing.T) {
 func TestErrorHandling(t *testing.T) {
 	t.Run("ErrorTypes", func(t *testing.T) {
 		// Test that functions return appropriate error types
-		err := Install()
+		err := Install(Options{})
 		if err != nil {
 			assert.NotEmpty(t, err.Error())
 		}
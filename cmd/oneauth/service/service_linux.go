@@ -1,17 +1,213 @@
 package service
 
-func Install() error {
-	return ErrNotImplemented
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/vitalvas/oneauth/cmd/oneauth/paths"
+)
+
+const serviceName = "oneauth"
+
+//go:embed template/systemd.service
+var serviceTmpl string
+
+//go:embed template/systemd.socket
+var socketTmpl string
+
+// runCommand runs a command and returns its output, it is replaced in tests
+var runCommand = func(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to run %s: %w: %s", name, err, strings.TrimSpace(string(out)))
+	}
+
+	return string(out), nil
+}
+
+func callSystemctl(args ...string) error {
+	_, err := runCommand("systemctl", append([]string{"--user"}, args...)...)
+	return err
+}
+
+func Install(opts Options) error {
+	execPath, err := serviceExecutable()
+	if err != nil {
+		return err
+	}
+
+	servicePath, err := paths.ServiceFile(serviceName)
+	if err != nil {
+		return fmt.Errorf("failed to get service path: %w", err)
+	}
+
+	socketPath, err := paths.SocketFile(serviceName)
+	if err != nil {
+		return fmt.Errorf("failed to get socket path: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(servicePath), 0700); err != nil {
+		return fmt.Errorf("failed to create service directory: %w", err)
+	}
+
+	// the units are stopped so the new ones are used, like launchctl unload on darwin
+	if units := installedUnits(); len(units) > 0 {
+		if err := callSystemctl(append([]string{"stop"}, units...)...); err != nil {
+			return fmt.Errorf("failed to stop service: %w", err)
+		}
+	}
+
+	info := unitInfo{
+		Name:       serviceName,
+		Args:       []string{execPath, "agent", "--handoff"},
+		Socket:     opts.SocketPath != "",
+		SocketPath: opts.SocketPath,
+	}
+
+	if err := writeUnit(servicePath, serviceTmpl, info); err != nil {
+		return fmt.Errorf("failed to write service file: %w", err)
+	}
+
+	units := []string{serviceName + ".service"}
+
+	if info.Socket {
+		if err := writeUnit(socketPath, socketTmpl, info); err != nil {
+			return fmt.Errorf("failed to write socket file: %w", err)
+		}
+
+		units = append([]string{serviceName + ".socket"}, units...)
+	} else if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove socket file: %w", err)
+	}
+
+	if err := callSystemctl("daemon-reload"); err != nil {
+		return fmt.Errorf("failed to reload systemd: %w", err)
+	}
+
+	if err := callSystemctl(append([]string{"enable", "--now"}, units...)...); err != nil {
+		return fmt.Errorf("failed to enable service: %w", err)
+	}
+
+	return nil
 }
 
 func Uninstal() error {
-	return ErrNotImplemented
+	if err := checkService(); err == ErrNotInstalled {
+		return nil
+	}
+
+	if err := callSystemctl(append([]string{"disable", "--now"}, installedUnits()...)...); err != nil {
+		return fmt.Errorf("failed to disable service: %w", err)
+	}
+
+	for _, file := range []func(string) (string, error){paths.ServiceFile, paths.SocketFile} {
+		path, err := file(serviceName)
+		if err != nil {
+			return fmt.Errorf("failed to get service path: %w", err)
+		}
+
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove service file: %w", err)
+		}
+	}
+
+	if err := callSystemctl("daemon-reload"); err != nil {
+		return fmt.Errorf("failed to reload systemd: %w", err)
+	}
+
+	return nil
 }
 
 func Restart() error {
-	return ErrNotImplemented
+	if err := checkService(); err == ErrNotInstalled {
+		return nil
+	}
+
+	if err := callSystemctl("restart", serviceName+".service"); err != nil {
+		return fmt.Errorf("failed to restart service: %w", err)
+	}
+
+	return nil
+}
+
+func checkService() error {
+	servicePath, err := paths.ServiceFile(serviceName)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(servicePath); err != nil {
+		return ErrNotInstalled
+	}
+
+	return nil
 }
 
-func SetSSHAuthSock(_ string) error {
+// installedUnits returns the units of the service that have a unit file, the socket comes first
+func installedUnits() []string {
+	var units []string
+
+	if path, err := paths.SocketFile(serviceName); err == nil {
+		if _, err := os.Stat(path); err == nil {
+			units = append(units, serviceName+".socket")
+		}
+	}
+
+	if checkService() == nil {
+		units = append(units, serviceName+".service")
+	}
+
+	return units
+}
+
+type unitInfo struct {
+	Name       string
+	Args       []string
+	Socket     bool
+	SocketPath string
+}
+
+var unitFuncs = template.FuncMap{
+	"escape": escapeSpecifiers,
+	"quote": func(arg string) string {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", "$$").Replace(escapeSpecifiers(arg)) + `"`
+	},
+}
+
+// escapeSpecifiers keeps systemd from expanding % in a path
+func escapeSpecifiers(value string) string {
+	return strings.ReplaceAll(value, "%", "%%")
+}
+
+func writeUnit(path, tmpl string, info unitInfo) error {
+	unitTmpl, err := template.New(filepath.Base(path)).Funcs(unitFuncs).Parse(tmpl)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := unitTmpl.Execute(file, info); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// SetSSHAuthSock publishes the agent socket to the systemd user manager, so services and new sessions see it
+func SetSSHAuthSock(socketPath string) error {
+	if err := callSystemctl("set-environment", "SSH_AUTH_SOCK="+socketPath); err != nil {
+		return fmt.Errorf("failed to set SSH_AUTH_SOCK: %w", err)
+	}
+
 	return nil
 }
@@ -0,0 +1,191 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubSystemd points the service at a temporary home and records the commands instead of running them
+func stubSystemd(t *testing.T) (string, *[]string) {
+	t.Helper()
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	origExecutable, origRun, origStart := executablePath, runCommand, startDetached
+	t.Cleanup(func() { executablePath, runCommand, startDetached = origExecutable, origRun, origStart })
+
+	executablePath = func() (string, error) {
+		return filepath.Join(home, ".oneauth", "bin", "oneauth"), nil
+	}
+
+	var calls []string
+
+	runCommand = func(name string, args ...string) (string, error) {
+		calls = append(calls, name+" "+strings.Join(args, " "))
+		return "", nil
+	}
+
+	startDetached = func(env []string, name string, args ...string) error {
+		calls = append(calls, "detached "+strings.Join(env, " ")+" "+name+" "+strings.Join(args, " "))
+		return nil
+	}
+
+	return home, &calls
+}
+
+func TestInstall(t *testing.T) {
+	t.Run("Service", func(t *testing.T) {
+		home, calls := stubSystemd(t)
+
+		require.NoError(t, Install(Options{}))
+
+		assert.Equal(t, []string{
+			"systemctl --user daemon-reload",
+			"systemctl --user enable --now oneauth.service",
+		}, *calls)
+
+		unit, err := os.ReadFile(filepath.Join(home, ".config", "systemd", "user", "oneauth.service"))
+		require.NoError(t, err)
+		assert.Contains(t, string(unit), `ExecStart="`+filepath.Join(home, ".oneauth", "bin", "oneauth")+`" "agent" "--handoff"`)
+		assert.Contains(t, string(unit), "Restart=always\n")
+		assert.NotContains(t, string(unit), "oneauth.socket")
+
+		assert.NoFileExists(t, filepath.Join(home, ".config", "systemd", "user", "oneauth.socket"))
+	})
+
+	t.Run("Socket", func(t *testing.T) {
+		home, calls := stubSystemd(t)
+
+		require.NoError(t, Install(Options{SocketPath: "/run/user/1000/50%/agent.sock"}))
+
+		assert.Equal(t, []string{
+			"systemctl --user daemon-reload",
+			"systemctl --user enable --now oneauth.socket oneauth.service",
+		}, *calls)
+
+		unit, err := os.ReadFile(filepath.Join(home, ".config", "systemd", "user", "oneauth.socket"))
+		require.NoError(t, err)
+		assert.Contains(t, string(unit), "ListenStream=/run/user/1000/50%%/agent.sock\n")
+		assert.Contains(t, string(unit), "FileDescriptorName=main\n")
+
+		unit, err = os.ReadFile(filepath.Join(home, ".config", "systemd", "user", "oneauth.service"))
+		require.NoError(t, err)
+		assert.Contains(t, string(unit), "Requires=oneauth.socket\n")
+	})
+
+	t.Run("Reinstall", func(t *testing.T) {
+		home, calls := stubSystemd(t)
+
+		require.NoError(t, Install(Options{SocketPath: "/tmp/agent.sock"}))
+		*calls = nil
+
+		require.NoError(t, Install(Options{}))
+
+		assert.Equal(t, []string{
+			"systemctl --user stop oneauth.socket oneauth.service",
+			"systemctl --user daemon-reload",
+			"systemctl --user enable --now oneauth.service",
+		}, *calls)
+
+		assert.NoFileExists(t, filepath.Join(home, ".config", "systemd", "user", "oneauth.socket"))
+	})
+
+	t.Run("OutsideBinDir", func(t *testing.T) {
+		_, calls := stubSystemd(t)
+
+		executablePath = func() (string, error) { return "/usr/bin/oneauth", nil }
+
+		assert.EqualError(t, Install(Options{}), "service can be installed only from app home directory")
+		assert.Empty(t, *calls)
+	})
+
+	t.Run("SystemctlFails", func(t *testing.T) {
+		stubSystemd(t)
+
+		runCommand = func(_ string, _ ...string) (string, error) {
+			return "", errors.New("no user manager")
+		}
+
+		assert.ErrorContains(t, Install(Options{}), "failed to reload systemd: no user manager")
+	})
+}
+
+func TestUninstal(t *testing.T) {
+	t.Run("Installed", func(t *testing.T) {
+		home, calls := stubSystemd(t)
+
+		require.NoError(t, Install(Options{SocketPath: "/tmp/agent.sock"}))
+		*calls = nil
+
+		require.NoError(t, Uninstal())
+
+		assert.Equal(t, []string{
+			"systemctl --user disable --now oneauth.socket oneauth.service",
+			"systemctl --user daemon-reload",
+		}, *calls)
+
+		assert.NoFileExists(t, filepath.Join(home, ".config", "systemd", "user", "oneauth.service"))
+		assert.NoFileExists(t, filepath.Join(home, ".config", "systemd", "user", "oneauth.socket"))
+	})
+
+	t.Run("NotInstalled", func(t *testing.T) {
+		_, calls := stubSystemd(t)
+
+		require.NoError(t, Uninstal())
+		assert.Empty(t, *calls)
+	})
+}
+
+func TestRestart(t *testing.T) {
+	t.Run("Installed", func(t *testing.T) {
+		_, calls := stubSystemd(t)
+
+		require.NoError(t, Install(Options{}))
+		*calls = nil
+
+		require.NoError(t, Restart())
+		assert.Equal(t, []string{"systemctl --user restart oneauth.service"}, *calls)
+	})
+
+	t.Run("NotInstalled", func(t *testing.T) {
+		_, calls := stubSystemd(t)
+
+		require.NoError(t, Restart())
+		assert.Empty(t, *calls)
+	})
+}
+
+func TestSetSSHAuthSock(t *testing.T) {
+	_, calls := stubSystemd(t)
+
+	require.NoError(t, SetSSHAuthSock("/home/user/.oneauth/ssh-agent.sock"))
+	assert.Equal(t, []string{"systemctl --user set-environment SSH_AUTH_SOCK=/home/user/.oneauth/ssh-agent.sock"}, *calls)
+}
+
+func TestHandoff(t *testing.T) {
+	t.Run("Installed", func(t *testing.T) {
+		home, calls := stubSystemd(t)
+
+		require.NoError(t, Install(Options{}))
+		*calls = nil
+
+		require.NoError(t, Handoff("/tmp/config.yaml", "secret"))
+
+		execPath := filepath.Join(home, ".oneauth", "bin", "oneauth")
+		assert.Equal(t, []string{"detached ONEAUTH_HANDOFF_TOKEN=secret " + execPath + " --config /tmp/config.yaml agent --handoff"}, *calls)
+	})
+
+	t.Run("NotInstalled", func(t *testing.T) {
+		_, calls := stubSystemd(t)
+
+		assert.ErrorIs(t, Handoff("/tmp/config.yaml", "secret"), ErrNotInstalled)
+		assert.Empty(t, *calls)
+	})
+}
@@ -1,14 +1,21 @@
 package sshagent
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/vitalvas/oneauth/cmd/oneauth/config"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+	"github.com/vitalvas/oneauth/internal/audit"
 	"github.com/vitalvas/oneauth/internal/keystore"
 	"github.com/vitalvas/oneauth/internal/netutil"
+	"github.com/vitalvas/oneauth/internal/policy"
 	"github.com/vitalvas/oneauth/internal/yubikey"
 	"golang.org/x/crypto/ssh/agent"
 )
@@ -16,41 +23,107 @@ import (
 var _ agent.ExtendedAgent = &SSHAgent{}
 
 type SSHAgent struct {
-	yk   *yubikey.Yubikey
+	// yks are the attached YubiKeys, in the order they were attached
+	yks  []*yubikey.Yubikey
 	lock sync.Mutex
 
+	// absent are the serials of attached YubiKeys that are not plugged in
+	absent map[uint32]bool
+	// inventory caches the certificates of the plugged in YubiKeys by serial
+	inventory map[uint32][]yubikey.Cert
+	// readers are the PC/SC readers seen by the last presence check
+	readers        []string
+	presenceEvents []PresenceEvent
+
 	actions       Actions
 	log           *logrus.Entry
 	agentListener net.Listener
 
 	lockPassphrase []byte
+	lockPolicy     LockPolicy
+	// lockHook is called when a removed YubiKey locks the agent
+	lockHook func(reason string)
+	// lastActive is the time a key was last used or the agent was unlocked
+	lastActive time.Time
+
+	// localOnlySlots are hidden from forwarded agent connections
+	localOnlySlots []string
 
 	softKeys *keystore.Store
+	audit    *audit.Logger
+	access   netutil.Access
+
+	// pins are the PINs entered with pinentry, by serial
+	pins map[uint32]cachedPIN
+	// pinRetries are the PIN retries last seen on the cards, by serial
+	pinRetries map[uint32]int
+	// unlockAttempts delays the next unlock with the PIN after a wrong one
+	unlockAttempts pinAttempts
+
+	// cards serializes the YubiKey operations, timeout bounds a request waiting for the card
+	cards   cardWorker
+	timeout time.Duration
 }
 
 type Actions struct {
 	BeforeSignHook string
+	// Askpass is the program used to confirm keys added with `ssh-add -c`
+	Askpass string
+	// Policy decides whether a signature is allowed, nil allows everything
+	Policy *policy.Engine
+	// Pinentry asks for the YubiKey PIN when it is not in the OS keyring
+	Pinentry string
+	// PINCache keeps a PIN entered with pinentry in memory, zero does not cache it
+	PINCache time.Duration
+	// MinPINRetries is the number of PIN retries below which a stored PIN is not used, zero uses 2
+	MinPINRetries int
 }
 
-func New(serial uint32, log *logrus.Logger, config *config.Config) (*SSHAgent, error) {
-	yk, err := yubikey.OpenBySerial(serial)
-	if err != nil {
-		return nil, err
+// New opens the YubiKeys with the serials. Cards that are not plugged in are attached as absent,
+// they are opened by WatchYubikeys when they are plugged in.
+func New(serials []uint32, log *logrus.Logger, config *config.Config) (*SSHAgent, error) {
+	if len(serials) == 0 {
+		return nil, errors.New("yubikey serial is required")
 	}
 
-	contextLogger := log.WithFields(logrus.Fields{
-		"yubikey": serial,
-	})
+	yks := make([]*yubikey.Yubikey, 0, len(serials))
+	absent := make(map[uint32]bool)
+
+	for _, serial := range serials {
+		yk, err := yubikey.OpenBySerial(serial)
+		if err != nil {
+			log.WithField("yubikey", serial).Warnln("yubikey is not available:", err)
+
+			yk = &yubikey.Yubikey{Serial: serial}
+			absent[serial] = true
+		}
+
+		yks = append(yks, yk)
+	}
 
-	return &SSHAgent{
+	a := &SSHAgent{
 		actions: Actions{
 			BeforeSignHook: config.Keyring.BeforeSignHook,
+			Askpass:        config.Askpass,
+			Pinentry:       config.Pinentry.Program,
+			PINCache:       time.Duration(config.Pinentry.CacheSeconds) * time.Second,
+			MinPINRetries:  config.Keyring.Yubikey.MinPINRetries,
 		},
-		yk:  yk,
-		log: contextLogger,
+		yks:    yks,
+		absent: absent,
+		log:    logrus.NewEntry(log),
+
+		localOnlySlots: normalizeSlots(config.Keyring.Yubikey.LocalOnlySlots),
+		access:         config.Socket.Access,
+
+		softKeys:   keystore.New(config.Keyring.KeepKeySeconds),
+		timeout:    time.Duration(config.Keyring.SignTimeoutSeconds) * time.Second,
+		lastActive: time.Now(),
+	}
+
+	a.softKeys.SetEvictHandler(evictHandler(rpcapi.DefaultAgent, nil, a.log))
 
-		softKeys: keystore.New(config.Keyring.KeepKeySeconds),
-	}, nil
+	return a, nil
 }
 
 func (a *SSHAgent) Close() error {
@@ -75,6 +148,12 @@ func (a *SSHAgent) setListener(listener net.Listener) {
 	a.agentListener = listener
 }
 
+// SetListener serves an inherited socket, e.g. from systemd socket activation.
+// ListenAndServe does not create or remove the socket file then.
+func (a *SSHAgent) SetListener(listener net.Listener) {
+	a.setListener(listener)
+}
+
 func (a *SSHAgent) handleConn(conn net.Conn) {
 	defer conn.Close()
 
@@ -89,7 +168,28 @@ func (a *SSHAgent) handleConn(conn net.Conn) {
 		return
 	}
 
-	if err := agent.ServeAgent(a, conn); err != nil && err != io.EOF {
+	a.lock.Lock()
+	auditLog := a.audit
+	access := a.access
+	a.lock.Unlock()
+
+	if err := access.Check(creds); err != nil {
+		a.log.Warnln(err)
+		return
+	}
+
+	sess := newSession(creds)
+	defer sess.close()
+
+	sessAgent := &sessionAgent{
+		sessionBackend: a,
+		sess:           sess,
+		name:           rpcapi.DefaultAgent,
+		audit:          auditLog,
+		log:            a.log,
+	}
+
+	if err := serveAgent(sessAgent, conn); err != nil && err != io.EOF {
 		a.log.Println("Agent client connection ended with error:", err)
 	}
 }
@@ -99,8 +199,17 @@ func (a *SSHAgent) Shutdown() error {
 		return err
 	}
 
-	if a.yk != nil {
-		if err := a.yk.Close(); err != nil {
+	a.lock.Lock()
+	yks := a.yks
+	a.yks = nil
+	a.lock.Unlock()
+
+	// a request waiting for touch is not interrupted, the cards are closed after it
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownCardTimeout)
+	defer cancel()
+
+	for _, yk := range yks {
+		if err := a.cards.do(ctx, CardRequest{Operation: CardOpClose, Serial: yk.Serial}, yk.Close); err != nil {
 			return err
 		}
 	}
@@ -113,3 +222,77 @@ func (a *SSHAgent) Shutdown() error {
 
 	return nil
 }
+
+// normalizeSlots accepts slot names written as "95" or "0x95"
+func normalizeSlots(slots []string) []string {
+	out := make([]string, 0, len(slots))
+
+	for _, slot := range slots {
+		out = append(out, strings.TrimPrefix(strings.ToLower(strings.TrimSpace(slot)), "0x"))
+	}
+
+	return out
+}
+
+// SetActions replaces the actions used when signing
+func (a *SSHAgent) SetActions(actions Actions) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.actions = actions
+}
+
+// SetAccess replaces the rules checked for new connections
+func (a *SSHAgent) SetAccess(access netutil.Access) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.access = access
+}
+
+// SetAuditLogger sets the log that records requests of new connections
+func (a *SSHAgent) SetAuditLogger(logger *audit.Logger) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.audit = logger
+	a.softKeys.SetEvictHandler(evictHandler(rpcapi.DefaultAgent, logger, a.log))
+}
+
+// SetKeepKeySeconds changes how long idle keys added with ssh-add are kept
+func (a *SSHAgent) SetKeepKeySeconds(keepKeySeconds int64) {
+	a.softKeys.SetKeepKeySeconds(keepKeySeconds)
+}
+
+// SetLocalOnlySlots replaces the slots hidden from forwarded agent connections
+func (a *SSHAgent) SetLocalOnlySlots(slots []string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.localOnlySlots = normalizeSlots(slots)
+}
+
+// SetSignTimeout changes how long a request waits for the YubiKey, the PIN and touch. Zero uses the default.
+func (a *SSHAgent) SetSignTimeout(seconds int64) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.timeout = time.Duration(seconds) * time.Second
+}
+
+// signTimeout returns how long a request waits for the YubiKey
+func (a *SSHAgent) signTimeout() time.Duration {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.timeout <= 0 {
+		return defaultSignTimeout
+	}
+
+	return a.timeout
+}
+
+// PendingRequests returns the YubiKey requests that are queued or running, oldest first
+func (a *SSHAgent) PendingRequests() []CardRequest {
+	return a.cards.requests()
+}
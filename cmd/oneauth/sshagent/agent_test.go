@@ -30,17 +30,23 @@ func TestSSHAgent(t *testing.T) {
 		cfg := &config.Config{
 			Keyring: config.Keyring{BeforeSignHook: "echo test", KeepKeySeconds: 300},
 		}
-		agent, err := New(cards[0].Serial, logrus.New(), cfg)
+		agent, err := New([]uint32{cards[0].Serial}, logrus.New(), cfg)
 		require.NoError(t, err)
 		assert.Equal(t, "echo test", agent.actions.BeforeSignHook)
 		agent.Close()
 	}
 
-	// Test invalid creation
-	agent, err := New(999999, logrus.New(), &config.Config{})
+	// Test creation without a serial
+	agent, err := New(nil, logrus.New(), &config.Config{})
 	assert.Error(t, err)
 	assert.Nil(t, agent)
 
+	// Test creation with a YubiKey that is not plugged in
+	agent, err = New([]uint32{999999}, logrus.New(), &config.Config{})
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{999999}, agent.Serials())
+	assert.Equal(t, []uint32{999999}, agent.AbsentSerials())
+
 	// Test basic operations
 	testAgent := createTestAgent()
 	assert.NoError(t, testAgent.Close())
@@ -225,11 +231,10 @@ func TestSSHAgentShutdown(t *testing.T) {
 func TestSSHAgentListWithNilYubikey(t *testing.T) {
 	testAgent := createTestAgent()
 
-	t.Run("ListReturnsError", func(t *testing.T) {
+	t.Run("ListReturnsSoftKeys", func(t *testing.T) {
 		keys, err := testAgent.List()
-		assert.Error(t, err)
-		assert.Nil(t, keys)
-		assert.Contains(t, err.Error(), "no yubikey available")
+		assert.NoError(t, err)
+		assert.Empty(t, keys)
 	})
 }
 
@@ -317,6 +322,34 @@ func TestListenAndServeNilListener(t *testing.T) {
 	})
 }
 
+func TestSSHAgentSetters(t *testing.T) {
+	t.Run("SetActions", func(t *testing.T) {
+		testAgent := createTestAgent()
+
+		testAgent.SetActions(Actions{BeforeSignHook: "/bin/true", Askpass: "/usr/bin/ssh-askpass"})
+		assert.Equal(t, "/bin/true", testAgent.actions.BeforeSignHook)
+		assert.Equal(t, "/usr/bin/ssh-askpass", testAgent.actions.Askpass)
+	})
+
+	t.Run("SetLocalOnlySlots", func(t *testing.T) {
+		testAgent := createTestAgent()
+
+		testAgent.SetLocalOnlySlots([]string{"9A", "95"})
+		assert.Equal(t, normalizeSlots([]string{"9A", "95"}), testAgent.localOnlySlots)
+
+		testAgent.SetLocalOnlySlots(nil)
+		assert.Empty(t, testAgent.localOnlySlots)
+	})
+
+	t.Run("SetKeepKeySeconds", func(t *testing.T) {
+		testAgent := createTestAgent()
+
+		assert.NotPanics(t, func() {
+			testAgent.SetKeepKeySeconds(60)
+		})
+	})
+}
+
 // Helper functions
 func createTestAgent() *SSHAgent {
 	return &SSHAgent{
@@ -1,30 +1,213 @@
 package sshagent
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"path/filepath"
+	"time"
 
 	"github.com/vitalvas/oneauth/internal/keyring"
+	"github.com/vitalvas/oneauth/internal/netutil"
+	"github.com/vitalvas/oneauth/internal/pinentry"
 )
 
 var (
-	ErrPINNotFound = errors.New("pin not found")
+	ErrPINNotFound   = errors.New("pin not found")
+	ErrPINBlocked    = errors.New("yubikey PIN is blocked, use `oneauth yubikey unblock-pin`")
+	ErrPINRetriesLow = errors.New("too few PIN retries left to use the stored PIN")
 )
 
-func (a *SSHAgent) askPINPrompt() (string, error) {
-	pin, err := keyring.Get(fmt.Sprintf("yubikey:%d:%s", a.yk.Serial, "pin"))
+var (
+	keyringGet    = keyring.Get
+	keyringDelete = keyring.Delete
+	getPIN        = pinentry.GetPIN
+)
+
+type cachedPIN struct {
+	pin       string
+	expiresAt time.Time
+}
+
+// defaultMinPINRetries is the number of PIN retries below which a stored PIN is not used
+const defaultMinPINRetries = 2
+
+// pinSource tells where the PIN given to the card came from
+type pinSource int
+
+const (
+	pinFromKeyring pinSource = iota + 1
+	pinFromCache
+	pinFromPinentry
+)
+
+// pinRequest describes the key a PIN is asked for
+type pinRequest struct {
+	serial uint32
+	slot   string
+	peer   netutil.UnixCreds
+	// retries left on the card, negative when unknown
+	retries int
+}
+
+// minPINRetries is the number of PIN retries below which a PIN is only taken from pinentry
+func (a *SSHAgent) minPINRetries() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.actions.MinPINRetries <= 0 {
+		return defaultMinPINRetries
+	}
+
+	return a.actions.MinPINRetries
+}
+
+// askPINPrompt returns the PIN from the OS keyring, from the cache or asks for it with pinentry.
+// A stored or cached PIN is not used when fewer than min_pin_retries are left, as a stale one
+// would block the card, the PIN is asked for with pinentry instead.
+func (a *SSHAgent) askPINPrompt(ctx context.Context, req pinRequest) (string, pinSource, error) {
+	if req.retries == 0 {
+		return "", 0, fmt.Errorf("%w: %d", ErrPINBlocked, req.serial)
+	}
+
+	a.lock.Lock()
+	program := a.actions.Pinentry
+	cacheFor := a.actions.PINCache
+	cached, cachedOK := a.pins[req.serial]
+	a.lock.Unlock()
+
+	minRetries := a.minPINRetries()
+	lowRetries := req.retries >= 0 && req.retries < minRetries
+
+	if lowRetries {
+		a.log.WithField("yubikey", req.serial).Warnf("only %d PIN retries left, the stored PIN is not used", req.retries)
+	} else {
+		pin, err := keyringGet(fmt.Sprintf("yubikey:%d:%s", req.serial, "pin"))
+
+		if err == nil {
+			a.log.Println("used PIN from keyring")
+
+			return pin, pinFromKeyring, nil
+		}
+
+		if err != keyring.ErrNotFound {
+			return "", 0, err
+		}
+
+		if cachedOK && time.Now().Before(cached.expiresAt) {
+			a.log.Println("used cached PIN")
+
+			return cached.pin, pinFromCache, nil
+		}
+	}
+
+	if program == "" {
+		if lowRetries {
+			return "", 0, fmt.Errorf("%w: %d left on yubikey %d", ErrPINRetriesLow, req.retries, req.serial)
+		}
+
+		return "", 0, ErrPINNotFound
+	}
+
+	pinReq := pinentry.Request{
+		Title:       "OneAuth",
+		Description: pinDescription(req),
+		Prompt:      "PIN:",
+	}
+
+	if lowRetries {
+		pinReq.Error = fmt.Sprintf("Only %d PIN attempts left", req.retries)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		pinReq.Timeout = time.Until(deadline)
+	}
+
+	pin, err := getPIN(ctx, program, pinReq)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to ask for PIN: %w", err)
+	}
+
+	if cacheFor > 0 {
+		a.lock.Lock()
+
+		if a.pins == nil {
+			a.pins = make(map[uint32]cachedPIN)
+		}
+
+		a.pins[req.serial] = cachedPIN{pin: pin, expiresAt: time.Now().Add(cacheFor)}
+
+		a.lock.Unlock()
+	}
+
+	return pin, pinFromPinentry, nil
+}
+
+// rejectedPIN drops the PIN the card refused, so it is not tried again.
+// A PIN from the OS keyring is deleted from it, as it is stale.
+func (a *SSHAgent) rejectedPIN(serial uint32, source pinSource) {
+	a.forgetPIN(serial)
+
+	if source != pinFromKeyring {
+		return
+	}
+
+	if err := keyringDelete(fmt.Sprintf("yubikey:%d:%s", serial, "pin")); err != nil {
+		a.log.WithField("yubikey", serial).Warnln("failed to delete the rejected PIN from keyring:", err)
+		return
+	}
+
+	a.log.WithField("yubikey", serial).Warnln("the PIN in keyring was rejected by the card and deleted")
+}
+
+// setPINRetries records the PIN retries last seen on the card, it must be called with the agent lock held
+func (a *SSHAgent) setPINRetries(serial uint32, retries int) {
+	if a.pinRetries == nil {
+		a.pinRetries = make(map[uint32]int)
+	}
+
+	a.pinRetries[serial] = retries
+}
+
+// PINBlockedSerials returns the attached YubiKeys whose PIN was found blocked
+func (a *SSHAgent) PINBlockedSerials() []uint32 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
 
-	if err == nil {
-		a.log.Println("used PIN from keyring")
+	var serials []uint32
 
-		return pin, nil
+	for _, yk := range a.yks {
+		if retries, ok := a.pinRetries[yk.Serial]; ok && retries == 0 {
+			serials = append(serials, yk.Serial)
+		}
 	}
 
-	if err != keyring.ErrNotFound {
-		return "", err
+	return serials
+}
+
+// forgetPIN drops the cached PIN of the YubiKey, e.g. after it was rejected by the card
+func (a *SSHAgent) forgetPIN(serial uint32) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	delete(a.pins, serial)
+}
+
+func pinDescription(req pinRequest) string {
+	desc := fmt.Sprintf("Enter the PIN of YubiKey %d to use the key in slot %s.", req.serial, req.slot)
+
+	if req.peer.PID > 0 {
+		process := fmt.Sprintf("process %d", req.peer.PID)
+		if req.peer.Exe != "" {
+			process = fmt.Sprintf("%s (pid %d)", filepath.Base(req.peer.Exe), req.peer.PID)
+		}
+
+		desc += "\nRequested by " + process + "."
 	}
 
-	// TODO: prompt for PIN
+	if req.retries >= 0 {
+		desc += fmt.Sprintf("\n%d attempts left before the PIN is blocked.", req.retries)
+	}
 
-	return "", ErrPINNotFound
+	return desc
 }
@@ -1,9 +1,18 @@
 package sshagent
 
 import (
+	"context"
+	"errors"
 	"testing"
+	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vitalvas/oneauth/internal/keyring"
+	"github.com/vitalvas/oneauth/internal/netutil"
+	"github.com/vitalvas/oneauth/internal/pinentry"
+	"github.com/vitalvas/oneauth/internal/yubikey"
 )
 
 func TestErrPINNotFound(t *testing.T) {
@@ -15,3 +24,232 @@ func TestErrPINNotFound(t *testing.T) {
 		assert.NotNil(t, ErrPINNotFound)
 	})
 }
+
+func TestAskPINPrompt(t *testing.T) {
+	get := keyringGet
+	keyringGet = func(_ string) (string, error) {
+		return "", keyring.ErrNotFound
+	}
+
+	entry := getPIN
+
+	t.Cleanup(func() {
+		keyringGet = get
+		getPIN = entry
+	})
+
+	var requests []pinentry.Request
+
+	getPIN = func(_ context.Context, program string, req pinentry.Request) (string, error) {
+		assert.Equal(t, "pinentry-test", program)
+		requests = append(requests, req)
+
+		return "123456", nil
+	}
+
+	req := pinRequest{
+		serial:  42,
+		slot:    "9a",
+		peer:    netutil.UnixCreds{PID: 1234, Exe: "/usr/bin/ssh"},
+		retries: 2,
+	}
+
+	newAgent := func(actions Actions) *SSHAgent {
+		return &SSHAgent{
+			actions: actions,
+			log:     logrus.NewEntry(logrus.New()),
+		}
+	}
+
+	t.Run("NoPinentry", func(t *testing.T) {
+		_, _, err := newAgent(Actions{}).askPINPrompt(context.Background(), req)
+		assert.ErrorIs(t, err, ErrPINNotFound)
+	})
+
+	t.Run("Prompt", func(t *testing.T) {
+		requests = nil
+		testAgent := newAgent(Actions{Pinentry: "pinentry-test"})
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		pin, source, err := testAgent.askPINPrompt(ctx, req)
+		require.NoError(t, err)
+		assert.Equal(t, "123456", pin)
+		assert.Equal(t, pinFromPinentry, source)
+
+		require.Len(t, requests, 1)
+		assert.Contains(t, requests[0].Description, "YubiKey 42")
+		assert.Contains(t, requests[0].Description, "slot 9a")
+		assert.Contains(t, requests[0].Description, "ssh (pid 1234)")
+		assert.Contains(t, requests[0].Description, "2 attempts left")
+		assert.Greater(t, requests[0].Timeout, 50*time.Second)
+
+		// the PIN is not cached without cache_seconds
+		_, _, err = testAgent.askPINPrompt(context.Background(), req)
+		require.NoError(t, err)
+		assert.Len(t, requests, 2)
+	})
+
+	t.Run("Cache", func(t *testing.T) {
+		requests = nil
+		testAgent := newAgent(Actions{Pinentry: "pinentry-test", PINCache: time.Minute})
+
+		for range 3 {
+			pin, _, err := testAgent.askPINPrompt(context.Background(), req)
+			require.NoError(t, err)
+			assert.Equal(t, "123456", pin)
+		}
+
+		assert.Len(t, requests, 1)
+
+		testAgent.forgetPIN(42)
+
+		_, _, err := testAgent.askPINPrompt(context.Background(), req)
+		require.NoError(t, err)
+		assert.Len(t, requests, 2)
+
+		// locking the agent drops the cached PINs
+		require.NoError(t, testAgent.Lock([]byte("secret")))
+		assert.Empty(t, testAgent.pins)
+	})
+
+	t.Run("CacheExpired", func(t *testing.T) {
+		requests = nil
+		testAgent := newAgent(Actions{Pinentry: "pinentry-test", PINCache: time.Minute})
+		testAgent.pins = map[uint32]cachedPIN{42: {pin: "654321", expiresAt: time.Now().Add(-time.Second)}}
+
+		pin, _, err := testAgent.askPINPrompt(context.Background(), req)
+		require.NoError(t, err)
+		assert.Equal(t, "123456", pin)
+		assert.Len(t, requests, 1)
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		getPIN = func(_ context.Context, _ string, _ pinentry.Request) (string, error) {
+			return "", pinentry.ErrCancelled
+		}
+
+		testAgent := newAgent(Actions{Pinentry: "pinentry-test", PINCache: time.Minute})
+
+		_, _, err := testAgent.askPINPrompt(context.Background(), req)
+		assert.True(t, errors.Is(err, pinentry.ErrCancelled))
+		assert.Empty(t, testAgent.pins)
+	})
+}
+
+func TestPINRetryGuard(t *testing.T) {
+	get := keyringGet
+	del := keyringDelete
+	entry := getPIN
+
+	var deleted []string
+
+	keyringGet = func(_ string) (string, error) {
+		return "111111", nil
+	}
+
+	keyringDelete = func(user string) error {
+		deleted = append(deleted, user)
+		return nil
+	}
+
+	getPIN = func(_ context.Context, _ string, req pinentry.Request) (string, error) {
+		assert.Equal(t, "Only 1 PIN attempts left", req.Error)
+		return "222222", nil
+	}
+
+	t.Cleanup(func() {
+		keyringGet = get
+		keyringDelete = del
+		getPIN = entry
+	})
+
+	req := pinRequest{serial: 42, slot: "9a", retries: 3}
+
+	newAgent := func(actions Actions) *SSHAgent {
+		return &SSHAgent{
+			actions: actions,
+			log:     logrus.NewEntry(logrus.New()),
+		}
+	}
+
+	t.Run("StoredPIN", func(t *testing.T) {
+		pin, source, err := newAgent(Actions{}).askPINPrompt(context.Background(), req)
+		require.NoError(t, err)
+		assert.Equal(t, "111111", pin)
+		assert.Equal(t, pinFromKeyring, source)
+	})
+
+	t.Run("LowRetries", func(t *testing.T) {
+		req := req
+		req.retries = 1
+
+		// the stored PIN is not used, without pinentry it is an error
+		_, _, err := newAgent(Actions{}).askPINPrompt(context.Background(), req)
+		assert.ErrorIs(t, err, ErrPINRetriesLow)
+
+		pin, source, err := newAgent(Actions{Pinentry: "pinentry-test"}).askPINPrompt(context.Background(), req)
+		require.NoError(t, err)
+		assert.Equal(t, "222222", pin)
+		assert.Equal(t, pinFromPinentry, source)
+	})
+
+	t.Run("Threshold", func(t *testing.T) {
+		req := req
+		req.retries = 2
+
+		_, _, err := newAgent(Actions{MinPINRetries: 3}).askPINPrompt(context.Background(), req)
+		assert.ErrorIs(t, err, ErrPINRetriesLow)
+
+		_, source, err := newAgent(Actions{}).askPINPrompt(context.Background(), req)
+		require.NoError(t, err)
+		assert.Equal(t, pinFromKeyring, source)
+	})
+
+	t.Run("Blocked", func(t *testing.T) {
+		req := req
+		req.retries = 0
+
+		_, _, err := newAgent(Actions{Pinentry: "pinentry-test"}).askPINPrompt(context.Background(), req)
+		assert.ErrorIs(t, err, ErrPINBlocked)
+		assert.Contains(t, err.Error(), "oneauth yubikey unblock-pin")
+	})
+
+	t.Run("RejectedPIN", func(t *testing.T) {
+		deleted = nil
+		testAgent := newAgent(Actions{})
+		testAgent.pins = map[uint32]cachedPIN{42: {pin: "222222", expiresAt: time.Now().Add(time.Minute)}}
+
+		testAgent.rejectedPIN(42, pinFromPinentry)
+		assert.Empty(t, testAgent.pins)
+		assert.Empty(t, deleted)
+
+		testAgent.rejectedPIN(42, pinFromKeyring)
+		assert.Equal(t, []string{"yubikey:42:pin"}, deleted)
+	})
+
+	t.Run("BlockedSerials", func(t *testing.T) {
+		testAgent := newAgent(Actions{})
+		testAgent.yks = []*yubikey.Yubikey{{Serial: 42}, {Serial: 43}}
+
+		testAgent.lock.Lock()
+		testAgent.setPINRetries(42, 0)
+		testAgent.setPINRetries(43, 3)
+		testAgent.lock.Unlock()
+
+		assert.Equal(t, []uint32{42}, testAgent.PINBlockedSerials())
+
+		// the card may be unblocked through the control API
+		require.NoError(t, testAgent.WithYubikey(context.Background(), 42, func(_ *yubikey.Yubikey) error {
+			return nil
+		}))
+		assert.Empty(t, testAgent.PINBlockedSerials())
+	})
+}
+
+func TestPINDescription(t *testing.T) {
+	desc := pinDescription(pinRequest{serial: 42, slot: "9a", peer: netutil.UnixCreds{PID: 7}, retries: -1})
+
+	assert.Equal(t, "Enter the PIN of YubiKey 42 to use the key in slot 9a.\nRequested by process 7.", desc)
+}
@@ -0,0 +1,137 @@
+package sshagent
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/vitalvas/oneauth/internal/audit"
+	"github.com/vitalvas/oneauth/internal/keystore"
+	"github.com/vitalvas/oneauth/internal/tools"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// event returns an audit event with the peer of the connection filled in
+func (s *sessionAgent) event(op audit.Operation) audit.Event {
+	event := audit.Event{
+		Operation: op,
+		Agent:     s.name,
+		PID:       s.sess.peer.PID,
+		UID:       s.sess.peer.UID,
+		Exe:       s.sess.peer.Exe,
+		Forwarded: s.sess.forwarded(),
+	}
+
+	if len(s.sess.hops) > 0 {
+		event.DestinationHostKey = ssh.FingerprintSHA256(s.sess.hops[len(s.sess.hops)-1].HostKey)
+	}
+
+	return event
+}
+
+func (s *sessionAgent) record(event audit.Event, err error) {
+	event.Success = err == nil
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	if err := s.audit.Log(event); err != nil && s.log != nil {
+		s.log.Warnln("failed to write audit log:", err)
+	}
+}
+
+func (s *sessionAgent) Add(key agent.AddedKey) error {
+	event := s.event(audit.OpAdd)
+
+	if signer, err := ssh.NewSignerFromKey(key.PrivateKey); err == nil {
+		event.Fingerprint = ssh.FingerprintSHA256(signer.PublicKey())
+	}
+
+	err := s.sessionBackend.Add(key)
+	s.record(event, err)
+
+	return err
+}
+
+func (s *sessionAgent) Remove(key ssh.PublicKey) error {
+	event := s.event(audit.OpRemove)
+	event.Fingerprint = ssh.FingerprintSHA256(key)
+
+	err := s.sessionBackend.Remove(key)
+	s.record(event, err)
+
+	return err
+}
+
+func (s *sessionAgent) RemoveAll() error {
+	err := s.sessionBackend.RemoveAll()
+	s.record(s.event(audit.OpRemoveAll), err)
+
+	return err
+}
+
+func (s *sessionAgent) Lock(passphrase []byte) error {
+	err := s.sessionBackend.Lock(passphrase)
+	s.record(s.event(audit.OpLock), err)
+
+	return err
+}
+
+func (s *sessionAgent) Unlock(passphrase []byte) error {
+	err := s.sessionBackend.Unlock(passphrase)
+	s.record(s.event(audit.OpUnlock), err)
+
+	return err
+}
+
+func (s *sessionAgent) signEvent(reqKey ssh.PublicKey, data []byte) audit.Event {
+	event := s.event(audit.OpSign)
+	event.Fingerprint = ssh.FingerprintSHA256(reqKey)
+	event.PayloadHash = tools.FastHash(data)
+
+	if req, err := parseUserauthRequest(data); err == nil {
+		event.DestinationUser = req.User
+
+		if req.HostKey != nil {
+			event.DestinationHostKey = ssh.FingerprintSHA256(req.HostKey)
+		}
+	}
+
+	return event
+}
+
+// evictHandler logs the soft keys the key store of the agent evicted.
+// It does not take the agent lock, the store calls it from List and Get.
+func evictHandler(agentName string, logger *audit.Logger, log *logrus.Entry) func(keystore.Eviction) {
+	return func(ev keystore.Eviction) {
+		log.Printf("evicted soft key %s: %s", ev.Name, ev.Reason)
+
+		err := logger.Log(audit.Event{
+			Time:        ev.Time.UTC(),
+			Operation:   audit.OpEvict,
+			Agent:       agentName,
+			Success:     true,
+			Fingerprint: ev.Fingerprint,
+			Reason:      ev.Reason,
+		})
+		if err != nil {
+			log.Warnln("failed to write audit log:", err)
+		}
+	}
+}
+
+// recordAutoLock logs a lock without a client, e.g. of an idle agent. A lock requested through the control API
+// is recorded there with the client of the control socket.
+func recordAutoLock(agentName string, logger *audit.Logger, log *logrus.Entry, reason string) {
+	if reason == LockReasonRequest {
+		return
+	}
+
+	err := logger.Log(audit.Event{
+		Operation: audit.OpLock,
+		Agent:     agentName,
+		Success:   true,
+		Reason:    reason,
+	})
+	if err != nil {
+		log.Warnln("failed to write audit log:", err)
+	}
+}
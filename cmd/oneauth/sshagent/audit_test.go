@@ -0,0 +1,154 @@
+package sshagent
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vitalvas/oneauth/internal/audit"
+	"github.com/vitalvas/oneauth/internal/netutil"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// serveAuditedSession serves the backend with an audit log and returns a client and the log path
+func serveAuditedSession(t *testing.T, backend sessionBackend, peer netutil.UnixCreds) (agent.ExtendedAgent, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	logger, err := audit.New(path, 0, 0)
+	require.NoError(t, err)
+
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+		logger.Close()
+	})
+
+	go agent.ServeAgent(&sessionAgent{
+		sessionBackend: backend,
+		sess:           newSession(peer),
+		name:           "test",
+		audit:          logger,
+		log:            logrus.NewEntry(logrus.New()),
+	}, server)
+
+	return agent.NewClient(client), path
+}
+
+func TestSessionAgentAudit(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+
+	fp := ssh.FingerprintSHA256(signer.PublicKey())
+
+	t.Run("RecordsOperations", func(t *testing.T) {
+		exe, err := os.Executable()
+		require.NoError(t, err)
+
+		softAgent := NewSoftAgent("test", 0, logrus.New())
+		client, path := serveAuditedSession(t, softAgent, netutil.UnixCreds{PID: os.Getpid(), UID: os.Getuid(), Exe: exe})
+
+		require.NoError(t, client.Add(agent.AddedKey{PrivateKey: priv}))
+
+		keys, err := client.List()
+		require.NoError(t, err)
+		require.Len(t, keys, 1)
+
+		_, err = client.Sign(signer.PublicKey(), []byte("data"))
+		require.NoError(t, err)
+
+		require.NoError(t, client.Lock([]byte("pass")))
+		assert.Error(t, client.Unlock([]byte("wrong")))
+		require.NoError(t, client.Unlock([]byte("pass")))
+		require.NoError(t, client.Remove(signer.PublicKey()))
+		require.NoError(t, client.RemoveAll())
+
+		events, err := audit.Read(path, audit.Filter{})
+		require.NoError(t, err)
+		require.Len(t, events, 8)
+
+		ops := make([]audit.Operation, 0, len(events))
+		for _, event := range events {
+			ops = append(ops, event.Operation)
+
+			assert.Equal(t, "test", event.Agent)
+			assert.Equal(t, os.Getpid(), event.PID)
+			assert.Equal(t, os.Getuid(), event.UID)
+			assert.Equal(t, exe, event.Exe)
+		}
+
+		assert.Equal(t, []audit.Operation{
+			audit.OpAdd, audit.OpList, audit.OpSign, audit.OpLock,
+			audit.OpUnlock, audit.OpUnlock, audit.OpRemove, audit.OpRemoveAll,
+		}, ops)
+
+		assert.Equal(t, fp, events[0].Fingerprint)
+		assert.Equal(t, 1, events[1].Keys)
+		assert.Equal(t, fp, events[2].Fingerprint)
+		assert.NotEmpty(t, events[2].PayloadHash)
+		assert.True(t, events[2].Success)
+		assert.False(t, events[4].Success)
+		assert.Equal(t, "incorrect passphrase", events[4].Error)
+	})
+
+	t.Run("RecordsDestination", func(t *testing.T) {
+		softAgent := NewSoftAgent("test", 0, logrus.New())
+		client, path := serveAuditedSession(t, softAgent, netutil.UnixCreds{PID: -1, UID: -1})
+
+		require.NoError(t, client.Add(agent.AddedKey{PrivateKey: priv}))
+
+		hostKey, hostSigner := createTestSigner(t)
+		sessionID := []byte("session-id")
+
+		_, err := client.Extension(sessionBindExtension, marshalSessionBind(t, hostSigner, sessionID, false))
+		require.NoError(t, err)
+
+		_, err = client.Sign(signer.PublicKey(), marshalUserauthRequest(sessionID, "alice", signer.PublicKey(), nil))
+		require.NoError(t, err)
+
+		events, err := audit.Read(path, audit.Filter{Operation: audit.OpSign})
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+
+		assert.Equal(t, "alice", events[0].DestinationUser)
+		assert.Equal(t, ssh.FingerprintSHA256(hostKey), events[0].DestinationHostKey)
+		assert.False(t, events[0].Forwarded)
+		assert.Empty(t, events[0].Exe)
+	})
+
+	t.Run("RecordsRefusedSign", func(t *testing.T) {
+		softAgent := NewSoftAgent("test", 0, logrus.New())
+		client, path := serveAuditedSession(t, softAgent, netutil.UnixCreds{PID: -1, UID: -1})
+
+		_, err := client.Sign(signer.PublicKey(), []byte("data"))
+		require.Error(t, err)
+
+		events, err := audit.Read(path, audit.Filter{FailedOnly: true})
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+		assert.Equal(t, audit.OpSign, events[0].Operation)
+		assert.Contains(t, events[0].Error, "unknown key")
+	})
+
+	t.Run("WithoutAuditLog", func(t *testing.T) {
+		softAgent := NewSoftAgent("test", 0, logrus.New())
+		client := serveSession(t, softAgent)
+
+		require.NoError(t, client.Add(agent.AddedKey{PrivateKey: priv}))
+
+		_, err := client.Sign(signer.PublicKey(), []byte("data"))
+		require.NoError(t, err)
+	})
+}
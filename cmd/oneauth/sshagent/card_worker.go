@@ -0,0 +1,139 @@
+package sshagent
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// maxCardRequests bounds the YubiKey requests waiting for the card, including the running one
+	maxCardRequests = 32
+
+	// defaultSignTimeout limits how long a request waits for the card, the PIN and touch
+	defaultSignTimeout = 60 * time.Second
+
+	// shutdownCardTimeout limits how long the shutdown waits for a running request before closing the cards
+	shutdownCardTimeout = 5 * time.Second
+)
+
+// Operations of the card requests
+const (
+	CardOpSign    = "sign"
+	CardOpList    = "list"
+	CardOpOpen    = "open"
+	CardOpClose   = "close"
+	CardOpControl = "control"
+)
+
+// CardRequest describes a YubiKey operation that is queued or running
+type CardRequest struct {
+	ID        uint64
+	Operation string
+	Serial    uint32
+	Slot      string
+	// Fingerprint, PID and Exe are set for sign requests
+	Fingerprint string
+	PID         int
+	Exe         string
+
+	QueuedAt time.Time
+	// StartedAt is zero while the request waits for the card
+	StartedAt time.Time
+}
+
+type cardJob struct {
+	req  CardRequest
+	ctx  context.Context
+	fn   func() error
+	done chan error
+}
+
+// cardWorker runs YubiKey operations one at a time on its own goroutine, so a request
+// waiting for the PIN or touch does not hold the agent lock
+type cardWorker struct {
+	mu      sync.Mutex
+	jobs    chan *cardJob
+	pending []*cardJob
+	nextID  uint64
+}
+
+// do runs fn on the worker and waits until it returns or ctx is done.
+// A request that is cancelled while queued is skipped, a running one can not be interrupted
+// and its result is dropped.
+func (w *cardWorker) do(ctx context.Context, req CardRequest, fn func() error) error {
+	w.mu.Lock()
+
+	if w.jobs == nil {
+		w.jobs = make(chan *cardJob, maxCardRequests)
+		go w.run()
+	}
+
+	if len(w.pending) >= maxCardRequests {
+		w.mu.Unlock()
+		return ErrCardQueueFull
+	}
+
+	w.nextID++
+	req.ID = w.nextID
+	req.QueuedAt = time.Now()
+
+	job := &cardJob{
+		req:  req,
+		ctx:  ctx,
+		fn:   fn,
+		done: make(chan error, 1),
+	}
+
+	w.pending = append(w.pending, job)
+	w.jobs <- job
+
+	w.mu.Unlock()
+
+	select {
+	case err := <-job.done:
+		return err
+
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *cardWorker) run() {
+	for job := range w.jobs {
+		if err := job.ctx.Err(); err != nil {
+			w.finish(job, err)
+			continue
+		}
+
+		w.mu.Lock()
+		job.req.StartedAt = time.Now()
+		w.mu.Unlock()
+
+		w.finish(job, job.fn())
+	}
+}
+
+func (w *cardWorker) finish(job *cardJob, err error) {
+	w.mu.Lock()
+	w.pending = slices.DeleteFunc(w.pending, func(row *cardJob) bool {
+		return row == job
+	})
+	w.mu.Unlock()
+
+	job.done <- err
+}
+
+// requests returns the queued and running requests, oldest first
+func (w *cardWorker) requests() []CardRequest {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	out := make([]CardRequest, 0, len(w.pending))
+	for _, job := range w.pending {
+		out = append(out, job.req)
+	}
+
+	return out
+}
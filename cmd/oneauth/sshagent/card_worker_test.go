@@ -0,0 +1,114 @@
+package sshagent
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCardWorker(t *testing.T) {
+	t.Run("Order", func(t *testing.T) {
+		var worker cardWorker
+
+		var order []int
+
+		for i := range 3 {
+			err := worker.do(context.Background(), CardRequest{Operation: CardOpList}, func() error {
+				order = append(order, i)
+				return nil
+			})
+			require.NoError(t, err)
+		}
+
+		assert.Equal(t, []int{0, 1, 2}, order)
+		assert.Empty(t, worker.requests())
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		var worker cardWorker
+
+		errCard := errors.New("card failed")
+
+		err := worker.do(context.Background(), CardRequest{Operation: CardOpSign}, func() error {
+			return errCard
+		})
+		assert.ErrorIs(t, err, errCard)
+	})
+
+	t.Run("QueueAndCancel", func(t *testing.T) {
+		var worker cardWorker
+
+		started := make(chan struct{})
+		release := make(chan struct{})
+
+		go worker.do(context.Background(), CardRequest{Operation: CardOpSign, Serial: 42, Slot: "9a"}, func() error {
+			close(started)
+			<-release
+			return nil
+		})
+
+		<-started
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		called := false
+		done := make(chan error, 1)
+
+		go func() {
+			done <- worker.do(ctx, CardRequest{Operation: CardOpSign, Serial: 42, Slot: "9c"}, func() error {
+				called = true
+				return nil
+			})
+		}()
+
+		require.Eventually(t, func() bool {
+			return len(worker.requests()) == 2
+		}, time.Second, time.Millisecond)
+
+		requests := worker.requests()
+		assert.Equal(t, "9a", requests[0].Slot)
+		assert.False(t, requests[0].StartedAt.IsZero())
+		assert.Equal(t, "9c", requests[1].Slot)
+		assert.True(t, requests[1].StartedAt.IsZero())
+		assert.Less(t, requests[0].ID, requests[1].ID)
+
+		// the client went away while the request waited for the card
+		cancel()
+		assert.ErrorIs(t, <-done, context.Canceled)
+
+		close(release)
+
+		require.Eventually(t, func() bool {
+			return len(worker.requests()) == 0
+		}, time.Second, time.Millisecond)
+
+		assert.False(t, called)
+	})
+
+	t.Run("QueueFull", func(t *testing.T) {
+		var worker cardWorker
+
+		release := make(chan struct{})
+		defer close(release)
+
+		for range maxCardRequests {
+			go worker.do(context.Background(), CardRequest{Operation: CardOpSign}, func() error {
+				<-release
+				return nil
+			})
+		}
+
+		require.Eventually(t, func() bool {
+			return len(worker.requests()) == maxCardRequests
+		}, time.Second, time.Millisecond)
+
+		err := worker.do(context.Background(), CardRequest{Operation: CardOpSign}, func() error {
+			return nil
+		})
+		assert.ErrorIs(t, err, ErrCardQueueFull)
+	})
+}
@@ -0,0 +1,54 @@
+package sshagent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/vitalvas/oneauth/internal/agentkey"
+	"github.com/vitalvas/oneauth/internal/netutil"
+)
+
+var (
+	ErrConfirmUnavailable = errors.New("key requires confirmation, but askpass is not configured")
+	ErrConfirmDenied      = errors.New("key use was not confirmed")
+)
+
+// confirmKeyUse asks the user to approve a signature with a key added by `ssh-add -c`.
+// The askpass program follows the ssh-askpass convention: exit code 0 means approved.
+func confirmKeyUse(askpass string, key *agentkey.Key, peer netutil.UnixCreds) error {
+	return confirmUse(askpass, key.Name(), key.Fingerprint(), key.AgentKey().Comment, peer)
+}
+
+// confirmUse asks the user to approve a signature with the key
+func confirmUse(askpass, name, fingerprint, comment string, peer netutil.UnixCreds) error {
+	if askpass == "" {
+		return ErrConfirmUnavailable
+	}
+
+	prompt := fmt.Sprintf("Allow use of key %s?\nKey fingerprint %s.", name, fingerprint)
+	if peer.PID > 0 {
+		prompt += fmt.Sprintf("\nRequested by process %d (uid %d).", peer.PID, peer.UID)
+	}
+
+	cmd := exec.Command(askpass, prompt) //nolint:gosec
+	cmd.Env = append(os.Environ(),
+		"SSH_ASKPASS_PROMPT=confirm",
+		fmt.Sprintf("ONEAUTH_KEY_FINGERPRINT=%s", fingerprint),
+		fmt.Sprintf("ONEAUTH_KEY_COMMENT=%s", comment),
+		fmt.Sprintf("ONEAUTH_PEER_PID=%d", peer.PID),
+		fmt.Sprintf("ONEAUTH_PEER_UID=%d", peer.UID),
+	)
+
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return ErrConfirmDenied
+		}
+
+		return fmt.Errorf("failed to run askpass: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package sshagent
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vitalvas/oneauth/internal/agentkey"
+	"github.com/vitalvas/oneauth/internal/audit"
+	"github.com/vitalvas/oneauth/internal/netutil"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func createConfirmKey(t *testing.T) *agentkey.Key {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	key, err := agentkey.NewKey(agent.AddedKey{
+		PrivateKey:       priv,
+		Comment:          "confirm-key",
+		ConfirmBeforeUse: true,
+	})
+	require.NoError(t, err)
+
+	return key
+}
+
+func TestConfirmKeyUse(t *testing.T) {
+	key := createConfirmKey(t)
+	peer := netutil.UnixCreds{PID: 1234, UID: 1000}
+
+	t.Run("NoAskpass", func(t *testing.T) {
+		err := confirmKeyUse("", key, peer)
+		assert.ErrorIs(t, err, ErrConfirmUnavailable)
+	})
+
+	t.Run("Approved", func(t *testing.T) {
+		assert.NoError(t, confirmKeyUse("true", key, peer))
+	})
+
+	t.Run("Denied", func(t *testing.T) {
+		err := confirmKeyUse("false", key, peer)
+		assert.ErrorIs(t, err, ErrConfirmDenied)
+	})
+
+	t.Run("MissingProgram", func(t *testing.T) {
+		err := confirmKeyUse("/nonexistent/askpass", key, peer)
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, ErrConfirmDenied)
+		assert.Contains(t, err.Error(), "failed to run askpass")
+	})
+}
+
+func TestSignSoftKey(t *testing.T) {
+	key := createConfirmKey(t)
+
+	t.Run("ConfirmDenied", func(t *testing.T) {
+		sig, err := signSoftKey(Actions{Askpass: "false"}, &session{}, &audit.Event{}, key, []byte("data"), 0, testLogEntry())
+		assert.ErrorIs(t, err, ErrConfirmDenied)
+		assert.Nil(t, sig)
+	})
+
+	t.Run("ConfirmApproved", func(t *testing.T) {
+		sig, err := signSoftKey(Actions{Askpass: "true"}, &session{}, &audit.Event{}, key, []byte("data"), 0, testLogEntry())
+		require.NoError(t, err)
+		assert.NoError(t, key.AgentKey().Verify([]byte("data"), sig))
+	})
+}
@@ -7,4 +7,15 @@ var (
 	ErrNoPrivateKey         = errors.New("no private key")
 
 	ErrAgentLocked = errors.New("method is not allowed on agent locked")
+	ErrNoYubikey   = errors.New("no yubikey available")
+
+	ErrPINUnlockUnavailable = errors.New("agent can not be unlocked with a yubikey PIN")
+	ErrPINUnlockRetriesLow  = errors.New("too few PIN retries left to unlock with the PIN, reset them with `oneauth yubikey change-pin`")
+	ErrPINUnlockBackoff     = errors.New("too many wrong PINs")
+	ErrLockChanged          = errors.New("agent was unlocked or locked again while the unlock was checked")
+
+	ErrYubikeyAttached    = errors.New("yubikey is already attached")
+	ErrYubikeyNotAttached = errors.New("yubikey is not attached")
+	ErrYubikeyAbsent      = errors.New("yubikey is not plugged in")
+	ErrCardQueueFull      = errors.New("too many pending yubikey requests")
 )
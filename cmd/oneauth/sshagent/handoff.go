@@ -0,0 +1,185 @@
+package sshagent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+	"github.com/vitalvas/oneauth/internal/agentkey"
+	"github.com/vitalvas/oneauth/internal/keystore"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Listener returns the socket the agent serves, nil before ListenAndServe
+func (a *SSHAgent) Listener() net.Listener {
+	return a.getListener()
+}
+
+// Handoff returns the keys added with ssh-add for the agent process that takes over,
+// a locked agent is not handed off
+func (a *SSHAgent) Handoff() (rpcapi.HandoffAgent, error) {
+	if a.Locked() {
+		return rpcapi.HandoffAgent{}, ErrAgentLocked
+	}
+
+	keys, err := handoffKeys(a.softKeys, time.Now())
+	if err != nil {
+		return rpcapi.HandoffAgent{}, err
+	}
+
+	return rpcapi.HandoffAgent{Keys: keys}, nil
+}
+
+// Adopt adds the keys passed by the agent process that handed off
+func (a *SSHAgent) Adopt(state rpcapi.HandoffAgent) error {
+	return adoptKeys(a.softKeys, state.Keys, time.Now())
+}
+
+// Listener returns the socket the agent serves, nil before ListenAndServe
+func (a *SoftAgent) Listener() net.Listener {
+	return a.getListener()
+}
+
+// Handoff returns the keys added with ssh-add for the agent process that takes over,
+// a locked agent is not handed off
+func (a *SoftAgent) Handoff() (rpcapi.HandoffAgent, error) {
+	a.lock.Lock()
+	locked := a.lockPassphrase != nil
+	persist := a.persist
+	a.lock.Unlock()
+
+	if locked {
+		return rpcapi.HandoffAgent{}, ErrAgentLocked
+	}
+
+	keys, err := handoffKeys(a.softKeys, time.Now())
+	if err != nil {
+		return rpcapi.HandoffAgent{}, err
+	}
+
+	return rpcapi.HandoffAgent{
+		Keys:   keys,
+		Loaded: persist != nil && persist.loaded.Load(),
+	}, nil
+}
+
+// Adopt adds the keys passed by the agent process that handed off. They are not persisted again,
+// and the persisted keys are not unwrapped on the card when the other process had loaded them.
+func (a *SoftAgent) Adopt(state rpcapi.HandoffAgent) error {
+	a.lock.Lock()
+	persist := a.persist
+	a.lock.Unlock()
+
+	if err := adoptKeys(a.softKeys, state.Keys, time.Now()); err != nil {
+		return err
+	}
+
+	if persist != nil && state.Loaded {
+		persist.loaded.Store(true)
+	}
+
+	return nil
+}
+
+func handoffKeys(store *keystore.Store, now time.Time) ([]rpcapi.HandoffKey, error) {
+	var out []rpcapi.HandoffKey
+
+	for _, key := range store.List() {
+		if key.Expired(now) {
+			continue
+		}
+
+		privateKey, constraints, err := key.Export()
+		if errors.Is(err, agentkey.ErrKeyDestroyed) {
+			// removed while the keys were listed
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to export key %s: %w", key.Fingerprint(), err)
+		}
+
+		handed := rpcapi.HandoffKey{
+			PrivateKey:       privateKey,
+			Comment:          key.AgentKey().Comment,
+			ConfirmBeforeUse: key.ConfirmBeforeUse(),
+		}
+
+		for _, ext := range constraints {
+			handed.Constraints = append(handed.Constraints, rpcapi.HandoffConstraint{
+				Name:    ext.ExtensionName,
+				Details: ext.ExtensionDetails,
+			})
+		}
+
+		if expiresAt := key.ExpiresAt(); !expiresAt.IsZero() {
+			handed.ExpiresAt = &expiresAt
+		}
+
+		out = append(out, handed)
+	}
+
+	return out, nil
+}
+
+// adoptKeys adds the passed keys to the store, keys whose lifetime ended meanwhile are dropped
+func adoptKeys(store *keystore.Store, keys []rpcapi.HandoffKey, now time.Time) error {
+	for _, handed := range keys {
+		added, ok, err := adoptedKey(handed, now)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			continue
+		}
+
+		key, err := agentkey.NewKey(added)
+		if err != nil {
+			return fmt.Errorf("invalid handed off key: %w", err)
+		}
+
+		if !store.Add(key) {
+			key.Destroy()
+		}
+	}
+
+	return nil
+}
+
+func adoptedKey(handed rpcapi.HandoffKey, now time.Time) (agent.AddedKey, bool, error) {
+	defer clear(handed.PrivateKey)
+
+	added := agent.AddedKey{
+		Comment:          handed.Comment,
+		ConfirmBeforeUse: handed.ConfirmBeforeUse,
+	}
+
+	if handed.ExpiresAt != nil {
+		remaining := handed.ExpiresAt.Sub(now)
+		if remaining <= 0 {
+			return agent.AddedKey{}, false, nil
+		}
+
+		added.LifetimeSecs = uint32((remaining + time.Second - 1) / time.Second)
+	}
+
+	priv, err := ssh.ParseRawPrivateKey(handed.PrivateKey)
+	if err != nil {
+		return agent.AddedKey{}, false, fmt.Errorf("invalid handed off key: %w", err)
+	}
+
+	added.PrivateKey = priv
+
+	for _, ext := range handed.Constraints {
+		added.ConstraintExtensions = append(added.ConstraintExtensions, agent.ConstraintExtension{
+			ExtensionName:    ext.Name,
+			ExtensionDetails: ext.Details,
+		})
+	}
+
+	return added, true, nil
+}
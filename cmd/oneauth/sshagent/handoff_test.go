@@ -0,0 +1,85 @@
+package sshagent
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestSoftAgentHandoff(t *testing.T) {
+	t.Run("Keys", func(t *testing.T) {
+		oldAgent := NewSoftAgent("work", 0, logrus.New())
+
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+
+		require.NoError(t, oldAgent.Add(agent.AddedKey{
+			PrivateKey:       priv,
+			Comment:          "expiring",
+			ConfirmBeforeUse: true,
+			LifetimeSecs:     300,
+		}))
+		addTestKey(t, oldAgent, "plain")
+
+		state, err := oldAgent.Handoff()
+		require.NoError(t, err)
+		require.Len(t, state.Keys, 2)
+
+		newAgent := NewSoftAgent("work", 0, logrus.New())
+		require.NoError(t, newAgent.Adopt(state))
+
+		keys := newAgent.SoftKeys()
+		require.Len(t, keys, 2)
+
+		byComment := map[string]int{}
+		for i, key := range keys {
+			byComment[key.AgentKey().Comment] = i
+		}
+
+		expiring := keys[byComment["expiring"]]
+		assert.True(t, expiring.ConfirmBeforeUse())
+		assert.WithinDuration(t, time.Now().Add(300*time.Second), expiring.ExpiresAt(), 2*time.Second)
+
+		pub, err := ssh.NewPublicKey(priv.Public())
+		require.NoError(t, err)
+		assert.Equal(t, ssh.FingerprintSHA256(pub), expiring.Fingerprint())
+
+		assert.True(t, keys[byComment["plain"]].ExpiresAt().IsZero())
+	})
+
+	t.Run("ExpiredMeanwhile", func(t *testing.T) {
+		expired := time.Now().Add(-time.Second)
+
+		newAgent := NewSoftAgent("work", 0, logrus.New())
+		require.NoError(t, newAgent.Adopt(rpcapi.HandoffAgent{
+			Keys: []rpcapi.HandoffKey{{Comment: "gone", ExpiresAt: &expired}},
+		}))
+
+		assert.Empty(t, newAgent.SoftKeys())
+	})
+
+	t.Run("InvalidKey", func(t *testing.T) {
+		newAgent := NewSoftAgent("work", 0, logrus.New())
+
+		err := newAgent.Adopt(rpcapi.HandoffAgent{
+			Keys: []rpcapi.HandoffKey{{PrivateKey: []byte("garbage")}},
+		})
+		assert.ErrorContains(t, err, "invalid handed off key")
+	})
+
+	t.Run("Locked", func(t *testing.T) {
+		oldAgent := NewSoftAgent("work", 0, logrus.New())
+		require.NoError(t, oldAgent.Lock([]byte("secret")))
+
+		_, err := oldAgent.Handoff()
+		assert.ErrorIs(t, err, ErrAgentLocked)
+	})
+}
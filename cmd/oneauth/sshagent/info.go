@@ -0,0 +1,325 @@
+package sshagent
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/vitalvas/oneauth/internal/agentkey"
+	"github.com/vitalvas/oneauth/internal/yubikey"
+	"golang.org/x/crypto/ssh"
+)
+
+// SlotKey is a public key stored in a YubiKey PIV slot
+type SlotKey struct {
+	Serial    uint32
+	Slot      yubikey.Slot
+	PublicKey ssh.PublicKey
+	Comment   string
+}
+
+// Serial returns the serial number of the first YubiKey used by the agent, or zero when none is open
+func (a *SSHAgent) Serial() uint32 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if len(a.yks) == 0 {
+		return 0
+	}
+
+	return a.yks[0].Serial
+}
+
+// Locked reports whether the agent was locked with `ssh-add -x`
+func (a *SSHAgent) Locked() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.lockPassphrase != nil
+}
+
+// PINUnlock reports whether the agent can be unlocked with the YubiKey PIN, the PIN is checked by the YubiKey itself
+func (a *SSHAgent) PINUnlock() bool {
+	return true
+}
+
+// SlotKeys returns the keys from the slots of every attached YubiKey served over SSH
+func (a *SSHAgent) SlotKeys() ([]SlotKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), a.signTimeout())
+	defer cancel()
+
+	return a.slotKeys(ctx)
+}
+
+// slotKeys must be called without the agent lock held.
+// A card that fails is skipped, so one unplugged YubiKey does not hide the keys of the others.
+func (a *SSHAgent) slotKeys(ctx context.Context) ([]SlotKey, error) {
+	inventory, err := a.slotInventory(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		keys    []SlotKey
+		lastErr error
+		listed  int
+	)
+
+	for _, card := range inventory {
+		cardKeys, err := sshSlotKeys(card.yk.Serial, card.certs)
+		if err != nil {
+			a.log.WithField("yubikey", card.yk.Serial).Warnln("failed to list keys:", err)
+			lastErr = err
+			continue
+		}
+
+		keys = append(keys, cardKeys...)
+		listed++
+	}
+
+	if listed == 0 {
+		return nil, lastErr
+	}
+
+	return keys, nil
+}
+
+// cardSlots are the certificates of a plugged in YubiKey
+type cardSlots struct {
+	yk    *yubikey.Yubikey
+	certs []yubikey.Cert
+}
+
+// slotInventory returns the certificates of the plugged in YubiKeys, a card that fails is skipped
+func (a *SSHAgent) slotInventory(ctx context.Context) ([]cardSlots, error) {
+	a.lock.Lock()
+	yks := a.presentYubikeys()
+	a.lock.Unlock()
+
+	if len(yks) == 0 {
+		return nil, ErrNoYubikey
+	}
+
+	var (
+		inventory []cardSlots
+		lastErr   error
+	)
+
+	for _, yk := range yks {
+		certs, err := a.cardCerts(ctx, yk)
+		if err != nil {
+			a.log.WithField("yubikey", yk.Serial).Warnln("failed to list keys:", err)
+			lastErr = err
+			continue
+		}
+
+		inventory = append(inventory, cardSlots{yk: yk, certs: certs})
+	}
+
+	if len(inventory) == 0 {
+		return nil, lastErr
+	}
+
+	return inventory, nil
+}
+
+// cardCerts returns the certificates of all slots of the YubiKey. They are read from the card once
+// on the card worker and cached until the card is removed or changed.
+func (a *SSHAgent) cardCerts(ctx context.Context, yk *yubikey.Yubikey) ([]yubikey.Cert, error) {
+	a.lock.Lock()
+	certs, ok := a.inventory[yk.Serial]
+	a.lock.Unlock()
+
+	if ok {
+		return certs, nil
+	}
+
+	var listed []yubikey.Cert
+
+	err := a.cards.do(ctx, CardRequest{Operation: CardOpList, Serial: yk.Serial}, func() error {
+		var err error
+		listed, err = yk.ListKeys(yubikey.AllSlots...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	// the card may have been removed or detached while it was read
+	if !a.absent[yk.Serial] && slices.Contains(a.yks, yk) {
+		if a.inventory == nil {
+			a.inventory = make(map[uint32][]yubikey.Cert)
+		}
+
+		a.inventory[yk.Serial] = listed
+	}
+
+	return listed, nil
+}
+
+// sshSlotKeys returns the keys from the slots served over SSH, in the order of yubikey.AllSSHSlots
+func sshSlotKeys(serial uint32, certs []yubikey.Cert) ([]SlotKey, error) {
+	keys := make([]SlotKey, 0, len(yubikey.AllSSHSlots))
+
+	for _, slot := range yubikey.AllSSHSlots {
+		idx := slices.IndexFunc(certs, func(cert yubikey.Cert) bool {
+			return cert.Slot == slot
+		})
+
+		if idx < 0 {
+			continue
+		}
+
+		cert := certs[idx]
+
+		pk, err := ssh.NewPublicKey(cert.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create ssh public key: %w", err)
+		}
+
+		keys = append(keys, SlotKey{
+			Serial:    serial,
+			Slot:      cert.Slot,
+			PublicKey: pk,
+			Comment:   fmt.Sprintf("YubiKey #%d PIV Slot 0x%s", serial, cert.Slot.PIVSlot.String()),
+		})
+	}
+
+	return keys, nil
+}
+
+// SoftKeys returns the keys added with ssh-add
+func (a *SSHAgent) SoftKeys() []*agentkey.Key {
+	if a.softKeys == nil {
+		return nil
+	}
+
+	return a.softKeys.List()
+}
+
+// RemoveAllSoftKeys removes the keys added with ssh-add and returns how many were removed
+func (a *SSHAgent) RemoveAllSoftKeys() (int, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.lockPassphrase != nil {
+		return 0, ErrAgentLocked
+	}
+
+	if a.softKeys == nil {
+		return 0, nil
+	}
+
+	removed := a.softKeys.Len()
+	a.softKeys.RemoveAll()
+
+	return removed, nil
+}
+
+// RemoveSoftKeys removes keys added with ssh-add by fingerprint and returns how many were removed
+func (a *SSHAgent) RemoveSoftKeys(fingerprints ...string) (int, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.lockPassphrase != nil {
+		return 0, ErrAgentLocked
+	}
+
+	if a.softKeys == nil {
+		return 0, nil
+	}
+
+	return removeSoftKeys(a.softKeys.Remove, fingerprints), nil
+}
+
+// Name returns the name of the agent from the config
+func (a *SoftAgent) Name() string {
+	return a.name
+}
+
+// Locked reports whether the agent was locked with `ssh-add -x`
+func (a *SoftAgent) Locked() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.lockPassphrase != nil
+}
+
+// SoftKeys returns the keys added with ssh-add that are in memory. Persisted keys are listed once
+// an SSH request loaded them, so the list does not unwrap the vault on the YubiKey.
+func (a *SoftAgent) SoftKeys() []*agentkey.Key {
+	return a.softKeys.List()
+}
+
+// RemoveAllSoftKeys removes the keys added with ssh-add and the persisted ones without loading them,
+// it returns how many were removed
+func (a *SoftAgent) RemoveAllSoftKeys() (int, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.lockPassphrase != nil {
+		return 0, ErrAgentLocked
+	}
+
+	var fingerprints []string
+	for _, key := range a.softKeys.List() {
+		fingerprints = append(fingerprints, key.Fingerprint())
+	}
+
+	a.softKeys.RemoveAll()
+
+	if a.persist == nil {
+		return len(fingerprints), nil
+	}
+
+	_, records, err := a.persist.vault.Records()
+	if err != nil {
+		return len(fingerprints), err
+	}
+
+	now := time.Now()
+
+	for _, record := range records {
+		if !record.Expired(now) && !slices.Contains(fingerprints, record.Fingerprint) {
+			fingerprints = append(fingerprints, record.Fingerprint)
+		}
+	}
+
+	return len(fingerprints), a.persist.vault.Clear()
+}
+
+// RemoveSoftKeys removes keys added with ssh-add by fingerprint and returns how many were removed
+func (a *SoftAgent) RemoveSoftKeys(fingerprints ...string) (int, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.lockPassphrase != nil {
+		return 0, ErrAgentLocked
+	}
+
+	removed := removeSoftKeys(a.softKeys.Remove, fingerprints)
+
+	if a.persist != nil {
+		if err := a.persist.vault.Delete(fingerprints...); err != nil {
+			return removed, err
+		}
+	}
+
+	return removed, nil
+}
+
+func removeSoftKeys(remove func(fp string) bool, fingerprints []string) int {
+	var removed int
+
+	for _, fp := range fingerprints {
+		if remove(fp) {
+			removed++
+		}
+	}
+
+	return removed
+}
@@ -0,0 +1,65 @@
+package sshagent
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestSSHAgentInfo(t *testing.T) {
+	testAgent := &SSHAgent{}
+
+	assert.Zero(t, testAgent.Serial())
+	assert.False(t, testAgent.Locked())
+	assert.Empty(t, testAgent.SoftKeys())
+
+	_, err := testAgent.SlotKeys()
+	assert.Error(t, err)
+
+	removed, err := testAgent.RemoveSoftKeys("SHA256:unknown")
+	assert.NoError(t, err)
+	assert.Zero(t, removed)
+}
+
+func TestSoftAgentInfo(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+
+	fp := ssh.FingerprintSHA256(signer.PublicKey())
+
+	t.Run("Name", func(t *testing.T) {
+		assert.Equal(t, "work", NewSoftAgent("work", 0, logrus.New()).Name())
+	})
+
+	t.Run("RemoveSoftKeys", func(t *testing.T) {
+		softAgent := NewSoftAgent("work", 0, logrus.New())
+		require.NoError(t, softAgent.Add(agent.AddedKey{PrivateKey: priv}))
+		require.Len(t, softAgent.SoftKeys(), 1)
+
+		removed, err := softAgent.RemoveSoftKeys(fp, "SHA256:unknown")
+		require.NoError(t, err)
+		assert.Equal(t, 1, removed)
+		assert.Empty(t, softAgent.SoftKeys())
+	})
+
+	t.Run("Locked", func(t *testing.T) {
+		softAgent := NewSoftAgent("work", 0, logrus.New())
+		require.NoError(t, softAgent.Add(agent.AddedKey{PrivateKey: priv}))
+		require.NoError(t, softAgent.Lock([]byte("secret")))
+
+		assert.True(t, softAgent.Locked())
+
+		_, err := softAgent.RemoveSoftKeys(fp)
+		assert.ErrorIs(t, err, ErrAgentLocked)
+		assert.Len(t, softAgent.SoftKeys(), 1)
+	})
+}
@@ -11,12 +11,6 @@ import (
 )
 
 func (a *SSHAgent) ListenAndServe(ctx context.Context, socketPath string) error {
-	defer func() {
-		if _, err := os.Stat(socketPath); err == nil {
-			os.Remove(socketPath)
-		}
-	}()
-
 	a.log.Println("listening ssh-agent on", socketPath)
 
 	// If no listener is set (normal case), create one
@@ -32,17 +26,18 @@ func (a *SSHAgent) ListenAndServe(ctx context.Context, socketPath string) error
 			return fmt.Errorf("failed to listen: %w", err)
 		}
 
+		// the socket file is removed when the listener is closed, unless it was handed off to another process
 		a.setListener(listener)
 
-		if err := os.Chmod(socketPath, 0600); err != nil {
-			return fmt.Errorf("failed to chmod: %w", err)
-		}
-
 		defer func() {
 			if l := a.getListener(); l != nil {
 				l.Close()
 			}
 		}()
+
+		if err := os.Chmod(socketPath, 0600); err != nil {
+			return fmt.Errorf("failed to chmod: %w", err)
+		}
 	}
 
 	// Start a goroutine to close the listener when context is cancelled
@@ -53,6 +48,12 @@ func (a *SSHAgent) ListenAndServe(ctx context.Context, socketPath string) error
 		}
 	}()
 
+	watchCtx, stopWatch := context.WithCancel(ctx)
+	defer stopWatch()
+
+	go watchIdle(watchCtx, a)
+	go a.softKeys.Run(watchCtx)
+
 	for {
 		listener := a.getListener()
 		if listener == nil {
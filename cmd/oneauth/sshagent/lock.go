@@ -0,0 +1,148 @@
+package sshagent
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/vitalvas/oneauth/internal/tools"
+)
+
+const (
+	LockReasonIdle           = "idle"
+	LockReasonYubikeyRemoved = "yubikey removed"
+	LockReasonRequest        = "control api"
+
+	idleCheckInterval = 15 * time.Second
+
+	// unlockTimeout bounds the PIN check on the YubiKey
+	unlockTimeout = 30 * time.Second
+
+	// a YubiKey PIN has 6 to 8 characters, other passphrases are not checked on the card
+	minPINLength = 6
+	maxPINLength = 8
+
+	// pinBackoff is the delay after a wrong PIN before the next unlock is checked on the card,
+	// it doubles with every wrong PIN up to maxPINBackoff
+	pinBackoff    = time.Second
+	maxPINBackoff = time.Minute
+)
+
+var (
+	// pinLock is the lock passphrase of an agent locked without one, only the YubiKey PIN unlocks it
+	pinLock = []byte{}
+)
+
+// LockPolicy decides when an agent locks itself and what unlocks it
+type LockPolicy struct {
+	// Idle locks the agent when no key was used for this long, zero never locks it
+	Idle time.Duration
+	// OnYubikeyRemoval locks the YubiKey agent when an attached YubiKey is removed
+	OnYubikeyRemoval bool
+	// UnlockWithPIN also accepts the YubiKey PIN for an agent locked with a passphrase
+	UnlockWithPIN bool
+	// WipeSoftKeys removes the keys added with ssh-add on lock, instead of hiding them
+	WipeSoftKeys bool
+}
+
+// pinVerifier checks a PIN on the YubiKey
+type pinVerifier func(ctx context.Context, pin string) error
+
+// sameLock reports whether the agent still holds the lock an unlock was checked against,
+// a lock set again while the PIN was checked has another passphrase slice
+func sameLock(current, checked []byte) bool {
+	if current == nil || checked == nil || len(current) != len(checked) {
+		return false
+	}
+
+	return len(current) == 0 || &current[0] == &checked[0]
+}
+
+// checkUnlock compares the passphrase with the lock, and checks it on the YubiKey when a PIN is accepted.
+// It must be called without the agent lock held, the PIN check waits for the card.
+func checkUnlock(lockPassphrase, passphrase []byte, policy LockPolicy, verifyPIN pinVerifier) error {
+	withPIN := len(lockPassphrase) == 0 || policy.UnlockWithPIN
+
+	if len(lockPassphrase) > 0 && subtle.ConstantTimeCompare(tools.EncodePassphrase(passphrase), lockPassphrase) == 1 {
+		return nil
+	}
+
+	// a mistyped passphrase must not use up the PIN retries
+	if !withPIN || len(passphrase) < minPINLength || len(passphrase) > maxPINLength {
+		return errors.New("incorrect passphrase")
+	}
+
+	if verifyPIN == nil {
+		return ErrPINUnlockUnavailable
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), unlockTimeout)
+	defer cancel()
+
+	return verifyPIN(ctx, string(passphrase))
+}
+
+// pinAttempts delays the PIN checks of unlock requests after a wrong PIN,
+// so a client can not use up the PIN retries of the card in a burst
+type pinAttempts struct {
+	lock     sync.Mutex
+	failures int
+	next     time.Time
+}
+
+// check returns an error while the delay after the last wrong PIN runs
+func (p *pinAttempts) check(now time.Time) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if now.Before(p.next) {
+		return fmt.Errorf("%w, try again in %s", ErrPINUnlockBackoff, p.next.Sub(now).Round(time.Second))
+	}
+
+	return nil
+}
+
+// record starts the delay after a wrong PIN, a correct PIN resets it
+func (p *pinAttempts) record(now time.Time, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if err == nil {
+		p.failures = 0
+		p.next = time.Time{}
+
+		return
+	}
+
+	p.failures++
+	p.next = now.Add(min(pinBackoff<<min(p.failures-1, 16), maxPINBackoff))
+}
+
+// idleLocker is an agent that locks itself when its keys are not used
+type idleLocker interface {
+	lockIfIdle(now time.Time)
+}
+
+// watchIdle checks the agent until ctx is done
+func watchIdle(ctx context.Context, agent idleLocker) {
+	ticker := time.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case now := <-ticker.C:
+			agent.lockIfIdle(now)
+		}
+	}
+}
+
+// idleFor reports whether an agent last used at lastActive is idle for the policy
+func (p LockPolicy) idleFor(lastActive, now time.Time) bool {
+	return p.Idle > 0 && !lastActive.IsZero() && now.Sub(lastActive) >= p.Idle
+}
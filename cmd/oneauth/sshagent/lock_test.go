@@ -0,0 +1,303 @@
+package sshagent
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vitalvas/oneauth/internal/audit"
+	"github.com/vitalvas/oneauth/internal/tools"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestCheckUnlock(t *testing.T) {
+	var checked []string
+
+	verifyPIN := func(_ context.Context, pin string) error {
+		checked = append(checked, pin)
+
+		if pin != "135790" {
+			return errors.New("wrong PIN")
+		}
+
+		return nil
+	}
+
+	locked := tools.EncodePassphrase([]byte("secret"))
+
+	t.Run("Passphrase", func(t *testing.T) {
+		checked = nil
+
+		assert.NoError(t, checkUnlock(locked, []byte("secret"), LockPolicy{}, verifyPIN))
+		assert.Error(t, checkUnlock(locked, []byte("135790"), LockPolicy{}, verifyPIN))
+		assert.Empty(t, checked)
+	})
+
+	t.Run("PassphraseOrPIN", func(t *testing.T) {
+		checked = nil
+
+		policy := LockPolicy{UnlockWithPIN: true}
+
+		assert.NoError(t, checkUnlock(locked, []byte("secret"), policy, verifyPIN))
+		assert.NoError(t, checkUnlock(locked, []byte("135790"), policy, verifyPIN))
+		assert.Error(t, checkUnlock(locked, []byte("000000"), policy, verifyPIN))
+
+		// a passphrase that can not be a PIN is not tried on the card
+		assert.Error(t, checkUnlock(locked, []byte("wrong passphrase"), policy, verifyPIN))
+		assert.Equal(t, []string{"135790", "000000"}, checked)
+	})
+
+	t.Run("PINLock", func(t *testing.T) {
+		checked = nil
+
+		assert.NoError(t, checkUnlock(pinLock, []byte("135790"), LockPolicy{}, verifyPIN))
+		assert.Error(t, checkUnlock(pinLock, []byte{}, LockPolicy{}, verifyPIN))
+		assert.ErrorIs(t, checkUnlock(pinLock, []byte("135790"), LockPolicy{}, nil), ErrPINUnlockUnavailable)
+		assert.Equal(t, []string{"135790"}, checked)
+	})
+}
+
+func TestPINAttempts(t *testing.T) {
+	var attempts pinAttempts
+
+	now := time.Now()
+	wrongPIN := errors.New("wrong PIN")
+
+	require.NoError(t, attempts.check(now))
+
+	attempts.record(now, wrongPIN)
+	assert.ErrorIs(t, attempts.check(now), ErrPINUnlockBackoff)
+	assert.NoError(t, attempts.check(now.Add(pinBackoff)))
+
+	// the delay doubles with every wrong PIN
+	attempts.record(now, wrongPIN)
+	assert.ErrorIs(t, attempts.check(now.Add(pinBackoff)), ErrPINUnlockBackoff)
+	assert.NoError(t, attempts.check(now.Add(2*pinBackoff)))
+
+	for range 20 {
+		attempts.record(now, wrongPIN)
+	}
+
+	assert.ErrorIs(t, attempts.check(now.Add(maxPINBackoff-time.Second)), ErrPINUnlockBackoff)
+	assert.NoError(t, attempts.check(now.Add(maxPINBackoff)))
+
+	attempts.record(now, nil)
+	assert.NoError(t, attempts.check(now))
+}
+
+func TestSoftAgentAutoLock(t *testing.T) {
+	addKey := func(t *testing.T, testAgent *SoftAgent) ssh.PublicKey {
+		t.Helper()
+
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+
+		require.NoError(t, testAgent.Add(agent.AddedKey{PrivateKey: priv, Comment: "soft"}))
+
+		pub, err := ssh.NewPublicKey(&priv.PublicKey)
+		require.NoError(t, err)
+
+		return pub
+	}
+
+	verifyPIN := func(_ context.Context, pin string) error {
+		if pin != "135790" {
+			return errors.New("wrong PIN")
+		}
+
+		return nil
+	}
+
+	t.Run("WithoutPINVerifier", func(t *testing.T) {
+		testAgent := NewSoftAgent("test", 0, logrus.New())
+
+		assert.ErrorIs(t, testAgent.AutoLock(LockReasonRequest), ErrPINUnlockUnavailable)
+		assert.False(t, testAgent.Locked())
+	})
+
+	t.Run("UnlockWithPIN", func(t *testing.T) {
+		testAgent := NewSoftAgent("test", 0, logrus.New())
+		testAgent.SetPINVerifier(verifyPIN)
+		addKey(t, testAgent)
+
+		require.NoError(t, testAgent.AutoLock(LockReasonRequest))
+		assert.True(t, testAgent.Locked())
+		assert.ErrorIs(t, testAgent.AutoLock(LockReasonRequest), ErrAgentLocked)
+
+		_, err := testAgent.List()
+		assert.ErrorIs(t, err, ErrAgentLocked)
+
+		assert.Error(t, testAgent.Unlock([]byte("000000")))
+		assert.True(t, testAgent.Locked())
+
+		require.NoError(t, testAgent.Unlock([]byte("135790")))
+
+		// the keys are only hidden while the agent is locked
+		keys, err := testAgent.List()
+		require.NoError(t, err)
+		assert.Len(t, keys, 1)
+	})
+
+	t.Run("WipeSoftKeys", func(t *testing.T) {
+		testAgent := NewSoftAgent("test", 0, logrus.New())
+		testAgent.SetLockPolicy(LockPolicy{WipeSoftKeys: true})
+		addKey(t, testAgent)
+
+		require.NoError(t, testAgent.Lock([]byte("secret")))
+		require.NoError(t, testAgent.Unlock([]byte("secret")))
+
+		keys, err := testAgent.List()
+		require.NoError(t, err)
+		assert.Empty(t, keys)
+	})
+
+	t.Run("Idle", func(t *testing.T) {
+		testAgent := NewSoftAgent("test", 0, logrus.New())
+		testAgent.SetLockPolicy(LockPolicy{Idle: time.Minute})
+		pub := addKey(t, testAgent)
+
+		// the agent is locked only when it can be unlocked with the PIN
+		testAgent.lockIfIdle(time.Now().Add(time.Hour))
+		assert.False(t, testAgent.Locked())
+
+		testAgent.SetPINVerifier(verifyPIN)
+
+		_, err := testAgent.Sign(pub, []byte("data"))
+		require.NoError(t, err)
+
+		testAgent.lockIfIdle(time.Now().Add(30 * time.Second))
+		assert.False(t, testAgent.Locked())
+
+		testAgent.lockIfIdle(time.Now().Add(2 * time.Minute))
+		assert.True(t, testAgent.Locked())
+	})
+
+	t.Run("LockChangedWhileUnlocking", func(t *testing.T) {
+		entered := make(chan struct{})
+		release := make(chan struct{})
+
+		var calls atomic.Int32
+
+		testAgent := NewSoftAgent("test", 0, logrus.New())
+		testAgent.SetPINVerifier(func(ctx context.Context, pin string) error {
+			if calls.Add(1) == 1 {
+				close(entered)
+				<-release
+			}
+
+			return verifyPIN(ctx, pin)
+		})
+
+		require.NoError(t, testAgent.AutoLock(LockReasonRequest))
+
+		done := make(chan error, 1)
+		go func() {
+			done <- testAgent.Unlock([]byte("135790"))
+		}()
+
+		<-entered
+
+		// another client unlocks and locks the agent with its own passphrase while the card checks the PIN
+		require.NoError(t, testAgent.Unlock([]byte("135790")))
+		require.NoError(t, testAgent.Lock([]byte("other")))
+
+		close(release)
+
+		assert.ErrorIs(t, <-done, ErrLockChanged)
+		assert.True(t, testAgent.Locked())
+
+		require.NoError(t, testAgent.Unlock([]byte("other")))
+	})
+
+	t.Run("Audited", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "audit.log")
+
+		logger, err := audit.New(path, 0, 0)
+		require.NoError(t, err)
+		defer logger.Close()
+
+		testAgent := NewSoftAgent("test", 0, logrus.New())
+		testAgent.SetAuditLogger(logger)
+		testAgent.SetPINVerifier(verifyPIN)
+
+		require.NoError(t, testAgent.AutoLock(LockReasonIdle))
+		require.NoError(t, testAgent.Unlock([]byte("135790")))
+
+		// the control API records its locks with the client
+		require.NoError(t, testAgent.AutoLock(LockReasonRequest))
+
+		events, err := audit.Read(path, audit.Filter{})
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+
+		assert.Equal(t, audit.OpLock, events[0].Operation)
+		assert.Equal(t, "test", events[0].Agent)
+		assert.Equal(t, LockReasonIdle, events[0].Reason)
+		assert.True(t, events[0].Success)
+	})
+}
+
+func TestSSHAgentAutoLock(t *testing.T) {
+	t.Run("YubikeyRemoved", func(t *testing.T) {
+		testAgent := newPresenceTestAgent(t)
+		testAgent.SetLockPolicy(LockPolicy{OnYubikeyRemoval: true})
+
+		var reasons []string
+		testAgent.SetLockHook(func(reason string) {
+			reasons = append(reasons, reason)
+		})
+
+		testAgent.updatePresence([]string{})
+
+		assert.True(t, testAgent.Locked())
+		assert.Equal(t, []string{LockReasonYubikeyRemoved}, reasons)
+
+		// the PIN is checked on a plugged in card
+		assert.ErrorIs(t, testAgent.Unlock([]byte("135790")), ErrNoYubikey)
+		assert.True(t, testAgent.Locked())
+	})
+
+	t.Run("RemovalPolicyDisabled", func(t *testing.T) {
+		testAgent := newPresenceTestAgent(t)
+
+		testAgent.updatePresence([]string{})
+
+		assert.False(t, testAgent.Locked())
+	})
+
+	t.Run("Idle", func(t *testing.T) {
+		testAgent := newPresenceTestAgent(t)
+		testAgent.SetLockPolicy(LockPolicy{Idle: time.Minute})
+
+		// the idle time is counted from the last use
+		testAgent.lockIfIdle(time.Now())
+		assert.False(t, testAgent.Locked())
+
+		testAgent.markActive()
+
+		testAgent.lockIfIdle(time.Now().Add(2 * time.Minute))
+		assert.True(t, testAgent.Locked())
+	})
+
+	t.Run("WipeSoftKeys", func(t *testing.T) {
+		testAgent := newPresenceTestAgent(t)
+		testAgent.SetLockPolicy(LockPolicy{WipeSoftKeys: true})
+
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		require.NoError(t, testAgent.Add(agent.AddedKey{PrivateKey: priv}))
+
+		require.NoError(t, testAgent.AutoLock(LockReasonRequest))
+		assert.Zero(t, testAgent.softKeys.Len())
+	})
+}
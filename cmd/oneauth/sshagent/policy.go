@@ -0,0 +1,55 @@
+package sshagent
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vitalvas/oneauth/internal/audit"
+	"github.com/vitalvas/oneauth/internal/netutil"
+	"github.com/vitalvas/oneauth/internal/policy"
+)
+
+var (
+	ErrPolicyDenied = errors.New("denied by signing policy")
+)
+
+// checkPolicy applies the signing policy to the request described by the audit event.
+// It reports whether the user already confirmed the signature.
+func checkPolicy(actions Actions, event *audit.Event, peer netutil.UnixCreds, keyName, comment string, log *logrus.Entry) (bool, error) {
+	if actions.Policy == nil {
+		return false, nil
+	}
+
+	decision := actions.Policy.Evaluate(policy.Request{
+		Agent:       event.Agent,
+		Fingerprint: event.Fingerprint,
+		Slot:        event.Slot,
+		Exe:         event.Exe,
+		UID:         event.UID,
+		HostKey:     event.DestinationHostKey,
+		User:        event.DestinationUser,
+	})
+
+	event.Policy = decision.String()
+
+	if decision.DryRun {
+		log.Printf("signing policy: %s for key %s requested by pid %d (%s)", decision, event.Fingerprint, peer.PID, event.Exe)
+		return false, nil
+	}
+
+	switch decision.Action {
+	case policy.ActionDeny:
+		log.Warnf("signing policy: %s for key %s requested by pid %d (%s)", decision, event.Fingerprint, peer.PID, event.Exe)
+		return false, fmt.Errorf("%w: %s", ErrPolicyDenied, decision)
+
+	case policy.ActionConfirm:
+		if err := confirmUse(actions.Askpass, keyName, event.Fingerprint, comment, peer); err != nil {
+			return false, err
+		}
+
+		return true, nil
+	}
+
+	return false, nil
+}
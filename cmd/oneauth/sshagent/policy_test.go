@@ -0,0 +1,153 @@
+package sshagent
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vitalvas/oneauth/internal/audit"
+	"github.com/vitalvas/oneauth/internal/netutil"
+	"github.com/vitalvas/oneauth/internal/policy"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func testLogEntry() *logrus.Entry {
+	return logrus.NewEntry(logrus.New())
+}
+
+func newTestPolicy(t *testing.T, conf policy.Config) *policy.Engine {
+	t.Helper()
+
+	engine, err := policy.New(conf)
+	require.NoError(t, err)
+
+	return engine
+}
+
+// countingAskpass returns an askpass script that approves and counts how often it was called
+func countingAskpass(t *testing.T) (string, func() int) {
+	t.Helper()
+
+	dir := t.TempDir()
+	script := filepath.Join(dir, "askpass")
+	counter := filepath.Join(dir, "count")
+
+	require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\necho x >> "+counter+"\n"), 0700))
+
+	return script, func() int {
+		data, err := os.ReadFile(counter)
+		if err != nil {
+			return 0
+		}
+
+		return len(data) / 2
+	}
+}
+
+func TestCheckPolicy(t *testing.T) {
+	peer := netutil.UnixCreds{PID: -1, UID: -1}
+
+	t.Run("NoPolicy", func(t *testing.T) {
+		event := &audit.Event{Fingerprint: "SHA256:key"}
+
+		confirmed, err := checkPolicy(Actions{}, event, peer, "key", "", testLogEntry())
+		require.NoError(t, err)
+		assert.False(t, confirmed)
+		assert.Empty(t, event.Policy)
+	})
+
+	t.Run("Deny", func(t *testing.T) {
+		actions := Actions{
+			Policy: newTestPolicy(t, policy.Config{
+				Rules: []policy.Rule{{Name: "npm", Action: policy.ActionDeny, Exe: []string{"node"}}},
+			}),
+		}
+
+		event := &audit.Event{Fingerprint: "SHA256:key", Exe: "/usr/bin/node"}
+
+		_, err := checkPolicy(actions, event, peer, "key", "", testLogEntry())
+		assert.ErrorIs(t, err, ErrPolicyDenied)
+		assert.Equal(t, "deny (rule npm)", event.Policy)
+
+		event = &audit.Event{Fingerprint: "SHA256:key", Exe: "/usr/bin/ssh"}
+
+		_, err = checkPolicy(actions, event, peer, "key", "", testLogEntry())
+		assert.NoError(t, err)
+		assert.Equal(t, "allow", event.Policy)
+	})
+
+	t.Run("DryRun", func(t *testing.T) {
+		actions := Actions{
+			Policy: newTestPolicy(t, policy.Config{DryRun: true, Default: policy.ActionDeny}),
+		}
+
+		event := &audit.Event{Fingerprint: "SHA256:key"}
+
+		_, err := checkPolicy(actions, event, peer, "key", "", testLogEntry())
+		assert.NoError(t, err)
+		assert.Equal(t, "deny (dry run)", event.Policy)
+	})
+
+	t.Run("Confirm", func(t *testing.T) {
+		event := &audit.Event{Fingerprint: "SHA256:key"}
+
+		confirmed, err := checkPolicy(Actions{
+			Askpass: "true",
+			Policy:  newTestPolicy(t, policy.Config{Default: policy.ActionConfirm}),
+		}, event, peer, "key", "", testLogEntry())
+		require.NoError(t, err)
+		assert.True(t, confirmed)
+
+		_, err = checkPolicy(Actions{
+			Askpass: "false",
+			Policy:  newTestPolicy(t, policy.Config{Default: policy.ActionConfirm}),
+		}, event, peer, "key", "", testLogEntry())
+		assert.ErrorIs(t, err, ErrConfirmDenied)
+	})
+}
+
+func TestSoftAgentPolicy(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+
+	t.Run("DeniedByAgentName", func(t *testing.T) {
+		softAgent := NewSoftAgent("work", 0, logrus.New())
+		softAgent.SetActions(Actions{
+			Policy: newTestPolicy(t, policy.Config{
+				Rules: []policy.Rule{{Action: policy.ActionDeny, Agents: []string{"work"}}},
+			}),
+		})
+		require.NoError(t, softAgent.Add(agent.AddedKey{PrivateKey: priv}))
+
+		_, err := softAgent.Sign(signer.PublicKey(), []byte("data"))
+		assert.ErrorIs(t, err, ErrPolicyDenied)
+	})
+
+	t.Run("SingleConfirmation", func(t *testing.T) {
+		askpass, count := countingAskpass(t)
+
+		softAgent := NewSoftAgent("work", 0, logrus.New())
+		softAgent.SetActions(Actions{
+			Askpass: askpass,
+			Policy:  newTestPolicy(t, policy.Config{Default: policy.ActionConfirm}),
+		})
+
+		client := serveSession(t, softAgent)
+		require.NoError(t, client.Add(agent.AddedKey{PrivateKey: priv, ConfirmBeforeUse: true}))
+
+		_, err := client.Sign(signer.PublicKey(), []byte("data"))
+		require.NoError(t, err)
+
+		// the policy confirmation also covers the key added with `ssh-add -c`
+		assert.Equal(t, 1, count())
+	})
+}
@@ -0,0 +1,194 @@
+package sshagent
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/vitalvas/oneauth/internal/yubikey"
+)
+
+const (
+	presenceInterval = 2 * time.Second
+
+	// maxPresenceEvents is the number of events kept for the control API
+	maxPresenceEvents = 100
+)
+
+var (
+	listReaders   = yubikey.Readers
+	reopenYubikey = (*yubikey.Yubikey).Reopen
+)
+
+// PresenceEvent records a YubiKey being plugged in or removed
+type PresenceEvent struct {
+	Time    time.Time
+	Serial  uint32
+	Present bool
+}
+
+// WatchYubikeys follows the PC/SC readers until ctx is done, so removed YubiKeys are released
+// and plugged in ones are opened again. Only reader names are polled, the cards are opened only
+// while an attached YubiKey is absent and a reader is not used by the present ones.
+func (a *SSHAgent) WatchYubikeys(ctx context.Context) error {
+	ticker := time.NewTicker(presenceInterval)
+	defer ticker.Stop()
+
+	var lastErr string
+
+	for {
+		readers, err := listReaders()
+		if err != nil {
+			// pcscd may be restarting, the state is kept until the readers can be listed again
+			if err.Error() != lastErr {
+				a.log.Warnln("failed to list yubikey readers:", err)
+				lastErr = err.Error()
+			}
+		} else {
+			lastErr = ""
+			a.updatePresence(readers)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-ticker.C:
+		}
+	}
+}
+
+// updatePresence compares the attached YubiKeys with the readers.
+// Cards are closed and opened on the card worker without the agent lock held.
+func (a *SSHAgent) updatePresence(readers []string) {
+	a.lock.Lock()
+
+	a.readers = readers
+
+	var removed, lookup []*yubikey.Yubikey
+
+	for _, yk := range a.yks {
+		if !a.absent[yk.Serial] && !slices.Contains(readers, yk.Reader()) {
+			// the card is marked at once, so new requests do not wait for it
+			a.setPresence(yk.Serial, false)
+			removed = append(removed, yk)
+		}
+	}
+
+	// an absent card is looked for on every check while a reader is not used by the present cards,
+	// it may be held by another process for a while, e.g. by the agent that handed off its sockets
+	if a.freeReader(readers) {
+		for _, yk := range a.yks {
+			if a.absent[yk.Serial] && !slices.Contains(removed, yk) {
+				lookup = append(lookup, yk)
+			}
+		}
+	}
+
+	a.lock.Unlock()
+
+	for _, yk := range removed {
+		a.closeYubikey(yk)
+	}
+
+	if len(removed) > 0 {
+		a.lockOnRemoval()
+	}
+
+	for _, yk := range lookup {
+		err := a.cards.do(context.Background(), CardRequest{Operation: CardOpOpen, Serial: yk.Serial}, func() error {
+			return reopenYubikey(yk)
+		})
+		if err != nil {
+			continue
+		}
+
+		a.lock.Lock()
+		// the card may have been detached while it was opened
+		if a.absent[yk.Serial] && slices.Contains(a.yks, yk) {
+			a.setPresence(yk.Serial, true)
+		}
+		a.lock.Unlock()
+	}
+}
+
+// freeReader reports whether a reader is not used by a present card, it must be called with the agent lock held
+func (a *SSHAgent) freeReader(readers []string) bool {
+	for _, reader := range readers {
+		used := slices.ContainsFunc(a.yks, func(yk *yubikey.Yubikey) bool {
+			return !a.absent[yk.Serial] && yk.Reader() == reader
+		})
+
+		if !used {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setPresence must be called with the agent lock held
+func (a *SSHAgent) setPresence(serial uint32, present bool) {
+	if a.absent == nil {
+		a.absent = make(map[uint32]bool)
+	}
+
+	if present {
+		delete(a.absent, serial)
+		a.log.WithField("yubikey", serial).Println("yubikey plugged in:", serial)
+	} else {
+		a.absent[serial] = true
+		delete(a.pins, serial)
+		a.log.WithField("yubikey", serial).Println("yubikey removed:", serial)
+	}
+
+	delete(a.inventory, serial)
+	delete(a.pinRetries, serial)
+
+	a.presenceEvents = append(a.presenceEvents, PresenceEvent{
+		Time:    time.Now(),
+		Serial:  serial,
+		Present: present,
+	})
+
+	if len(a.presenceEvents) > maxPresenceEvents {
+		a.presenceEvents = slices.Delete(a.presenceEvents, 0, len(a.presenceEvents)-maxPresenceEvents)
+	}
+}
+
+// PresenceEvents returns the last YubiKeys plugged in or removed, oldest first
+func (a *SSHAgent) PresenceEvents() []PresenceEvent {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return slices.Clone(a.presenceEvents)
+}
+
+// AbsentSerials returns the serial numbers of the attached YubiKeys that are not plugged in
+func (a *SSHAgent) AbsentSerials() []uint32 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var serials []uint32
+
+	for _, yk := range a.yks {
+		if a.absent[yk.Serial] {
+			serials = append(serials, yk.Serial)
+		}
+	}
+
+	return serials
+}
+
+// presentYubikeys must be called with the agent lock held
+func (a *SSHAgent) presentYubikeys() []*yubikey.Yubikey {
+	yks := make([]*yubikey.Yubikey, 0, len(a.yks))
+
+	for _, yk := range a.yks {
+		if !a.absent[yk.Serial] {
+			yks = append(yks, yk)
+		}
+	}
+
+	return yks
+}
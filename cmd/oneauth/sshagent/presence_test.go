@@ -0,0 +1,260 @@
+package sshagent
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vitalvas/oneauth/internal/keystore"
+	"github.com/vitalvas/oneauth/internal/yubikey"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func testSlotCert(t *testing.T, slot yubikey.Slot) yubikey.Cert {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return yubikey.Cert{Certificate: cert, Slot: slot}
+}
+
+func newPresenceTestAgent(t *testing.T) *SSHAgent {
+	t.Helper()
+
+	return &SSHAgent{
+		yks: []*yubikey.Yubikey{{Serial: 42}},
+		inventory: map[uint32][]yubikey.Cert{
+			42: {testSlotCert(t, yubikey.SlotKeyECDSA), testSlotCert(t, yubikey.MustSlotFromKeyID(0x9a))},
+		},
+		softKeys: keystore.New(0),
+		log:      logrus.NewEntry(logrus.New()),
+	}
+}
+
+func TestSlotInventory(t *testing.T) {
+	testAgent := newPresenceTestAgent(t)
+
+	// only the SSH slots are served, the keys come from the inventory without opening the card
+	keys, err := testAgent.SlotKeys()
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	assert.Equal(t, uint32(42), keys[0].Serial)
+	assert.Equal(t, yubikey.SlotKeyECDSA, keys[0].Slot)
+	assert.Equal(t, "YubiKey #42 PIV Slot 0x94", keys[0].Comment)
+
+	yk, cert, err := testAgent.findSlotKey(context.Background(), ssh.FingerprintSHA256(keys[0].PublicKey))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(42), yk.Serial)
+	assert.Equal(t, yubikey.SlotKeyECDSA, cert.Slot)
+
+	t.Run("InvalidatedByYubikeyAccess", func(t *testing.T) {
+		testAgent := newPresenceTestAgent(t)
+
+		require.NoError(t, testAgent.WithYubikey(context.Background(), 42, func(_ *yubikey.Yubikey) error {
+			return nil
+		}))
+
+		assert.NotContains(t, testAgent.inventory, uint32(42))
+	})
+}
+
+func TestUpdatePresence(t *testing.T) {
+	t.Run("Removed", func(t *testing.T) {
+		reopen := reopenYubikey
+		reopenYubikey = func(_ *yubikey.Yubikey) error {
+			return errors.New("yubikey with serial 42 not found")
+		}
+
+		t.Cleanup(func() {
+			reopenYubikey = reopen
+		})
+
+		testAgent := newPresenceTestAgent(t)
+
+		testAgent.updatePresence([]string{"Yubico YubiKey OTP+FIDO+CCID 00 00"})
+
+		assert.Equal(t, []uint32{42}, testAgent.AbsentSerials())
+		assert.Empty(t, testAgent.inventory)
+
+		events := testAgent.PresenceEvents()
+		require.Len(t, events, 1)
+		assert.Equal(t, uint32(42), events[0].Serial)
+		assert.False(t, events[0].Present)
+
+		_, err := testAgent.SlotKeys()
+		assert.ErrorIs(t, err, ErrNoYubikey)
+
+		err = testAgent.WithYubikey(context.Background(), 42, func(_ *yubikey.Yubikey) error {
+			return nil
+		})
+		assert.ErrorIs(t, err, ErrYubikeyAbsent)
+
+		// nothing changes while the card stays removed
+		testAgent.updatePresence([]string{"Yubico YubiKey OTP+FIDO+CCID 00 00"})
+		assert.Len(t, testAgent.PresenceEvents(), 1)
+	})
+
+	t.Run("PluggedIn", func(t *testing.T) {
+		var reopened []uint32
+
+		reopen := reopenYubikey
+		reopenYubikey = func(yk *yubikey.Yubikey) error {
+			reopened = append(reopened, yk.Serial)
+			return nil
+		}
+
+		t.Cleanup(func() {
+			reopenYubikey = reopen
+		})
+
+		testAgent := newPresenceTestAgent(t)
+		testAgent.absent = map[uint32]bool{42: true}
+		testAgent.readers = []string{}
+
+		// there is no reader, so the card is not looked for
+		testAgent.updatePresence([]string{})
+		assert.Empty(t, reopened)
+
+		testAgent.updatePresence([]string{"Yubico YubiKey OTP+FIDO+CCID 00 00"})
+		assert.Equal(t, []uint32{42}, reopened)
+		assert.Empty(t, testAgent.AbsentSerials())
+
+		events := testAgent.PresenceEvents()
+		require.Len(t, events, 1)
+		assert.True(t, events[0].Present)
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		reopen := reopenYubikey
+		reopenYubikey = func(_ *yubikey.Yubikey) error {
+			return errors.New("yubikey with serial 42 not found")
+		}
+
+		t.Cleanup(func() {
+			reopenYubikey = reopen
+		})
+
+		testAgent := newPresenceTestAgent(t)
+		testAgent.absent = map[uint32]bool{42: true}
+
+		testAgent.updatePresence([]string{"Yubico YubiKey OTP+FIDO+CCID 00 00"})
+		assert.Equal(t, []uint32{42}, testAgent.AbsentSerials())
+		assert.Empty(t, testAgent.PresenceEvents())
+	})
+
+	t.Run("HeldByAnotherProcess", func(t *testing.T) {
+		var attempts int
+
+		reopen := reopenYubikey
+		reopenYubikey = func(_ *yubikey.Yubikey) error {
+			// the agent that handed off its sockets releases the card after a while
+			attempts++
+			if attempts < 3 {
+				return errors.New("yubikey with serial 42 not found")
+			}
+
+			return nil
+		}
+
+		t.Cleanup(func() {
+			reopenYubikey = reopen
+		})
+
+		testAgent := newPresenceTestAgent(t)
+		testAgent.absent = map[uint32]bool{42: true}
+
+		readers := []string{"Yubico YubiKey OTP+FIDO+CCID 00 00"}
+
+		// the readers do not change, the card is looked for on every check
+		for range 3 {
+			testAgent.updatePresence(readers)
+		}
+
+		assert.Equal(t, 3, attempts)
+		assert.Empty(t, testAgent.AbsentSerials())
+
+		events := testAgent.PresenceEvents()
+		require.Len(t, events, 1)
+		assert.True(t, events[0].Present)
+	})
+
+	t.Run("EventLimit", func(t *testing.T) {
+		testAgent := newPresenceTestAgent(t)
+
+		testAgent.lock.Lock()
+		for i := range maxPresenceEvents + 10 {
+			testAgent.setPresence(42, i%2 == 0)
+		}
+		testAgent.lock.Unlock()
+
+		assert.Len(t, testAgent.PresenceEvents(), maxPresenceEvents)
+	})
+}
+
+func TestListWithoutYubikey(t *testing.T) {
+	testAgent := newPresenceTestAgent(t)
+	testAgent.updatePresence(nil)
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	require.NoError(t, testAgent.Add(agent.AddedKey{PrivateKey: priv, Comment: "soft"}))
+
+	// soft keys are served while the YubiKey is removed
+	keys, err := testAgent.List()
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	assert.Equal(t, "soft", keys[0].Comment)
+}
+
+func TestWatchYubikeys(t *testing.T) {
+	list := listReaders
+	listReaders = func() ([]string, error) {
+		return nil, nil
+	}
+
+	t.Cleanup(func() {
+		listReaders = list
+	})
+
+	testAgent := newPresenceTestAgent(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error, 1)
+	go func() {
+		done <- testAgent.WatchYubikeys(ctx)
+	}()
+
+	require.Eventually(t, func() bool {
+		return len(testAgent.AbsentSerials()) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	assert.NoError(t, <-done)
+}
@@ -0,0 +1,102 @@
+package sshagent
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vitalvas/oneauth/internal/agentkey"
+	"github.com/vitalvas/oneauth/internal/audit"
+	"github.com/vitalvas/oneauth/internal/netutil"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// session holds the state of a single client connection to an agent
+type session struct {
+	peer netutil.UnixCreds
+
+	// hops recorded with session-bind@openssh.com, in order from the origin
+	hops       []agentkey.Hop
+	bindFailed bool
+
+	// ctx is cancelled when the client disconnects
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newSession(peer netutil.UnixCreds) *session {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &session{
+		peer:   peer,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// context returns the context of the connection, requests made without a connection are never cancelled
+func (s *session) context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+
+	return s.ctx
+}
+
+// close cancels the requests of the connection that are still running
+func (s *session) close() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// sessionBackend is implemented by agents that need to know which connection a request came from
+type sessionBackend interface {
+	agent.ExtendedAgent
+
+	listWithSession(sess *session) ([]*agent.Key, error)
+	// signWithSession fills in the key slot of the event when a YubiKey is used
+	signWithSession(sess *session, event *audit.Event, reqKey ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error)
+}
+
+// sessionAgent binds an agent to a client connection
+type sessionAgent struct {
+	sessionBackend
+	sess *session
+
+	// name and audit identify the agent in the audit log, a nil audit logger disables it
+	name  string
+	audit *audit.Logger
+	log   *logrus.Entry
+}
+
+func (s *sessionAgent) List() ([]*agent.Key, error) {
+	keys, err := s.sessionBackend.listWithSession(s.sess)
+
+	event := s.event(audit.OpList)
+	event.Keys = len(keys)
+	s.record(event, err)
+
+	return keys, err
+}
+
+func (s *sessionAgent) Sign(reqKey ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return s.SignWithFlags(reqKey, data, 0)
+}
+
+func (s *sessionAgent) SignWithFlags(reqKey ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	event := s.signEvent(reqKey, data)
+
+	sig, err := s.sessionBackend.signWithSession(s.sess, &event, reqKey, data, flags)
+	s.record(event, err)
+
+	return sig, err
+}
+
+func (s *sessionAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	if extensionType == sessionBindExtension {
+		return nil, s.sess.bind(contents)
+	}
+
+	return s.sessionBackend.Extension(extensionType, contents)
+}
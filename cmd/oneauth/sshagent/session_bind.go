@@ -0,0 +1,156 @@
+package sshagent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/vitalvas/oneauth/internal/agentkey"
+	"golang.org/x/crypto/ssh"
+)
+
+// origin: PROTOCOL.agent and ssh-agent.c from OpenSSH
+
+const (
+	sessionBindExtension = "session-bind@openssh.com"
+	maxSessionBindings   = 16
+)
+
+var (
+	ErrSessionBind = errors.New("session bind failed")
+)
+
+// bind records a session-bind@openssh.com message sent by ssh before authentication or forwarding
+func (s *session) bind(contents []byte) error {
+	if err := s.appendBinding(contents); err != nil {
+		s.bindFailed = true
+		return err
+	}
+
+	return nil
+}
+
+func (s *session) appendBinding(contents []byte) error {
+	var msg struct {
+		HostKey    []byte
+		SessionID  []byte
+		Signature  []byte
+		Forwarding bool
+	}
+
+	if err := ssh.Unmarshal(contents, &msg); err != nil {
+		return fmt.Errorf("%w: %w", ErrSessionBind, err)
+	}
+
+	hostKey, err := ssh.ParsePublicKey(msg.HostKey)
+	if err != nil {
+		return fmt.Errorf("%w: failed to parse host key: %w", ErrSessionBind, err)
+	}
+
+	sig := new(ssh.Signature)
+	if err := ssh.Unmarshal(msg.Signature, sig); err != nil {
+		return fmt.Errorf("%w: failed to parse signature: %w", ErrSessionBind, err)
+	}
+
+	if err := hostKey.Verify(msg.SessionID, sig); err != nil {
+		return fmt.Errorf("%w: host key signature is invalid: %w", ErrSessionBind, err)
+	}
+
+	for _, hop := range s.hops {
+		if !hop.Forwarded {
+			return fmt.Errorf("%w: connection already bound for authentication", ErrSessionBind)
+		}
+
+		if !bytes.Equal(hop.SessionID, msg.SessionID) {
+			// the same host key with a new session id happens on multiple connections to one host
+			continue
+		}
+
+		if bytes.Equal(hop.HostKey.Marshal(), hostKey.Marshal()) {
+			// already recorded
+			return nil
+		}
+
+		return fmt.Errorf("%w: session id recorded against a different host key", ErrSessionBind)
+	}
+
+	if len(s.hops) >= maxSessionBindings {
+		return fmt.Errorf("%w: too many session bindings", ErrSessionBind)
+	}
+
+	s.hops = append(s.hops, agentkey.Hop{
+		HostKey:   hostKey,
+		SessionID: msg.SessionID,
+		Forwarded: msg.Forwarding,
+	})
+
+	return nil
+}
+
+// forwarded reports whether the connection came through a forwarded agent
+func (s *session) forwarded() bool {
+	for _, hop := range s.hops {
+		if hop.Forwarded {
+			return true
+		}
+	}
+
+	return false
+}
+
+// permitsListing reports whether a soft key may be offered to this connection
+func (s *session) permitsListing(key *agentkey.Key) bool {
+	if !key.DestinationConstrained() {
+		return true
+	}
+
+	if s.bindFailed {
+		return false
+	}
+
+	return key.PermittedForList(s.hops)
+}
+
+// checkSign enforces `ssh-add -h` destination constraints for a signature request
+func (s *session) checkSign(key *agentkey.Key, data []byte) error {
+	if !key.DestinationConstrained() {
+		return nil
+	}
+
+	if s.bindFailed {
+		return fmt.Errorf("%w: previous session bind failed", agentkey.ErrDestinationNotPermitted)
+	}
+
+	if len(s.hops) == 0 {
+		return fmt.Errorf("%w: refusing to sign on unbound connection", agentkey.ErrDestinationNotPermitted)
+	}
+
+	req, err := parseUserauthRequest(data)
+	if err != nil {
+		return fmt.Errorf("%w: refusing to sign an unidentified payload: %w", agentkey.ErrDestinationNotPermitted, err)
+	}
+
+	if !bytes.Equal(req.PublicKey, key.AgentKey().Blob) {
+		return fmt.Errorf("%w: userauth request is for another key", agentkey.ErrDestinationNotPermitted)
+	}
+
+	if err := key.PermittedForSign(s.hops, req.User); err != nil {
+		return err
+	}
+
+	last := s.hops[len(s.hops)-1]
+
+	if !bytes.Equal(req.SessionID, last.SessionID) {
+		return fmt.Errorf("%w: unexpected session id in userauth request", agentkey.ErrDestinationNotPermitted)
+	}
+
+	if req.HostKey == nil && len(s.hops) > 1 {
+		return fmt.Errorf("%w: no host key in userauth request on forwarded connection", agentkey.ErrDestinationNotPermitted)
+	}
+
+	if req.HostKey != nil && !bytes.Equal(req.HostKey.Marshal(), last.HostKey.Marshal()) {
+		return fmt.Errorf("%w: host key in userauth request does not match bound session", agentkey.ErrDestinationNotPermitted)
+	}
+
+	return nil
+}
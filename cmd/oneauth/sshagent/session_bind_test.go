@@ -0,0 +1,270 @@
+package sshagent
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vitalvas/oneauth/internal/agentkey"
+	"github.com/vitalvas/oneauth/internal/yubikey"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func createTestSigner(t *testing.T) (ssh.PublicKey, ssh.Signer) {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+
+	return signer.PublicKey(), signer
+}
+
+// marshalSessionBind builds a session-bind@openssh.com request as sent by ssh
+func marshalSessionBind(t *testing.T, hostSigner ssh.Signer, sessionID []byte, forwarding bool) []byte {
+	t.Helper()
+
+	sig, err := hostSigner.Sign(rand.Reader, sessionID)
+	require.NoError(t, err)
+
+	return ssh.Marshal(struct {
+		HostKey    []byte
+		SessionID  []byte
+		Signature  []byte
+		Forwarding bool
+	}{
+		HostKey:    hostSigner.PublicKey().Marshal(),
+		SessionID:  sessionID,
+		Signature:  ssh.Marshal(sig),
+		Forwarding: forwarding,
+	})
+}
+
+func TestSessionBind(t *testing.T) {
+	_, hostA := createTestSigner(t)
+	_, hostB := createTestSigner(t)
+
+	t.Run("Authentication", func(t *testing.T) {
+		sess := &session{}
+
+		require.NoError(t, sess.bind(marshalSessionBind(t, hostA, []byte("sid-a"), false)))
+		require.Len(t, sess.hops, 1)
+		assert.False(t, sess.forwarded())
+		assert.Equal(t, []byte("sid-a"), sess.hops[0].SessionID)
+	})
+
+	t.Run("Forwarding", func(t *testing.T) {
+		sess := &session{}
+
+		require.NoError(t, sess.bind(marshalSessionBind(t, hostA, []byte("sid-a"), true)))
+		require.NoError(t, sess.bind(marshalSessionBind(t, hostB, []byte("sid-b"), false)))
+		assert.Len(t, sess.hops, 2)
+		assert.True(t, sess.forwarded())
+	})
+
+	t.Run("DuplicateIsIgnored", func(t *testing.T) {
+		sess := &session{}
+
+		require.NoError(t, sess.bind(marshalSessionBind(t, hostA, []byte("sid-a"), true)))
+		require.NoError(t, sess.bind(marshalSessionBind(t, hostA, []byte("sid-a"), true)))
+		assert.Len(t, sess.hops, 1)
+	})
+
+	t.Run("SessionIDReused", func(t *testing.T) {
+		sess := &session{}
+
+		require.NoError(t, sess.bind(marshalSessionBind(t, hostA, []byte("sid-a"), true)))
+		assert.ErrorIs(t, sess.bind(marshalSessionBind(t, hostB, []byte("sid-a"), true)), ErrSessionBind)
+		assert.True(t, sess.bindFailed)
+	})
+
+	t.Run("BindAfterAuthentication", func(t *testing.T) {
+		sess := &session{}
+
+		require.NoError(t, sess.bind(marshalSessionBind(t, hostA, []byte("sid-a"), false)))
+		assert.ErrorIs(t, sess.bind(marshalSessionBind(t, hostB, []byte("sid-b"), false)), ErrSessionBind)
+	})
+
+	t.Run("BadSignature", func(t *testing.T) {
+		sess := &session{}
+
+		sig, err := hostB.Sign(rand.Reader, []byte("sid-a"))
+		require.NoError(t, err)
+
+		data := ssh.Marshal(struct {
+			HostKey    []byte
+			SessionID  []byte
+			Signature  []byte
+			Forwarding bool
+		}{hostA.PublicKey().Marshal(), []byte("sid-a"), ssh.Marshal(sig), false})
+
+		assert.ErrorIs(t, sess.bind(data), ErrSessionBind)
+		assert.Empty(t, sess.hops)
+		assert.True(t, sess.bindFailed)
+	})
+
+	t.Run("TooManyBindings", func(t *testing.T) {
+		sess := &session{}
+
+		for i := 0; i < maxSessionBindings; i++ {
+			require.NoError(t, sess.bind(marshalSessionBind(t, hostA, fmt.Appendf(nil, "sid-%d", i), true)))
+		}
+
+		assert.ErrorIs(t, sess.bind(marshalSessionBind(t, hostA, []byte("sid-last"), true)), ErrSessionBind)
+	})
+
+	t.Run("Garbage", func(t *testing.T) {
+		sess := &session{}
+
+		assert.ErrorIs(t, sess.bind([]byte{0x01}), ErrSessionBind)
+	})
+}
+
+func TestSessionAgentDestinations(t *testing.T) {
+	hostAKey, hostA := createTestSigner(t)
+	hostBKey, hostB := createTestSigner(t)
+	_, hostC := createTestSigner(t)
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	userSigner, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+
+	restricted := agent.AddedKey{
+		PrivateKey: priv,
+		ConstraintExtensions: []agent.ConstraintExtension{
+			{
+				ExtensionName: agentkey.RestrictDestinationExtension,
+				ExtensionDetails: agentkey.MarshalDestinationConstraints([]agentkey.DestinationConstraint{
+					{To: agentkey.DestinationHop{Hostname: "a.example.com", Keys: []agentkey.DestinationKey{{Key: hostAKey}}}},
+					{
+						From: agentkey.DestinationHop{Hostname: "a.example.com", Keys: []agentkey.DestinationKey{{Key: hostAKey}}},
+						To:   agentkey.DestinationHop{Hostname: "b.example.com", Keys: []agentkey.DestinationKey{{Key: hostBKey}}},
+					},
+				}),
+			},
+		},
+	}
+
+	newClient := func(t *testing.T) agent.ExtendedAgent {
+		t.Helper()
+
+		client := serveSession(t, NewSoftAgent("test", 0, logrus.New()))
+		require.NoError(t, client.Add(restricted))
+
+		return client
+	}
+
+	t.Run("UnboundConnection", func(t *testing.T) {
+		client := newClient(t)
+
+		keys, err := client.List()
+		require.NoError(t, err)
+		assert.Len(t, keys, 1)
+
+		_, err = client.Sign(userSigner.PublicKey(), marshalUserauthRequest([]byte("sid-a"), "git", userSigner.PublicKey(), nil))
+		assert.Error(t, err)
+	})
+
+	t.Run("PermittedHost", func(t *testing.T) {
+		client := newClient(t)
+
+		_, err := client.Extension(sessionBindExtension, marshalSessionBind(t, hostA, []byte("sid-a"), false))
+		require.NoError(t, err)
+
+		keys, err := client.List()
+		require.NoError(t, err)
+		assert.Len(t, keys, 1)
+
+		data := marshalUserauthRequest([]byte("sid-a"), "git", userSigner.PublicKey(), hostAKey)
+		sig, err := client.Sign(userSigner.PublicKey(), data)
+		require.NoError(t, err)
+		assert.NoError(t, userSigner.PublicKey().Verify(data, sig))
+	})
+
+	t.Run("ArbitraryPayload", func(t *testing.T) {
+		client := newClient(t)
+
+		_, err := client.Extension(sessionBindExtension, marshalSessionBind(t, hostA, []byte("sid-a"), false))
+		require.NoError(t, err)
+
+		_, err = client.Sign(userSigner.PublicKey(), []byte("data"))
+		assert.Error(t, err)
+	})
+
+	t.Run("WrongSessionID", func(t *testing.T) {
+		client := newClient(t)
+
+		_, err := client.Extension(sessionBindExtension, marshalSessionBind(t, hostA, []byte("sid-a"), false))
+		require.NoError(t, err)
+
+		_, err = client.Sign(userSigner.PublicKey(), marshalUserauthRequest([]byte("sid-x"), "git", userSigner.PublicKey(), nil))
+		assert.Error(t, err)
+	})
+
+	t.Run("UnknownHost", func(t *testing.T) {
+		client := newClient(t)
+
+		_, err := client.Extension(sessionBindExtension, marshalSessionBind(t, hostC, []byte("sid-c"), false))
+		require.NoError(t, err)
+
+		keys, err := client.List()
+		require.NoError(t, err)
+		assert.Empty(t, keys)
+
+		_, err = client.Sign(userSigner.PublicKey(), marshalUserauthRequest([]byte("sid-c"), "git", userSigner.PublicKey(), nil))
+		assert.Error(t, err)
+	})
+
+	t.Run("ForwardedThroughPermittedHost", func(t *testing.T) {
+		client := newClient(t)
+
+		_, err := client.Extension(sessionBindExtension, marshalSessionBind(t, hostA, []byte("sid-a"), true))
+		require.NoError(t, err)
+		_, err = client.Extension(sessionBindExtension, marshalSessionBind(t, hostB, []byte("sid-b"), false))
+		require.NoError(t, err)
+
+		// forwarded connections must use publickey-hostbound
+		_, err = client.Sign(userSigner.PublicKey(), marshalUserauthRequest([]byte("sid-b"), "git", userSigner.PublicKey(), nil))
+		assert.Error(t, err)
+
+		_, err = client.Sign(userSigner.PublicKey(), marshalUserauthRequest([]byte("sid-b"), "git", userSigner.PublicKey(), hostBKey))
+		assert.NoError(t, err)
+	})
+
+	t.Run("FailedBindHidesKeys", func(t *testing.T) {
+		client := newClient(t)
+
+		_, err := client.Extension(sessionBindExtension, []byte{0x01})
+		assert.Error(t, err)
+
+		keys, err := client.List()
+		require.NoError(t, err)
+		assert.Empty(t, keys)
+	})
+
+	t.Run("OtherExtensionsAreForwarded", func(t *testing.T) {
+		client := newClient(t)
+
+		_, err := client.Extension("test@example.com", nil)
+		assert.ErrorIs(t, err, agent.ErrExtensionUnsupported)
+	})
+}
+
+func TestLocalOnlySlots(t *testing.T) {
+	a := &SSHAgent{
+		localOnlySlots: normalizeSlots([]string{"0x95", " 9A "}),
+	}
+
+	assert.Equal(t, []string{"95", "9a"}, a.localOnlySlots)
+	assert.True(t, a.localOnlySlot(yubikey.AllSSHSlots[0]))
+	assert.False(t, a.localOnlySlot(yubikey.AllSSHSlots[1]))
+}
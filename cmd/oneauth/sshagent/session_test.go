@@ -0,0 +1,89 @@
+package sshagent
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vitalvas/oneauth/internal/netutil"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// serveSession serves the backend over an in-memory connection and returns a client for it
+func serveSession(t *testing.T, backend sessionBackend) agent.ExtendedAgent {
+	t.Helper()
+
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	go agent.ServeAgent(&sessionAgent{
+		sessionBackend: backend,
+		sess:           newSession(netutil.UnixCreds{PID: -1, UID: -1}),
+	}, server)
+
+	return agent.NewClient(client)
+}
+
+func TestSessionAgentConstraints(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+
+	t.Run("LifetimeIsKept", func(t *testing.T) {
+		softAgent := NewSoftAgent("test", 0, logrus.New())
+		client := serveSession(t, softAgent)
+
+		require.NoError(t, client.Add(agent.AddedKey{PrivateKey: priv, LifetimeSecs: 300}))
+
+		key, ok := softAgent.softKeys.Get(ssh.FingerprintSHA256(signer.PublicKey()))
+		require.True(t, ok)
+		assert.False(t, key.ExpiresAt().IsZero())
+	})
+
+	t.Run("ConfirmDenied", func(t *testing.T) {
+		softAgent := NewSoftAgent("test", 0, logrus.New())
+		softAgent.SetActions(Actions{Askpass: "false"})
+		client := serveSession(t, softAgent)
+
+		require.NoError(t, client.Add(agent.AddedKey{PrivateKey: priv, ConfirmBeforeUse: true}))
+
+		_, err := client.Sign(signer.PublicKey(), []byte("data"))
+		assert.Error(t, err)
+	})
+
+	t.Run("ConfirmApproved", func(t *testing.T) {
+		softAgent := NewSoftAgent("test", 0, logrus.New())
+		softAgent.SetActions(Actions{Askpass: "true"})
+		client := serveSession(t, softAgent)
+
+		require.NoError(t, client.Add(agent.AddedKey{PrivateKey: priv, ConfirmBeforeUse: true}))
+
+		sig, err := client.Sign(signer.PublicKey(), []byte("data"))
+		require.NoError(t, err)
+		assert.NoError(t, signer.PublicKey().Verify([]byte("data"), sig))
+	})
+
+	t.Run("UnknownExtensionRejected", func(t *testing.T) {
+		softAgent := NewSoftAgent("test", 0, logrus.New())
+		client := serveSession(t, softAgent)
+
+		err := client.Add(agent.AddedKey{
+			PrivateKey: priv,
+			ConstraintExtensions: []agent.ConstraintExtension{
+				{ExtensionName: "unknown@example.com", ExtensionDetails: []byte("x")},
+			},
+		})
+		assert.Error(t, err)
+		assert.Equal(t, 0, softAgent.softKeys.Len())
+	})
+}
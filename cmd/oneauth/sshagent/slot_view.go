@@ -0,0 +1,70 @@
+package sshagent
+
+import (
+	"bytes"
+	"slices"
+
+	"github.com/vitalvas/oneauth/internal/audit"
+	"github.com/vitalvas/oneauth/internal/yubikey"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// slotView is the set of YubiKey slots of the YubiKey agent that a named agent serves.
+// A nil view permits every slot.
+type slotView struct {
+	agent *SSHAgent
+	slots []yubikey.Slot
+}
+
+func (v *slotView) permits(slot yubikey.Slot) bool {
+	return v == nil || slices.Contains(v.slots, slot)
+}
+
+// keys returns the keys of the slots in the view, none while the YubiKey agent is locked
+func (v *slotView) keys(sess *session) []*agent.Key {
+	if v.agent.Locked() {
+		return nil
+	}
+
+	return v.agent.slotAgentKeys(sess, v)
+}
+
+// serves reports whether the key is in a slot of the view
+func (v *slotView) serves(sess *session, reqKey ssh.PublicKey) bool {
+	blob := reqKey.Marshal()
+
+	return slices.ContainsFunc(v.keys(sess), func(key *agent.Key) bool {
+		return bytes.Equal(key.Blob, blob)
+	})
+}
+
+// sign signs with a slot of the view with the actions of the YubiKey agent,
+// the signing policy sees the name of the named agent
+func (v *slotView) sign(sess *session, event *audit.Event, fp string, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	if v.agent.Locked() {
+		return nil, ErrAgentLocked
+	}
+
+	sig, err := v.agent.signYubikey(sess, event, fp, data, flags, v)
+	if err != nil {
+		return nil, err
+	}
+
+	v.agent.markActive()
+
+	return sig, nil
+}
+
+// SetYubikeySlots serves the slots of the YubiKey agent next to the keys added with ssh-add,
+// no slots stop serving them
+func (a *SoftAgent) SetYubikeySlots(ykAgent *SSHAgent, slots []yubikey.Slot) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.slots = nil
+
+	if ykAgent != nil && len(slots) > 0 {
+		a.slots = &slotView{agent: ykAgent, slots: slots}
+	}
+}
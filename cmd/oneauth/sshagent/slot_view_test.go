@@ -0,0 +1,89 @@
+package sshagent
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vitalvas/oneauth/internal/audit"
+	"github.com/vitalvas/oneauth/internal/policy"
+	"github.com/vitalvas/oneauth/internal/yubikey"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSoftAgentYubikeySlots(t *testing.T) {
+	ykAgent := newPresenceTestAgent(t)
+
+	slotKeys, err := ykAgent.SlotKeys()
+	require.NoError(t, err)
+	require.Len(t, slotKeys, 1)
+
+	slotKey := slotKeys[0].PublicKey
+
+	t.Run("List", func(t *testing.T) {
+		testAgent := NewSoftAgent("work", 0, logrus.New())
+		testAgent.SetYubikeySlots(ykAgent, []yubikey.Slot{yubikey.SlotKeyECDSA})
+		addTestKey(t, testAgent, "local")
+
+		keys, err := testAgent.List()
+		require.NoError(t, err)
+		require.Len(t, keys, 2)
+		assert.Equal(t, "local", keys[0].Comment)
+		assert.Equal(t, "YubiKey #42 PIV Slot 0x94", keys[1].Comment)
+	})
+
+	t.Run("OtherSlot", func(t *testing.T) {
+		testAgent := NewSoftAgent("personal", 0, logrus.New())
+		testAgent.SetYubikeySlots(ykAgent, []yubikey.Slot{yubikey.SlotKeyRSA})
+
+		keys, err := testAgent.List()
+		require.NoError(t, err)
+		assert.Empty(t, keys)
+
+		// a slot outside of the view is not used, even when the client knows the key
+		_, err = testAgent.Sign(slotKey, []byte("data"))
+		assert.ErrorContains(t, err, "unknown key")
+
+		_, err = ykAgent.signYubikey(&session{}, &audit.Event{}, ssh.FingerprintSHA256(slotKey), []byte("data"), 0, testAgent.slots)
+		assert.ErrorContains(t, err, "unknown key")
+	})
+
+	t.Run("Policy", func(t *testing.T) {
+		ykAgent.SetActions(Actions{
+			Policy: newTestPolicy(t, policy.Config{
+				Rules: []policy.Rule{{Name: "work", Action: policy.ActionDeny, Agents: []string{"work"}, Keys: []string{"94"}}},
+			}),
+		})
+		t.Cleanup(func() { ykAgent.SetActions(Actions{}) })
+
+		testAgent := NewSoftAgent("work", 0, logrus.New())
+		testAgent.SetYubikeySlots(ykAgent, []yubikey.Slot{yubikey.SlotKeyECDSA})
+
+		event := &audit.Event{Operation: audit.OpSign, Agent: "work"}
+
+		_, err := testAgent.signWithSession(&session{}, event, slotKey, []byte("data"), 0)
+		assert.ErrorIs(t, err, ErrPolicyDenied)
+		assert.Equal(t, uint32(42), event.Serial)
+		assert.Equal(t, "94", event.Slot)
+	})
+
+	t.Run("YubikeyAgentLocked", func(t *testing.T) {
+		lockedAgent := newPresenceTestAgent(t)
+		require.NoError(t, lockedAgent.Lock([]byte("secret")))
+
+		testAgent := NewSoftAgent("work", 0, logrus.New())
+		testAgent.SetYubikeySlots(lockedAgent, []yubikey.Slot{yubikey.SlotKeyECDSA})
+
+		keys, err := testAgent.List()
+		require.NoError(t, err)
+		assert.Empty(t, keys)
+	})
+
+	t.Run("NoSlots", func(t *testing.T) {
+		testAgent := NewSoftAgent("work", 0, logrus.New())
+		testAgent.SetYubikeySlots(ykAgent, nil)
+
+		assert.Nil(t, testAgent.slots)
+	})
+}
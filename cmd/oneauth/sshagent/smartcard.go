@@ -0,0 +1,215 @@
+package sshagent
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/vitalvas/oneauth/internal/audit"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// origin: PROTOCOL.agent and ssh-agent.c from OpenSSH
+
+const (
+	agentFailure = 5
+	agentSuccess = 6
+
+	agentAddSmartcardKey            = 20
+	agentRemoveSmartcardKey         = 21
+	agentAddSmartcardKeyConstrained = 26
+
+	// maxAgentMessage matches the limit of agent.ServeAgent
+	maxAgentMessage = 16 << 20
+)
+
+var (
+	ErrSmartcardConstraints = errors.New("constraints are not supported for smartcards")
+	ErrSmartcardForwarded   = errors.New("smartcards can not be changed through a forwarded agent")
+)
+
+// smartcardBackend is implemented by agents that attach YubiKeys with `ssh-add -s SERIAL` and detach them with `ssh-add -e SERIAL`
+type smartcardBackend interface {
+	AttachYubikey(serial uint32) error
+	DetachYubikey(serial uint32) error
+	Locked() bool
+}
+
+// serveAgent serves the session like agent.ServeAgent, cancels the session when the client disconnects,
+// and handles the smartcard messages that agent.ServeAgent does not know when the backend supports them
+func serveAgent(sessAgent *sessionAgent, conn io.ReadWriter) error {
+	backend, smartcard := sessAgent.sessionBackend.(smartcardBackend)
+
+	inner, outer := net.Pipe()
+	defer outer.Close()
+
+	go func() {
+		agent.ServeAgent(sessAgent, inner)
+		inner.Close()
+	}()
+
+	// requests are read ahead, so a client that disconnects cancels the request it waits for
+	msgs := make(chan []byte)
+	readErr := make(chan error, 1)
+	stop := make(chan struct{})
+
+	defer close(stop)
+
+	go func() {
+		defer sessAgent.sess.close()
+
+		for {
+			msg, err := readAgentMessage(conn)
+			if err != nil {
+				readErr <- err
+				return
+			}
+
+			select {
+			case msgs <- msg:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	for {
+		var msg []byte
+
+		select {
+		case msg = <-msgs:
+		case err := <-readErr:
+			return err
+		}
+
+		var reply []byte
+
+		switch {
+		case len(msg) == 0:
+			reply = []byte{agentFailure}
+
+		case smartcard && (msg[0] == agentAddSmartcardKey || msg[0] == agentAddSmartcardKeyConstrained || msg[0] == agentRemoveSmartcardKey):
+			reply = []byte{agentSuccess}
+
+			if err := sessAgent.updateSmartcard(backend, msg); err != nil {
+				if sessAgent.log != nil {
+					sessAgent.log.Warnln("smartcard request failed:", err)
+				}
+
+				reply = []byte{agentFailure}
+			}
+
+		default:
+			// agent.ServeAgent answers every request with exactly one message
+			if err := writeAgentMessage(outer, msg); err != nil {
+				return err
+			}
+
+			var err error
+			if reply, err = readAgentMessage(outer); err != nil {
+				return err
+			}
+		}
+
+		if err := writeAgentMessage(conn, reply); err != nil {
+			return err
+		}
+	}
+}
+
+func readAgentMessage(r io.Reader) ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(length[:])
+	if size > maxAgentMessage {
+		return nil, fmt.Errorf("agent message too large: %d bytes", size)
+	}
+
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func writeAgentMessage(w io.Writer, msg []byte) error {
+	buf := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(msg)), uint32(len(msg)))
+	buf = append(buf, msg...)
+
+	_, err := w.Write(buf)
+
+	return err
+}
+
+// updateSmartcard attaches or detaches the YubiKey named by the reader ID of the message
+func (s *sessionAgent) updateSmartcard(backend smartcardBackend, msg []byte) error {
+	op := audit.OpAddSmartcard
+	if msg[0] == agentRemoveSmartcardKey {
+		op = audit.OpRemoveSmartcard
+	}
+
+	event := s.event(op)
+
+	err := func() error {
+		var req struct {
+			ReaderID    string
+			PIN         []byte
+			Constraints []byte `ssh:"rest"`
+		}
+
+		if err := ssh.Unmarshal(msg[1:], &req); err != nil {
+			return fmt.Errorf("failed to parse smartcard request: %w", err)
+		}
+
+		// the PIN is asked when a key is used, not when the card is added
+		clear(req.PIN)
+
+		if len(req.Constraints) > 0 {
+			return ErrSmartcardConstraints
+		}
+
+		serial, err := parseReaderID(req.ReaderID)
+		if err != nil {
+			return err
+		}
+
+		event.Serial = serial
+
+		if s.sess.forwarded() {
+			return ErrSmartcardForwarded
+		}
+
+		if backend.Locked() {
+			return ErrAgentLocked
+		}
+
+		if op == audit.OpRemoveSmartcard {
+			return backend.DetachYubikey(serial)
+		}
+
+		return backend.AttachYubikey(serial)
+	}()
+
+	s.record(event, err)
+
+	return err
+}
+
+// parseReaderID accepts the YubiKey serial number given to `ssh-add -s`
+func parseReaderID(readerID string) (uint32, error) {
+	serial, err := strconv.ParseUint(strings.TrimSpace(readerID), 10, 32)
+	if err != nil || serial == 0 {
+		return 0, fmt.Errorf("invalid yubikey serial %q", readerID)
+	}
+
+	return uint32(serial), nil
+}
@@ -0,0 +1,183 @@
+package sshagent
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vitalvas/oneauth/internal/agentkey"
+	"github.com/vitalvas/oneauth/internal/netutil"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// smartcardTestBackend records the cards attached through the agent protocol
+type smartcardTestBackend struct {
+	*SoftAgent
+	attached []uint32
+}
+
+func (b *smartcardTestBackend) AttachYubikey(serial uint32) error {
+	b.attached = append(b.attached, serial)
+	return nil
+}
+
+func (b *smartcardTestBackend) DetachYubikey(serial uint32) error {
+	for i, s := range b.attached {
+		if s == serial {
+			b.attached = append(b.attached[:i], b.attached[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrYubikeyNotAttached
+}
+
+func smartcardMessage(op byte, readerID, pin string, constraints ...byte) []byte {
+	msg := append([]byte{op}, ssh.Marshal(struct {
+		ReaderID string
+		PIN      string
+	}{readerID, pin})...)
+
+	return append(msg, constraints...)
+}
+
+func TestServeAgentSmartcard(t *testing.T) {
+	serve := func(t *testing.T, sess *session) (*smartcardTestBackend, net.Conn) {
+		backend := &smartcardTestBackend{SoftAgent: NewSoftAgent("test", 0, logrus.New())}
+
+		server, client := net.Pipe()
+		t.Cleanup(func() {
+			client.Close()
+			server.Close()
+		})
+
+		go serveAgent(&sessionAgent{
+			sessionBackend: backend,
+			sess:           sess,
+			name:           "test",
+			log:            logrus.NewEntry(logrus.New()),
+		}, server)
+
+		return backend, client
+	}
+
+	request := func(t *testing.T, conn net.Conn, msg []byte) byte {
+		require.NoError(t, writeAgentMessage(conn, msg))
+
+		reply, err := readAgentMessage(conn)
+		require.NoError(t, err)
+		require.Len(t, reply, 1)
+
+		return reply[0]
+	}
+
+	t.Run("AddAndRemove", func(t *testing.T) {
+		backend, conn := serve(t, newSession(netutil.UnixCreds{}))
+
+		assert.Equal(t, byte(agentSuccess), request(t, conn, smartcardMessage(agentAddSmartcardKey, "12345678", "")))
+		assert.Equal(t, []uint32{12345678}, backend.attached)
+
+		assert.Equal(t, byte(agentSuccess), request(t, conn, smartcardMessage(agentRemoveSmartcardKey, "12345678", "")))
+		assert.Empty(t, backend.attached)
+
+		assert.Equal(t, byte(agentFailure), request(t, conn, smartcardMessage(agentRemoveSmartcardKey, "12345678", "")))
+	})
+
+	t.Run("InvalidSerial", func(t *testing.T) {
+		backend, conn := serve(t, newSession(netutil.UnixCreds{}))
+
+		assert.Equal(t, byte(agentFailure), request(t, conn, smartcardMessage(agentAddSmartcardKey, "/usr/lib/opensc-pkcs11.so", "")))
+		assert.Empty(t, backend.attached)
+	})
+
+	t.Run("Constraints", func(t *testing.T) {
+		backend, conn := serve(t, newSession(netutil.UnixCreds{}))
+
+		assert.Equal(t, byte(agentFailure), request(t, conn, smartcardMessage(agentAddSmartcardKeyConstrained, "12345678", "", 3)))
+		assert.Empty(t, backend.attached)
+	})
+
+	t.Run("Forwarded", func(t *testing.T) {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+
+		hostKey, err := ssh.NewPublicKey(pub)
+		require.NoError(t, err)
+
+		sess := newSession(netutil.UnixCreds{})
+		sess.hops = []agentkey.Hop{{HostKey: hostKey, Forwarded: true}}
+
+		backend, conn := serve(t, sess)
+
+		assert.Equal(t, byte(agentFailure), request(t, conn, smartcardMessage(agentAddSmartcardKey, "12345678", "")))
+		assert.Empty(t, backend.attached)
+	})
+
+	t.Run("Locked", func(t *testing.T) {
+		backend, conn := serve(t, newSession(netutil.UnixCreds{}))
+		require.NoError(t, backend.Lock([]byte("secret")))
+
+		assert.Equal(t, byte(agentFailure), request(t, conn, smartcardMessage(agentAddSmartcardKey, "12345678", "")))
+		assert.Empty(t, backend.attached)
+	})
+
+	t.Run("PassesOtherRequests", func(t *testing.T) {
+		_, conn := serve(t, newSession(netutil.UnixCreds{}))
+
+		assert.Equal(t, byte(agentSuccess), request(t, conn, smartcardMessage(agentAddSmartcardKey, "42", "")))
+
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+
+		// the client reads replies in the background, so raw requests must come first
+		client := agent.NewClient(conn)
+		require.NoError(t, client.Add(agent.AddedKey{PrivateKey: priv, Comment: "test"}))
+
+		keys, err := client.List()
+		require.NoError(t, err)
+		require.Len(t, keys, 1)
+		assert.Equal(t, "test", keys[0].Comment)
+	})
+
+	t.Run("WithoutSmartcardBackend", func(t *testing.T) {
+		server, conn := net.Pipe()
+		t.Cleanup(func() { server.Close() })
+
+		sess := newSession(netutil.UnixCreds{})
+
+		go serveAgent(&sessionAgent{
+			sessionBackend: NewSoftAgent("test", 0, logrus.New()),
+			sess:           sess,
+			name:           "test",
+			log:            logrus.NewEntry(logrus.New()),
+		}, server)
+
+		assert.Equal(t, byte(agentFailure), request(t, conn, smartcardMessage(agentAddSmartcardKey, "12345678", "")))
+
+		// the requests of a client that disconnects are canceled
+		conn.Close()
+
+		select {
+		case <-sess.context().Done():
+		case <-time.After(time.Second):
+			t.Fatal("session is not canceled")
+		}
+	})
+}
+
+func TestParseReaderID(t *testing.T) {
+	serial, err := parseReaderID(" 12345678\n")
+	require.NoError(t, err)
+	assert.Equal(t, uint32(12345678), serial)
+
+	for _, readerID := range []string{"", "0", "-1", "yubikey", "99999999999"} {
+		_, err := parseReaderID(readerID)
+		assert.Error(t, err, readerID)
+	}
+}
@@ -2,7 +2,6 @@ package sshagent
 
 import (
 	"context"
-	"crypto/subtle"
 	"errors"
 	"fmt"
 	"io"
@@ -13,7 +12,9 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/vitalvas/oneauth/internal/agentkey"
+	"github.com/vitalvas/oneauth/internal/audit"
 	"github.com/vitalvas/oneauth/internal/keystore"
+	"github.com/vitalvas/oneauth/internal/keyvault"
 	"github.com/vitalvas/oneauth/internal/netutil"
 	"github.com/vitalvas/oneauth/internal/tools"
 	"golang.org/x/crypto/ssh"
@@ -28,9 +29,18 @@ type SoftAgent struct {
 	lock sync.Mutex
 	log  *logrus.Entry
 
+	actions        Actions
 	agentListener  net.Listener
 	lockPassphrase []byte
+	lockPolicy     LockPolicy
+	lastActive     time.Time
+	verifyPIN      pinVerifier
 	softKeys       *keystore.Store
+	audit          *audit.Logger
+	access         netutil.Access
+	persist        *persistentKeys
+	upstreams      []Upstream
+	slots          *slotView
 }
 
 // NewSoftAgent creates a new soft-key-only SSH agent
@@ -39,13 +49,132 @@ func NewSoftAgent(name string, keepKeySeconds int64, log *logrus.Logger) *SoftAg
 		"agent": name,
 	})
 
+	softKeys := keystore.New(keepKeySeconds)
+	softKeys.SetEvictHandler(evictHandler(name, nil, contextLogger))
+
 	return &SoftAgent{
-		name:     name,
-		log:      contextLogger,
-		softKeys: keystore.New(keepKeySeconds),
+		name:       name,
+		log:        contextLogger,
+		softKeys:   softKeys,
+		lastActive: time.Now(),
+	}
+}
+
+// SetActions replaces the actions used when signing
+func (a *SoftAgent) SetActions(actions Actions) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.actions = actions
+}
+
+// SetAccess replaces the rules checked for new connections
+func (a *SoftAgent) SetAccess(access netutil.Access) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.access = access
+}
+
+// SetAuditLogger sets the log that records requests of new connections
+func (a *SoftAgent) SetAuditLogger(logger *audit.Logger) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.audit = logger
+	a.softKeys.SetEvictHandler(a.evictHandler())
+}
+
+// SetPersistence keeps the keys added with ssh-add in the vault, encrypted to the slot of the YubiKey.
+// The stored keys are loaded on first use, with ECDH on the card. A nil vault turns persistence off.
+func (a *SoftAgent) SetPersistence(vault *keyvault.Vault, serial uint32, slot string, card VaultCard) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.persist = nil
+
+	if vault != nil {
+		a.persist = &persistentKeys{
+			vault:  vault,
+			serial: serial,
+			slot:   slot,
+			card:   card,
+		}
+	}
+
+	a.softKeys.SetEvictHandler(a.evictHandler())
+}
+
+// evictHandler must be called with the agent lock held, evicted keys are dropped from the vault as well
+func (a *SoftAgent) evictHandler() func(keystore.Eviction) {
+	logEviction := evictHandler(a.name, a.audit, a.log)
+	persist := a.persist
+	log := a.log
+
+	return func(ev keystore.Eviction) {
+		logEviction(ev)
+
+		if persist == nil {
+			return
+		}
+
+		if err := persist.vault.Delete(ev.Fingerprint); err != nil {
+			log.Warnln("failed to delete evicted key from vault:", err)
+		}
 	}
 }
 
+// loadPersisted adds the keys stored in the vault, a failed load is retried on the next request
+func (a *SoftAgent) loadPersisted() {
+	a.lock.Lock()
+	persist := a.persist
+	locked := a.lockPassphrase != nil
+	a.lock.Unlock()
+
+	if persist == nil || locked || persist.loaded.Load() {
+		return
+	}
+
+	persist.lock.Lock()
+	defer persist.lock.Unlock()
+
+	if persist.loaded.Load() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), vaultLoadTimeout)
+	defer cancel()
+
+	keys, err := persist.load(ctx, time.Now())
+	if err != nil {
+		a.log.Warnln("failed to load persisted keys:", err)
+		return
+	}
+
+	for _, added := range keys {
+		key, err := agentkey.NewKey(added)
+		if err != nil {
+			a.log.Warnln("failed to load persisted key:", err)
+			continue
+		}
+
+		if !a.softKeys.Add(key) {
+			key.Destroy()
+		}
+	}
+
+	if len(keys) > 0 {
+		a.log.Printf("loaded %d persisted keys", len(keys))
+	}
+
+	persist.loaded.Store(true)
+}
+
+// SetKeepKeySeconds changes how long idle keys added with ssh-add are kept
+func (a *SoftAgent) SetKeepKeySeconds(keepKeySeconds int64) {
+	a.softKeys.SetKeepKeySeconds(keepKeySeconds)
+}
+
 func (a *SoftAgent) Close() error {
 	if a.softKeys != nil {
 		a.softKeys.RemoveAll()
@@ -65,6 +194,12 @@ func (a *SoftAgent) setListener(listener net.Listener) {
 	a.agentListener = listener
 }
 
+// SetListener serves an inherited socket, e.g. from systemd socket activation.
+// ListenAndServe does not create or remove the socket file then.
+func (a *SoftAgent) SetListener(listener net.Listener) {
+	a.setListener(listener)
+}
+
 func (a *SoftAgent) handleConn(conn net.Conn) {
 	defer conn.Close()
 
@@ -79,18 +214,33 @@ func (a *SoftAgent) handleConn(conn net.Conn) {
 		return
 	}
 
-	if err := agent.ServeAgent(a, conn); err != nil && err != io.EOF {
+	a.lock.Lock()
+	auditLog := a.audit
+	access := a.access
+	a.lock.Unlock()
+
+	if err := access.Check(creds); err != nil {
+		a.log.Warnln(err)
+		return
+	}
+
+	sess := newSession(creds)
+	defer sess.close()
+
+	sessAgent := &sessionAgent{
+		sessionBackend: a,
+		sess:           sess,
+		name:           a.name,
+		audit:          auditLog,
+		log:            a.log,
+	}
+
+	if err := serveAgent(sessAgent, conn); err != nil && err != io.EOF {
 		a.log.Println("Agent client connection ended with error:", err)
 	}
 }
 
 func (a *SoftAgent) ListenAndServe(ctx context.Context, socketPath string) error {
-	defer func() {
-		if _, err := os.Stat(socketPath); err == nil {
-			os.Remove(socketPath)
-		}
-	}()
-
 	a.log.Println("listening ssh-agent on", socketPath)
 
 	if a.getListener() == nil {
@@ -103,17 +253,18 @@ func (a *SoftAgent) ListenAndServe(ctx context.Context, socketPath string) error
 			return fmt.Errorf("failed to listen: %w", err)
 		}
 
+		// the socket file is removed when the listener is closed, unless it was handed off to another process
 		a.setListener(listener)
 
-		if err := os.Chmod(socketPath, 0600); err != nil {
-			return fmt.Errorf("failed to chmod: %w", err)
-		}
-
 		defer func() {
 			if l := a.getListener(); l != nil {
 				l.Close()
 			}
 		}()
+
+		if err := os.Chmod(socketPath, 0600); err != nil {
+			return fmt.Errorf("failed to chmod: %w", err)
+		}
 	}
 
 	go func() {
@@ -123,6 +274,12 @@ func (a *SoftAgent) ListenAndServe(ctx context.Context, socketPath string) error
 		}
 	}()
 
+	watchCtx, stopWatch := context.WithCancel(ctx)
+	defer stopWatch()
+
+	go watchIdle(watchCtx, a)
+	go a.softKeys.Run(watchCtx)
+
 	for {
 		listener := a.getListener()
 		if listener == nil {
@@ -174,20 +331,42 @@ func (a *SoftAgent) Shutdown() error {
 
 // List returns all keys in the soft key store
 func (a *SoftAgent) List() ([]*agent.Key, error) {
-	a.lock.Lock()
-	defer a.lock.Unlock()
+	return a.listWithSession(&session{})
+}
+
+func (a *SoftAgent) listWithSession(sess *session) ([]*agent.Key, error) {
+	a.loadPersisted()
 
+	a.lock.Lock()
 	if a.lockPassphrase != nil {
+		a.lock.Unlock()
 		return nil, ErrAgentLocked
 	}
 
+	view := a.slots
+	a.lock.Unlock()
+
 	keys := make([]*agent.Key, 0, a.softKeys.Len())
+	seen := make(map[string]bool)
 
 	for _, key := range a.softKeys.List() {
+		seen[key.Fingerprint()] = true
+
+		if !sess.permitsListing(key) {
+			continue
+		}
+
 		keys = append(keys, key.AgentKey())
 	}
 
-	return keys, nil
+	if view != nil {
+		for _, key := range view.keys(sess) {
+			seen[ssh.FingerprintSHA256(key)] = true
+			keys = append(keys, key)
+		}
+	}
+
+	return append(keys, a.upstreamKeys(sess, seen)...), nil
 }
 
 func (a *SoftAgent) Sign(reqKey ssh.PublicKey, data []byte) (*ssh.Signature, error) {
@@ -195,36 +374,75 @@ func (a *SoftAgent) Sign(reqKey ssh.PublicKey, data []byte) (*ssh.Signature, err
 }
 
 func (a *SoftAgent) SignWithFlags(reqKey ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
-	a.lock.Lock()
-	defer a.lock.Unlock()
+	return a.signWithSession(&session{}, &audit.Event{Operation: audit.OpSign, Agent: a.name}, reqKey, data, flags)
+}
 
+func (a *SoftAgent) signWithSession(sess *session, event *audit.Event, reqKey ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	a.loadPersisted()
+
+	a.lock.Lock()
 	if a.lockPassphrase != nil {
+		a.lock.Unlock()
 		return nil, ErrAgentLocked
 	}
 
+	actions := a.actions
+	view := a.slots
+	a.lock.Unlock()
+
 	fp := ssh.FingerprintSHA256(reqKey)
+	event.Fingerprint = fp
+
 	dataHash := tools.FastHash(data)
 
 	a.log.Println("request to sign payload:", dataHash)
 
 	if key, ok := a.softKeys.Get(fp); ok {
-		sig, err := key.Sign(data, flags)
+		sig, err := signSoftKey(actions, sess, event, key, data, flags, a.log)
 		if err != nil {
 			return nil, err
 		}
 
 		a.log.Println("signed payload:", dataHash)
+
+		a.lock.Lock()
+		a.lastActive = time.Now()
+		a.lock.Unlock()
+
 		return sig, nil
 	}
 
-	return nil, fmt.Errorf("unknown key %s", fp)
+	var (
+		sig *ssh.Signature
+		err error
+	)
+
+	if view != nil && view.serves(sess, reqKey) {
+		sig, err = view.sign(sess, event, fp, data, flags)
+	} else {
+		sig, err = a.signUpstream(sess, event, actions, reqKey, data, flags)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	a.log.Println("signed payload:", dataHash)
+
+	a.lock.Lock()
+	a.lastActive = time.Now()
+	a.lock.Unlock()
+
+	return sig, nil
 }
 
 func (a *SoftAgent) Add(newKey agent.AddedKey) error {
 	a.lock.Lock()
-	defer a.lock.Unlock()
+	locked := a.lockPassphrase != nil
+	persist := a.persist
+	a.lock.Unlock()
 
-	if a.lockPassphrase != nil {
+	if locked {
 		return ErrAgentLocked
 	}
 
@@ -233,7 +451,20 @@ func (a *SoftAgent) Add(newKey agent.AddedKey) error {
 		return fmt.Errorf("Add: %w", err)
 	}
 
-	a.softKeys.Add(key)
+	// the key is stored first, so a key the agent serves survives a restart
+	if persist != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), vaultLoadTimeout)
+		err := persist.save(ctx, newKey, key)
+		cancel()
+
+		if err != nil {
+			key.Destroy()
+			return fmt.Errorf("Add: failed to persist key: %w", err)
+		}
+	}
+
+	// a key added again replaces the constraints it was stored with, like in the vault
+	a.softKeys.Replace(key)
 
 	return nil
 }
@@ -249,6 +480,12 @@ func (a *SoftAgent) Remove(reqKey ssh.PublicKey) error {
 	fp := ssh.FingerprintSHA256(reqKey)
 	a.softKeys.Remove(fp)
 
+	if a.persist != nil {
+		if err := a.persist.vault.Delete(fp); err != nil {
+			return fmt.Errorf("Remove: %w", err)
+		}
+	}
+
 	return nil
 }
 
@@ -256,7 +493,17 @@ func (a *SoftAgent) RemoveAll() error {
 	a.lock.Lock()
 	defer a.lock.Unlock()
 
-	return a.Close()
+	if err := a.Close(); err != nil {
+		return err
+	}
+
+	if a.persist != nil {
+		if err := a.persist.vault.Clear(); err != nil {
+			return fmt.Errorf("RemoveAll: %w", err)
+		}
+	}
+
+	return nil
 }
 
 func (a *SoftAgent) Lock(passphrase []byte) error {
@@ -271,29 +518,109 @@ func (a *SoftAgent) Lock(passphrase []byte) error {
 		return fmt.Errorf("Lock: %w", ErrNoPrivateKey)
 	}
 
-	a.lockPassphrase = tools.EncodePassphrase(passphrase)
+	a.lockWith(tools.EncodePassphrase(passphrase))
 
 	return nil
 }
 
-func (a *SoftAgent) Unlock(passphrase []byte) error {
+// AutoLock locks the agent without a passphrase, it is unlocked with the YubiKey PIN checked by the YubiKey agent
+func (a *SoftAgent) AutoLock(reason string) error {
 	a.lock.Lock()
 	defer a.lock.Unlock()
 
-	if a.lockPassphrase == nil {
+	if a.lockPassphrase != nil {
+		return fmt.Errorf("Lock: %w", ErrAgentLocked)
+	}
+
+	if a.verifyPIN == nil {
+		return fmt.Errorf("Lock: %w", ErrPINUnlockUnavailable)
+	}
+
+	a.lockWith(pinLock)
+
+	a.log.Println("agent locked:", reason)
+	recordAutoLock(a.name, a.audit, a.log, reason)
+
+	return nil
+}
+
+// lockWith must be called with the agent lock held
+func (a *SoftAgent) lockWith(lockPassphrase []byte) {
+	a.lockPassphrase = lockPassphrase
+
+	if a.lockPolicy.WipeSoftKeys {
+		a.softKeys.RemoveAll()
+
+		// the vault is kept, the keys are loaded again after the unlock
+		if a.persist != nil {
+			a.persist.loaded.Store(false)
+		}
+	}
+}
+
+func (a *SoftAgent) Unlock(passphrase []byte) error {
+	a.lock.Lock()
+	lockPassphrase := a.lockPassphrase
+	policy := a.lockPolicy
+	verifyPIN := a.verifyPIN
+	a.lock.Unlock()
+
+	if lockPassphrase == nil {
 		return errors.New("can't unlock not locked agent")
 	}
 
-	passphraseEncoded := tools.EncodePassphrase(passphrase)
-	if subtle.ConstantTimeCompare(passphraseEncoded, a.lockPassphrase) != 1 {
-		return errors.New("incorrect passphrase")
+	if err := checkUnlock(lockPassphrase, passphrase, policy, verifyPIN); err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	// another client may have unlocked and locked the agent with another passphrase meanwhile
+	if !sameLock(a.lockPassphrase, lockPassphrase) {
+		return ErrLockChanged
 	}
 
 	a.lockPassphrase = nil
+	a.lastActive = time.Now()
 
 	return nil
 }
 
+// SetLockPolicy replaces the rules that lock the agent
+func (a *SoftAgent) SetLockPolicy(policy LockPolicy) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.lockPolicy = policy
+}
+
+// SetPINVerifier sets the YubiKey PIN check that unlocks the agent, nil disables the unlock with the PIN
+func (a *SoftAgent) SetPINVerifier(verifyPIN func(ctx context.Context, pin string) error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.verifyPIN = verifyPIN
+}
+
+// PINUnlock reports whether the agent can be unlocked with the YubiKey PIN, so it can be locked without a passphrase
+func (a *SoftAgent) PINUnlock() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.verifyPIN != nil
+}
+
+func (a *SoftAgent) lockIfIdle(now time.Time) {
+	a.lock.Lock()
+	idle := a.lockPassphrase == nil && a.verifyPIN != nil && a.lockPolicy.idleFor(a.lastActive, now)
+	a.lock.Unlock()
+
+	if idle {
+		a.AutoLock(LockReasonIdle)
+	}
+}
+
 func (a *SoftAgent) Signers() ([]ssh.Signer, error) {
 	return nil, fmt.Errorf("Signers: %w", ErrOperationUnsupported)
 }
@@ -14,6 +14,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/vitalvas/oneauth/internal/netutil"
 	"golang.org/x/crypto/ssh"
 	sshagent "golang.org/x/crypto/ssh/agent"
 )
@@ -90,6 +91,26 @@ func TestSoftAgentKeyOperations(t *testing.T) {
 	assert.Empty(t, keys)
 }
 
+func TestSoftAgentAddAgain(t *testing.T) {
+	agent := NewSoftAgent("test", 300, logrus.New())
+	defer agent.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	require.NoError(t, agent.Add(sshagent.AddedKey{PrivateKey: key, Comment: "first", LifetimeSecs: 60}))
+	require.NoError(t, agent.Add(sshagent.AddedKey{PrivateKey: key, Comment: "second"}))
+
+	keys, err := agent.List()
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	assert.Equal(t, "second", keys[0].Comment)
+
+	soft := agent.SoftKeys()
+	require.Len(t, soft, 1)
+	assert.True(t, soft[0].ExpiresAt().IsZero())
+}
+
 func TestSoftAgentLockUnlock(t *testing.T) {
 	agent := NewSoftAgent("test", 300, logrus.New())
 	defer agent.Close()
@@ -497,3 +518,43 @@ func TestSoftAgentMultipleKeys(t *testing.T) {
 	require.NoError(t, err)
 	assert.Empty(t, keys)
 }
+
+func TestSoftAgentAccess(t *testing.T) {
+	agent := NewSoftAgent("access-test", 300, logrus.New())
+
+	tmpDir, err := os.MkdirTemp("", "soft-agent-access")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	socketPath := filepath.Join(tmpDir, "agent.sock")
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	go func() {
+		agent.ListenAndServe(ctx, socketPath)
+	}()
+
+	require.NoError(t, waitForSocket(socketPath, 100*time.Millisecond))
+
+	exe, err := os.Executable()
+	require.NoError(t, err)
+
+	list := func() error {
+		conn, err := net.Dial("unix", socketPath)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = sshagent.NewClient(conn).List()
+		return err
+	}
+
+	t.Run("Denied", func(t *testing.T) {
+		agent.SetAccess(netutil.Access{DenyExe: []string{filepath.Base(exe)}})
+		assert.Error(t, list())
+	})
+
+	t.Run("Allowed", func(t *testing.T) {
+		agent.SetAccess(netutil.Access{AllowExe: []string{exe}, AllowUIDs: []int{os.Getuid()}})
+		assert.NoError(t, list())
+	})
+}
@@ -0,0 +1,30 @@
+package sshagent
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/vitalvas/oneauth/internal/agentkey"
+	"github.com/vitalvas/oneauth/internal/audit"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// signSoftKey signs with a key added through ssh-add, enforcing the constraints it was added with.
+// Lifetime is enforced by the keystore, so destination restrictions, the signing policy and confirmation are left here.
+func signSoftKey(actions Actions, sess *session, event *audit.Event, key *agentkey.Key, data []byte, flags agent.SignatureFlags, log *logrus.Entry) (*ssh.Signature, error) {
+	if err := sess.checkSign(key, data); err != nil {
+		return nil, err
+	}
+
+	confirmed, err := checkPolicy(actions, event, sess.peer, key.Name(), key.AgentKey().Comment, log)
+	if err != nil {
+		return nil, err
+	}
+
+	if key.ConfirmBeforeUse() && !confirmed {
+		if err := confirmKeyUse(actions.Askpass, key, sess.peer); err != nil {
+			return nil, err
+		}
+	}
+
+	return key.Sign(data, flags)
+}
@@ -1,12 +1,18 @@
 package sshagent
 
 import (
-	"crypto/rand"
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"slices"
 	"time"
 
 	"github.com/go-piv/piv-go/v2/piv"
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
+	"github.com/vitalvas/oneauth/internal/agentkey"
+	"github.com/vitalvas/oneauth/internal/audit"
+	"github.com/vitalvas/oneauth/internal/netutil"
 	"github.com/vitalvas/oneauth/internal/tools"
 	"github.com/vitalvas/oneauth/internal/yubikey"
 	"golang.org/x/crypto/ssh"
@@ -18,47 +24,55 @@ func (a *SSHAgent) RemoveAll() error {
 }
 
 func (a *SSHAgent) List() ([]*agent.Key, error) {
-	a.lock.Lock()
-	defer a.lock.Unlock()
+	return a.listWithSession(&session{})
+}
 
-	if a.lockPassphrase != nil {
+func (a *SSHAgent) listWithSession(sess *session) ([]*agent.Key, error) {
+	if a.Locked() {
 		return nil, ErrAgentLocked
 	}
 
-	keys := make([]*agent.Key, 0, len(yubikey.AllSSHSlots)+a.softKeys.Len())
+	keys := a.slotAgentKeys(sess, nil)
 
-	if a.yk == nil {
-		return nil, fmt.Errorf("no yubikey available")
-	}
+	for _, key := range a.softKeys.List() {
+		if !sess.permitsListing(key) {
+			continue
+		}
 
-	activeSlots, err := a.yk.GetActiveSlots(yubikey.AllSSHSlots...)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get active slots: %w", err)
+		keys = append(keys, key.AgentKey())
 	}
 
-	for _, slot := range activeSlots {
-		certPublicKey, err := a.yk.GetCertPublicKey(slot.PIVSlot)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get public key: %w", err)
+	return keys, nil
+}
+
+// slotAgentKeys returns the keys of the YubiKey slots for the connection, limited to the slots
+// permitted by the view of a named agent when it is not nil
+func (a *SSHAgent) slotAgentKeys(sess *session, view *slotView) []*agent.Key {
+	ctx, cancel := context.WithTimeout(sess.context(), a.signTimeout())
+	defer cancel()
+
+	// soft keys are served while no YubiKey is plugged in, failed cards are logged by slotKeys
+	slotKeys, _ := a.slotKeys(ctx)
+
+	keys := make([]*agent.Key, 0, len(slotKeys))
+
+	for _, key := range slotKeys {
+		if !view.permits(key.Slot) {
+			continue
 		}
 
-		pk, err := ssh.NewPublicKey(certPublicKey)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create ssh public key: %w", err)
+		if sess.forwarded() && a.localOnlySlot(key.Slot) {
+			continue
 		}
 
 		keys = append(keys, &agent.Key{
-			Format:  pk.Type(),
-			Blob:    pk.Marshal(),
-			Comment: fmt.Sprintf("YubiKey #%d PIV Slot 0x%s", a.yk.Serial, slot.PIVSlot.String()),
+			Format:  key.PublicKey.Type(),
+			Blob:    key.PublicKey.Marshal(),
+			Comment: key.Comment,
 		})
 	}
 
-	for _, key := range a.softKeys.List() {
-		keys = append(keys, key.AgentKey())
-	}
-
-	return keys, nil
+	return keys
 }
 
 func (a *SSHAgent) Sign(reqKey ssh.PublicKey, data []byte) (*ssh.Signature, error) {
@@ -66,67 +80,145 @@ func (a *SSHAgent) Sign(reqKey ssh.PublicKey, data []byte) (*ssh.Signature, erro
 }
 
 func (a *SSHAgent) SignWithFlags(reqKey ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
-	a.lock.Lock()
-	defer a.lock.Unlock()
+	return a.signWithSession(&session{}, &audit.Event{Operation: audit.OpSign, Agent: rpcapi.DefaultAgent}, reqKey, data, flags)
+}
 
+func (a *SSHAgent) signWithSession(sess *session, event *audit.Event, reqKey ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	a.lock.Lock()
 	if a.lockPassphrase != nil {
+		a.lock.Unlock()
 		return nil, ErrAgentLocked
 	}
 
+	actions := a.actions
+	a.lock.Unlock()
+
 	fp := ssh.FingerprintSHA256(reqKey)
+	event.Fingerprint = fp
 
-	if a.yk == nil {
-		return nil, fmt.Errorf("no yubikey available")
+	var (
+		sig *ssh.Signature
+		err error
+	)
+
+	// soft keys may wait for the user to confirm, so they are signed without holding the agent lock
+	if key, ok := a.softKeys.Get(fp); ok {
+		sig, err = signSoftKey(actions, sess, event, key, data, flags, a.log)
+	} else {
+		sig, err = a.signYubikey(sess, event, fp, data, flags, nil)
 	}
 
-	keys, err := a.yk.ListKeys(yubikey.AllSlots...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list keys: %w", err)
+		return nil, err
 	}
 
+	a.markActive()
+
+	return sig, nil
+}
+
+// signYubikey finds the key in the slot inventory and signs on the card worker, a view limits the usable slots.
+// The agent lock is not held while the card waits for the PIN or touch.
+func (a *SSHAgent) signYubikey(sess *session, event *audit.Event, fp string, data []byte, flags agent.SignatureFlags, view *slotView) (*ssh.Signature, error) {
+	a.lock.Lock()
+	actions := a.actions
+	a.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(sess.context(), a.signTimeout())
+	defer cancel()
+
 	dataHash := tools.FastHash(data)
 
 	a.log.Println("request to sign payload:", dataHash)
 
-	for _, key := range keys {
-		sshPublicKey, err := ssh.NewPublicKey(key.PublicKey)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create ssh public key for sing: %w", err)
-		}
+	yk, key, err := a.findSlotKey(ctx, fp)
+	if err != nil {
+		return nil, err
+	}
 
-		if fp != ssh.FingerprintSHA256(sshPublicKey) {
-			continue
-		}
+	if !view.permits(key.Slot) {
+		return nil, fmt.Errorf("unknown key %s", fp)
+	}
 
-		hookEnv := map[string]string{
-			"YUBIKEY_SLOT":   key.Slot.String(),
-			"YUBIKEY_SERIAL": fmt.Sprintf("%d", a.yk.Serial),
-		}
+	event.Serial = yk.Serial
+	event.Slot = key.Slot.String()
 
-		if a.actions.BeforeSignHook != "" {
-			if err := tools.RunCommand(a.actions.BeforeSignHook, hookEnv); err != nil {
-				return nil, fmt.Errorf("before sign hook failed: %w", err)
-			}
+	if sess.forwarded() && a.localOnlySlot(key.Slot) {
+		return nil, fmt.Errorf("slot %s is not available through a forwarded agent", key.Slot.String())
+	}
+
+	keyName := fmt.Sprintf("YubiKey %d slot %s", yk.Serial, key.Slot.String())
+
+	if _, err := checkPolicy(actions, event, sess.peer, keyName, key.Subject.CommonName, a.log); err != nil {
+		return nil, err
+	}
+
+	hookEnv := map[string]string{
+		"YUBIKEY_SLOT":   key.Slot.String(),
+		"YUBIKEY_SERIAL": fmt.Sprintf("%d", yk.Serial),
+	}
+
+	if actions.BeforeSignHook != "" {
+		if err := tools.RunCommand(actions.BeforeSignHook, hookEnv); err != nil {
+			return nil, fmt.Errorf("before sign hook failed: %w", err)
 		}
+	}
+
+	req := CardRequest{
+		Operation:   CardOpSign,
+		Serial:      yk.Serial,
+		Slot:        key.Slot.String(),
+		Fingerprint: fp,
+		PID:         sess.peer.PID,
+		Exe:         sess.peer.Exe,
+	}
+
+	var sig *ssh.Signature
 
-		sig, err := a.sshSign(key, data, flags)
+	err = a.cards.do(ctx, req, func() error {
+		signature, err := a.sshSign(ctx, yk, key, data, flags, sess.peer)
 		if err != nil {
-			return nil, fmt.Errorf("failed to sign: %w", err)
+			return err
 		}
 
-		a.log.Println("signed with slot:", key.Slot.String(), "payload:", dataHash)
+		sig = signature
 
-		return sig, nil
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign: %w", err)
 	}
 
-	if key, ok := a.softKeys.Get(fp); ok {
-		return key.Sign(data, flags)
+	a.log.Println("signed with yubikey:", yk.Serial, "slot:", key.Slot.String(), "payload:", dataHash)
+
+	return sig, nil
+}
+
+// findSlotKey returns the plugged in YubiKey that holds the key
+func (a *SSHAgent) findSlotKey(ctx context.Context, fp string) (*yubikey.Yubikey, yubikey.Cert, error) {
+	inventory, err := a.slotInventory(ctx)
+	if err != nil {
+		return nil, yubikey.Cert{}, err
+	}
+
+	for _, card := range inventory {
+		for _, key := range card.certs {
+			sshPublicKey, err := ssh.NewPublicKey(key.PublicKey)
+			if err != nil {
+				return nil, yubikey.Cert{}, fmt.Errorf("failed to create ssh public key for sing: %w", err)
+			}
+
+			if fp == ssh.FingerprintSHA256(sshPublicKey) {
+				return card.yk, key, nil
+			}
+		}
 	}
 
-	return nil, fmt.Errorf("unknown key %s", fp)
+	return nil, yubikey.Cert{}, fmt.Errorf("unknown key %s", fp)
 }
 
-func (a *SSHAgent) sshSign(key yubikey.Cert, data []byte, _ agent.SignatureFlags) (*ssh.Signature, error) {
+// sshSign signs with the key in the slot, RSA keys honor the rsa-sha2-256 and rsa-sha2-512 signature flags
+func (a *SSHAgent) sshSign(ctx context.Context, yk *yubikey.Yubikey, key yubikey.Cert, data []byte, flags agent.SignatureFlags, peer netutil.UnixCreds) (*ssh.Signature, error) {
 	if _, skip := os.LookupEnv("I_AM_A_REALLY_STUPID_PERSON_WHO_IGNORES_SECURITY_ADVICE"); !skip {
 		if !key.NotBefore.IsZero() && key.NotBefore.After(time.Now()) {
 			return nil, fmt.Errorf("key not yet valid")
@@ -137,8 +229,35 @@ func (a *SSHAgent) sshSign(key yubikey.Cert, data []byte, _ agent.SignatureFlags
 		}
 	}
 
-	priv, err := a.yk.PrivateKey(key.Slot.PIVSlot, key.PublicKey, piv.KeyAuth{
-		PINPrompt: a.askPINPrompt,
+	pinReq := pinRequest{
+		serial:  yk.Serial,
+		slot:    key.Slot.String(),
+		peer:    peer,
+		retries: -1,
+	}
+
+	// the retries are read before signing, the PIN prompt runs inside the card transaction
+	if retries, err := yk.Retries(); err == nil {
+		pinReq.retries = retries
+
+		a.lock.Lock()
+		a.setPINRetries(yk.Serial, retries)
+		a.lock.Unlock()
+	}
+
+	var (
+		source    pinSource
+		promptErr error
+	)
+
+	priv, err := yk.PrivateKey(key.Slot.PIVSlot, key.PublicKey, piv.KeyAuth{
+		PINPrompt: func() (string, error) {
+			pin, from, err := a.askPINPrompt(ctx, pinReq)
+			source = from
+			promptErr = err
+
+			return pin, err
+		},
 	})
 
 	if err != nil {
@@ -150,5 +269,36 @@ func (a *SSHAgent) sshSign(key yubikey.Cert, data []byte, _ agent.SignatureFlags
 		return nil, fmt.Errorf("failed to create signer: %w", err)
 	}
 
-	return signer.Sign(rand.Reader, data)
+	sig, err := agentkey.SignWithFlags(signer, data, flags)
+	if err != nil {
+		// piv-go does not wrap the errors of the PIN prompt
+		if promptErr != nil {
+			return nil, promptErr
+		}
+
+		var authErr piv.AuthErr
+		if errors.As(err, &authErr) {
+			a.rejectedPIN(yk.Serial, source)
+
+			a.lock.Lock()
+			a.setPINRetries(yk.Serial, authErr.Retries)
+			a.lock.Unlock()
+
+			if authErr.Retries == 0 {
+				return nil, fmt.Errorf("%w: %d", ErrPINBlocked, yk.Serial)
+			}
+		}
+
+		return nil, err
+	}
+
+	return sig, nil
+}
+
+// localOnlySlot reports whether the slot must not be used through agent forwarding
+func (a *SSHAgent) localOnlySlot(slot yubikey.Slot) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return slices.Contains(a.localOnlySlots, slot.String())
 }
@@ -1,14 +1,20 @@
 package sshagent
 
 import (
-	"crypto/subtle"
+	"context"
 	"errors"
 	"fmt"
+	"time"
 
+	"github.com/vitalvas/oneauth/cmd/oneauth/rpcapi"
 	"github.com/vitalvas/oneauth/internal/tools"
+	"github.com/vitalvas/oneauth/internal/yubikey"
 )
 
 func (a *SSHAgent) Lock(passphrase []byte) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
 	if a.lockPassphrase != nil {
 		return fmt.Errorf("Lock: %w", ErrAgentLocked)
 	}
@@ -17,22 +23,144 @@ func (a *SSHAgent) Lock(passphrase []byte) error {
 		return fmt.Errorf("Lock: %w", ErrNoPrivateKey)
 	}
 
-	a.lockPassphrase = tools.EncodePassphrase(passphrase)
+	a.lockWith(tools.EncodePassphrase(passphrase))
+
+	return nil
+}
+
+// AutoLock locks the agent without a passphrase, it is unlocked with the YubiKey PIN
+func (a *SSHAgent) AutoLock(reason string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.lockPassphrase != nil {
+		return fmt.Errorf("Lock: %w", ErrAgentLocked)
+	}
+
+	a.lockWith(pinLock)
+
+	a.log.Println("agent locked:", reason)
+	recordAutoLock(rpcapi.DefaultAgent, a.audit, a.log, reason)
 
 	return nil
 }
 
+// lockWith must be called with the agent lock held
+func (a *SSHAgent) lockWith(lockPassphrase []byte) {
+	a.lockPassphrase = lockPassphrase
+
+	// PINs entered with pinentry are asked for again after unlocking
+	a.pins = nil
+
+	if a.lockPolicy.WipeSoftKeys && a.softKeys != nil {
+		a.softKeys.RemoveAll()
+	}
+}
+
 func (a *SSHAgent) Unlock(passphrase []byte) error {
-	if a.lockPassphrase == nil {
+	a.lock.Lock()
+	lockPassphrase := a.lockPassphrase
+	policy := a.lockPolicy
+	a.lock.Unlock()
+
+	if lockPassphrase == nil {
 		return errors.New("can't unlock not locked agent")
 	}
 
-	passphraseEncoded := tools.EncodePassphrase(passphrase)
-	if subtle.ConstantTimeCompare(passphraseEncoded, a.lockPassphrase) != 1 {
-		return errors.New("incorrect passphrase")
+	if err := checkUnlock(lockPassphrase, passphrase, policy, a.VerifyPIN); err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	// another client may have unlocked and locked the agent with another passphrase meanwhile
+	if !sameLock(a.lockPassphrase, lockPassphrase) {
+		return ErrLockChanged
 	}
 
 	a.lockPassphrase = nil
+	a.lastActive = time.Now()
 
 	return nil
 }
+
+// VerifyPIN checks the PIN on the first plugged in YubiKey. The PIN is not checked when fewer than
+// min_pin_retries are left, or while the delay after the last wrong PIN runs.
+func (a *SSHAgent) VerifyPIN(ctx context.Context, pin string) error {
+	return a.WithYubikey(ctx, 0, func(yk *yubikey.Yubikey) error {
+		if err := a.unlockAttempts.check(time.Now()); err != nil {
+			return err
+		}
+
+		retries, err := yk.Retries()
+		if err != nil {
+			return fmt.Errorf("failed to get PIN retries: %w", err)
+		}
+
+		if retries == 0 {
+			return fmt.Errorf("%w: %d", ErrPINBlocked, yk.Serial)
+		}
+
+		if minRetries := a.minPINRetries(); retries < minRetries {
+			return fmt.Errorf("%w: %d left on yubikey %d", ErrPINUnlockRetriesLow, retries, yk.Serial)
+		}
+
+		err = yk.VerifyPIN(pin)
+		a.unlockAttempts.record(time.Now(), err)
+
+		return err
+	})
+}
+
+// SetLockPolicy replaces the rules that lock the agent
+func (a *SSHAgent) SetLockPolicy(policy LockPolicy) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.lockPolicy = policy
+}
+
+// SetLockHook sets the function called when a removed YubiKey locks the agent, e.g. to lock the soft-key agents
+func (a *SSHAgent) SetLockHook(hook func(reason string)) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.lockHook = hook
+}
+
+// markActive records that a key was used, it delays the idle lock
+func (a *SSHAgent) markActive() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.lastActive = time.Now()
+}
+
+func (a *SSHAgent) lockIfIdle(now time.Time) {
+	a.lock.Lock()
+	idle := a.lockPassphrase == nil && a.lockPolicy.idleFor(a.lastActive, now)
+	a.lock.Unlock()
+
+	if idle {
+		a.AutoLock(LockReasonIdle)
+	}
+}
+
+// lockOnRemoval locks the agent after an attached YubiKey was removed, when the policy asks for it
+func (a *SSHAgent) lockOnRemoval() {
+	a.lock.Lock()
+	policy := a.lockPolicy
+	hook := a.lockHook
+	a.lock.Unlock()
+
+	if !policy.OnYubikeyRemoval {
+		return
+	}
+
+	a.AutoLock(LockReasonYubikeyRemoved)
+
+	if hook != nil {
+		hook(LockReasonYubikeyRemoved)
+	}
+}
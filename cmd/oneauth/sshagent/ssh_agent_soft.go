@@ -9,6 +9,9 @@ import (
 )
 
 func (a *SSHAgent) Add(newKey agent.AddedKey) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
 	if a.lockPassphrase != nil {
 		return ErrAgentLocked
 	}
@@ -18,12 +21,16 @@ func (a *SSHAgent) Add(newKey agent.AddedKey) error {
 		return fmt.Errorf("Add: %w", err)
 	}
 
-	a.softKeys.Add(key)
+	// a key added again replaces the constraints it was added with
+	a.softKeys.Replace(key)
 
 	return nil
 }
 
 func (a *SSHAgent) Remove(reqKey ssh.PublicKey) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
 	if a.lockPassphrase != nil {
 		return ErrAgentLocked
 	}
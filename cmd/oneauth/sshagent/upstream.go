@@ -0,0 +1,186 @@
+package sshagent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/vitalvas/oneauth/internal/audit"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// upstreamTimeout bounds connecting to an upstream agent and listing its keys
+const upstreamTimeout = 5 * time.Second
+
+// Upstream is another agent whose keys a soft-key agent serves next to its own
+type Upstream struct {
+	SocketPath string
+	// Fingerprints and Comments limit the keys taken from the agent, a key matching either list is taken.
+	// Comments are glob patterns. Empty lists take every key.
+	Fingerprints []string
+	Comments     []string
+}
+
+// permits reports whether the key of the upstream agent is served
+func (u Upstream) permits(key *agent.Key) bool {
+	if len(u.Fingerprints) == 0 && len(u.Comments) == 0 {
+		return true
+	}
+
+	if slices.Contains(u.Fingerprints, ssh.FingerprintSHA256(key)) {
+		return true
+	}
+
+	for _, pattern := range u.Comments {
+		if ok, _ := path.Match(pattern, key.Comment); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dial connects to the upstream agent, the connection is closed when ctx is done
+func (u Upstream) dial(ctx context.Context) (agent.ExtendedAgent, func(), error) {
+	dialer := net.Dialer{Timeout: upstreamTimeout}
+
+	conn, err := dialer.DialContext(ctx, "unix", u.SocketPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to upstream agent %s: %w", u.SocketPath, err)
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+
+	return agent.NewClient(conn), func() {
+		stop()
+		conn.Close()
+	}, nil
+}
+
+// list returns the keys of the upstream agent that pass the filters
+func (u Upstream) list(ctx context.Context) ([]*agent.Key, error) {
+	ctx, cancel := context.WithTimeout(ctx, upstreamTimeout)
+	defer cancel()
+
+	client, closeConn, err := u.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer closeConn()
+
+	keys, err := client.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list keys of upstream agent %s: %w", u.SocketPath, err)
+	}
+
+	return slices.DeleteFunc(keys, func(key *agent.Key) bool {
+		return !u.permits(key)
+	}), nil
+}
+
+// fromSelf reports whether the connection comes from this process, e.g. an agent that has another
+// agent of this process as upstream. Upstreams are not asked then, so a loop of agents ends.
+func (s *session) fromSelf() bool {
+	return s.peer.PID == os.Getpid()
+}
+
+// upstreamKeys returns the keys of the upstream agents that are not in seen, an agent that fails is skipped
+func (a *SoftAgent) upstreamKeys(sess *session, seen map[string]bool) []*agent.Key {
+	a.lock.Lock()
+	upstreams := a.upstreams
+	a.lock.Unlock()
+
+	if sess.fromSelf() {
+		return nil
+	}
+
+	var out []*agent.Key
+
+	for _, upstream := range upstreams {
+		keys, err := upstream.list(sess.context())
+		if err != nil {
+			a.log.Warnln(err)
+			continue
+		}
+
+		for _, key := range keys {
+			fp := ssh.FingerprintSHA256(key)
+			if seen[fp] {
+				continue
+			}
+
+			seen[fp] = true
+			out = append(out, key)
+		}
+	}
+
+	return out
+}
+
+// signUpstream passes the request to the first upstream agent that serves the key,
+// after the signing policy of this agent allowed it
+func (a *SoftAgent) signUpstream(sess *session, event *audit.Event, actions Actions, reqKey ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	a.lock.Lock()
+	upstreams := a.upstreams
+	a.lock.Unlock()
+
+	if sess.fromSelf() {
+		return nil, fmt.Errorf("unknown key %s", event.Fingerprint)
+	}
+
+	blob := reqKey.Marshal()
+
+	for _, upstream := range upstreams {
+		keys, err := upstream.list(sess.context())
+		if err != nil {
+			a.log.Warnln(err)
+			continue
+		}
+
+		idx := slices.IndexFunc(keys, func(key *agent.Key) bool {
+			return bytes.Equal(key.Blob, blob)
+		})
+		if idx < 0 {
+			continue
+		}
+
+		event.Upstream = upstream.SocketPath
+
+		if _, err := checkPolicy(actions, event, sess.peer, keys[idx].Comment, keys[idx].Comment, a.log); err != nil {
+			return nil, err
+		}
+
+		client, closeConn, err := upstream.dial(sess.context())
+		if err != nil {
+			return nil, err
+		}
+
+		sig, err := client.SignWithFlags(reqKey, data, flags)
+		closeConn()
+
+		if err != nil {
+			return nil, fmt.Errorf("upstream agent %s: %w", upstream.SocketPath, err)
+		}
+
+		return sig, nil
+	}
+
+	return nil, fmt.Errorf("unknown key %s", event.Fingerprint)
+}
+
+// SetUpstreams replaces the agents whose keys are served next to the keys added with ssh-add
+func (a *SoftAgent) SetUpstreams(upstreams []Upstream) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.upstreams = upstreams
+}
@@ -0,0 +1,180 @@
+package sshagent
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vitalvas/oneauth/internal/audit"
+	"github.com/vitalvas/oneauth/internal/netutil"
+	"github.com/vitalvas/oneauth/internal/policy"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// serveTestKeyring serves an in-memory agent on a unix socket, like the system ssh-agent
+func serveTestKeyring(t *testing.T) (agent.Agent, string) {
+	t.Helper()
+
+	// unix socket paths are limited in length, so keep it short
+	dir, err := os.MkdirTemp("", "upstream")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	socketPath := filepath.Join(dir, "agent.sock")
+
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	keyring := agent.NewKeyring()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	return keyring, socketPath
+}
+
+func addTestKey(t *testing.T, target agent.Agent, comment string) ssh.PublicKey {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	require.NoError(t, target.Add(agent.AddedKey{PrivateKey: priv, Comment: comment}))
+
+	pub, err := ssh.NewPublicKey(priv.Public())
+	require.NoError(t, err)
+
+	return pub
+}
+
+func TestSoftAgentUpstreams(t *testing.T) {
+	keyring, socketPath := serveTestKeyring(t)
+
+	deployKey := addTestKey(t, keyring, "deploy@ci")
+	personalKey := addTestKey(t, keyring, "me@laptop")
+
+	comments := func(keys []*agent.Key) []string {
+		out := make([]string, 0, len(keys))
+		for _, key := range keys {
+			out = append(out, key.Comment)
+		}
+
+		return out
+	}
+
+	t.Run("List", func(t *testing.T) {
+		testAgent := NewSoftAgent("work", 0, logrus.New())
+		testAgent.SetUpstreams([]Upstream{{SocketPath: socketPath}})
+		addTestKey(t, testAgent, "local")
+
+		keys, err := testAgent.List()
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"local", "deploy@ci", "me@laptop"}, comments(keys))
+
+		// keys added to the agent stay local
+		upstreamKeys, err := keyring.List()
+		require.NoError(t, err)
+		assert.Len(t, upstreamKeys, 2)
+	})
+
+	t.Run("Filters", func(t *testing.T) {
+		testAgent := NewSoftAgent("work", 0, logrus.New())
+
+		testAgent.SetUpstreams([]Upstream{{SocketPath: socketPath, Comments: []string{"*@ci"}}})
+
+		keys, err := testAgent.List()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"deploy@ci"}, comments(keys))
+
+		testAgent.SetUpstreams([]Upstream{{SocketPath: socketPath, Fingerprints: []string{ssh.FingerprintSHA256(personalKey)}}})
+
+		keys, err = testAgent.List()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"me@laptop"}, comments(keys))
+
+		// a filtered key can not be used either
+		_, err = testAgent.Sign(deployKey, []byte("data"))
+		assert.ErrorContains(t, err, "unknown key")
+	})
+
+	t.Run("Duplicates", func(t *testing.T) {
+		testAgent := NewSoftAgent("work", 0, logrus.New())
+		testAgent.SetUpstreams([]Upstream{{SocketPath: socketPath}, {SocketPath: socketPath}})
+
+		keys, err := testAgent.List()
+		require.NoError(t, err)
+		assert.Len(t, keys, 2)
+	})
+
+	t.Run("Sign", func(t *testing.T) {
+		testAgent := NewSoftAgent("work", 0, logrus.New())
+		testAgent.SetUpstreams([]Upstream{{SocketPath: socketPath}})
+
+		event := &audit.Event{Operation: audit.OpSign, Agent: "work"}
+
+		sig, err := testAgent.signWithSession(&session{}, event, deployKey, []byte("data"), 0)
+		require.NoError(t, err)
+		assert.NoError(t, deployKey.Verify([]byte("data"), sig))
+		assert.Equal(t, socketPath, event.Upstream)
+	})
+
+	t.Run("Policy", func(t *testing.T) {
+		testAgent := NewSoftAgent("work", 0, logrus.New())
+		testAgent.SetUpstreams([]Upstream{{SocketPath: socketPath}})
+		testAgent.SetActions(Actions{
+			Policy: newTestPolicy(t, policy.Config{Default: policy.ActionDeny}),
+		})
+
+		_, err := testAgent.Sign(deployKey, []byte("data"))
+		assert.ErrorIs(t, err, ErrPolicyDenied)
+	})
+
+	t.Run("Locked", func(t *testing.T) {
+		testAgent := NewSoftAgent("work", 0, logrus.New())
+		testAgent.SetUpstreams([]Upstream{{SocketPath: socketPath}})
+
+		require.NoError(t, testAgent.Lock([]byte("secret")))
+
+		_, err := testAgent.Sign(deployKey, []byte("data"))
+		assert.ErrorIs(t, err, ErrAgentLocked)
+	})
+
+	t.Run("Unavailable", func(t *testing.T) {
+		testAgent := NewSoftAgent("work", 0, logrus.New())
+		testAgent.SetUpstreams([]Upstream{{SocketPath: filepath.Join(t.TempDir(), "missing.sock")}})
+		addTestKey(t, testAgent, "local")
+
+		keys, err := testAgent.List()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"local"}, comments(keys))
+	})
+
+	t.Run("FromSelf", func(t *testing.T) {
+		testAgent := NewSoftAgent("work", 0, logrus.New())
+		testAgent.SetUpstreams([]Upstream{{SocketPath: socketPath}})
+
+		// an agent of this process asking is not passed on, so a loop of agents ends
+		keys, err := testAgent.listWithSession(&session{peer: netutil.UnixCreds{PID: os.Getpid()}})
+		require.NoError(t, err)
+		assert.Empty(t, keys)
+	})
+}
@@ -0,0 +1,88 @@
+package sshagent
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	msgUserAuthRequest = 50
+
+	userauthMethodPublicKey          = "publickey"
+	userauthMethodPublicKeyHostbound = "publickey-hostbound-v00@openssh.com"
+)
+
+// userauthRequest is the payload ssh signs during publickey authentication (RFC 4252 section 7)
+type userauthRequest struct {
+	SessionID []byte
+	User      string
+	PublicKey []byte
+	// HostKey is only sent by OpenSSH clients that use publickey-hostbound-v00@openssh.com
+	HostKey ssh.PublicKey
+}
+
+func parseUserauthRequest(data []byte) (*userauthRequest, error) {
+	var msg struct {
+		SessionID []byte
+		Type      byte
+		User      string
+		Service   string
+		Method    string
+		HasSig    bool
+		Algo      string
+		PublicKey []byte
+		Rest      []byte `ssh:"rest"`
+	}
+
+	if err := ssh.Unmarshal(data, &msg); err != nil {
+		return nil, fmt.Errorf("not a userauth request: %w", err)
+	}
+
+	if msg.Type != msgUserAuthRequest {
+		return nil, fmt.Errorf("not a userauth request: message type %d", msg.Type)
+	}
+
+	if msg.Service != "ssh-connection" {
+		return nil, fmt.Errorf("unexpected userauth service %q", msg.Service)
+	}
+
+	if !msg.HasSig {
+		return nil, errors.New("userauth request without signature flag")
+	}
+
+	req := &userauthRequest{
+		SessionID: msg.SessionID,
+		User:      msg.User,
+		PublicKey: msg.PublicKey,
+	}
+
+	switch msg.Method {
+	case userauthMethodPublicKey:
+		if len(msg.Rest) > 0 {
+			return nil, errors.New("unexpected trailing data in userauth request")
+		}
+
+	case userauthMethodPublicKeyHostbound:
+		var hostbound struct {
+			HostKey []byte
+		}
+
+		if err := ssh.Unmarshal(msg.Rest, &hostbound); err != nil {
+			return nil, fmt.Errorf("failed to parse hostbound userauth request: %w", err)
+		}
+
+		hostKey, err := ssh.ParsePublicKey(hostbound.HostKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse host key: %w", err)
+		}
+
+		req.HostKey = hostKey
+
+	default:
+		return nil, fmt.Errorf("unexpected userauth method %q", msg.Method)
+	}
+
+	return req, nil
+}
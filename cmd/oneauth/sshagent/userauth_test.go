@@ -0,0 +1,90 @@
+package sshagent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// marshalUserauthRequest builds the payload ssh asks the agent to sign during authentication
+func marshalUserauthRequest(sessionID []byte, user string, key ssh.PublicKey, hostKey ssh.PublicKey) []byte {
+	method := userauthMethodPublicKey
+	if hostKey != nil {
+		method = userauthMethodPublicKeyHostbound
+	}
+
+	data := ssh.Marshal(struct {
+		SessionID []byte
+		Type      byte
+		User      string
+		Service   string
+		Method    string
+		HasSig    bool
+		Algo      string
+		PublicKey []byte
+	}{
+		SessionID: sessionID,
+		Type:      msgUserAuthRequest,
+		User:      user,
+		Service:   "ssh-connection",
+		Method:    method,
+		HasSig:    true,
+		Algo:      key.Type(),
+		PublicKey: key.Marshal(),
+	})
+
+	if hostKey != nil {
+		data = append(data, ssh.Marshal(struct{ HostKey []byte }{hostKey.Marshal()})...)
+	}
+
+	return data
+}
+
+func TestParseUserauthRequest(t *testing.T) {
+	userKey, _ := createTestSigner(t)
+	hostKey, _ := createTestSigner(t)
+
+	t.Run("PublicKey", func(t *testing.T) {
+		req, err := parseUserauthRequest(marshalUserauthRequest([]byte("sid"), "git", userKey, nil))
+		require.NoError(t, err)
+
+		assert.Equal(t, []byte("sid"), req.SessionID)
+		assert.Equal(t, "git", req.User)
+		assert.Equal(t, userKey.Marshal(), req.PublicKey)
+		assert.Nil(t, req.HostKey)
+	})
+
+	t.Run("Hostbound", func(t *testing.T) {
+		req, err := parseUserauthRequest(marshalUserauthRequest([]byte("sid"), "git", userKey, hostKey))
+		require.NoError(t, err)
+
+		require.NotNil(t, req.HostKey)
+		assert.Equal(t, hostKey.Marshal(), req.HostKey.Marshal())
+	})
+
+	t.Run("TrailingData", func(t *testing.T) {
+		data := append(marshalUserauthRequest([]byte("sid"), "git", userKey, nil), 0x00)
+
+		_, err := parseUserauthRequest(data)
+		assert.Error(t, err)
+	})
+
+	t.Run("NotUserauth", func(t *testing.T) {
+		_, err := parseUserauthRequest([]byte("arbitrary data"))
+		assert.Error(t, err)
+	})
+
+	t.Run("WrongService", func(t *testing.T) {
+		data := ssh.Marshal(struct {
+			SessionID []byte
+			Type      byte
+			User      string
+			Service   string
+		}{[]byte("sid"), msgUserAuthRequest, "git", "ssh-userauth"})
+
+		_, err := parseUserauthRequest(data)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,297 @@
+package sshagent
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-piv/piv-go/v2/piv"
+	"github.com/vitalvas/oneauth/internal/agentkey"
+	"github.com/vitalvas/oneauth/internal/keyvault"
+	"github.com/vitalvas/oneauth/internal/yubikey"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// vaultLoadTimeout bounds the wait for the card and the PIN when persisted keys are stored or loaded
+const vaultLoadTimeout = time.Minute
+
+// VaultCard is the YubiKey agent that encrypts and unwraps the persisted keys of a soft-key agent
+type VaultCard interface {
+	SlotPublicKey(ctx context.Context, serial uint32, slot string) (crypto.PublicKey, error)
+	SharedKeys(ctx context.Context, serial uint32, slot string, peers []*ecdh.PublicKey) ([][]byte, error)
+}
+
+// SlotPublicKey returns the public key of the certificate in the slot of the YubiKey
+func (a *SSHAgent) SlotPublicKey(ctx context.Context, serial uint32, slot string) (crypto.PublicKey, error) {
+	var pub crypto.PublicKey
+
+	err := a.WithYubikey(ctx, serial, func(yk *yubikey.Yubikey) error {
+		cert, err := slotCert(yk, slot)
+		if err != nil {
+			return err
+		}
+
+		pub = cert.PublicKey
+
+		return nil
+	})
+
+	return pub, err
+}
+
+// SharedKeys does ECDH on the card with the EC key in the slot for every peer key.
+// The PIN is asked for once, like for a signature.
+func (a *SSHAgent) SharedKeys(ctx context.Context, serial uint32, slot string, peers []*ecdh.PublicKey) ([][]byte, error) {
+	var secrets [][]byte
+
+	err := a.WithYubikey(ctx, serial, func(yk *yubikey.Yubikey) error {
+		cert, err := slotCert(yk, slot)
+		if err != nil {
+			return err
+		}
+
+		pinReq := pinRequest{
+			serial:  yk.Serial,
+			slot:    cert.Slot.String(),
+			retries: -1,
+		}
+
+		if retries, err := yk.Retries(); err == nil {
+			pinReq.retries = retries
+		}
+
+		var source pinSource
+
+		priv, err := yk.PrivateKey(cert.Slot.PIVSlot, cert.PublicKey, piv.KeyAuth{
+			PINPrompt: func() (string, error) {
+				pin, from, err := a.askPINPrompt(ctx, pinReq)
+				source = from
+
+				return pin, err
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get private key: %w", err)
+		}
+
+		ecPriv, ok := priv.(*piv.ECDSAPrivateKey)
+		if !ok {
+			return fmt.Errorf("%w: slot %s", keyvault.ErrUnsupportedKey, cert.Slot.String())
+		}
+
+		for _, peer := range peers {
+			secret, err := ecPriv.ECDH(peer)
+			if err != nil {
+				var authErr piv.AuthErr
+				if errors.As(err, &authErr) {
+					a.rejectedPIN(yk.Serial, source)
+				}
+
+				return fmt.Errorf("failed to unwrap key: %w", err)
+			}
+
+			secrets = append(secrets, secret)
+		}
+
+		return nil
+	})
+
+	return secrets, err
+}
+
+func slotCert(yk *yubikey.Yubikey, slot string) (yubikey.Cert, error) {
+	pivSlot, err := yubikey.ParseSlot(slot)
+	if err != nil {
+		return yubikey.Cert{}, err
+	}
+
+	certs, err := yk.ListKeys(pivSlot)
+	if err != nil {
+		return yubikey.Cert{}, err
+	}
+
+	if len(certs) == 0 {
+		return yubikey.Cert{}, fmt.Errorf("no certificate in slot %s of yubikey %d", pivSlot.String(), yk.Serial)
+	}
+
+	return certs[0], nil
+}
+
+// persistedKey is the sealed content of a vault record
+type persistedKey struct {
+	PrivateKey       []byte                      `json:"private_key"`
+	Comment          string                      `json:"comment,omitempty"`
+	ConfirmBeforeUse bool                        `json:"confirm_before_use,omitempty"`
+	Constraints      []agent.ConstraintExtension `json:"constraints,omitempty"`
+}
+
+// persistentKeys keeps the keys added to a soft-key agent in a vault encrypted to a YubiKey slot
+type persistentKeys struct {
+	vault  *keyvault.Vault
+	serial uint32
+	slot   string
+	card   VaultCard
+
+	// lock serializes loading, loaded is set once the records are in the key store
+	lock   sync.Mutex
+	loaded atomic.Bool
+}
+
+// recipient returns the slot of the vault, the card is asked only for a new vault
+func (p *persistentKeys) recipient(ctx context.Context) (keyvault.Recipient, error) {
+	recipient, ok, err := p.vault.Recipient()
+	if err != nil {
+		return keyvault.Recipient{}, err
+	}
+
+	if ok {
+		return recipient, nil
+	}
+
+	pub, err := p.card.SlotPublicKey(ctx, p.serial, p.slot)
+	if err != nil {
+		return keyvault.Recipient{}, err
+	}
+
+	return keyvault.NewRecipient(p.serial, p.slot, pub)
+}
+
+// save seals the key added with ssh-add into the vault
+func (p *persistentKeys) save(ctx context.Context, added agent.AddedKey, key *agentkey.Key) error {
+	recipient, err := p.recipient(ctx)
+	if err != nil {
+		return err
+	}
+
+	block, err := ssh.MarshalPrivateKey(added.PrivateKey, added.Comment)
+	if err != nil {
+		return err
+	}
+
+	payload := persistedKey{
+		PrivateKey:       pem.EncodeToMemory(block),
+		Comment:          added.Comment,
+		ConfirmBeforeUse: added.ConfirmBeforeUse,
+		Constraints:      added.ConstraintExtensions,
+	}
+
+	defer clear(payload.PrivateKey)
+	defer clear(block.Bytes)
+
+	plaintext, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	defer clear(plaintext)
+
+	record, err := keyvault.Seal(recipient, key.Fingerprint(), key.ExpiresAt(), plaintext)
+	if err != nil {
+		return err
+	}
+
+	return p.vault.Put(recipient, record)
+}
+
+// load unwraps the records on the card, expired records are dropped from the vault
+func (p *persistentKeys) load(ctx context.Context, now time.Time) ([]agent.AddedKey, error) {
+	recipient, records, err := p.vault.Records()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		live    []keyvault.Record
+		expired []string
+		peers   []*ecdh.PublicKey
+	)
+
+	for _, record := range records {
+		if record.Expired(now) {
+			expired = append(expired, record.Fingerprint)
+			continue
+		}
+
+		peer, err := record.EphemeralKey(recipient)
+		if err != nil {
+			return nil, err
+		}
+
+		live = append(live, record)
+		peers = append(peers, peer)
+	}
+
+	if len(expired) > 0 {
+		if err := p.vault.Delete(expired...); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(live) == 0 {
+		return nil, nil
+	}
+
+	secrets, err := p.card.SharedKeys(ctx, recipient.Serial, recipient.Slot, peers)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]agent.AddedKey, 0, len(live))
+
+	for i, record := range live {
+		added, err := openPersistedKey(record, secrets[i], now)
+		clear(secrets[i])
+
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, added)
+	}
+
+	return keys, nil
+}
+
+func openPersistedKey(record keyvault.Record, secret []byte, now time.Time) (agent.AddedKey, error) {
+	plaintext, err := record.Open(secret)
+	if err != nil {
+		return agent.AddedKey{}, err
+	}
+
+	defer clear(plaintext)
+
+	var payload persistedKey
+	if err := json.Unmarshal(plaintext, &payload); err != nil {
+		return agent.AddedKey{}, fmt.Errorf("invalid persisted key %s: %w", record.Fingerprint, err)
+	}
+
+	defer clear(payload.PrivateKey)
+
+	priv, err := ssh.ParseRawPrivateKey(payload.PrivateKey)
+	if err != nil {
+		return agent.AddedKey{}, fmt.Errorf("invalid persisted key %s: %w", record.Fingerprint, err)
+	}
+
+	added := agent.AddedKey{
+		PrivateKey:           priv,
+		Comment:              payload.Comment,
+		ConfirmBeforeUse:     payload.ConfirmBeforeUse,
+		ConstraintExtensions: payload.Constraints,
+	}
+
+	// the lifetime goes on from where it was before the restart
+	if record.ExpiresAt != nil {
+		remaining := record.ExpiresAt.Sub(now)
+		added.LifetimeSecs = uint32((remaining + time.Second - 1) / time.Second)
+	}
+
+	return added, nil
+}
@@ -0,0 +1,267 @@
+package sshagent
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vitalvas/oneauth/internal/keyvault"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// testVaultCard does ECDH with a local key instead of a YubiKey slot
+type testVaultCard struct {
+	priv    *ecdsa.PrivateKey
+	unwraps int
+	err     error
+}
+
+func newTestVaultCard(t *testing.T) *testVaultCard {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	return &testVaultCard{priv: priv}
+}
+
+func (c *testVaultCard) SlotPublicKey(_ context.Context, _ uint32, _ string) (crypto.PublicKey, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	return &c.priv.PublicKey, nil
+}
+
+func (c *testVaultCard) SharedKeys(_ context.Context, _ uint32, _ string, peers []*ecdh.PublicKey) ([][]byte, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	c.unwraps++
+
+	priv, err := c.priv.ECDH()
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := make([][]byte, 0, len(peers))
+
+	for _, peer := range peers {
+		secret, err := priv.ECDH(peer)
+		if err != nil {
+			return nil, err
+		}
+
+		secrets = append(secrets, secret)
+	}
+
+	return secrets, nil
+}
+
+func TestSoftAgentPersistence(t *testing.T) {
+	newAgent := func(t *testing.T, vault *keyvault.Vault, card VaultCard) *SoftAgent {
+		t.Helper()
+
+		testAgent := NewSoftAgent("work", 0, logrus.New())
+		testAgent.SetPersistence(vault, 42, "9d", card)
+
+		return testAgent
+	}
+
+	addKey := func(t *testing.T, testAgent *SoftAgent, lifetime uint32) ssh.PublicKey {
+		t.Helper()
+
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+
+		require.NoError(t, testAgent.Add(agent.AddedKey{PrivateKey: priv, Comment: "deploy", LifetimeSecs: lifetime}))
+
+		pub, err := ssh.NewPublicKey(priv.Public())
+		require.NoError(t, err)
+
+		return pub
+	}
+
+	t.Run("SurvivesRestart", func(t *testing.T) {
+		vault := keyvault.New(filepath.Join(t.TempDir(), "work.json"))
+		card := newTestVaultCard(t)
+
+		testAgent := newAgent(t, vault, card)
+		kept := addKey(t, testAgent, 0)
+		expiring := addKey(t, testAgent, 3600)
+		require.NoError(t, testAgent.Close())
+
+		restarted := newAgent(t, vault, card)
+
+		keys, err := restarted.List()
+		require.NoError(t, err)
+		require.Len(t, keys, 2)
+		assert.Equal(t, 1, card.unwraps)
+
+		// the keys are unwrapped once, on first use
+		_, err = restarted.List()
+		require.NoError(t, err)
+		assert.Equal(t, 1, card.unwraps)
+
+		assert.True(t, restarted.softKeys.Deadline(ssh.FingerprintSHA256(kept)).IsZero())
+		assert.WithinDuration(t, time.Now().Add(time.Hour), restarted.softKeys.Deadline(ssh.FingerprintSHA256(expiring)), 2*time.Second)
+
+		_, err = restarted.Sign(kept, []byte("data"))
+		assert.NoError(t, err)
+	})
+
+	t.Run("RemoveKeys", func(t *testing.T) {
+		vault := keyvault.New(filepath.Join(t.TempDir(), "work.json"))
+		testAgent := newAgent(t, vault, newTestVaultCard(t))
+
+		removed := addKey(t, testAgent, 0)
+		forgotten := addKey(t, testAgent, 0)
+		addKey(t, testAgent, 0)
+
+		require.NoError(t, testAgent.Remove(removed))
+
+		count, err := testAgent.RemoveSoftKeys(ssh.FingerprintSHA256(forgotten))
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+
+		_, records, err := vault.Records()
+		require.NoError(t, err)
+		assert.Len(t, records, 1)
+
+		require.NoError(t, testAgent.RemoveAll())
+
+		_, err = os.Stat(vault.Path())
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("ExpiredWhileStopped", func(t *testing.T) {
+		vault := keyvault.New(filepath.Join(t.TempDir(), "work.json"))
+		card := newTestVaultCard(t)
+
+		recipient, err := keyvault.NewRecipient(42, "9d", &card.priv.PublicKey)
+		require.NoError(t, err)
+
+		record, err := keyvault.Seal(recipient, "SHA256:expired", time.Now().Add(-time.Minute), []byte("{}"))
+		require.NoError(t, err)
+		require.NoError(t, vault.Put(recipient, record))
+
+		keys, err := newAgent(t, vault, card).List()
+		require.NoError(t, err)
+		assert.Empty(t, keys)
+
+		// expired keys are dropped without the card
+		assert.Zero(t, card.unwraps)
+
+		_, err = os.Stat(vault.Path())
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("CardMissing", func(t *testing.T) {
+		vault := keyvault.New(filepath.Join(t.TempDir(), "work.json"))
+		card := newTestVaultCard(t)
+
+		addKey(t, newAgent(t, vault, card), 0)
+
+		card.err = ErrNoYubikey
+		restarted := newAgent(t, vault, card)
+
+		keys, err := restarted.List()
+		require.NoError(t, err)
+		assert.Empty(t, keys)
+
+		// the load is retried once the card is back
+		card.err = nil
+
+		keys, err = restarted.List()
+		require.NoError(t, err)
+		assert.Len(t, keys, 1)
+	})
+
+	t.Run("CardMissingOnAdd", func(t *testing.T) {
+		vault := keyvault.New(filepath.Join(t.TempDir(), "work.json"))
+		card := newTestVaultCard(t)
+		card.err = ErrNoYubikey
+
+		testAgent := newAgent(t, vault, card)
+
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+
+		assert.ErrorIs(t, testAgent.Add(agent.AddedKey{PrivateKey: priv}), ErrNoYubikey)
+		assert.Zero(t, testAgent.softKeys.Len())
+	})
+
+	t.Run("WipedOnLock", func(t *testing.T) {
+		vault := keyvault.New(filepath.Join(t.TempDir(), "work.json"))
+		card := newTestVaultCard(t)
+
+		testAgent := newAgent(t, vault, card)
+		testAgent.SetLockPolicy(LockPolicy{WipeSoftKeys: true})
+		addKey(t, testAgent, 0)
+
+		require.NoError(t, testAgent.Lock([]byte("secret")))
+		assert.Zero(t, testAgent.softKeys.Len())
+
+		require.NoError(t, testAgent.Unlock([]byte("secret")))
+
+		// the wiped keys come back from the vault
+		keys, err := testAgent.List()
+		require.NoError(t, err)
+		assert.Len(t, keys, 1)
+		assert.Equal(t, 1, card.unwraps)
+	})
+	t.Run("SoftKeysDoNotLoad", func(t *testing.T) {
+		vault := keyvault.New(filepath.Join(t.TempDir(), "work.json"))
+		card := newTestVaultCard(t)
+
+		addKey(t, newAgent(t, vault, card), 0)
+
+		restarted := newAgent(t, vault, card)
+
+		// the control API lists the keys in memory, it does not unwrap the vault on the card
+		assert.Empty(t, restarted.SoftKeys())
+		assert.Zero(t, card.unwraps)
+
+		_, err := restarted.List()
+		require.NoError(t, err)
+		assert.Len(t, restarted.SoftKeys(), 1)
+		assert.Equal(t, 1, card.unwraps)
+	})
+
+	t.Run("RemoveAllWithoutLoading", func(t *testing.T) {
+		vault := keyvault.New(filepath.Join(t.TempDir(), "work.json"))
+		card := newTestVaultCard(t)
+
+		testAgent := newAgent(t, vault, card)
+		addKey(t, testAgent, 0)
+		addKey(t, testAgent, 0)
+
+		restarted := newAgent(t, vault, card)
+
+		removed, err := restarted.RemoveAllSoftKeys()
+		require.NoError(t, err)
+		assert.Equal(t, 2, removed)
+		assert.Zero(t, card.unwraps)
+
+		_, records, err := vault.Records()
+		require.NoError(t, err)
+		assert.Empty(t, records)
+
+		keys, err := restarted.List()
+		require.NoError(t, err)
+		assert.Empty(t, keys)
+	})
+}
@@ -0,0 +1,170 @@
+package sshagent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/vitalvas/oneauth/internal/yubikey"
+)
+
+// WithYubikey runs fn on the card worker with exclusive access to the YubiKey held by the agent,
+// so card operations from the CLI do not race with signing. A request still queued when ctx is done is dropped.
+// A zero serial selects the first plugged in YubiKey. The cached slots and PIN retries of the card
+// are dropped, as fn may change them.
+func (a *SSHAgent) WithYubikey(ctx context.Context, serial uint32, fn func(yk *yubikey.Yubikey) error) error {
+	a.lock.Lock()
+	yk := a.findYubikey(serial)
+	absent := yk != nil && a.absent[yk.Serial]
+	a.lock.Unlock()
+
+	if yk == nil {
+		return ErrNoYubikey
+	}
+
+	if absent {
+		return fmt.Errorf("%w: %d", ErrYubikeyAbsent, yk.Serial)
+	}
+
+	defer func() {
+		a.lock.Lock()
+		delete(a.inventory, yk.Serial)
+		delete(a.pinRetries, yk.Serial)
+		a.lock.Unlock()
+	}()
+
+	return a.cards.do(ctx, CardRequest{Operation: CardOpControl, Serial: yk.Serial}, func() error {
+		return fn(yk)
+	})
+}
+
+// Serials returns the serial numbers of the attached YubiKeys
+func (a *SSHAgent) Serials() []uint32 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	serials := make([]uint32, 0, len(a.yks))
+	for _, yk := range a.yks {
+		serials = append(serials, yk.Serial)
+	}
+
+	return serials
+}
+
+// AttachYubikey opens the YubiKey with the serial and serves its slots next to the attached ones
+func (a *SSHAgent) AttachYubikey(serial uint32) error {
+	return a.attachYubikey(serial, false)
+}
+
+// ExpectYubikey attaches the YubiKey with the serial like AttachYubikey,
+// a card that is not plugged in is opened by WatchYubikeys when it is plugged in
+func (a *SSHAgent) ExpectYubikey(serial uint32) error {
+	return a.attachYubikey(serial, true)
+}
+
+func (a *SSHAgent) attachYubikey(serial uint32, allowAbsent bool) error {
+	if serial == 0 {
+		return errors.New("yubikey serial is required")
+	}
+
+	a.lock.Lock()
+	attached := a.findYubikey(serial) != nil
+	a.lock.Unlock()
+
+	if attached {
+		return fmt.Errorf("%w: %d", ErrYubikeyAttached, serial)
+	}
+
+	var yk *yubikey.Yubikey
+
+	openErr := a.cards.do(context.Background(), CardRequest{Operation: CardOpOpen, Serial: serial}, func() error {
+		var err error
+		yk, err = yubikey.OpenBySerial(serial)
+		return err
+	})
+
+	if openErr != nil && !allowAbsent {
+		return fmt.Errorf("failed to open yubikey %d: %w", serial, openErr)
+	}
+
+	a.lock.Lock()
+
+	// the card may have been attached while it was opened
+	if a.findYubikey(serial) != nil {
+		a.lock.Unlock()
+
+		if yk != nil {
+			a.closeYubikey(yk)
+		}
+
+		return fmt.Errorf("%w: %d", ErrYubikeyAttached, serial)
+	}
+
+	defer a.lock.Unlock()
+
+	if openErr != nil {
+		yk = &yubikey.Yubikey{Serial: serial}
+
+		if a.absent == nil {
+			a.absent = make(map[uint32]bool)
+		}
+
+		a.absent[serial] = true
+		a.log.WithField("yubikey", serial).Warnln("yubikey is not available:", openErr)
+	}
+
+	a.yks = append(a.yks, yk)
+	a.log.Println("attached yubikey:", serial)
+
+	return nil
+}
+
+// DetachYubikey releases the YubiKey with the serial, its slots are no longer served
+func (a *SSHAgent) DetachYubikey(serial uint32) error {
+	a.lock.Lock()
+
+	idx := slices.IndexFunc(a.yks, func(yk *yubikey.Yubikey) bool {
+		return yk.Serial == serial
+	})
+
+	if idx < 0 {
+		a.lock.Unlock()
+		return fmt.Errorf("%w: %d", ErrYubikeyNotAttached, serial)
+	}
+
+	yk := a.yks[idx]
+	a.yks = slices.Delete(a.yks, idx, idx+1)
+
+	delete(a.absent, serial)
+	delete(a.inventory, serial)
+	delete(a.pins, serial)
+	delete(a.pinRetries, serial)
+
+	a.lock.Unlock()
+
+	a.closeYubikey(yk)
+	a.log.Println("detached yubikey:", serial)
+
+	return nil
+}
+
+// closeYubikey closes the card on the card worker, after the requests queued before it.
+// It must be called without the agent lock held.
+func (a *SSHAgent) closeYubikey(yk *yubikey.Yubikey) {
+	err := a.cards.do(context.Background(), CardRequest{Operation: CardOpClose, Serial: yk.Serial}, yk.Close)
+	if err != nil {
+		a.log.WithField("yubikey", yk.Serial).Warnln("failed to close yubikey:", err)
+	}
+}
+
+// findYubikey must be called with the agent lock held, a zero serial returns the first plugged in YubiKey
+func (a *SSHAgent) findYubikey(serial uint32) *yubikey.Yubikey {
+	for _, yk := range a.yks {
+		if yk.Serial == serial || (serial == 0 && !a.absent[yk.Serial]) {
+			return yk
+		}
+	}
+
+	return nil
+}
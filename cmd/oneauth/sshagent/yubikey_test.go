@@ -0,0 +1,117 @@
+package sshagent
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/vitalvas/oneauth/internal/yubikey"
+)
+
+func TestWithYubikey(t *testing.T) {
+	t.Run("NoYubikey", func(t *testing.T) {
+		testAgent := &SSHAgent{}
+
+		called := false
+		err := testAgent.WithYubikey(context.Background(), 0, func(_ *yubikey.Yubikey) error {
+			called = true
+			return nil
+		})
+
+		assert.ErrorIs(t, err, ErrNoYubikey)
+		assert.False(t, called)
+	})
+
+	t.Run("CardWorker", func(t *testing.T) {
+		testAgent := &SSHAgent{yks: []*yubikey.Yubikey{{Serial: 42}}}
+
+		err := testAgent.WithYubikey(context.Background(), 0, func(yk *yubikey.Yubikey) error {
+			assert.Equal(t, uint32(42), yk.Serial)
+
+			// the agent lock is free while the card is used, the request is visible in the queue
+			assert.True(t, testAgent.lock.TryLock())
+			testAgent.lock.Unlock()
+
+			// fn runs on the worker goroutine, where require must not be used
+			requests := testAgent.PendingRequests()
+			if assert.Len(t, requests, 1) {
+				assert.Equal(t, CardOpControl, requests[0].Operation)
+				assert.False(t, requests[0].StartedAt.IsZero())
+			}
+
+			return nil
+		})
+
+		assert.NoError(t, err)
+		assert.Empty(t, testAgent.PendingRequests())
+	})
+
+	t.Run("SelectBySerial", func(t *testing.T) {
+		testAgent := &SSHAgent{yks: []*yubikey.Yubikey{{Serial: 42}, {Serial: 43}}}
+
+		err := testAgent.WithYubikey(context.Background(), 43, func(yk *yubikey.Yubikey) error {
+			assert.Equal(t, uint32(43), yk.Serial)
+			return nil
+		})
+		assert.NoError(t, err)
+
+		err = testAgent.WithYubikey(context.Background(), 44, func(_ *yubikey.Yubikey) error {
+			return nil
+		})
+		assert.ErrorIs(t, err, ErrNoYubikey)
+	})
+}
+
+func TestSSHAgentYubikeys(t *testing.T) {
+	newAgent := func() *SSHAgent {
+		return &SSHAgent{
+			yks: []*yubikey.Yubikey{{Serial: 42}, {Serial: 43}},
+			log: logrus.NewEntry(logrus.New()),
+		}
+	}
+
+	t.Run("Serials", func(t *testing.T) {
+		testAgent := newAgent()
+
+		assert.Equal(t, []uint32{42, 43}, testAgent.Serials())
+		assert.Equal(t, uint32(42), testAgent.Serial())
+	})
+
+	t.Run("Detach", func(t *testing.T) {
+		testAgent := newAgent()
+
+		assert.NoError(t, testAgent.DetachYubikey(42))
+		assert.Equal(t, []uint32{43}, testAgent.Serials())
+		assert.Equal(t, uint32(43), testAgent.Serial())
+
+		assert.ErrorIs(t, testAgent.DetachYubikey(42), ErrYubikeyNotAttached)
+	})
+
+	t.Run("AttachAttached", func(t *testing.T) {
+		testAgent := newAgent()
+
+		assert.ErrorIs(t, testAgent.AttachYubikey(43), ErrYubikeyAttached)
+		assert.Error(t, testAgent.AttachYubikey(0))
+	})
+
+	t.Run("ExpectAbsent", func(t *testing.T) {
+		testAgent := newAgent()
+
+		// the card is not plugged in
+		assert.Error(t, testAgent.AttachYubikey(44))
+		assert.NoError(t, testAgent.ExpectYubikey(44))
+		assert.Equal(t, []uint32{42, 43, 44}, testAgent.Serials())
+		assert.Equal(t, []uint32{44}, testAgent.AbsentSerials())
+
+		assert.NoError(t, testAgent.DetachYubikey(44))
+		assert.Empty(t, testAgent.AbsentSerials())
+	})
+
+	t.Run("Shutdown", func(t *testing.T) {
+		testAgent := newAgent()
+
+		assert.NoError(t, testAgent.Shutdown())
+		assert.Empty(t, testAgent.Serials())
+	})
+}
@@ -0,0 +1,309 @@
+package agentkey
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// origin: PROTOCOL.agent and ssh-agent.c from OpenSSH
+
+const RestrictDestinationExtension = "restrict-destination-v00@openssh.com"
+
+var (
+	ErrDestinationNotPermitted = errors.New("key is not permitted for this destination")
+)
+
+// Hop is a host the agent connection passed through, as recorded by session-bind@openssh.com
+type Hop struct {
+	HostKey   ssh.PublicKey
+	SessionID []byte
+	Forwarded bool
+}
+
+// DestinationConstraint is a single `ssh-add -h` rule
+type DestinationConstraint struct {
+	From DestinationHop
+	To   DestinationHop
+}
+
+type DestinationHop struct {
+	User     string
+	Hostname string
+	Keys     []DestinationKey
+}
+
+type DestinationKey struct {
+	Key  ssh.PublicKey
+	IsCA bool
+}
+
+func parseDestinationConstraints(details []byte) ([]DestinationConstraint, error) {
+	var wrapper struct {
+		Constraints []byte
+	}
+
+	if err := ssh.Unmarshal(details, &wrapper); err != nil {
+		return nil, fmt.Errorf("failed to parse destination constraints: %w", err)
+	}
+
+	var out []DestinationConstraint
+
+	rest := wrapper.Constraints
+	for len(rest) > 0 {
+		var msg struct {
+			From     []byte
+			To       []byte
+			Reserved []byte
+			Rest     []byte `ssh:"rest"`
+		}
+
+		if err := ssh.Unmarshal(rest, &msg); err != nil {
+			return nil, fmt.Errorf("failed to parse destination constraint: %w", err)
+		}
+
+		from, err := parseDestinationHop(msg.From)
+		if err != nil {
+			return nil, err
+		}
+
+		to, err := parseDestinationHop(msg.To)
+		if err != nil {
+			return nil, err
+		}
+
+		if from.Hostname == "" && len(from.Keys) > 0 {
+			return nil, errors.New("destination constraint has keys for the origin hop")
+		}
+
+		if from.Hostname != "" && len(from.Keys) == 0 {
+			return nil, fmt.Errorf("destination constraint has no keys for 'from' host %s", from.Hostname)
+		}
+
+		if to.Hostname == "" {
+			return nil, errors.New("destination constraint has no 'to' host")
+		}
+
+		if len(to.Keys) == 0 {
+			return nil, fmt.Errorf("destination constraint has no keys for 'to' host %s", to.Hostname)
+		}
+
+		out = append(out, DestinationConstraint{From: from, To: to})
+		rest = msg.Rest
+	}
+
+	if len(out) == 0 {
+		return nil, errors.New("empty destination constraint")
+	}
+
+	return out, nil
+}
+
+func parseDestinationHop(data []byte) (DestinationHop, error) {
+	var msg struct {
+		User     string
+		Hostname string
+		Reserved []byte
+		Rest     []byte `ssh:"rest"`
+	}
+
+	if err := ssh.Unmarshal(data, &msg); err != nil {
+		return DestinationHop{}, fmt.Errorf("failed to parse destination hop: %w", err)
+	}
+
+	hop := DestinationHop{
+		User:     msg.User,
+		Hostname: msg.Hostname,
+	}
+
+	rest := msg.Rest
+	for len(rest) > 0 {
+		var keyMsg struct {
+			Blob []byte
+			IsCA bool
+			Rest []byte `ssh:"rest"`
+		}
+
+		if err := ssh.Unmarshal(rest, &keyMsg); err != nil {
+			return DestinationHop{}, fmt.Errorf("failed to parse destination key: %w", err)
+		}
+
+		key, err := ssh.ParsePublicKey(keyMsg.Blob)
+		if err != nil {
+			return DestinationHop{}, fmt.Errorf("failed to parse destination key: %w", err)
+		}
+
+		hop.Keys = append(hop.Keys, DestinationKey{Key: key, IsCA: keyMsg.IsCA})
+		rest = keyMsg.Rest
+	}
+
+	return hop, nil
+}
+
+// MarshalDestinationConstraints encodes constraints as the details of RestrictDestinationExtension
+func MarshalDestinationConstraints(constraints []DestinationConstraint) []byte {
+	var buf []byte
+
+	for _, dc := range constraints {
+		buf = append(buf, ssh.Marshal(struct {
+			From     []byte
+			To       []byte
+			Reserved []byte
+		}{
+			From: marshalDestinationHop(dc.From),
+			To:   marshalDestinationHop(dc.To),
+		})...)
+	}
+
+	return ssh.Marshal(struct {
+		Constraints []byte
+	}{
+		Constraints: buf,
+	})
+}
+
+func marshalDestinationHop(hop DestinationHop) []byte {
+	buf := ssh.Marshal(struct {
+		User     string
+		Hostname string
+		Reserved []byte
+	}{
+		User:     hop.User,
+		Hostname: hop.Hostname,
+	})
+
+	for _, key := range hop.Keys {
+		buf = append(buf, ssh.Marshal(struct {
+			Blob []byte
+			IsCA bool
+		}{
+			Blob: key.Key.Marshal(),
+			IsCA: key.IsCA,
+		})...)
+	}
+
+	return buf
+}
+
+// DestinationConstrained reports whether the key was added with `ssh-add -h`
+func (k *Key) DestinationConstrained() bool {
+	return len(k.destinations) > 0
+}
+
+// PermittedForList reports whether the key may be offered on a connection that went through the hops
+func (k *Key) PermittedForList(hops []Hop) bool {
+	return k.permitted(hops, "", false) == nil
+}
+
+// PermittedForSign checks whether the key may authenticate the user on the last hop
+func (k *Key) PermittedForSign(hops []Hop, user string) error {
+	return k.permitted(hops, user, true)
+}
+
+func (k *Key) permitted(hops []Hop, user string, sign bool) error {
+	if len(k.destinations) == 0 {
+		return nil
+	}
+
+	// local use, e.g. ssh-keygen -Y sign
+	if len(hops) == 0 {
+		return nil
+	}
+
+	var fromKey ssh.PublicKey
+
+	for i, hop := range hops {
+		last := i == len(hops)-1
+
+		testUser := ""
+		if last {
+			testUser = user
+		}
+
+		if last && hop.Forwarded && sign {
+			return fmt.Errorf("%w: tried to sign on forwarding hop", ErrDestinationNotPermitted)
+		}
+
+		if i > 0 && !hops[i-1].Forwarded {
+			return fmt.Errorf("%w: tried to forward though signing bind", ErrDestinationNotPermitted)
+		}
+
+		if !k.permittedByConstraints(fromKey, hop.HostKey, testUser) {
+			return ErrDestinationNotPermitted
+		}
+
+		fromKey = hop.HostKey
+	}
+
+	// hide keys that may be used to authenticate to the host, but not beyond it
+	last := hops[len(hops)-1]
+	if last.Forwarded && !sign && !k.permittedByConstraints(last.HostKey, nil, "") {
+		return ErrDestinationNotPermitted
+	}
+
+	return nil
+}
+
+func (k *Key) permittedByConstraints(fromKey, toKey ssh.PublicKey, user string) bool {
+	for _, dc := range k.destinations {
+		if fromKey == nil {
+			if dc.From.Hostname != "" || len(dc.From.Keys) > 0 {
+				continue
+			}
+		} else if !matchKeyHop(fromKey, dc.From) {
+			continue
+		}
+
+		if toKey != nil && !matchKeyHop(toKey, dc.To) {
+			continue
+		}
+
+		if dc.To.User != "" && user != "" {
+			if ok, err := path.Match(dc.To.User, user); err != nil || !ok {
+				continue
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+func matchKeyHop(key ssh.PublicKey, hop DestinationHop) bool {
+	for _, row := range hop.Keys {
+		if !row.IsCA {
+			if bytes.Equal(key.Marshal(), row.Key.Marshal()) {
+				return true
+			}
+
+			continue
+		}
+
+		cert, ok := key.(*ssh.Certificate)
+		if !ok || cert.CertType != ssh.HostCert {
+			continue
+		}
+
+		if !bytes.Equal(cert.SignatureKey.Marshal(), row.Key.Marshal()) {
+			continue
+		}
+
+		now := uint64(time.Now().Unix())
+		if now < cert.ValidAfter || (cert.ValidBefore != ssh.CertTimeInfinity && now >= cert.ValidBefore) {
+			continue
+		}
+
+		for _, principal := range cert.ValidPrincipals {
+			if principal == hop.Hostname {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,235 @@
+package agentkey
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func createTestHostKey(t *testing.T) (ssh.PublicKey, ssh.Signer) {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+
+	return signer.PublicKey(), signer
+}
+
+func createTestDestinationKey(t *testing.T, constraints ...DestinationConstraint) *Key {
+	t.Helper()
+
+	addedKey := createTestAddedKey(t, "restricted")
+	addedKey.ConstraintExtensions = []agent.ConstraintExtension{
+		{
+			ExtensionName:    RestrictDestinationExtension,
+			ExtensionDetails: MarshalDestinationConstraints(constraints),
+		},
+	}
+
+	key, err := NewKey(addedKey)
+	require.NoError(t, err)
+
+	return key
+}
+
+func TestParseDestinationConstraints(t *testing.T) {
+	hostA, _ := createTestHostKey(t)
+	hostB, _ := createTestHostKey(t)
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		constraints := []DestinationConstraint{
+			{To: DestinationHop{User: "git", Hostname: "a.example.com", Keys: []DestinationKey{{Key: hostA}}}},
+			{
+				From: DestinationHop{Hostname: "a.example.com", Keys: []DestinationKey{{Key: hostA}}},
+				To:   DestinationHop{Hostname: "b.example.com", Keys: []DestinationKey{{Key: hostB, IsCA: true}}},
+			},
+		}
+
+		parsed, err := parseDestinationConstraints(MarshalDestinationConstraints(constraints))
+		require.NoError(t, err)
+		require.Len(t, parsed, 2)
+
+		assert.Equal(t, "git", parsed[0].To.User)
+		assert.Equal(t, "a.example.com", parsed[0].To.Hostname)
+		assert.Equal(t, hostA.Marshal(), parsed[0].To.Keys[0].Key.Marshal())
+		assert.Equal(t, "a.example.com", parsed[1].From.Hostname)
+		assert.True(t, parsed[1].To.Keys[0].IsCA)
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		_, err := parseDestinationConstraints(MarshalDestinationConstraints(nil))
+		assert.Error(t, err)
+	})
+
+	t.Run("MissingToHost", func(t *testing.T) {
+		_, err := parseDestinationConstraints(MarshalDestinationConstraints([]DestinationConstraint{
+			{To: DestinationHop{Keys: []DestinationKey{{Key: hostA}}}},
+		}))
+		assert.Error(t, err)
+	})
+
+	t.Run("MissingToKeys", func(t *testing.T) {
+		_, err := parseDestinationConstraints(MarshalDestinationConstraints([]DestinationConstraint{
+			{To: DestinationHop{Hostname: "a.example.com"}},
+		}))
+		assert.Error(t, err)
+	})
+
+	t.Run("FromHostWithoutKeys", func(t *testing.T) {
+		_, err := parseDestinationConstraints(MarshalDestinationConstraints([]DestinationConstraint{
+			{
+				From: DestinationHop{Hostname: "a.example.com"},
+				To:   DestinationHop{Hostname: "b.example.com", Keys: []DestinationKey{{Key: hostB}}},
+			},
+		}))
+		assert.Error(t, err)
+	})
+
+	t.Run("Garbage", func(t *testing.T) {
+		_, err := parseDestinationConstraints([]byte{0x00, 0x01})
+		assert.Error(t, err)
+	})
+
+	t.Run("SpecifiedTwice", func(t *testing.T) {
+		details := MarshalDestinationConstraints([]DestinationConstraint{
+			{To: DestinationHop{Hostname: "a.example.com", Keys: []DestinationKey{{Key: hostA}}}},
+		})
+
+		addedKey := createTestAddedKey(t, "")
+		addedKey.ConstraintExtensions = []agent.ConstraintExtension{
+			{ExtensionName: RestrictDestinationExtension, ExtensionDetails: details},
+			{ExtensionName: RestrictDestinationExtension, ExtensionDetails: details},
+		}
+
+		_, err := NewKey(addedKey)
+		assert.ErrorIs(t, err, ErrUnsupportedConstraint)
+	})
+}
+
+func TestKey_Destinations(t *testing.T) {
+	hostA, _ := createTestHostKey(t)
+	hostB, _ := createTestHostKey(t)
+	hostC, _ := createTestHostKey(t)
+
+	key := createTestDestinationKey(t,
+		DestinationConstraint{To: DestinationHop{User: "deploy*", Hostname: "a.example.com", Keys: []DestinationKey{{Key: hostA}}}},
+		DestinationConstraint{
+			From: DestinationHop{Hostname: "a.example.com", Keys: []DestinationKey{{Key: hostA}}},
+			To:   DestinationHop{Hostname: "b.example.com", Keys: []DestinationKey{{Key: hostB}}},
+		},
+	)
+
+	t.Run("Unconstrained", func(t *testing.T) {
+		plain, err := NewKey(createTestAddedKey(t, ""))
+		require.NoError(t, err)
+
+		assert.False(t, plain.DestinationConstrained())
+		assert.True(t, plain.PermittedForList([]Hop{{HostKey: hostC}}))
+		assert.NoError(t, plain.PermittedForSign([]Hop{{HostKey: hostC}}, "root"))
+	})
+
+	t.Run("LocalUse", func(t *testing.T) {
+		assert.True(t, key.DestinationConstrained())
+		assert.True(t, key.PermittedForList(nil))
+		assert.NoError(t, key.PermittedForSign(nil, ""))
+	})
+
+	t.Run("DirectHop", func(t *testing.T) {
+		hops := []Hop{{HostKey: hostA}}
+
+		assert.True(t, key.PermittedForList(hops))
+		assert.NoError(t, key.PermittedForSign(hops, "deploy"))
+		assert.ErrorIs(t, key.PermittedForSign(hops, "root"), ErrDestinationNotPermitted)
+	})
+
+	t.Run("UnknownHost", func(t *testing.T) {
+		hops := []Hop{{HostKey: hostC}}
+
+		assert.False(t, key.PermittedForList(hops))
+		assert.ErrorIs(t, key.PermittedForSign(hops, "deploy"), ErrDestinationNotPermitted)
+	})
+
+	t.Run("ForwardedThroughPermittedHost", func(t *testing.T) {
+		hops := []Hop{{HostKey: hostA, Forwarded: true}, {HostKey: hostB}}
+
+		assert.True(t, key.PermittedForList(hops))
+		assert.NoError(t, key.PermittedForSign(hops, "anyone"))
+	})
+
+	t.Run("ForwardedToUnknownHost", func(t *testing.T) {
+		hops := []Hop{{HostKey: hostA, Forwarded: true}, {HostKey: hostC}}
+
+		assert.False(t, key.PermittedForList(hops))
+		assert.ErrorIs(t, key.PermittedForSign(hops, "anyone"), ErrDestinationNotPermitted)
+	})
+
+	t.Run("SignOnForwardingHop", func(t *testing.T) {
+		hops := []Hop{{HostKey: hostA, Forwarded: true}}
+
+		assert.True(t, key.PermittedForList(hops))
+		assert.ErrorIs(t, key.PermittedForSign(hops, "deploy"), ErrDestinationNotPermitted)
+	})
+
+	t.Run("ForwardedPastLastPermittedHost", func(t *testing.T) {
+		hops := []Hop{{HostKey: hostA, Forwarded: true}, {HostKey: hostB, Forwarded: true}}
+
+		assert.False(t, key.PermittedForList(hops))
+	})
+
+	t.Run("ForwardAfterSigningBind", func(t *testing.T) {
+		hops := []Hop{{HostKey: hostA}, {HostKey: hostB}}
+
+		assert.ErrorIs(t, key.PermittedForSign(hops, "deploy"), ErrDestinationNotPermitted)
+	})
+}
+
+func TestMatchKeyHop(t *testing.T) {
+	caKey, caSigner := createTestHostKey(t)
+	hostKey, _ := createTestHostKey(t)
+
+	newCert := func(t *testing.T, certType uint32, principals []string) *ssh.Certificate {
+		t.Helper()
+
+		cert := &ssh.Certificate{
+			Key:             hostKey,
+			CertType:        certType,
+			ValidPrincipals: principals,
+			ValidAfter:      0,
+			ValidBefore:     ssh.CertTimeInfinity,
+		}
+		require.NoError(t, cert.SignCert(rand.Reader, caSigner))
+
+		return cert
+	}
+
+	hop := DestinationHop{Hostname: "a.example.com", Keys: []DestinationKey{{Key: caKey, IsCA: true}}}
+
+	t.Run("PlainKey", func(t *testing.T) {
+		assert.True(t, matchKeyHop(hostKey, DestinationHop{Keys: []DestinationKey{{Key: hostKey}}}))
+		assert.False(t, matchKeyHop(caKey, DestinationHop{Keys: []DestinationKey{{Key: hostKey}}}))
+	})
+
+	t.Run("HostCertificate", func(t *testing.T) {
+		assert.True(t, matchKeyHop(newCert(t, ssh.HostCert, []string{"a.example.com"}), hop))
+	})
+
+	t.Run("WrongPrincipal", func(t *testing.T) {
+		assert.False(t, matchKeyHop(newCert(t, ssh.HostCert, []string{"b.example.com"}), hop))
+	})
+
+	t.Run("UserCertificate", func(t *testing.T) {
+		assert.False(t, matchKeyHop(newCert(t, ssh.UserCert, []string{"a.example.com"}), hop))
+	})
+
+	t.Run("PlainKeyAgainstCA", func(t *testing.T) {
+		assert.False(t, matchKeyHop(hostKey, hop))
+	})
+}
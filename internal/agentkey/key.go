@@ -1,23 +1,62 @@
 package agentkey
 
 import (
-	"crypto/rand"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
 
+var (
+	ErrUnsupportedConstraint = errors.New("unsupported key constraint")
+	ErrKeyDestroyed          = errors.New("key was removed from the agent")
+)
+
 type Key struct {
 	agentKey    *agent.Key
 	fingerprint string
-	lastUsed    time.Time
+	lastUsed    atomic.Int64 // unix nanoseconds
 	name        string
-	signer      ssh.Signer
+
+	// lock guards the private key, Destroy waits for running signatures
+	lock    sync.RWMutex
+	signer  ssh.Signer
+	private any
+
+	confirm      bool
+	expiresAt    time.Time // zero means no lifetime constraint
+	destinations []DestinationConstraint
+	constraints  []agent.ConstraintExtension
 }
 
 func NewKey(key agent.AddedKey) (*Key, error) {
+	var destinations []DestinationConstraint
+
+	// OpenSSH refuses keys with constraints it does not understand, so do we
+	for _, ext := range key.ConstraintExtensions {
+		switch ext.ExtensionName {
+		case RestrictDestinationExtension:
+			if destinations != nil {
+				return nil, fmt.Errorf("%w: %s specified twice", ErrUnsupportedConstraint, ext.ExtensionName)
+			}
+
+			parsed, err := parseDestinationConstraints(ext.ExtensionDetails)
+			if err != nil {
+				return nil, err
+			}
+
+			destinations = parsed
+
+		default:
+			return nil, fmt.Errorf("%w: %s", ErrUnsupportedConstraint, ext.ExtensionName)
+		}
+	}
+
 	signer, err := ssh.NewSignerFromKey(key.PrivateKey)
 	if err != nil {
 		return nil, err
@@ -33,52 +72,131 @@ func NewKey(key agent.AddedKey) (*Key, error) {
 		keyName = fingerprint
 	}
 
-	return &Key{
+	now := time.Now()
+
+	var expiresAt time.Time
+	if key.LifetimeSecs > 0 {
+		expiresAt = now.Add(time.Duration(key.LifetimeSecs) * time.Second)
+	}
+
+	newKey := &Key{
 		name:        keyName,
 		fingerprint: fingerprint,
 		signer:      signer,
+		private:     key.PrivateKey,
 		agentKey: &agent.Key{
 			Format:  pubKey.Type(),
 			Blob:    pubKey.Marshal(),
 			Comment: key.Comment,
 		},
-		lastUsed: time.Now(),
-	}, nil
+		confirm:      key.ConfirmBeforeUse,
+		expiresAt:    expiresAt,
+		destinations: destinations,
+		constraints:  key.ConstraintExtensions,
+	}
+
+	newKey.lastUsed.Store(now.UnixNano())
+
+	for _, mem := range privateKeyMemory(key.PrivateKey) {
+		mlock(mem)
+	}
+
+	return newKey, nil
 }
 
 func (k *Key) Fingerprint() string {
 	return k.fingerprint
 }
 
+// Name returns the key comment, or the fingerprint when the comment is empty
+func (k *Key) Name() string {
+	return k.name
+}
+
 func (k *Key) LastUsed() time.Time {
-	return k.lastUsed
+	return time.Unix(0, k.lastUsed.Load())
 }
 
 func (k *Key) AgentKey() *agent.Key {
 	return k.agentKey
 }
 
+// ConfirmBeforeUse reports whether the key was added with `ssh-add -c`
+func (k *Key) ConfirmBeforeUse() bool {
+	return k.confirm
+}
+
+// ExpiresAt returns the deadline set with `ssh-add -t`, or zero time if the key has no lifetime
+func (k *Key) ExpiresAt() time.Time {
+	return k.expiresAt
+}
+
+// Expired reports whether the key lifetime is over at the given time
+func (k *Key) Expired(now time.Time) bool {
+	return !k.expiresAt.IsZero() && !now.Before(k.expiresAt)
+}
+
+// Export returns the private key in the OpenSSH format with the constraint extensions it was added with,
+// so another agent process can add the key again
+func (k *Key) Export() ([]byte, []agent.ConstraintExtension, error) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	if k.signer == nil {
+		return nil, nil, ErrKeyDestroyed
+	}
+
+	block, err := ssh.MarshalPrivateKey(k.private, k.agentKey.Comment)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer clear(block.Bytes)
+
+	return pem.EncodeToMemory(block), k.constraints, nil
+}
+
 func (k *Key) Sign(data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
-	if flags == 0 {
-		return k.signer.Sign(rand.Reader, data)
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	if k.signer == nil {
+		return nil, ErrKeyDestroyed
 	}
 
-	algorithmSigner, ok := k.signer.(ssh.AlgorithmSigner)
-	if !ok {
-		return nil, fmt.Errorf("signature does not support non-default signature algorithm: %T", k.signer)
+	sig, err := SignWithFlags(k.signer, data, flags)
+	if err != nil {
+		return nil, err
 	}
 
-	var algorithm string
-	switch flags {
-	case agent.SignatureFlagRsaSha256:
-		algorithm = ssh.KeyAlgoRSASHA256
-	case agent.SignatureFlagRsaSha512:
-		algorithm = ssh.KeyAlgoRSASHA512
-	default:
-		return nil, fmt.Errorf("unsupported signature flags: %d", flags)
+	k.lastUsed.Store(time.Now().UnixNano())
+
+	return sig, nil
+}
+
+// Destroy overwrites the private key, the key can not sign afterwards.
+// It is best effort: the Go crypto packages may keep copies of the key that are out of reach.
+func (k *Key) Destroy() {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if k.signer == nil {
+		return
+	}
+
+	for _, mem := range privateKeyMemory(k.private) {
+		clear(mem)
+		munlock(mem)
 	}
 
-	k.lastUsed = time.Now()
+	k.signer = nil
+	k.private = nil
+}
+
+// Destroyed reports whether the private key was overwritten
+func (k *Key) Destroyed() bool {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
 
-	return algorithmSigner.SignWithAlgorithm(rand.Reader, data, algorithm)
+	return k.signer == nil
 }
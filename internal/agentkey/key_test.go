@@ -1,6 +1,9 @@
 package agentkey
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"testing"
@@ -108,8 +111,78 @@ func TestKey_LastUsed(t *testing.T) {
 	_, err = key.Sign(data, 0)
 	require.NoError(t, err)
 
-	// LastUsed should not change for default signature (flags == 0)
-	assert.Equal(t, initialTime.Unix(), key.LastUsed().Unix())
+	// every signature counts as a use, so keep_key_seconds does not evict a key in use
+	assert.True(t, key.LastUsed().After(initialTime))
+}
+
+func TestKey_Destroy(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	for name, privateKey := range map[string]any{
+		"RSA":     rsaKey,
+		"ECDSA":   ecdsaKey,
+		"Ed25519": &ed25519Key,
+	} {
+		t.Run(name, func(t *testing.T) {
+			key, err := NewKey(agent.AddedKey{PrivateKey: privateKey})
+			require.NoError(t, err)
+
+			mem := privateKeyMemory(privateKey)
+			require.NotEmpty(t, mem)
+
+			key.Destroy()
+			assert.True(t, key.Destroyed())
+
+			for _, part := range mem {
+				assert.Equal(t, make([]byte, len(part)), part)
+			}
+
+			_, err = key.Sign([]byte("data"), 0)
+			assert.ErrorIs(t, err, ErrKeyDestroyed)
+
+			// the public part is kept for listing and audit records
+			assert.NotEmpty(t, key.Fingerprint())
+
+			key.Destroy()
+		})
+	}
+}
+
+func TestKey_Export(t *testing.T) {
+	t.Run("PrivateKey", func(t *testing.T) {
+		addedKey := createTestAddedKey(t, "exported")
+
+		key, err := NewKey(addedKey)
+		require.NoError(t, err)
+
+		block, constraints, err := key.Export()
+		require.NoError(t, err)
+		assert.Empty(t, constraints)
+
+		priv, err := ssh.ParseRawPrivateKey(block)
+		require.NoError(t, err)
+
+		again, err := NewKey(agent.AddedKey{PrivateKey: priv})
+		require.NoError(t, err)
+		assert.Equal(t, key.Fingerprint(), again.Fingerprint())
+	})
+
+	t.Run("Destroyed", func(t *testing.T) {
+		key, err := NewKey(createTestAddedKey(t, "test"))
+		require.NoError(t, err)
+
+		key.Destroy()
+
+		_, _, err = key.Export()
+		assert.ErrorIs(t, err, ErrKeyDestroyed)
+	})
 }
 
 func TestKey_AgentKey(t *testing.T) {
@@ -223,3 +296,56 @@ func TestKey_DifferentFingerprints(t *testing.T) {
 	// Different private keys should produce different fingerprints
 	assert.NotEqual(t, key1.Fingerprint(), key2.Fingerprint())
 }
+
+func TestNewKey_Constraints(t *testing.T) {
+	t.Run("Lifetime", func(t *testing.T) {
+		addedKey := createTestAddedKey(t, "test")
+		addedKey.LifetimeSecs = 60
+
+		key, err := NewKey(addedKey)
+		require.NoError(t, err)
+
+		assert.WithinDuration(t, time.Now().Add(time.Minute), key.ExpiresAt(), time.Second)
+		assert.False(t, key.Expired(time.Now()))
+		assert.True(t, key.Expired(time.Now().Add(time.Minute)))
+	})
+
+	t.Run("NoLifetime", func(t *testing.T) {
+		key, err := NewKey(createTestAddedKey(t, "test"))
+		require.NoError(t, err)
+
+		assert.True(t, key.ExpiresAt().IsZero())
+		assert.False(t, key.Expired(time.Now().Add(24*time.Hour)))
+	})
+
+	t.Run("ConfirmBeforeUse", func(t *testing.T) {
+		addedKey := createTestAddedKey(t, "test")
+		addedKey.ConfirmBeforeUse = true
+
+		key, err := NewKey(addedKey)
+		require.NoError(t, err)
+		assert.True(t, key.ConfirmBeforeUse())
+	})
+
+	t.Run("UnknownExtension", func(t *testing.T) {
+		addedKey := createTestAddedKey(t, "test")
+		addedKey.ConstraintExtensions = []agent.ConstraintExtension{
+			{ExtensionName: "unknown@example.com"},
+		}
+
+		key, err := NewKey(addedKey)
+		assert.ErrorIs(t, err, ErrUnsupportedConstraint)
+		assert.Contains(t, err.Error(), "unknown@example.com")
+		assert.Nil(t, key)
+	})
+}
+
+func TestKey_Name(t *testing.T) {
+	key, err := NewKey(createTestAddedKey(t, "named"))
+	require.NoError(t, err)
+	assert.Equal(t, "named", key.Name())
+
+	key, err = NewKey(createTestAddedKey(t, ""))
+	require.NoError(t, err)
+	assert.Equal(t, key.Fingerprint(), key.Name())
+}
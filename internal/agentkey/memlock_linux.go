@@ -0,0 +1,16 @@
+package agentkey
+
+import "golang.org/x/sys/unix"
+
+// mlock keeps the memory out of swap, errors are ignored as the limit of locked memory is often small
+func mlock(mem []byte) {
+	if len(mem) > 0 {
+		unix.Mlock(mem)
+	}
+}
+
+func munlock(mem []byte) {
+	if len(mem) > 0 {
+		unix.Munlock(mem)
+	}
+}
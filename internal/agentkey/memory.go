@@ -0,0 +1,55 @@
+package agentkey
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"math/big"
+	"math/bits"
+	"unsafe"
+)
+
+// privateKeyMemory returns the memory that holds the secret parts of a private key
+func privateKeyMemory(key any) [][]byte {
+	var mem [][]byte
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		mem = appendInt(mem, k.D)
+
+		for _, prime := range k.Primes {
+			mem = appendInt(mem, prime)
+		}
+
+		mem = appendInt(mem, k.Precomputed.Dp)
+		mem = appendInt(mem, k.Precomputed.Dq)
+		mem = appendInt(mem, k.Precomputed.Qinv)
+
+	case *ecdsa.PrivateKey:
+		mem = appendInt(mem, k.D)
+
+	case ed25519.PrivateKey:
+		mem = append(mem, k)
+
+	case *ed25519.PrivateKey:
+		if k != nil {
+			mem = append(mem, *k)
+		}
+	}
+
+	return mem
+}
+
+// appendInt appends the words of the number as bytes
+func appendInt(mem [][]byte, n *big.Int) [][]byte {
+	if n == nil {
+		return mem
+	}
+
+	words := n.Bits()
+	if len(words) == 0 {
+		return mem
+	}
+
+	return append(mem, unsafe.Slice((*byte)(unsafe.Pointer(&words[0])), len(words)*bits.UintSize/8))
+}
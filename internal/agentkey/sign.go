@@ -0,0 +1,48 @@
+package agentkey
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// SignWithFlags signs data with the algorithm requested by the agent signature flags.
+// Without flags an RSA key makes an ssh-rsa (SHA-1) signature, as the agent protocol requires.
+// The RSA flags are ignored for other key types, like OpenSSH does.
+func SignWithFlags(signer ssh.Signer, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	if flags == 0 {
+		return signer.Sign(rand.Reader, data)
+	}
+
+	var algorithm string
+	switch flags {
+	case agent.SignatureFlagRsaSha256:
+		algorithm = ssh.KeyAlgoRSASHA256
+	case agent.SignatureFlagRsaSha512:
+		algorithm = ssh.KeyAlgoRSASHA512
+	default:
+		return nil, fmt.Errorf("unsupported signature flags: %d", flags)
+	}
+
+	if signer.PublicKey().Type() != ssh.KeyAlgoRSA {
+		return signer.Sign(rand.Reader, data)
+	}
+
+	algorithmSigner, ok := signer.(ssh.AlgorithmSigner)
+	if !ok {
+		return nil, fmt.Errorf("signature does not support non-default signature algorithm: %T", signer)
+	}
+
+	return algorithmSigner.SignWithAlgorithm(rand.Reader, data, algorithm)
+}
+
+// SignatureAlgorithms returns the signature algorithms the agent can make with the key, preferred first
+func SignatureAlgorithms(pub ssh.PublicKey) []string {
+	if pub.Type() == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+
+	return []string{pub.Type()}
+}
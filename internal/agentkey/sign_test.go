@@ -0,0 +1,96 @@
+package agentkey
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// opaqueSigner hides the private key behind crypto.Signer, like a key stored in a PIV slot
+type opaqueSigner struct {
+	signer crypto.Signer
+}
+
+func (s opaqueSigner) Public() crypto.PublicKey {
+	return s.signer.Public()
+}
+
+func (s opaqueSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return s.signer.Sign(rand, digest, opts)
+}
+
+func TestSignWithFlags(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	rsaSigner, err := ssh.NewSignerFromSigner(opaqueSigner{signer: rsaKey})
+	require.NoError(t, err)
+
+	data := []byte("test data to sign")
+
+	tests := []struct {
+		name   string
+		flags  agent.SignatureFlags
+		format string
+	}{
+		{name: "Default", flags: 0, format: ssh.KeyAlgoRSA},
+		{name: "SHA256", flags: agent.SignatureFlagRsaSha256, format: ssh.KeyAlgoRSASHA256},
+		{name: "SHA512", flags: agent.SignatureFlagRsaSha512, format: ssh.KeyAlgoRSASHA512},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sig, err := SignWithFlags(rsaSigner, data, tt.flags)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.format, sig.Format)
+			assert.NoError(t, rsaSigner.PublicKey().Verify(data, sig))
+		})
+	}
+
+	t.Run("ECDSAIgnoresRSAFlags", func(t *testing.T) {
+		ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+
+		ecSigner, err := ssh.NewSignerFromSigner(opaqueSigner{signer: ecKey})
+		require.NoError(t, err)
+
+		sig, err := SignWithFlags(ecSigner, data, agent.SignatureFlagRsaSha256)
+		require.NoError(t, err)
+
+		assert.Equal(t, ssh.KeyAlgoECDSA256, sig.Format)
+		assert.NoError(t, ecSigner.PublicKey().Verify(data, sig))
+	})
+
+	t.Run("UnsupportedFlags", func(t *testing.T) {
+		_, err := SignWithFlags(rsaSigner, data, agent.SignatureFlags(999))
+		assert.ErrorContains(t, err, "unsupported signature flags")
+	})
+}
+
+func TestSignatureAlgorithms(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	rsaPub, err := ssh.NewPublicKey(&rsaKey.PublicKey)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}, SignatureAlgorithms(rsaPub))
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	ecPub, err := ssh.NewPublicKey(&ecKey.PublicKey)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{ssh.KeyAlgoECDSA256}, SignatureAlgorithms(ecPub))
+}
@@ -0,0 +1,237 @@
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/vitalvas/oneauth/internal/tools"
+)
+
+const (
+	DefaultMaxSize  = 10 << 20
+	DefaultMaxFiles = 5
+)
+
+type Operation string
+
+const (
+	OpList      Operation = "list"
+	OpSign      Operation = "sign"
+	OpAdd       Operation = "add"
+	OpRemove    Operation = "remove"
+	OpRemoveAll Operation = "remove_all"
+	OpLock      Operation = "lock"
+	OpUnlock    Operation = "unlock"
+	// OpEvict is a soft key removed by the agent after its lifetime or keep time
+	OpEvict Operation = "evict"
+
+	OpAddSmartcard    Operation = "add_smartcard"
+	OpRemoveSmartcard Operation = "remove_smartcard"
+)
+
+// Event is a single record of the audit log
+type Event struct {
+	Time      time.Time `json:"time"`
+	Operation Operation `json:"op"`
+	Agent     string    `json:"agent"`
+	Success   bool      `json:"success"`
+	Error     string    `json:"error,omitempty"`
+
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Serial and Slot identify the YubiKey slot that holds the key
+	Serial uint32 `json:"serial,omitempty"`
+	Slot   string `json:"slot,omitempty"`
+	// Keys is the number of keys returned by a list request
+	Keys int `json:"keys,omitempty"`
+	// PayloadHash matches the payload hash written to the agent log
+	PayloadHash string `json:"payload_hash,omitempty"`
+	// Policy is the signing policy decision
+	Policy string `json:"policy,omitempty"`
+	// Reason is why a key was evicted or the agent was locked, e.g. "expired" or "idle",
+	// requests to the control socket have "control api"
+	Reason string `json:"reason,omitempty"`
+	// Upstream is the socket of the agent that signed with a key of an upstream agent
+	Upstream string `json:"upstream,omitempty"`
+
+	PID int    `json:"pid"`
+	UID int    `json:"uid"`
+	Exe string `json:"exe,omitempty"`
+
+	Forwarded bool `json:"forwarded,omitempty"`
+	// DestinationHostKey is the SHA256 fingerprint of the host key the connection was bound to
+	DestinationHostKey string `json:"destination_host_key,omitempty"`
+	// DestinationUser is the user from the signed userauth request
+	DestinationUser string `json:"destination_user,omitempty"`
+}
+
+// Logger appends events as JSON lines and rotates the file once it grows over the max size
+type Logger struct {
+	lock sync.Mutex
+
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	file   *os.File
+	size   int64
+	closed bool
+	now    func() time.Time
+}
+
+// New opens the audit log, zero maxSize or maxFiles use the defaults
+func New(path string, maxSize int64, maxFiles int) (*Logger, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+
+	if maxFiles <= 0 {
+		maxFiles = DefaultMaxFiles
+	}
+
+	logger := &Logger{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		now:      time.Now,
+	}
+
+	if err := tools.MkDir(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create audit log directory: %w", err)
+	}
+
+	if err := logger.open(); err != nil {
+		return nil, err
+	}
+
+	return logger, nil
+}
+
+func (l *Logger) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat audit log: %w", err)
+	}
+
+	l.file = file
+	l.size = stat.Size()
+
+	return nil
+}
+
+// Log writes the event, a nil logger discards it
+func (l *Logger) Log(event Event) error {
+	if l == nil {
+		return nil
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.closed {
+		return os.ErrClosed
+	}
+
+	// a failed rotate may leave the log without a file, it is opened again for every event until it works
+	if l.file == nil {
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+
+	if event.Time.IsZero() {
+		event.Time = l.now().UTC()
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit event: %w", err)
+	}
+
+	line = append(line, '\n')
+
+	var rotateErr error
+
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		// the event is still written when the rotate fails, the error is returned after it
+		if rotateErr = l.rotate(); rotateErr != nil && l.file == nil {
+			return rotateErr
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+
+	if err != nil {
+		return fmt.Errorf("failed to write audit event: %w", err)
+	}
+
+	return rotateErr
+}
+
+// rotate shifts path.N-1 to path.N, down to path to path.1, and drops the oldest file.
+// When the files can not be shifted, the current file is opened again, so the log keeps growing over the max size.
+func (l *Logger) rotate() error {
+	err := l.file.Close()
+	l.file = nil
+
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to close audit log: %w", err), l.open())
+	}
+
+	if err := l.shift(); err != nil {
+		return errors.Join(err, l.open())
+	}
+
+	return l.open()
+}
+
+func (l *Logger) shift() error {
+	os.Remove(rotatedName(l.path, l.maxFiles))
+
+	for n := l.maxFiles - 1; n >= 1; n-- {
+		if err := os.Rename(rotatedName(l.path, n), rotatedName(l.path, n+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rotate audit log: %w", err)
+		}
+	}
+
+	if err := os.Rename(l.path, rotatedName(l.path, 1)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to rotate audit log: %w", err)
+	}
+
+	return nil
+}
+
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.closed = true
+
+	if l.file == nil {
+		return nil
+	}
+
+	err := l.file.Close()
+	l.file = nil
+
+	return err
+}
+
+func rotatedName(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
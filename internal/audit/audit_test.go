@@ -0,0 +1,161 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readLines(t *testing.T, path string) []Event {
+	t.Helper()
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var events []Event
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event Event
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		events = append(events, event)
+	}
+
+	return events
+}
+
+func TestNew(t *testing.T) {
+	t.Run("Defaults", func(t *testing.T) {
+		logger, err := New(filepath.Join(t.TempDir(), "audit.log"), 0, 0)
+		require.NoError(t, err)
+		defer logger.Close()
+
+		assert.Equal(t, int64(DefaultMaxSize), logger.maxSize)
+		assert.Equal(t, DefaultMaxFiles, logger.maxFiles)
+	})
+
+	t.Run("CreatesDirectory", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "log", "audit.log")
+
+		logger, err := New(path, 0, 0)
+		require.NoError(t, err)
+		defer logger.Close()
+
+		stat, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+	})
+}
+
+func TestLogger_Log(t *testing.T) {
+	t.Run("WritesJSONLines", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "audit.log")
+
+		logger, err := New(path, 0, 0)
+		require.NoError(t, err)
+
+		now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+		logger.now = func() time.Time { return now }
+
+		require.NoError(t, logger.Log(Event{Operation: OpSign, Agent: "default", Success: true, Fingerprint: "SHA256:abc", PID: 42, UID: 1000}))
+		require.NoError(t, logger.Log(Event{Operation: OpList, Agent: "work", Success: true, Keys: 2}))
+		require.NoError(t, logger.Close())
+
+		events := readLines(t, path)
+		require.Len(t, events, 2)
+
+		assert.Equal(t, now, events[0].Time)
+		assert.Equal(t, OpSign, events[0].Operation)
+		assert.Equal(t, "SHA256:abc", events[0].Fingerprint)
+		assert.Equal(t, 42, events[0].PID)
+		assert.Equal(t, 2, events[1].Keys)
+	})
+
+	t.Run("AppendsToExisting", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "audit.log")
+
+		for range 2 {
+			logger, err := New(path, 0, 0)
+			require.NoError(t, err)
+			require.NoError(t, logger.Log(Event{Operation: OpLock}))
+			require.NoError(t, logger.Close())
+		}
+
+		assert.Len(t, readLines(t, path), 2)
+	})
+
+	t.Run("NilLogger", func(t *testing.T) {
+		var logger *Logger
+
+		assert.NoError(t, logger.Log(Event{Operation: OpSign}))
+		assert.NoError(t, logger.Close())
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		logger, err := New(filepath.Join(t.TempDir(), "audit.log"), 0, 0)
+		require.NoError(t, err)
+		require.NoError(t, logger.Close())
+
+		assert.ErrorIs(t, logger.Log(Event{Operation: OpSign}), os.ErrClosed)
+	})
+}
+
+func TestLogger_Rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	// every event is larger than the max size, so each one ends up in its own file
+	logger, err := New(path, 10, 2)
+	require.NoError(t, err)
+	defer logger.Close()
+
+	for _, agent := range []string{"one", "two", "three", "four"} {
+		require.NoError(t, logger.Log(Event{Operation: OpSign, Agent: agent}))
+	}
+
+	files, err := Files(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{path + ".2", path + ".1", path}, files)
+
+	assert.Equal(t, "two", readLines(t, path+".2")[0].Agent)
+	assert.Equal(t, "three", readLines(t, path+".1")[0].Agent)
+	assert.Equal(t, "four", readLines(t, path)[0].Agent)
+
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestLogger_RotateFailed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	logger, err := New(path, 10, 1)
+	require.NoError(t, err)
+	defer logger.Close()
+
+	require.NoError(t, logger.Log(Event{Operation: OpSign, Agent: "one"}))
+
+	// a directory that is not empty can not be replaced by the rotated file
+	require.NoError(t, os.MkdirAll(filepath.Join(path+".1", "dir"), 0700))
+
+	err = logger.Log(Event{Operation: OpSign, Agent: "two"})
+	assert.ErrorContains(t, err, "failed to rotate audit log")
+
+	events := readLines(t, path)
+	require.Len(t, events, 2)
+	assert.Equal(t, "two", events[1].Agent)
+
+	require.NoError(t, os.RemoveAll(path+".1"))
+	require.NoError(t, logger.Log(Event{Operation: OpSign, Agent: "three"}))
+
+	assert.Len(t, readLines(t, path+".1"), 2)
+	assert.Equal(t, "three", readLines(t, path)[0].Agent)
+
+	require.NoError(t, logger.Close())
+	assert.ErrorIs(t, logger.Log(Event{Operation: OpSign}), os.ErrClosed)
+}
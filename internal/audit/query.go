@@ -0,0 +1,149 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Filter selects events from the audit log, zero fields match everything
+type Filter struct {
+	Since       time.Time
+	Until       time.Time
+	Operation   Operation
+	Agent       string
+	Fingerprint string
+	PID         int
+	// FailedOnly selects events of requests that were refused or failed
+	FailedOnly bool
+	// Limit keeps only the newest events
+	Limit int
+}
+
+func (f Filter) Match(event Event) bool {
+	switch {
+	case !f.Since.IsZero() && event.Time.Before(f.Since):
+		return false
+
+	case !f.Until.IsZero() && event.Time.After(f.Until):
+		return false
+
+	case f.Operation != "" && event.Operation != f.Operation:
+		return false
+
+	case f.Agent != "" && event.Agent != f.Agent:
+		return false
+
+	case f.Fingerprint != "" && event.Fingerprint != f.Fingerprint:
+		return false
+
+	case f.PID != 0 && event.PID != f.PID:
+		return false
+
+	case f.FailedOnly && event.Success:
+		return false
+	}
+
+	return true
+}
+
+// Files returns the audit log and its rotated files, oldest first
+func Files(path string) ([]string, error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	type rotated struct {
+		path string
+		n    int
+	}
+
+	var files []rotated
+
+	for _, match := range matches {
+		n, err := strconv.Atoi(strings.TrimPrefix(match, path+"."))
+		if err != nil || n < 1 {
+			continue
+		}
+
+		files = append(files, rotated{path: match, n: n})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].n > files[j].n
+	})
+
+	out := make([]string, 0, len(files)+1)
+	for _, file := range files {
+		out = append(out, file.path)
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		out = append(out, path)
+	}
+
+	return out, nil
+}
+
+// Read returns the events matching the filter, oldest first. Lines that can not be decoded are skipped.
+func Read(path string, filter Filter) ([]Event, error) {
+	files, err := Files(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []Event
+
+	for _, file := range files {
+		fileEvents, err := readFile(file, filter)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, fileEvents...)
+	}
+
+	if filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[len(events)-filter.Limit:]
+	}
+
+	return events, nil
+}
+
+func readFile(path string, filter Filter) ([]Event, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	defer file.Close()
+
+	var events []Event
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			continue
+		}
+
+		if filter.Match(event) {
+			events = append(events, event)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log %s: %w", path, err)
+	}
+
+	return events, nil
+}
@@ -0,0 +1,120 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilter_Match(t *testing.T) {
+	now := time.Now()
+
+	event := Event{
+		Time:        now,
+		Operation:   OpSign,
+		Agent:       "default",
+		Success:     true,
+		Fingerprint: "SHA256:abc",
+		PID:         42,
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		match  bool
+	}{
+		{"Empty", Filter{}, true},
+		{"SinceBefore", Filter{Since: now.Add(-time.Minute)}, true},
+		{"SinceAfter", Filter{Since: now.Add(time.Minute)}, false},
+		{"UntilBefore", Filter{Until: now.Add(-time.Minute)}, false},
+		{"Operation", Filter{Operation: OpSign}, true},
+		{"OtherOperation", Filter{Operation: OpList}, false},
+		{"Agent", Filter{Agent: "default"}, true},
+		{"OtherAgent", Filter{Agent: "work"}, false},
+		{"Fingerprint", Filter{Fingerprint: "SHA256:abc"}, true},
+		{"OtherFingerprint", Filter{Fingerprint: "SHA256:def"}, false},
+		{"PID", Filter{PID: 42}, true},
+		{"OtherPID", Filter{PID: 43}, false},
+		{"FailedOnly", Filter{FailedOnly: true}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.match, test.filter.Match(event))
+		})
+	}
+}
+
+func TestRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	// two events fit in a file, so the events are spread over all files
+	logger, err := New(path, 250, 3)
+	require.NoError(t, err)
+
+	for i := range 6 {
+		require.NoError(t, logger.Log(Event{Operation: OpSign, Agent: "default", PID: i + 1, Success: i%2 == 0}))
+	}
+
+	require.NoError(t, logger.Close())
+
+	t.Run("AllFilesInOrder", func(t *testing.T) {
+		events, err := Read(path, Filter{})
+		require.NoError(t, err)
+		require.Len(t, events, 6)
+
+		for i, event := range events {
+			assert.Equal(t, i+1, event.PID)
+		}
+	})
+
+	t.Run("Filtered", func(t *testing.T) {
+		events, err := Read(path, Filter{FailedOnly: true})
+		require.NoError(t, err)
+		require.Len(t, events, 3)
+		assert.Equal(t, 2, events[0].PID)
+	})
+
+	t.Run("Limit", func(t *testing.T) {
+		events, err := Read(path, Filter{Limit: 2})
+		require.NoError(t, err)
+		require.Len(t, events, 2)
+		assert.Equal(t, 5, events[0].PID)
+		assert.Equal(t, 6, events[1].PID)
+	})
+
+	t.Run("SkipsMalformedLines", func(t *testing.T) {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+		require.NoError(t, err)
+		_, err = file.WriteString("not json\n")
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+
+		events, err := Read(path, Filter{})
+		require.NoError(t, err)
+		assert.Len(t, events, 6)
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		events, err := Read(filepath.Join(t.TempDir(), "audit.log"), Filter{})
+		require.NoError(t, err)
+		assert.Empty(t, events)
+	})
+}
+
+func TestFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+
+	for _, name := range []string{"audit.log", "audit.log.1", "audit.log.10", "audit.log.2", "audit.log.old"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0600))
+	}
+
+	files, err := Files(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{path + ".10", path + ".2", path + ".1", path}, files)
+}
@@ -1,25 +1,186 @@
 package keystore
 
 import (
+	"context"
 	"sync"
 	"time"
 
 	"github.com/vitalvas/oneauth/internal/agentkey"
 )
 
+// maxJanitorInterval bounds the sleep of the janitor, so a changed clock is noticed
+const maxJanitorInterval = time.Minute
+
+const (
+	// EvictExpired is a key that outlived the lifetime set with `ssh-add -t`
+	EvictExpired = "expired"
+	// EvictIdle is a key that was not used for keep_key_seconds
+	EvictIdle = "idle"
+)
+
+// Eviction records a key removed from the store because its deadline passed
+type Eviction struct {
+	Time        time.Time
+	Fingerprint string
+	Name        string
+	Reason      string
+}
+
 type Store struct {
 	keys           map[string]*agentkey.Key // fingerprint -> key
 	lock           sync.Mutex
 	keepKeySeconds int64 // max time to keep a key in the store
+	now            func() time.Time
+
+	onEvict func(Eviction)
+	// wake tells the janitor that a deadline may have moved
+	wake chan struct{}
 }
 
 func New(keepKeySeconds int64) *Store {
 	return &Store{
 		keys:           make(map[string]*agentkey.Key),
 		keepKeySeconds: keepKeySeconds,
+		now:            time.Now,
+		wake:           make(chan struct{}, 1),
+	}
+}
+
+// deadline returns when the key leaves the store and why, zero time when it is kept until removed
+func (s *Store) deadline(key *agentkey.Key) (time.Time, string) {
+	deadline, reason := key.ExpiresAt(), EvictExpired
+
+	if s.keepKeySeconds > 0 {
+		idle := key.LastUsed().Add(time.Duration(s.keepKeySeconds) * time.Second)
+
+		if deadline.IsZero() || idle.Before(deadline) {
+			deadline, reason = idle, EvictIdle
+		}
+	}
+
+	return deadline, reason
+}
+
+// Deadline returns when the key with the fingerprint leaves the store, zero time when it is kept until removed
+func (s *Store) Deadline(fp string) time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key, ok := s.keys[fp]
+	if !ok {
+		return time.Time{}
+	}
+
+	deadline, _ := s.deadline(key)
+
+	return deadline
+}
+
+// evict must be called with the store lock held, the key is destroyed
+func (s *Store) evict(key *agentkey.Key, reason string, now time.Time) Eviction {
+	delete(s.keys, key.Fingerprint())
+	key.Destroy()
+
+	return Eviction{
+		Time:        now,
+		Fingerprint: key.Fingerprint(),
+		Name:        key.Name(),
+		Reason:      reason,
+	}
+}
+
+// expire must be called with the store lock held, it evicts the keys whose deadline passed
+func (s *Store) expire(now time.Time) []Eviction {
+	var evicted []Eviction
+
+	for _, key := range s.keys {
+		if deadline, reason := s.deadline(key); !deadline.IsZero() && !now.Before(deadline) {
+			evicted = append(evicted, s.evict(key, reason, now))
+		}
+	}
+
+	return evicted
+}
+
+// SetEvictHandler sets the function called for every evicted key. It is called without the store lock,
+// possibly from Get or List, so it must not wait for locks held by their callers.
+func (s *Store) SetEvictHandler(fn func(Eviction)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.onEvict = fn
+}
+
+func (s *Store) notify(evicted []Eviction) {
+	if len(evicted) == 0 {
+		return
+	}
+
+	s.lock.Lock()
+	fn := s.onEvict
+	s.lock.Unlock()
+
+	if fn == nil {
+		return
+	}
+
+	for _, ev := range evicted {
+		fn(ev)
+	}
+}
+
+// wakeJanitor tells the janitor to compute the next deadline again
+func (s *Store) wakeJanitor() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run evicts keys as their deadlines pass, until ctx is done
+func (s *Store) Run(ctx context.Context) {
+	timer := time.NewTimer(maxJanitorInterval)
+	defer timer.Stop()
+
+	for {
+		s.lock.Lock()
+		now := s.now()
+		evicted := s.expire(now)
+
+		wait := maxJanitorInterval
+
+		for _, key := range s.keys {
+			if deadline, _ := s.deadline(key); !deadline.IsZero() && deadline.Sub(now) < wait {
+				wait = deadline.Sub(now)
+			}
+		}
+		s.lock.Unlock()
+
+		s.notify(evicted)
+
+		timer.Reset(wait)
+
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-timer.C:
+		case <-s.wake:
+			timer.Stop()
+		}
 	}
 }
 
+// SetKeepKeySeconds changes how long idle keys are kept, it applies to keys already in the store
+func (s *Store) SetKeepKeySeconds(keepKeySeconds int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.keepKeySeconds = keepKeySeconds
+
+	s.wakeJanitor()
+}
+
 func (s *Store) Len() int {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -29,28 +190,44 @@ func (s *Store) Len() int {
 
 func (s *Store) List() []*agentkey.Key {
 	s.lock.Lock()
-	defer s.lock.Unlock()
+
+	evicted := s.expire(s.now())
 
 	keys := make([]*agentkey.Key, 0, len(s.keys))
 	for _, key := range s.keys {
-		if s.keepKeySeconds > 0 && (key.LastUsed().Unix()+s.keepKeySeconds) < time.Now().Unix() {
-			delete(s.keys, key.Fingerprint())
-		} else {
-			keys = append(keys, key)
-		}
+		keys = append(keys, key)
 	}
 
+	s.lock.Unlock()
+
+	s.notify(evicted)
+
 	return keys
 }
 
+// Get returns the key with the fingerprint, a key past its deadline is evicted instead
 func (s *Store) Get(fp string) (*agentkey.Key, bool) {
 	s.lock.Lock()
-	defer s.lock.Unlock()
 
-	if key, ok := s.keys[fp]; ok {
+	key, ok := s.keys[fp]
+	if !ok {
+		s.lock.Unlock()
+		return nil, false
+	}
+
+	now := s.now()
+
+	deadline, reason := s.deadline(key)
+	if deadline.IsZero() || now.Before(deadline) {
+		s.lock.Unlock()
 		return key, true
 	}
 
+	evicted := s.evict(key, reason, now)
+	s.lock.Unlock()
+
+	s.notify([]Eviction{evicted})
+
 	return nil, false
 }
 
@@ -64,24 +241,50 @@ func (s *Store) Add(key *agentkey.Key) bool {
 
 	s.keys[key.Fingerprint()] = key
 
+	s.wakeJanitor()
+
 	return true
 }
 
+// Replace stores the key, a key with the same fingerprint is dropped with its constraints and its private key overwritten
+func (s *Store) Replace(key *agentkey.Key) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	fp := key.Fingerprint()
+
+	if old, ok := s.keys[fp]; ok && old != key {
+		old.Destroy()
+	}
+
+	s.keys[fp] = key
+
+	s.wakeJanitor()
+}
+
+// Remove deletes the key and overwrites its private key
 func (s *Store) Remove(fp string) bool {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	if _, ok := s.keys[fp]; ok {
+	if key, ok := s.keys[fp]; ok {
 		delete(s.keys, fp)
+		key.Destroy()
+
 		return true
 	}
 
 	return false
 }
 
+// RemoveAll deletes every key and overwrites their private keys
 func (s *Store) RemoveAll() {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
+	for _, key := range s.keys {
+		key.Destroy()
+	}
+
 	s.keys = make(map[string]*agentkey.Key)
 }
@@ -1,6 +1,7 @@
 package keystore
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"fmt"
@@ -252,3 +253,189 @@ func TestStore_AddDuplicateKeys(t *testing.T) {
 
 	assert.Equal(t, 1, store.Len())
 }
+
+func TestStore_Replace(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	first, err := agentkey.NewKey(agent.AddedKey{
+		PrivateKey:       privateKey,
+		Comment:          "first",
+		LifetimeSecs:     60,
+		ConfirmBeforeUse: true,
+	})
+	require.NoError(t, err)
+
+	second, err := agentkey.NewKey(agent.AddedKey{
+		PrivateKey: privateKey,
+		Comment:    "second",
+	})
+	require.NoError(t, err)
+
+	store := New(0)
+	store.Replace(first)
+	store.Replace(second)
+
+	assert.Equal(t, 1, store.Len())
+	assert.True(t, first.Destroyed())
+
+	// the constraints of the first key are gone with it
+	store.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+
+	key, ok := store.Get(second.Fingerprint())
+	require.True(t, ok)
+	assert.Equal(t, "second", key.AgentKey().Comment)
+	assert.False(t, key.ConfirmBeforeUse())
+	assert.True(t, key.ExpiresAt().IsZero())
+
+	store.Replace(key)
+	assert.False(t, key.Destroyed())
+}
+
+func TestStore_KeyLifetime(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	key, err := agentkey.NewKey(agent.AddedKey{
+		PrivateKey:   privateKey,
+		Comment:      "short-lived",
+		LifetimeSecs: 60,
+	})
+	require.NoError(t, err)
+
+	t.Run("GetBeforeDeadline", func(t *testing.T) {
+		store := New(0)
+		store.Add(key)
+
+		_, ok := store.Get(key.Fingerprint())
+		assert.True(t, ok)
+		assert.Len(t, store.List(), 1)
+	})
+
+	t.Run("GetAfterDeadline", func(t *testing.T) {
+		store := New(0)
+		store.Add(key)
+		store.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+
+		_, ok := store.Get(key.Fingerprint())
+		assert.False(t, ok)
+		assert.Equal(t, 0, store.Len())
+	})
+
+	t.Run("ListAfterDeadline", func(t *testing.T) {
+		// lifetime is enforced even when keep_key_seconds is larger
+		store := New(3600)
+		store.Add(key)
+		store.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+
+		assert.Empty(t, store.List())
+		assert.Equal(t, 0, store.Len())
+	})
+}
+
+func TestStore_SetKeepKeySeconds(t *testing.T) {
+	store := New(0)
+	key := createTestKey(t, "test-key")
+	store.Add(key)
+
+	store.now = func() time.Time { return time.Now().Add(time.Hour) }
+	assert.Len(t, store.List(), 1)
+
+	store.SetKeepKeySeconds(60)
+	assert.Empty(t, store.List())
+}
+
+func TestStore_Deadline(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	key, err := agentkey.NewKey(agent.AddedKey{PrivateKey: privateKey, LifetimeSecs: 3600})
+	require.NoError(t, err)
+
+	store := New(0)
+	store.Add(key)
+
+	// the lifetime set with ssh-add -t is the only deadline
+	assert.Equal(t, key.ExpiresAt(), store.Deadline(key.Fingerprint()))
+
+	// the earlier of the lifetime and the keep time applies
+	store.SetKeepKeySeconds(60)
+	assert.Equal(t, key.LastUsed().Add(time.Minute), store.Deadline(key.Fingerprint()))
+
+	assert.True(t, store.Deadline("SHA256:unknown").IsZero())
+}
+
+func TestStore_Eviction(t *testing.T) {
+	t.Run("GetIdleKey", func(t *testing.T) {
+		store := New(60)
+		key := createTestKey(t, "idle-key")
+		store.Add(key)
+
+		var evicted []Eviction
+		store.SetEvictHandler(func(ev Eviction) {
+			evicted = append(evicted, ev)
+		})
+
+		store.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+
+		// a client that knows the fingerprint can not sign with an idle key
+		_, ok := store.Get(key.Fingerprint())
+		assert.False(t, ok)
+		assert.True(t, key.Destroyed())
+
+		require.Len(t, evicted, 1)
+		assert.Equal(t, key.Fingerprint(), evicted[0].Fingerprint)
+		assert.Equal(t, "idle-key", evicted[0].Name)
+		assert.Equal(t, EvictIdle, evicted[0].Reason)
+	})
+
+	t.Run("Janitor", func(t *testing.T) {
+		privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+
+		key, err := agentkey.NewKey(agent.AddedKey{PrivateKey: privateKey, LifetimeSecs: 1})
+		require.NoError(t, err)
+
+		store := New(0)
+
+		evicted := make(chan Eviction, 1)
+		store.SetEvictHandler(func(ev Eviction) {
+			evicted <- ev
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go store.Run(ctx)
+
+		store.Add(key)
+
+		select {
+		case ev := <-evicted:
+			assert.Equal(t, key.Fingerprint(), ev.Fingerprint)
+			assert.Equal(t, EvictExpired, ev.Reason)
+
+		case <-time.After(5 * time.Second):
+			t.Fatal("the key was not evicted")
+		}
+
+		assert.Equal(t, 0, store.Len())
+		assert.True(t, key.Destroyed())
+	})
+
+	t.Run("RemoveDestroysKey", func(t *testing.T) {
+		store := New(0)
+		key1 := createTestKey(t, "test-key-1")
+		key2 := createTestKey(t, "test-key-2")
+
+		store.Add(key1)
+		store.Add(key2)
+
+		store.Remove(key1.Fingerprint())
+		assert.True(t, key1.Destroyed())
+		assert.False(t, key2.Destroyed())
+
+		store.RemoveAll()
+		assert.True(t, key2.Destroyed())
+	})
+}
@@ -0,0 +1,353 @@
+// Package keyvault keeps soft keys on disk, encrypted to the EC public key of a YubiKey slot.
+//
+// Every record is sealed with an ephemeral ECDH key, so keys are stored without the card,
+// and opened with ECDH on the card, so they are only usable while the card is plugged in.
+package keyvault
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/vitalvas/oneauth/internal/tools"
+)
+
+const (
+	version = 1
+
+	kdfInfo = "oneauth keyvault v1"
+)
+
+var (
+	ErrRecipientMismatch = errors.New("vault is encrypted to another yubikey slot")
+	ErrUnsupportedKey    = errors.New("vault keys must be EC keys")
+)
+
+// Recipient is the YubiKey slot the records are encrypted to
+type Recipient struct {
+	Serial uint32 `json:"serial"`
+	Slot   string `json:"slot"`
+	// PublicKey is the PKIX encoded public key of the slot
+	PublicKey []byte `json:"public_key"`
+}
+
+// NewRecipient returns the recipient for the public key of an EC slot
+func NewRecipient(serial uint32, slot string, pub any) (Recipient, error) {
+	if _, ok := pub.(*ecdsa.PublicKey); !ok {
+		return Recipient{}, fmt.Errorf("%w: slot %s holds %T", ErrUnsupportedKey, slot, pub)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return Recipient{}, err
+	}
+
+	return Recipient{Serial: serial, Slot: slot, PublicKey: der}, nil
+}
+
+func (r Recipient) ecdhKey() (*ecdh.PublicKey, error) {
+	pub, err := x509.ParsePKIXPublicKey(r.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient key: %w", err)
+	}
+
+	ecPub, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedKey, pub)
+	}
+
+	return ecPub.ECDH()
+}
+
+// Record is a single encrypted key
+type Record struct {
+	Fingerprint string `json:"fingerprint"`
+	// ExpiresAt is the lifetime set with `ssh-add -t`, it is kept in clear so expired records are dropped without the card
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	Ephemeral  []byte `json:"ephemeral"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// Expired reports whether the key lifetime is over at the given time
+func (r Record) Expired(now time.Time) bool {
+	return r.ExpiresAt != nil && !now.Before(*r.ExpiresAt)
+}
+
+// EphemeralKey returns the public key the card does ECDH with to open the record
+func (r Record) EphemeralKey(recipient Recipient) (*ecdh.PublicKey, error) {
+	pub, err := recipient.ecdhKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return pub.Curve().NewPublicKey(r.Ephemeral)
+}
+
+// additionalData binds the clear fields to the ciphertext
+func (r Record) additionalData() []byte {
+	data := []byte(r.Fingerprint)
+
+	if r.ExpiresAt != nil {
+		data = append(data, '|')
+		data = strconv.AppendInt(data, r.ExpiresAt.Unix(), 10)
+	}
+
+	return data
+}
+
+// Seal encrypts the plaintext to the recipient
+func Seal(recipient Recipient, fingerprint string, expiresAt time.Time, plaintext []byte) (Record, error) {
+	pub, err := recipient.ecdhKey()
+	if err != nil {
+		return Record{}, err
+	}
+
+	ephemeral, err := pub.Curve().GenerateKey(rand.Reader)
+	if err != nil {
+		return Record{}, err
+	}
+
+	secret, err := ephemeral.ECDH(pub)
+	if err != nil {
+		return Record{}, err
+	}
+
+	defer clear(secret)
+
+	record := Record{
+		Fingerprint: fingerprint,
+		Ephemeral:   ephemeral.PublicKey().Bytes(),
+	}
+
+	if !expiresAt.IsZero() {
+		expires := expiresAt.UTC().Truncate(time.Second)
+		record.ExpiresAt = &expires
+	}
+
+	aead, err := newAEAD(secret, record.Ephemeral)
+	if err != nil {
+		return Record{}, err
+	}
+
+	record.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(record.Nonce); err != nil {
+		return Record{}, err
+	}
+
+	record.Ciphertext = aead.Seal(nil, record.Nonce, plaintext, record.additionalData())
+
+	return record, nil
+}
+
+// Open decrypts the record with the ECDH secret the card computed for the ephemeral key
+func (r Record) Open(secret []byte) ([]byte, error) {
+	aead, err := newAEAD(secret, r.Ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := aead.Open(nil, r.Nonce, r.Ciphertext, r.additionalData())
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt key %s: %w", r.Fingerprint, err)
+	}
+
+	return plaintext, nil
+}
+
+func newAEAD(secret, salt []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, secret, salt, kdfInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	defer clear(key)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+type vaultFile struct {
+	Version   int       `json:"version"`
+	Recipient Recipient `json:"recipient"`
+	Records   []Record  `json:"records"`
+}
+
+// Vault is a file of records encrypted to one YubiKey slot
+type Vault struct {
+	path string
+	lock sync.Mutex
+}
+
+func New(path string) *Vault {
+	return &Vault{path: path}
+}
+
+func (v *Vault) Path() string {
+	return v.path
+}
+
+// read must be called with the vault lock held, a missing file is an empty vault
+func (v *Vault) read() (*vaultFile, error) {
+	data, err := os.ReadFile(v.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &vaultFile{Version: version}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var file vaultFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid vault %s: %w", v.path, err)
+	}
+
+	if file.Version != version {
+		return nil, fmt.Errorf("unsupported vault version %d", file.Version)
+	}
+
+	return &file, nil
+}
+
+// write must be called with the vault lock held, the file is replaced at once
+func (v *Vault) write(file *vaultFile) error {
+	if len(file.Records) == 0 {
+		if err := os.Remove(v.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		return nil
+	}
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := tools.MkDir(filepath.Dir(v.path), 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(v.path), filepath.Base(v.path)+".*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), v.path)
+}
+
+// Recipient returns the slot the stored records are encrypted to, false when the vault is empty
+func (v *Vault) Recipient() (Recipient, bool, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	file, err := v.read()
+	if err != nil {
+		return Recipient{}, false, err
+	}
+
+	return file.Recipient, len(file.Records) > 0, nil
+}
+
+// Records returns the stored records and the slot they are encrypted to
+func (v *Vault) Records() (Recipient, []Record, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	file, err := v.read()
+	if err != nil {
+		return Recipient{}, nil, err
+	}
+
+	return file.Recipient, file.Records, nil
+}
+
+// Put stores the record, replacing a record of the same key
+func (v *Vault) Put(recipient Recipient, record Record) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	file, err := v.read()
+	if err != nil {
+		return err
+	}
+
+	if len(file.Records) > 0 && !recipient.equal(file.Recipient) {
+		return ErrRecipientMismatch
+	}
+
+	file.Recipient = recipient
+	file.Records = slices.DeleteFunc(file.Records, func(r Record) bool {
+		return r.Fingerprint == record.Fingerprint
+	})
+	file.Records = append(file.Records, record)
+
+	return v.write(file)
+}
+
+// Delete removes the records of the keys, unknown fingerprints are ignored
+func (v *Vault) Delete(fingerprints ...string) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	file, err := v.read()
+	if err != nil {
+		return err
+	}
+
+	records := slices.DeleteFunc(slices.Clone(file.Records), func(r Record) bool {
+		return slices.Contains(fingerprints, r.Fingerprint)
+	})
+
+	if len(records) == len(file.Records) {
+		return nil
+	}
+
+	file.Records = records
+
+	return v.write(file)
+}
+
+// Clear removes every record
+func (v *Vault) Clear() error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.write(&vaultFile{Version: version})
+}
+
+func (r Recipient) equal(other Recipient) bool {
+	return r.Serial == other.Serial && r.Slot == other.Slot && bytes.Equal(r.PublicKey, other.PublicKey)
+}
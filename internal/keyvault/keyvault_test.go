@@ -0,0 +1,155 @@
+package keyvault
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCard stands in for the EC key of a YubiKey slot
+func testCard(t *testing.T) (*ecdsa.PrivateKey, Recipient) {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	recipient, err := NewRecipient(42, "9d", &priv.PublicKey)
+	require.NoError(t, err)
+
+	return priv, recipient
+}
+
+func openRecord(t *testing.T, priv *ecdsa.PrivateKey, recipient Recipient, record Record) ([]byte, error) {
+	t.Helper()
+
+	ephemeral, err := record.EphemeralKey(recipient)
+	require.NoError(t, err)
+
+	ecdhPriv, err := priv.ECDH()
+	require.NoError(t, err)
+
+	secret, err := ecdhPriv.ECDH(ephemeral)
+	require.NoError(t, err)
+
+	return record.Open(secret)
+}
+
+func TestSealOpen(t *testing.T) {
+	priv, recipient := testCard(t)
+
+	expiresAt := time.Now().Add(time.Hour)
+
+	record, err := Seal(recipient, "SHA256:key", expiresAt, []byte("private key"))
+	require.NoError(t, err)
+
+	assert.Equal(t, "SHA256:key", record.Fingerprint)
+	assert.Equal(t, expiresAt.Unix(), record.ExpiresAt.Unix())
+	assert.NotContains(t, string(record.Ciphertext), "private key")
+
+	plaintext, err := openRecord(t, priv, recipient, record)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("private key"), plaintext)
+
+	t.Run("OtherCard", func(t *testing.T) {
+		other, _ := testCard(t)
+
+		_, err := openRecord(t, other, recipient, record)
+		assert.Error(t, err)
+	})
+
+	t.Run("ChangedLifetime", func(t *testing.T) {
+		changed := record
+		later := expiresAt.Add(time.Hour)
+		changed.ExpiresAt = &later
+
+		_, err := openRecord(t, priv, recipient, changed)
+		assert.Error(t, err)
+	})
+
+	t.Run("RSASlot", func(t *testing.T) {
+		rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+
+		_, err = NewRecipient(42, "9d", &rsaKey.PublicKey)
+		assert.ErrorIs(t, err, ErrUnsupportedKey)
+	})
+}
+
+func TestVault(t *testing.T) {
+	_, recipient := testCard(t)
+
+	seal := func(t *testing.T, fp string) Record {
+		t.Helper()
+
+		record, err := Seal(recipient, fp, time.Time{}, []byte(fp))
+		require.NoError(t, err)
+
+		return record
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		vault := New(filepath.Join(t.TempDir(), "keys", "work.json"))
+
+		_, ok, err := vault.Recipient()
+		require.NoError(t, err)
+		assert.False(t, ok)
+
+		_, records, err := vault.Records()
+		require.NoError(t, err)
+		assert.Empty(t, records)
+	})
+
+	t.Run("PutDeleteClear", func(t *testing.T) {
+		vault := New(filepath.Join(t.TempDir(), "keys", "work.json"))
+
+		require.NoError(t, vault.Put(recipient, seal(t, "SHA256:one")))
+		require.NoError(t, vault.Put(recipient, seal(t, "SHA256:two")))
+		require.NoError(t, vault.Put(recipient, seal(t, "SHA256:one")))
+
+		info, err := os.Stat(vault.Path())
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+		stored, records, err := vault.Records()
+		require.NoError(t, err)
+		assert.Equal(t, recipient, stored)
+		require.Len(t, records, 2)
+		assert.Equal(t, "SHA256:two", records[0].Fingerprint)
+		assert.Equal(t, "SHA256:one", records[1].Fingerprint)
+
+		require.NoError(t, vault.Delete("SHA256:one", "SHA256:unknown"))
+
+		_, records, err = vault.Records()
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+
+		require.NoError(t, vault.Clear())
+
+		_, err = os.Stat(vault.Path())
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("RecipientMismatch", func(t *testing.T) {
+		vault := New(filepath.Join(t.TempDir(), "work.json"))
+		require.NoError(t, vault.Put(recipient, seal(t, "SHA256:one")))
+
+		_, other := testCard(t)
+		assert.ErrorIs(t, vault.Put(other, seal(t, "SHA256:two")), ErrRecipientMismatch)
+	})
+
+	t.Run("InvalidFile", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "work.json")
+		require.NoError(t, os.WriteFile(path, []byte("{"), 0600))
+
+		_, _, err := New(path).Records()
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,119 @@
+package netutil
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Access limits which processes may connect to a socket, on top of CheckCreds.
+// Deny lists win over allow lists, an empty allow list allows everything.
+type Access struct {
+	// DenyRoot refuses connections from root, which CheckCreds allows
+	DenyRoot bool `yaml:"deny_root,omitempty"`
+	// DenyContainers refuses processes that run in a container
+	DenyContainers bool `yaml:"deny_containers,omitempty"`
+
+	AllowUIDs []int `yaml:"allow_uids,omitempty"`
+	DenyUIDs  []int `yaml:"deny_uids,omitempty"`
+	AllowGIDs []int `yaml:"allow_gids,omitempty"`
+	DenyGIDs  []int `yaml:"deny_gids,omitempty"`
+
+	// AllowExe and DenyExe are glob patterns of the executable. AllowExe patterns are absolute paths, as any
+	// program can be named like an allowed one, DenyExe patterns without a slash match the file name.
+	// Processes in a container never match AllowExe, as their path can not be verified on the host.
+	AllowExe []string `yaml:"allow_exe,omitempty"`
+	DenyExe  []string `yaml:"deny_exe,omitempty"`
+}
+
+// Validate checks the exe patterns
+func (a Access) Validate() error {
+	for _, pattern := range slices.Concat(a.AllowExe, a.DenyExe) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid exe pattern %q: %w", pattern, err)
+		}
+	}
+
+	for _, pattern := range a.AllowExe {
+		if !path.IsAbs(pattern) {
+			return fmt.Errorf("allowed exe pattern %q is not an absolute path", pattern)
+		}
+	}
+
+	return nil
+}
+
+// Check returns an error when the peer is not allowed to connect
+func (a Access) Check(creds UnixCreds) error {
+	if err := a.check(creds); err != nil {
+		exe := creds.Exe
+		if exe == "" {
+			exe = "unknown executable"
+		}
+
+		return fmt.Errorf("connection from pid %d (%s) is prohibited: %w", creds.PID, exe, err)
+	}
+
+	return nil
+}
+
+func (a Access) check(creds UnixCreds) error {
+	if a.DenyRoot && creds.UID == 0 {
+		return fmt.Errorf("root is denied")
+	}
+
+	if slices.Contains(a.DenyUIDs, creds.UID) || (len(a.AllowUIDs) > 0 && !slices.Contains(a.AllowUIDs, creds.UID)) {
+		return fmt.Errorf("uid %d is not allowed", creds.UID)
+	}
+
+	if slices.Contains(a.DenyGIDs, creds.GID) || (len(a.AllowGIDs) > 0 && !slices.Contains(a.AllowGIDs, creds.GID)) {
+		return fmt.Errorf("gid %d is not allowed", creds.GID)
+	}
+
+	if a.DenyContainers && creds.Container != "" {
+		return fmt.Errorf("container %s is denied", creds.Container)
+	}
+
+	if len(a.DenyExe) > 0 || len(a.AllowExe) > 0 {
+		if creds.Exe == "" {
+			return fmt.Errorf("executable is unknown")
+		}
+
+		if MatchExe(a.DenyExe, creds.Exe) {
+			return fmt.Errorf("executable is denied")
+		}
+
+		if len(a.AllowExe) > 0 {
+			if creds.Container != "" {
+				return fmt.Errorf("executable in container %s can not be verified", creds.Container)
+			}
+
+			if !MatchExe(a.AllowExe, creds.Exe) {
+				return fmt.Errorf("executable is not allowed")
+			}
+		}
+	}
+
+	return nil
+}
+
+// MatchExe reports whether the executable matches one of the glob patterns, patterns without a slash match the file name
+func MatchExe(patterns []string, exe string) bool {
+	if exe == "" {
+		return false
+	}
+
+	for _, pattern := range patterns {
+		name := exe
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(exe)
+		}
+
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
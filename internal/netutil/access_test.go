@@ -0,0 +1,85 @@
+package netutil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccess_Check(t *testing.T) {
+	ssh := UnixCreds{PID: 10, UID: 1000, GID: 1000, Exe: "/usr/bin/ssh"}
+
+	tests := []struct {
+		name   string
+		access Access
+		creds  UnixCreds
+		err    string
+	}{
+		{"NoRules", Access{}, ssh, ""},
+		{"DenyRoot", Access{DenyRoot: true}, UnixCreds{UID: 0, Exe: "/usr/bin/ssh"}, "root is denied"},
+		{"DenyRootAllowsUser", Access{DenyRoot: true}, ssh, ""},
+		{"AllowUIDs", Access{AllowUIDs: []int{1000}}, ssh, ""},
+		{"NotAllowedUID", Access{AllowUIDs: []int{1001}}, ssh, "uid 1000 is not allowed"},
+		{"DenyUIDs", Access{DenyUIDs: []int{1000}}, ssh, "uid 1000 is not allowed"},
+		{"AllowGIDs", Access{AllowGIDs: []int{1000}}, ssh, ""},
+		{"DenyGIDs", Access{DenyGIDs: []int{1000}}, ssh, "gid 1000 is not allowed"},
+		{"AllowExe", Access{AllowExe: []string{"/usr/bin/ssh", "/usr/bin/git"}}, ssh, ""},
+		{"AllowExePath", Access{AllowExe: []string{"/usr/bin/*"}}, ssh, ""},
+		{"NotAllowedExe", Access{AllowExe: []string{"/usr/bin/git"}}, ssh, "executable is not allowed"},
+		{"NotAllowedExeOtherPath", Access{AllowExe: []string{"/usr/bin/ssh"}}, UnixCreds{PID: 10, UID: 1000, Exe: "/tmp/ssh"}, "executable is not allowed"},
+		{"DenyExe", Access{DenyExe: []string{"ssh"}}, ssh, "executable is denied"},
+		{"DenyExeWins", Access{AllowExe: []string{"/usr/bin/*"}, DenyExe: []string{"ssh"}}, ssh, "executable is denied"},
+		{"UnknownExe", Access{AllowExe: []string{"/usr/bin/ssh"}}, UnixCreds{PID: 10, UID: 1000}, "executable is unknown"},
+		{
+			"AllowExeInContainer",
+			Access{AllowExe: []string{"/usr/bin/ssh"}},
+			UnixCreds{PID: 10, UID: 1000, Exe: "/usr/bin/ssh", Container: "0123456789ab"},
+			"executable in container 0123456789ab can not be verified",
+		},
+		{
+			"DenyContainers",
+			Access{DenyContainers: true},
+			UnixCreds{PID: 10, UID: 1000, Exe: "/usr/bin/ssh", Container: "0123456789ab"},
+			"container 0123456789ab is denied",
+		},
+		{"DenyContainersAllowsHost", Access{DenyContainers: true}, ssh, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.access.Check(tt.creds)
+
+			if tt.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+
+			assert.ErrorContains(t, err, tt.err)
+			assert.ErrorContains(t, err, "connection from pid")
+		})
+	}
+}
+
+func TestAccess_Validate(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		assert.NoError(t, Access{AllowExe: []string{"/usr/bin/ssh", "/usr/bin/*"}, DenyExe: []string{"node"}}.Validate())
+	})
+
+	t.Run("RelativeAllowPattern", func(t *testing.T) {
+		assert.ErrorContains(t, Access{AllowExe: []string{"ssh"}}.Validate(), "is not an absolute path")
+		assert.ErrorContains(t, Access{AllowExe: []string{"bin/ssh"}}.Validate(), "is not an absolute path")
+	})
+
+	t.Run("InvalidPattern", func(t *testing.T) {
+		assert.ErrorContains(t, Access{DenyExe: []string{"[ssh"}}.Validate(), "invalid exe pattern")
+	})
+}
+
+func TestMatchExe(t *testing.T) {
+	assert.True(t, MatchExe([]string{"ssh"}, "/usr/bin/ssh"))
+	assert.True(t, MatchExe([]string{"/usr/*/ssh"}, "/usr/bin/ssh"))
+	assert.True(t, MatchExe([]string{"git-*"}, "/usr/lib/git-core/git-remote-http"))
+	assert.False(t, MatchExe([]string{"/bin/ssh"}, "/usr/bin/ssh"))
+	assert.False(t, MatchExe([]string{"ssh"}, ""))
+	assert.False(t, MatchExe(nil, "/usr/bin/ssh"))
+}
@@ -0,0 +1,88 @@
+package netutil
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenFDsStart is the first file descriptor passed with systemd socket activation
+const listenFDsStart = 3
+
+// ActivatedListeners returns the sockets passed with systemd socket activation, by FileDescriptorName.
+// It returns nil when the process was not started by socket activation. The LISTEN_* variables are
+// unset, so they are not passed on to child processes.
+func ActivatedListeners() (map[string]net.Listener, error) {
+	pid, fds, names := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	return activatedListeners(pid, fds, names, listenFDsStart)
+}
+
+func activatedListeners(pid, fds, names string, start int) (map[string]net.Listener, error) {
+	if fds == "" {
+		return nil, nil
+	}
+
+	// the variables are meant for another process, e.g. they were inherited from a parent
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(fds)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %q", fds)
+	}
+
+	var fdNames []string
+	if names != "" {
+		fdNames = strings.Split(names, ":")
+	}
+
+	listeners := make(map[string]net.Listener, count)
+
+	for i := range count {
+		fd := start + i
+
+		name := fmt.Sprintf("fd%d", fd)
+		if i < len(fdNames) && fdNames[i] != "" {
+			name = fdNames[i]
+		}
+
+		unix.CloseOnExec(fd)
+
+		file := os.NewFile(uintptr(fd), name)
+
+		listener, err := net.FileListener(file)
+		file.Close()
+
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("invalid activated socket %s: %w", name, err)
+		}
+
+		if _, ok := listeners[name]; ok {
+			listener.Close()
+			closeListeners(listeners)
+
+			return nil, fmt.Errorf("duplicate activated socket name: %s", name)
+		}
+
+		listeners[name] = listener
+	}
+
+	return listeners, nil
+}
+
+func closeListeners(listeners map[string]net.Listener) {
+	for _, listener := range listeners {
+		listener.Close()
+	}
+}
@@ -0,0 +1,102 @@
+package netutil
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// inheritedSocket returns the file descriptor of a listening unix socket, like one passed by systemd
+func inheritedSocket(t *testing.T) (int, string) {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "activation")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	socketPath := filepath.Join(dir, "agent.sock")
+
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	file, err := listener.(*net.UnixListener).File()
+	require.NoError(t, err)
+	defer file.Close()
+
+	// the descriptor is taken over by activatedListeners, so it must not be owned by an *os.File
+	fd, err := unix.Dup(int(file.Fd()))
+	require.NoError(t, err)
+
+	return fd, socketPath
+}
+
+func TestActivatedListeners(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+
+	t.Run("NotActivated", func(t *testing.T) {
+		listeners, err := activatedListeners("", "", "", listenFDsStart)
+		require.NoError(t, err)
+		assert.Nil(t, listeners)
+	})
+
+	t.Run("OtherProcess", func(t *testing.T) {
+		listeners, err := activatedListeners("1", "1", "main", listenFDsStart)
+		require.NoError(t, err)
+		assert.Nil(t, listeners)
+	})
+
+	t.Run("Named", func(t *testing.T) {
+		fd, socketPath := inheritedSocket(t)
+
+		listeners, err := activatedListeners(pid, "1", "main", fd)
+		require.NoError(t, err)
+		require.Contains(t, listeners, "main")
+		defer listeners["main"].Close()
+
+		assert.Equal(t, socketPath, listeners["main"].Addr().String())
+
+		go func() {
+			if conn, err := net.Dial("unix", socketPath); err == nil {
+				conn.Close()
+			}
+		}()
+
+		conn, err := listeners["main"].Accept()
+		require.NoError(t, err)
+		conn.Close()
+	})
+
+	t.Run("Unnamed", func(t *testing.T) {
+		fd, _ := inheritedSocket(t)
+
+		listeners, err := activatedListeners(pid, "1", "", fd)
+		require.NoError(t, err)
+		require.Contains(t, listeners, "fd"+strconv.Itoa(fd))
+
+		listeners["fd"+strconv.Itoa(fd)].Close()
+	})
+
+	t.Run("InvalidCount", func(t *testing.T) {
+		_, err := activatedListeners(pid, "many", "", listenFDsStart)
+		assert.ErrorContains(t, err, "invalid LISTEN_FDS")
+	})
+
+	t.Run("NotASocket", func(t *testing.T) {
+		file, err := os.CreateTemp(t.TempDir(), "file")
+		require.NoError(t, err)
+		defer file.Close()
+
+		fd, err := unix.Dup(int(file.Fd()))
+		require.NoError(t, err)
+
+		_, err = activatedListeners(pid, "1", "main", fd)
+		assert.ErrorContains(t, err, "invalid activated socket main")
+	})
+}
@@ -3,4 +3,13 @@ package netutil
 type UnixCreds struct {
 	PID int
 	UID int
+	GID int
+
+	// Exe is the executable path of the peer, as seen in its own mount namespace
+	Exe     string
+	Cmdline []string
+	// Cgroup is the cgroup path of the peer, Linux only
+	Cgroup string
+	// Container identifies the container of the peer, empty when it runs on the host
+	Container string
 }
@@ -0,0 +1,106 @@
+package netutil
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxPassedFiles bounds the descriptors received with one message, SCM_MAX_FD on Linux
+const maxPassedFiles = 253
+
+// ListenerFile returns a copy of the listening socket to pass to another process.
+// The socket file is kept when the listener is closed afterwards, the other process serves it.
+// SetUnlinkOnClose restores the removal when the other process does not take over.
+func ListenerFile(listener net.Listener) (*os.File, error) {
+	unixListener, ok := listener.(*net.UnixListener)
+	if !ok {
+		return nil, fmt.Errorf("can not pass %T to another process", listener)
+	}
+
+	file, err := unixListener.File()
+	if err != nil {
+		return nil, err
+	}
+
+	unixListener.SetUnlinkOnClose(false)
+
+	return file, nil
+}
+
+// SetUnlinkOnClose sets whether the socket file of a unix listener is removed when it is closed
+func SetUnlinkOnClose(listener net.Listener, unlink bool) {
+	if unixListener, ok := listener.(*net.UnixListener); ok {
+		unixListener.SetUnlinkOnClose(unlink)
+	}
+}
+
+// SendFiles writes the data with the files attached as SCM_RIGHTS
+func SendFiles(conn *net.UnixConn, data []byte, files []*os.File) error {
+	if len(files) > maxPassedFiles {
+		return fmt.Errorf("too many files to pass: %d", len(files))
+	}
+
+	fds := make([]int, 0, len(files))
+
+	for _, file := range files {
+		// Fd would switch the shared socket to blocking mode, the listener of this process included
+		raw, err := file.SyscallConn()
+		if err != nil {
+			return err
+		}
+
+		if err := raw.Control(func(fd uintptr) { fds = append(fds, int(fd)) }); err != nil {
+			return err
+		}
+	}
+
+	var oob []byte
+	if len(fds) > 0 {
+		oob = unix.UnixRights(fds...)
+	}
+
+	n, _, err := conn.WriteMsgUnix(data, oob, nil)
+	if err != nil {
+		return err
+	}
+
+	if n < len(data) {
+		_, err = conn.Write(data[n:])
+	}
+
+	return err
+}
+
+// ReceiveFiles reads the data into buf, with the files attached to it as SCM_RIGHTS
+func ReceiveFiles(conn *net.UnixConn, buf []byte) (int, []*os.File, error) {
+	oob := make([]byte, unix.CmsgSpace(maxPassedFiles*4))
+
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var files []*os.File
+
+	for i := range msgs {
+		fds, err := unix.ParseUnixRights(&msgs[i])
+		if err != nil {
+			continue
+		}
+
+		for _, fd := range fds {
+			unix.CloseOnExec(fd)
+			files = append(files, os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd)))
+		}
+	}
+
+	return n, files, nil
+}
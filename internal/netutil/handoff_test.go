@@ -0,0 +1,114 @@
+package netutil
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPassListener(t *testing.T) {
+	dir, err := os.MkdirTemp("", "handoff")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	socketPath := filepath.Join(dir, "agent.sock")
+
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+
+	file, err := ListenerFile(listener)
+	require.NoError(t, err)
+	defer file.Close()
+
+	local, remote, err := socketPair()
+	require.NoError(t, err)
+	defer local.Close()
+	defer remote.Close()
+
+	require.NoError(t, SendFiles(local, []byte("state"), []*os.File{file}))
+
+	buf := make([]byte, 16)
+
+	n, files, err := ReceiveFiles(remote, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "state", string(buf[:n]))
+	require.Len(t, files, 1)
+
+	passed, err := net.FileListener(files[0])
+	require.NoError(t, err)
+	files[0].Close()
+	defer passed.Close()
+
+	// the socket file stays for the other process
+	require.NoError(t, listener.Close())
+	assert.FileExists(t, socketPath)
+
+	go func() {
+		if conn, err := net.Dial("unix", socketPath); err == nil {
+			conn.Close()
+		}
+	}()
+
+	conn, err := passed.Accept()
+	require.NoError(t, err)
+	conn.Close()
+
+	t.Run("NotUnix", func(t *testing.T) {
+		tcp, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer tcp.Close()
+
+		_, err = ListenerFile(tcp)
+		assert.ErrorContains(t, err, "can not pass")
+	})
+
+	t.Run("NotPassed", func(t *testing.T) {
+		socketPath := filepath.Join(dir, "restored.sock")
+
+		listener, err := net.Listen("unix", socketPath)
+		require.NoError(t, err)
+
+		file, err := ListenerFile(listener)
+		require.NoError(t, err)
+		file.Close()
+
+		// the other process did not take over, the socket file is removed with the listener again
+		SetUnlinkOnClose(listener, true)
+
+		require.NoError(t, listener.Close())
+		assert.NoFileExists(t, socketPath)
+	})
+}
+
+func socketPair() (*net.UnixConn, *net.UnixConn, error) {
+	dir, err := os.MkdirTemp("", "pair")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer os.RemoveAll(dir)
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: filepath.Join(dir, "pair.sock"), Net: "unix"})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer listener.Close()
+
+	local, err := net.DialUnix("unix", nil, listener.Addr().(*net.UnixAddr))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	remote, err := listener.AcceptUnix()
+	if err != nil {
+		local.Close()
+		return nil, nil, err
+	}
+
+	return local, remote, nil
+}
@@ -0,0 +1,104 @@
+package netutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// proc_info call and flavor used by proc_pidpath of libproc
+const (
+	procInfoCallPIDInfo = 2
+	procPIDPathInfo     = 11
+
+	// procPIDPathInfoMaxSize is PROC_PIDPATHINFO_MAXSIZE
+	procPIDPathInfoMaxSize = 4 * 1024
+)
+
+// procArgs returns the kern.procargs2 data: argc as int32 followed by the NUL terminated executable path,
+// NUL padding and the NUL terminated arguments
+func procArgs(pid int) ([]byte, error) {
+	if pid <= 0 {
+		return nil, fmt.Errorf("invalid pid %d", pid)
+	}
+
+	buf, err := unix.SysctlRaw("kern.procargs2", pid)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(buf) < 4 {
+		return nil, errors.New("short kern.procargs2 response")
+	}
+
+	return buf, nil
+}
+
+// ProcessExe returns the executable path of the process like proc_pidpath, the path is resolved by the kernel
+// from the executable file, the path in kern.procargs2 is the one given to exec by the parent
+func ProcessExe(pid int) (string, error) {
+	if pid <= 0 {
+		return "", fmt.Errorf("invalid pid %d", pid)
+	}
+
+	buf := make([]byte, procPIDPathInfoMaxSize)
+
+	_, _, errno := unix.Syscall6(unix.SYS_PROC_INFO, procInfoCallPIDInfo, uintptr(pid), procPIDPathInfo, 0,
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)))
+	if errno != 0 {
+		return "", fmt.Errorf("failed to read executable of %d: %w", pid, errno)
+	}
+
+	exe, _, _ := bytes.Cut(buf, []byte{0})
+	if len(exe) == 0 {
+		return "", fmt.Errorf("no executable path for %d", pid)
+	}
+
+	return string(exe), nil
+}
+
+// ProcessCmdline returns the arguments of the process
+func ProcessCmdline(pid int) ([]string, error) {
+	buf, err := procArgs(pid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read command line of %d: %w", pid, err)
+	}
+
+	return parseProcArgs(buf), nil
+}
+
+func parseProcArgs(buf []byte) []string {
+	argc := int(binary.NativeEndian.Uint32(buf[:4]))
+
+	_, rest, _ := bytes.Cut(buf[4:], []byte{0})
+	rest = bytes.TrimLeft(rest, "\x00")
+
+	args := make([]string, 0, argc)
+
+	for len(args) < argc && len(rest) > 0 {
+		var arg []byte
+		arg, rest, _ = bytes.Cut(rest, []byte{0})
+		args = append(args, string(arg))
+	}
+
+	return args
+}
+
+// readProcess fills in the process details of the peer, fields that can not be read are left empty
+func readProcess(creds *UnixCreds) {
+	if creds.PID <= 0 {
+		return
+	}
+
+	if exe, err := ProcessExe(creds.PID); err == nil {
+		creds.Exe = exe
+	}
+
+	if buf, err := procArgs(creds.PID); err == nil {
+		creds.Cmdline = parseProcArgs(buf)
+	}
+}
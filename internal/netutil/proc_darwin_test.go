@@ -0,0 +1,51 @@
+package netutil
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessExe(t *testing.T) {
+	t.Run("CurrentProcess", func(t *testing.T) {
+		expected, err := os.Executable()
+		require.NoError(t, err)
+
+		// the kernel returns the path without symlinks, e.g. /private/var instead of /var
+		expected, err = filepath.EvalSymlinks(expected)
+		require.NoError(t, err)
+
+		exe, err := ProcessExe(os.Getpid())
+		require.NoError(t, err)
+		assert.Equal(t, expected, exe)
+	})
+
+	t.Run("InvalidPID", func(t *testing.T) {
+		_, err := ProcessExe(-1)
+		assert.Error(t, err)
+	})
+}
+
+func TestProcessCmdline(t *testing.T) {
+	t.Run("CurrentProcess", func(t *testing.T) {
+		cmdline, err := ProcessCmdline(os.Getpid())
+		require.NoError(t, err)
+		assert.Equal(t, os.Args, cmdline)
+	})
+
+	t.Run("InvalidPID", func(t *testing.T) {
+		_, err := ProcessCmdline(0)
+		assert.Error(t, err)
+	})
+}
+
+func TestParseProcArgs(t *testing.T) {
+	buf := binary.NativeEndian.AppendUint32(nil, 2)
+	buf = append(buf, "/usr/bin/ssh\x00\x00\x00ssh\x00host\x00HOME=/Users/me\x00"...)
+
+	assert.Equal(t, []string{"ssh", "host"}, parseProcArgs(buf))
+}
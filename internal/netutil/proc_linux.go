@@ -0,0 +1,162 @@
+package netutil
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// containerPrefixes are cgroup name prefixes of container runtimes
+var containerPrefixes = []string{"docker-", "libpod-", "cri-containerd-", "crio-", "containerd-"}
+
+// ProcessExe returns the executable path of the process
+func ProcessExe(pid int) (string, error) {
+	if pid <= 0 {
+		return "", fmt.Errorf("invalid pid %d", pid)
+	}
+
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return "", fmt.Errorf("failed to read executable of %d: %w", pid, err)
+	}
+
+	return exe, nil
+}
+
+// ProcessCmdline returns the arguments of the process
+func ProcessCmdline(pid int) ([]string, error) {
+	if pid <= 0 {
+		return nil, fmt.Errorf("invalid pid %d", pid)
+	}
+
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read command line of %d: %w", pid, err)
+	}
+
+	data = bytes.TrimRight(data, "\x00")
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	return strings.Split(string(data), "\x00"), nil
+}
+
+// ProcessCgroup returns the cgroup v2 path of the process, or the first controller path on cgroup v1
+func ProcessCgroup(pid int) (string, error) {
+	if pid <= 0 {
+		return "", fmt.Errorf("invalid pid %d", pid)
+	}
+
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", fmt.Errorf("failed to read cgroup of %d: %w", pid, err)
+	}
+
+	return parseCgroup(string(data)), nil
+}
+
+func parseCgroup(data string) string {
+	var first string
+
+	for line := range strings.Lines(data) {
+		// hierarchy-ID:controller-list:cgroup-path
+		parts := strings.SplitN(strings.TrimSpace(line), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+
+		if parts[0] == "0" && parts[1] == "" {
+			return parts[2]
+		}
+
+		if first == "" {
+			first = parts[2]
+		}
+	}
+
+	return first
+}
+
+// containerFromCgroup returns the container ID from a cgroup path created by a container runtime
+func containerFromCgroup(cgroup string) string {
+	segments := strings.Split(cgroup, "/")
+
+	for i := len(segments) - 1; i >= 0; i-- {
+		name := strings.TrimSuffix(segments[i], ".scope")
+
+		for _, prefix := range containerPrefixes {
+			if id, ok := strings.CutPrefix(name, prefix); ok && isContainerID(id) {
+				return id
+			}
+		}
+
+		if i > 0 && isContainerID(name) {
+			switch parent := segments[i-1]; {
+			case parent == "docker", parent == "lxc", strings.HasPrefix(parent, "kubepods"), strings.HasPrefix(parent, "pod"):
+				return name
+			}
+		}
+
+		if name, ok := strings.CutPrefix(name, "lxc.payload."); ok && name != "" {
+			return name
+		}
+	}
+
+	return ""
+}
+
+func isContainerID(id string) bool {
+	if len(id) < 12 {
+		return false
+	}
+
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// processContainer returns the container of the process, from its cgroup or from a mount namespace other than ours
+func processContainer(pid int, cgroup string) string {
+	if id := containerFromCgroup(cgroup); id != "" {
+		return id
+	}
+
+	own, err := os.Readlink("/proc/self/ns/mnt")
+	if err != nil {
+		return ""
+	}
+
+	peer, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/mnt", pid))
+	if err != nil || peer == own {
+		return ""
+	}
+
+	return peer
+}
+
+// readProcess fills in the process details of the peer, fields that can not be read are left empty
+func readProcess(creds *UnixCreds) {
+	if creds.PID <= 0 {
+		return
+	}
+
+	if exe, err := ProcessExe(creds.PID); err == nil {
+		creds.Exe = exe
+	}
+
+	if cmdline, err := ProcessCmdline(creds.PID); err == nil {
+		creds.Cmdline = cmdline
+	}
+
+	if cgroup, err := ProcessCgroup(creds.PID); err == nil {
+		creds.Cgroup = cgroup
+	}
+
+	creds.Container = processContainer(creds.PID, creds.Cgroup)
+}
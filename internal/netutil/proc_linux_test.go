@@ -0,0 +1,93 @@
+package netutil
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessExe(t *testing.T) {
+	t.Run("CurrentProcess", func(t *testing.T) {
+		expected, err := os.Executable()
+		require.NoError(t, err)
+
+		exe, err := ProcessExe(os.Getpid())
+		require.NoError(t, err)
+		assert.Equal(t, expected, exe)
+	})
+
+	t.Run("InvalidPID", func(t *testing.T) {
+		_, err := ProcessExe(-1)
+		assert.Error(t, err)
+	})
+}
+
+func TestProcessCmdline(t *testing.T) {
+	t.Run("CurrentProcess", func(t *testing.T) {
+		cmdline, err := ProcessCmdline(os.Getpid())
+		require.NoError(t, err)
+		assert.Equal(t, os.Args, cmdline)
+	})
+
+	t.Run("InvalidPID", func(t *testing.T) {
+		_, err := ProcessCmdline(0)
+		assert.Error(t, err)
+	})
+}
+
+func TestParseCgroup(t *testing.T) {
+	t.Run("V2", func(t *testing.T) {
+		assert.Equal(t, "/user.slice/user-1000.slice/session-2.scope", parseCgroup("0::/user.slice/user-1000.slice/session-2.scope\n"))
+	})
+
+	t.Run("Hybrid", func(t *testing.T) {
+		assert.Equal(t, "/unified", parseCgroup("1:name=systemd:/legacy\n0::/unified\n"))
+	})
+
+	t.Run("V1", func(t *testing.T) {
+		assert.Equal(t, "/docker/abc", parseCgroup("12:cpuset:/docker/abc\n11:memory:/docker/abc\n"))
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		assert.Empty(t, parseCgroup(""))
+	})
+}
+
+func TestContainerFromCgroup(t *testing.T) {
+	id := "4f2c7d9e1b3a5c6d8e0f1a2b3c4d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b1c2d"
+
+	tests := []struct {
+		name     string
+		cgroup   string
+		expected string
+	}{
+		{"Host", "/user.slice/user-1000.slice/session-2.scope", ""},
+		{"DockerSystemd", "/system.slice/docker-" + id + ".scope", id},
+		{"DockerCgroupfs", "/docker/" + id, id},
+		{"Podman", "/user.slice/user-1000.slice/user@1000.service/user.slice/libpod-" + id + ".scope/container", id},
+		{"Kubernetes", "/kubepods/besteffort/pod1234/" + id, id},
+		{"KubernetesContainerd", "/kubepods.slice/kubepods-pod1234.slice/cri-containerd-" + id + ".scope", id},
+		{"LXC", "/lxc.payload.dev/init.scope", "dev"},
+		{"ShortHex", "/docker/abc", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, containerFromCgroup(tt.cgroup))
+		})
+	}
+}
+
+func TestReadProcess(t *testing.T) {
+	creds := UnixCreds{PID: os.Getpid()}
+	readProcess(&creds)
+
+	expected, err := os.Executable()
+	require.NoError(t, err)
+
+	assert.Equal(t, expected, creds.Exe)
+	assert.Equal(t, os.Args, creds.Cmdline)
+	assert.Empty(t, creds.Container)
+}
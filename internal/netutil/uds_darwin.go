@@ -14,6 +14,7 @@ func UnixSocketCreds(conn net.Conn) (UnixCreds, error) {
 	if !ok {
 		return UnixCreds{
 			UID: -1,
+			GID: -1,
 			PID: -1,
 		}, nil
 	}
@@ -54,8 +55,17 @@ func UnixSocketCreds(conn net.Conn) (UnixCreds, error) {
 		return UnixCreds{}, interr
 	}
 
-	return UnixCreds{
+	creds := UnixCreds{
 		UID: int(cred.Uid),
+		GID: -1,
 		PID: pid,
-	}, nil
+	}
+
+	if cred.Ngroups > 0 {
+		creds.GID = int(cred.Groups[0])
+	}
+
+	readProcess(&creds)
+
+	return creds, nil
 }
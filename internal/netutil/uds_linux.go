@@ -12,6 +12,7 @@ func UnixSocketCreds(conn net.Conn) (UnixCreds, error) {
 	if !ok {
 		return UnixCreds{
 			UID: -1,
+			GID: -1,
 			PID: -1,
 		}, nil
 	}
@@ -33,8 +34,13 @@ func UnixSocketCreds(conn net.Conn) (UnixCreds, error) {
 		return UnixCreds{}, fmt.Errorf("failed to get peer credentials: %w", err)
 	}
 
-	return UnixCreds{
+	creds := UnixCreds{
 		UID: int(cred.Uid),
+		GID: int(cred.Gid),
 		PID: int(cred.Pid),
-	}, nil
+	}
+
+	readProcess(&creds)
+
+	return creds, nil
 }
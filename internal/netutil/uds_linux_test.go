@@ -2,9 +2,12 @@ package netutil
 
 import (
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestUnixSocketCreds_NonUnixConn(t *testing.T) {
@@ -29,3 +32,31 @@ func TestUnixSocketCreds_NonUnixConn(t *testing.T) {
 	assert.Equal(t, -1, creds.UID)
 	assert.Equal(t, -1, creds.PID)
 }
+
+func TestUnixSocketCreds_PeerProcess(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "test.sock")
+
+	ln, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+	defer ln.Close()
+
+	conn, err := net.Dial("unix", socketPath)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	serverConn, err := ln.Accept()
+	require.NoError(t, err)
+	defer serverConn.Close()
+
+	creds, err := UnixSocketCreds(serverConn)
+	require.NoError(t, err)
+
+	expected, err := os.Executable()
+	require.NoError(t, err)
+
+	assert.Equal(t, os.Getpid(), creds.PID)
+	assert.Equal(t, os.Getuid(), creds.UID)
+	assert.Equal(t, os.Getgid(), creds.GID)
+	assert.Equal(t, expected, creds.Exe)
+	assert.Equal(t, os.Args, creds.Cmdline)
+}
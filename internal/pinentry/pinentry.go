@@ -0,0 +1,202 @@
+// Package pinentry asks for a PIN with a pinentry program, e.g. pinentry-gnome3 or pinentry-curses,
+// over the Assuan protocol.
+package pinentry
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrCancelled = errors.New("pin entry was cancelled")
+)
+
+// errCodeCancelled is the libgpg-error code sent by pinentry when the dialog is closed
+const errCodeCancelled = 99
+
+// Request describes the dialog shown by pinentry
+type Request struct {
+	Title       string
+	Description string
+	Prompt      string
+	// Error is shown above the prompt, e.g. after a wrong PIN
+	Error string
+	// Timeout closes the dialog, zero keeps it open until ctx is done
+	Timeout time.Duration
+}
+
+// GetPIN runs the pinentry program and returns the entered PIN.
+// The program is stopped when ctx is done.
+func GetPIN(ctx context.Context, program string, req Request) (string, error) {
+	cmd := exec.CommandContext(ctx, program) //nolint:gosec
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return "", err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("failed to run pinentry: %w", err)
+	}
+
+	defer func() {
+		stdin.Close()
+		cmd.Wait()
+	}()
+
+	conn := &client{
+		w: stdin,
+		r: bufio.NewReader(stdout),
+	}
+
+	pin, err := conn.getPIN(req)
+	if err != nil && ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+
+	return pin, err
+}
+
+type client struct {
+	w io.Writer
+	r *bufio.Reader
+}
+
+func (c *client) getPIN(req Request) (string, error) {
+	if _, err := c.response(); err != nil {
+		return "", fmt.Errorf("pinentry did not start: %w", err)
+	}
+
+	var commands []string
+
+	// terminal pinentry programs draw on the tty of the agent, as set by gpg
+	if tty := os.Getenv("GPG_TTY"); tty != "" {
+		commands = append(commands, "OPTION ttyname="+escape(tty))
+	}
+
+	if term := os.Getenv("TERM"); term != "" {
+		commands = append(commands, "OPTION ttytype="+escape(term))
+	}
+
+	for _, row := range []struct{ cmd, value string }{
+		{"SETTITLE", req.Title},
+		{"SETDESC", req.Description},
+		{"SETPROMPT", req.Prompt},
+		{"SETERROR", req.Error},
+	} {
+		if row.value != "" {
+			commands = append(commands, row.cmd+" "+escape(row.value))
+		}
+	}
+
+	if req.Timeout > 0 {
+		commands = append(commands, fmt.Sprintf("SETTIMEOUT %d", int(req.Timeout.Seconds())))
+	}
+
+	for _, command := range commands {
+		if err := c.send(command); err != nil {
+			return "", err
+		}
+
+		// options unknown to the program are not fatal
+		if _, err := c.response(); err != nil && !strings.HasPrefix(command, "OPTION ") {
+			return "", err
+		}
+	}
+
+	if err := c.send("GETPIN"); err != nil {
+		return "", err
+	}
+
+	pin, err := c.response()
+	if err != nil {
+		return "", err
+	}
+
+	c.send("BYE")
+
+	return pin, nil
+}
+
+func (c *client) send(command string) error {
+	if _, err := io.WriteString(c.w, command+"\n"); err != nil {
+		return fmt.Errorf("failed to write to pinentry: %w", err)
+	}
+
+	return nil
+}
+
+// response reads lines until OK or ERR and returns the data lines
+func (c *client) response() (string, error) {
+	var data strings.Builder
+
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return "", fmt.Errorf("failed to read from pinentry: %w", err)
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "OK", strings.HasPrefix(line, "OK "):
+			return data.String(), nil
+
+		case strings.HasPrefix(line, "D "):
+			data.WriteString(unescape(line[2:]))
+
+		case strings.HasPrefix(line, "ERR "):
+			return "", responseError(line[4:])
+		}
+
+		// status lines and comments are ignored
+	}
+}
+
+// responseError parses "ERR <code> <description>", the low 16 bits of the code are the error
+func responseError(value string) error {
+	code, _, _ := strings.Cut(value, " ")
+
+	if parsed, err := strconv.ParseUint(code, 10, 32); err == nil && parsed&0xffff == errCodeCancelled {
+		return ErrCancelled
+	}
+
+	return fmt.Errorf("pinentry failed: %s", value)
+}
+
+// escape encodes the characters that end an Assuan line
+func escape(value string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(value)
+}
+
+func unescape(value string) string {
+	var out strings.Builder
+
+	for i := 0; i < len(value); i++ {
+		if value[i] == '%' && i+2 < len(value) {
+			if b, err := strconv.ParseUint(value[i+1:i+3], 16, 8); err == nil {
+				out.WriteByte(byte(b))
+				i += 2
+
+				continue
+			}
+		}
+
+		out.WriteByte(value[i])
+	}
+
+	return out.String()
+}
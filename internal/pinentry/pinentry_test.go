@@ -0,0 +1,101 @@
+package pinentry
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePinentry writes a pinentry program that logs the commands it gets and answers GETPIN with reply
+func fakePinentry(t *testing.T, reply string) (string, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "commands")
+	program := filepath.Join(dir, "pinentry")
+
+	script := `#!/bin/sh
+echo "OK Pleased to meet you"
+while read -r line; do
+	echo "$line" >> "` + logPath + `"
+	case "$line" in
+	GETPIN) cat <<'END'
+` + reply + `
+END
+	;;
+	BYE) echo OK; exit 0 ;;
+	*) echo OK ;;
+	esac
+done
+`
+
+	require.NoError(t, os.WriteFile(program, []byte(script), 0700))
+
+	return program, logPath
+}
+
+func TestGetPIN(t *testing.T) {
+	t.Run("Entered", func(t *testing.T) {
+		program, logPath := fakePinentry(t, "D 12%2534\nOK")
+
+		pin, err := GetPIN(context.Background(), program, Request{
+			Title:       "OneAuth",
+			Description: "Enter the PIN\nof YubiKey 42",
+			Prompt:      "PIN:",
+			Timeout:     30 * time.Second,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, "12%34", pin)
+
+		commands, err := os.ReadFile(logPath)
+		require.NoError(t, err)
+		assert.Contains(t, string(commands), "SETTITLE OneAuth\n")
+		assert.Contains(t, string(commands), "SETDESC Enter the PIN%0Aof YubiKey 42\n")
+		assert.Contains(t, string(commands), "SETPROMPT PIN:\n")
+		assert.Contains(t, string(commands), "SETTIMEOUT 30\n")
+		assert.NotContains(t, string(commands), "SETERROR")
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		program, _ := fakePinentry(t, "ERR 83886179 Operation cancelled <Pinentry>")
+
+		_, err := GetPIN(context.Background(), program, Request{Prompt: "PIN:"})
+		assert.ErrorIs(t, err, ErrCancelled)
+	})
+
+	t.Run("Failed", func(t *testing.T) {
+		program, _ := fakePinentry(t, "ERR 83886360 No pinentry <Pinentry>")
+
+		_, err := GetPIN(context.Background(), program, Request{Prompt: "PIN:"})
+		assert.ErrorContains(t, err, "pinentry failed")
+		assert.NotErrorIs(t, err, ErrCancelled)
+	})
+
+	t.Run("MissingProgram", func(t *testing.T) {
+		_, err := GetPIN(context.Background(), filepath.Join(t.TempDir(), "missing"), Request{})
+		assert.ErrorContains(t, err, "failed to run pinentry")
+	})
+
+	t.Run("ContextDone", func(t *testing.T) {
+		dir := t.TempDir()
+		program := filepath.Join(dir, "pinentry")
+		require.NoError(t, os.WriteFile(program, []byte("#!/bin/sh\nexec sleep 10\n"), 0700))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		_, err := GetPIN(ctx, program, Request{})
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+func TestEscape(t *testing.T) {
+	assert.Equal(t, "100%25 sure%0Aok", escape("100% sure\nok"))
+	assert.Equal(t, "100% sure\nok", unescape("100%25 sure%0Aok"))
+	assert.Equal(t, "50%", unescape("50%"))
+}
@@ -0,0 +1,115 @@
+package policy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeWindow is a range of minutes since midnight, end is exclusive
+type timeWindow struct {
+	start int
+	end   int
+}
+
+func parseTimeWindow(value string) (*timeWindow, error) {
+	startValue, endValue, ok := strings.Cut(value, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid hours %q: expected HH:MM-HH:MM", value)
+	}
+
+	start, err := parseClock(strings.TrimSpace(startValue))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hours %q: %w", value, err)
+	}
+
+	end, err := parseClock(strings.TrimSpace(endValue))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hours %q: %w", value, err)
+	}
+
+	if start == end {
+		return nil, fmt.Errorf("invalid hours %q: empty window", value)
+	}
+
+	return &timeWindow{start: start, end: end}, nil
+}
+
+func parseClock(value string) (int, error) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+func (w *timeWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+
+	if w.start < w.end {
+		return minute >= w.start && minute < w.end
+	}
+
+	// the window wraps over midnight
+	return minute >= w.start || minute < w.end
+}
+
+func parseWeekday(value string) (time.Weekday, error) {
+	switch strings.ToLower(value) {
+	case "sun", "sunday":
+		return time.Sunday, nil
+	case "mon", "monday":
+		return time.Monday, nil
+	case "tue", "tuesday":
+		return time.Tuesday, nil
+	case "wed", "wednesday":
+		return time.Wednesday, nil
+	case "thu", "thursday":
+		return time.Thursday, nil
+	case "fri", "friday":
+		return time.Friday, nil
+	case "sat", "saturday":
+		return time.Saturday, nil
+	default:
+		return 0, fmt.Errorf("invalid weekday %q", value)
+	}
+}
+
+type rateLimit struct {
+	count  int
+	period time.Duration
+}
+
+func parseRateLimit(value string) (*rateLimit, error) {
+	countValue, periodValue, ok := strings.Cut(value, "/")
+	if !ok {
+		return nil, fmt.Errorf("invalid rate limit %q: expected COUNT/PERIOD", value)
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(countValue))
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("invalid rate limit %q: count must be a positive number", value)
+	}
+
+	period, err := time.ParseDuration(strings.TrimSpace(periodValue))
+	if err != nil || period <= 0 {
+		return nil, fmt.Errorf("invalid rate limit %q: period must be a positive duration", value)
+	}
+
+	return &rateLimit{count: count, period: period}, nil
+}
+
+// exceeded reports whether the recent requests, including the current one, are over the limit
+func (l *rateLimit) exceeded(recent []time.Time, now time.Time) bool {
+	count := 0
+
+	for _, t := range recent {
+		if now.Sub(t) <= l.period {
+			count++
+		}
+	}
+
+	return count > l.count
+}
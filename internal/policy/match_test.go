@@ -0,0 +1,77 @@
+package policy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTimeWindow(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2026, 1, 2, hour, minute, 0, 0, time.UTC)
+	}
+
+	t.Run("Day", func(t *testing.T) {
+		window, err := parseTimeWindow("09:00-18:30")
+		require.NoError(t, err)
+
+		assert.False(t, window.contains(at(8, 59)))
+		assert.True(t, window.contains(at(9, 0)))
+		assert.True(t, window.contains(at(18, 29)))
+		assert.False(t, window.contains(at(18, 30)))
+	})
+
+	t.Run("OverMidnight", func(t *testing.T) {
+		window, err := parseTimeWindow("22:00 - 06:00")
+		require.NoError(t, err)
+
+		assert.True(t, window.contains(at(23, 0)))
+		assert.True(t, window.contains(at(5, 59)))
+		assert.False(t, window.contains(at(6, 0)))
+		assert.False(t, window.contains(at(12, 0)))
+	})
+
+	for _, value := range []string{"09:00", "9-18", "09:00-25:00", "10:00-10:00"} {
+		t.Run("Invalid_"+value, func(t *testing.T) {
+			_, err := parseTimeWindow(value)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestParseWeekday(t *testing.T) {
+	day, err := parseWeekday("Mon")
+	require.NoError(t, err)
+	assert.Equal(t, time.Monday, day)
+
+	day, err = parseWeekday("sunday")
+	require.NoError(t, err)
+	assert.Equal(t, time.Sunday, day)
+
+	_, err = parseWeekday("funday")
+	assert.Error(t, err)
+}
+
+func TestParseRateLimit(t *testing.T) {
+	limit, err := parseRateLimit("10/1m")
+	require.NoError(t, err)
+	assert.Equal(t, &rateLimit{count: 10, period: time.Minute}, limit)
+
+	for _, value := range []string{"10", "0/1m", "x/1m", "10/", "10/-1m"} {
+		t.Run("Invalid_"+value, func(t *testing.T) {
+			_, err := parseRateLimit(value)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestRateLimit_Exceeded(t *testing.T) {
+	limit := &rateLimit{count: 2, period: time.Minute}
+	now := time.Now()
+
+	assert.False(t, limit.exceeded([]time.Time{now}, now))
+	assert.False(t, limit.exceeded([]time.Time{now.Add(-2 * time.Minute), now.Add(-time.Second), now}, now))
+	assert.True(t, limit.exceeded([]time.Time{now.Add(-30 * time.Second), now.Add(-time.Second), now}, now))
+}
@@ -0,0 +1,313 @@
+package policy
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vitalvas/oneauth/internal/netutil"
+)
+
+type Action string
+
+const (
+	ActionAllow   Action = "allow"
+	ActionDeny    Action = "deny"
+	ActionConfirm Action = "confirm"
+)
+
+// Config is the signing policy, rules are evaluated in order and the first matching rule decides
+type Config struct {
+	// DryRun logs decisions without enforcing them
+	DryRun bool `yaml:"dry_run,omitempty"`
+	// Default is the action when no rule matches, allow when empty
+	Default Action `yaml:"default,omitempty"`
+	Rules   []Rule `yaml:"rules,omitempty"`
+}
+
+// Rule matches a sign request, empty fields match everything
+type Rule struct {
+	Name   string `yaml:"name,omitempty"`
+	Action Action `yaml:"action"`
+
+	// Agents are agent names, "default" is the YubiKey agent
+	Agents []string `yaml:"agents,omitempty"`
+	// Keys are PIV slots (e.g. "9a") or key fingerprints (SHA256:...)
+	Keys []string `yaml:"keys,omitempty"`
+	// Exe are glob patterns of the requesting executable, patterns without a slash match the file name
+	Exe  []string `yaml:"exe,omitempty"`
+	UIDs []int    `yaml:"uids,omitempty"`
+	// Hosts are fingerprints of destination host keys, known from session-bind@openssh.com
+	Hosts []string `yaml:"hosts,omitempty"`
+	// Users are destination users from the signed userauth request
+	Users []string `yaml:"users,omitempty"`
+
+	// Hours is a local time window such as "09:00-18:00", it may wrap over midnight
+	Hours string `yaml:"hours,omitempty"`
+	// Weekdays are the days the rule applies on: mon, tue, wed, thu, fri, sat, sun
+	Weekdays []string `yaml:"weekdays,omitempty"`
+
+	// RateLimit such as "10/1m" makes the rule match only once the key
+	// got more sign requests within the period than the count
+	RateLimit string `yaml:"rate_limit,omitempty"`
+}
+
+// Request describes a sign request
+type Request struct {
+	Agent       string
+	Fingerprint string
+	Slot        string
+	Exe         string
+	UID         int
+	HostKey     string
+	User        string
+	Time        time.Time
+}
+
+// Decision is the result of evaluating a request
+type Decision struct {
+	Action Action
+	// Rule is the name of the matching rule, empty when the default action was used
+	Rule   string
+	DryRun bool
+}
+
+func (d Decision) String() string {
+	out := string(d.Action)
+
+	if d.Rule != "" {
+		out += fmt.Sprintf(" (rule %s)", d.Rule)
+	}
+
+	if d.DryRun {
+		out += " (dry run)"
+	}
+
+	return out
+}
+
+type compiledRule struct {
+	Rule
+
+	hours     *timeWindow
+	weekdays  []time.Weekday
+	rateLimit *rateLimit
+}
+
+// Engine evaluates sign requests against the policy
+type Engine struct {
+	lock sync.Mutex
+
+	dryRun        bool
+	defaultAction Action
+	rules         []compiledRule
+
+	// requests holds the time of recent sign requests per key for rate limits
+	requests  map[string][]time.Time
+	maxPeriod time.Duration
+}
+
+// New validates the policy, a nil engine allows everything
+func New(conf Config) (*Engine, error) {
+	engine := &Engine{
+		dryRun:        conf.DryRun,
+		defaultAction: conf.Default,
+		requests:      make(map[string][]time.Time),
+	}
+
+	if engine.defaultAction == "" {
+		engine.defaultAction = ActionAllow
+	}
+
+	if err := validateAction(engine.defaultAction); err != nil {
+		return nil, fmt.Errorf("default: %w", err)
+	}
+
+	for i, rule := range conf.Rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+
+		compiled, err := compileRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %w", name, err)
+		}
+
+		compiled.Name = name
+
+		if compiled.rateLimit != nil && compiled.rateLimit.period > engine.maxPeriod {
+			engine.maxPeriod = compiled.rateLimit.period
+		}
+
+		engine.rules = append(engine.rules, compiled)
+	}
+
+	return engine, nil
+}
+
+func validateAction(action Action) error {
+	switch action {
+	case ActionAllow, ActionDeny, ActionConfirm:
+		return nil
+
+	default:
+		return fmt.Errorf("unknown action %q", action)
+	}
+}
+
+func compileRule(rule Rule) (compiledRule, error) {
+	compiled := compiledRule{Rule: rule}
+
+	if err := validateAction(rule.Action); err != nil {
+		return compiled, err
+	}
+
+	for _, pattern := range rule.Exe {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return compiled, fmt.Errorf("invalid exe pattern %q: %w", pattern, err)
+		}
+	}
+
+	if rule.Hours != "" {
+		hours, err := parseTimeWindow(rule.Hours)
+		if err != nil {
+			return compiled, err
+		}
+
+		compiled.hours = hours
+	}
+
+	for _, day := range rule.Weekdays {
+		weekday, err := parseWeekday(day)
+		if err != nil {
+			return compiled, err
+		}
+
+		compiled.weekdays = append(compiled.weekdays, weekday)
+	}
+
+	if rule.RateLimit != "" {
+		limit, err := parseRateLimit(rule.RateLimit)
+		if err != nil {
+			return compiled, err
+		}
+
+		compiled.rateLimit = limit
+	}
+
+	return compiled, nil
+}
+
+// Evaluate returns the decision for the request and counts it for rate limits
+func (e *Engine) Evaluate(req Request) Decision {
+	if e == nil {
+		return Decision{Action: ActionAllow}
+	}
+
+	if req.Time.IsZero() {
+		req.Time = time.Now()
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	recent := e.countRequest(req.Fingerprint, req.Time)
+
+	decision := Decision{
+		Action: e.defaultAction,
+		DryRun: e.dryRun,
+	}
+
+	for _, rule := range e.rules {
+		if rule.match(req, recent) {
+			decision.Action = rule.Action
+			decision.Rule = rule.Name
+			break
+		}
+	}
+
+	return decision
+}
+
+// countRequest records the request and returns the recent requests for the key
+func (e *Engine) countRequest(fingerprint string, now time.Time) []time.Time {
+	if e.maxPeriod == 0 {
+		return nil
+	}
+
+	for fp, times := range e.requests {
+		times = slices.DeleteFunc(times, func(t time.Time) bool {
+			return now.Sub(t) > e.maxPeriod
+		})
+
+		if len(times) == 0 {
+			delete(e.requests, fp)
+		} else {
+			e.requests[fp] = times
+		}
+	}
+
+	e.requests[fingerprint] = append(e.requests[fingerprint], now)
+
+	return e.requests[fingerprint]
+}
+
+func (r compiledRule) match(req Request, recent []time.Time) bool {
+	if len(r.Agents) > 0 && !slices.Contains(r.Agents, req.Agent) {
+		return false
+	}
+
+	if len(r.Keys) > 0 && !r.matchKey(req) {
+		return false
+	}
+
+	if len(r.Exe) > 0 && !netutil.MatchExe(r.Exe, req.Exe) {
+		return false
+	}
+
+	if len(r.UIDs) > 0 && !slices.Contains(r.UIDs, req.UID) {
+		return false
+	}
+
+	if len(r.Hosts) > 0 && !slices.Contains(r.Hosts, req.HostKey) {
+		return false
+	}
+
+	if len(r.Users) > 0 && !slices.Contains(r.Users, req.User) {
+		return false
+	}
+
+	local := req.Time.Local()
+
+	if r.hours != nil && !r.hours.contains(local) {
+		return false
+	}
+
+	if len(r.weekdays) > 0 && !slices.Contains(r.weekdays, local.Weekday()) {
+		return false
+	}
+
+	if r.rateLimit != nil && !r.rateLimit.exceeded(recent, req.Time) {
+		return false
+	}
+
+	return true
+}
+
+func (r compiledRule) matchKey(req Request) bool {
+	for _, key := range r.Keys {
+		if key == req.Fingerprint {
+			return true
+		}
+
+		if req.Slot != "" && strings.EqualFold(strings.TrimPrefix(key, "0x"), req.Slot) {
+			return true
+		}
+	}
+
+	return false
+}
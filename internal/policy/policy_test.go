@@ -0,0 +1,177 @@
+package policy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	t.Run("Empty", func(t *testing.T) {
+		engine, err := New(Config{})
+		require.NoError(t, err)
+		assert.Equal(t, ActionAllow, engine.defaultAction)
+	})
+
+	t.Run("RuleNames", func(t *testing.T) {
+		engine, err := New(Config{
+			Rules: []Rule{
+				{Name: "named", Action: ActionDeny},
+				{Action: ActionAllow},
+			},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, "named", engine.rules[0].Name)
+		assert.Equal(t, "#2", engine.rules[1].Name)
+	})
+
+	tests := []struct {
+		name string
+		conf Config
+		err  string
+	}{
+		{"InvalidDefault", Config{Default: "maybe"}, `default: unknown action "maybe"`},
+		{"MissingAction", Config{Rules: []Rule{{Name: "x"}}}, `rule x: unknown action ""`},
+		{"InvalidExe", Config{Rules: []Rule{{Action: ActionDeny, Exe: []string{"["}}}}, "invalid exe pattern"},
+		{"InvalidHours", Config{Rules: []Rule{{Action: ActionDeny, Hours: "9-18"}}}, "invalid hours"},
+		{"InvalidWeekday", Config{Rules: []Rule{{Action: ActionDeny, Weekdays: []string{"someday"}}}}, "invalid weekday"},
+		{"InvalidRateLimit", Config{Rules: []Rule{{Action: ActionDeny, RateLimit: "10"}}}, "invalid rate limit"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := New(test.conf)
+			assert.ErrorContains(t, err, test.err)
+		})
+	}
+}
+
+func TestEngine_Evaluate(t *testing.T) {
+	// Friday 2026-01-02 12:00 local time
+	noon := time.Date(2026, 1, 2, 12, 0, 0, 0, time.Local)
+
+	base := Request{
+		Agent:       "default",
+		Fingerprint: "SHA256:key",
+		Slot:        "9a",
+		Exe:         "/usr/bin/ssh",
+		UID:         1000,
+		HostKey:     "SHA256:host",
+		User:        "git",
+		Time:        noon,
+	}
+
+	tests := []struct {
+		name  string
+		rule  Rule
+		req   func(req *Request)
+		match bool
+	}{
+		{"MatchAll", Rule{}, nil, true},
+		{"Agent", Rule{Agents: []string{"default"}}, nil, true},
+		{"OtherAgent", Rule{Agents: []string{"work"}}, nil, false},
+		{"Slot", Rule{Keys: []string{"9A"}}, nil, true},
+		{"SlotWithPrefix", Rule{Keys: []string{"0x9a"}}, nil, true},
+		{"Fingerprint", Rule{Keys: []string{"SHA256:key"}}, nil, true},
+		{"OtherKey", Rule{Keys: []string{"9c", "SHA256:other"}}, nil, false},
+		{"SlotOnSoftKey", Rule{Keys: []string{"9a"}}, func(req *Request) { req.Slot = "" }, false},
+		{"ExePath", Rule{Exe: []string{"/usr/bin/*"}}, nil, true},
+		{"ExeName", Rule{Exe: []string{"ssh"}}, nil, true},
+		{"OtherExe", Rule{Exe: []string{"node", "/usr/local/bin/*"}}, nil, false},
+		{"UnknownExe", Rule{Exe: []string{"*"}}, func(req *Request) { req.Exe = "" }, false},
+		{"UID", Rule{UIDs: []int{1000}}, nil, true},
+		{"OtherUID", Rule{UIDs: []int{0}}, nil, false},
+		{"Host", Rule{Hosts: []string{"SHA256:host"}}, nil, true},
+		{"UnboundHost", Rule{Hosts: []string{"SHA256:host"}}, func(req *Request) { req.HostKey = "" }, false},
+		{"User", Rule{Users: []string{"git"}}, nil, true},
+		{"OtherUser", Rule{Users: []string{"root"}}, nil, false},
+		{"Hours", Rule{Hours: "09:00-18:00"}, nil, true},
+		{"OutsideHours", Rule{Hours: "18:00-09:00"}, nil, false},
+		{"HoursOverMidnight", Rule{Hours: "22:00-06:00"}, func(req *Request) { req.Time = noon.Add(13 * time.Hour) }, true},
+		{"Weekday", Rule{Weekdays: []string{"fri"}}, nil, true},
+		{"OtherWeekday", Rule{Weekdays: []string{"sat", "sunday"}}, nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.rule.Action = ActionDeny
+
+			engine, err := New(Config{Rules: []Rule{test.rule}})
+			require.NoError(t, err)
+
+			req := base
+			if test.req != nil {
+				test.req(&req)
+			}
+
+			decision := engine.Evaluate(req)
+
+			if test.match {
+				assert.Equal(t, Decision{Action: ActionDeny, Rule: "#1"}, decision)
+			} else {
+				assert.Equal(t, Decision{Action: ActionAllow}, decision)
+			}
+		})
+	}
+}
+
+func TestEngine_EvaluateOrder(t *testing.T) {
+	engine, err := New(Config{
+		Default: ActionConfirm,
+		Rules: []Rule{
+			{Name: "deny-node", Action: ActionDeny, Exe: []string{"node"}},
+			{Name: "allow-ssh", Action: ActionAllow, Exe: []string{"ssh"}},
+			{Name: "deny-all", Action: ActionDeny},
+		},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, Decision{Action: ActionDeny, Rule: "deny-node"}, engine.Evaluate(Request{Exe: "/usr/bin/node"}))
+	assert.Equal(t, Decision{Action: ActionAllow, Rule: "allow-ssh"}, engine.Evaluate(Request{Exe: "/usr/bin/ssh"}))
+	assert.Equal(t, Decision{Action: ActionDeny, Rule: "deny-all"}, engine.Evaluate(Request{Exe: "/usr/bin/git"}))
+
+	engine, err = New(Config{Default: ActionConfirm, DryRun: true})
+	require.NoError(t, err)
+
+	assert.Equal(t, Decision{Action: ActionConfirm, DryRun: true}, engine.Evaluate(Request{}))
+}
+
+func TestEngine_RateLimit(t *testing.T) {
+	engine, err := New(Config{
+		Rules: []Rule{
+			{Name: "burst", Action: ActionDeny, RateLimit: "2/1m"},
+		},
+	})
+	require.NoError(t, err)
+
+	now := time.Now()
+
+	evaluate := func(fp string, at time.Duration) Action {
+		return engine.Evaluate(Request{Fingerprint: fp, Time: now.Add(at)}).Action
+	}
+
+	assert.Equal(t, ActionAllow, evaluate("SHA256:a", 0))
+	assert.Equal(t, ActionAllow, evaluate("SHA256:a", time.Second))
+	assert.Equal(t, ActionDeny, evaluate("SHA256:a", 2*time.Second))
+
+	// counted per key
+	assert.Equal(t, ActionAllow, evaluate("SHA256:b", 3*time.Second))
+
+	// old requests drop out of the period
+	assert.Equal(t, ActionAllow, evaluate("SHA256:a", 2*time.Minute))
+	assert.NotContains(t, engine.requests, "SHA256:b")
+}
+
+func TestEngine_Nil(t *testing.T) {
+	var engine *Engine
+
+	assert.Equal(t, Decision{Action: ActionAllow}, engine.Evaluate(Request{}))
+}
+
+func TestDecision_String(t *testing.T) {
+	assert.Equal(t, "allow", Decision{Action: ActionAllow}.String())
+	assert.Equal(t, "deny (rule npm)", Decision{Action: ActionDeny, Rule: "npm"}.String())
+	assert.Equal(t, "confirm (rule x) (dry run)", Decision{Action: ActionConfirm, Rule: "x", DryRun: true}.String())
+}
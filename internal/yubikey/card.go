@@ -18,18 +18,14 @@ func (c *Card) String() string {
 }
 
 func Cards() ([]Card, error) {
-	cards, err := piv.Cards()
+	readers, err := Readers()
 	if err != nil {
-		return nil, fmt.Errorf("failed to list cards: %w", err)
+		return nil, err
 	}
 
-	response := make([]Card, 0, len(cards))
-
-	for _, name := range cards {
-		if !strings.Contains(strings.ToLower(name), "yubikey") {
-			continue
-		}
+	response := make([]Card, 0, len(readers))
 
+	for _, name := range readers {
 		card, err := cardRead(name)
 		if err != nil {
 			return nil, fmt.Errorf("failed to read card: %w", err)
@@ -41,6 +37,24 @@ func Cards() ([]Card, error) {
 	return response, nil
 }
 
+// Readers returns the names of the PC/SC readers with a YubiKey, the cards are not opened
+func Readers() ([]string, error) {
+	cards, err := piv.Cards()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cards: %w", err)
+	}
+
+	readers := make([]string, 0, len(cards))
+
+	for _, name := range cards {
+		if strings.Contains(strings.ToLower(name), "yubikey") {
+			readers = append(readers, name)
+		}
+	}
+
+	return readers, nil
+}
+
 func cardRead(name string) (*Card, error) {
 	yk, err := piv.Open(name)
 	if err != nil {
@@ -2,6 +2,7 @@ package yubikey
 
 import (
 	"crypto/x509"
+	"fmt"
 
 	"github.com/go-piv/piv-go/v2/piv"
 )
@@ -16,3 +17,48 @@ type CertRequest struct {
 	CommonName string
 	Days       int
 }
+
+// NewInsecureCertRequest builds a request for a static SSH key in a PIV slot.
+// Supported key types are rsa2048, eccp256 and eccp384.
+func NewInsecureCertRequest(username, keyType, touchPolicy, pinPolicy string, days int) (CertRequest, error) {
+	touch, ok := MapTouchPolicy(touchPolicy)
+	if !ok {
+		return CertRequest{}, fmt.Errorf("unsupported touch policy: %s", touchPolicy)
+	}
+
+	pin, ok := MapPINPolicy(pinPolicy)
+	if !ok {
+		return CertRequest{}, fmt.Errorf("unsupported PIN policy: %s", pinPolicy)
+	}
+
+	if days <= 0 {
+		return CertRequest{}, fmt.Errorf("valid days must be positive")
+	}
+
+	req := CertRequest{
+		Days: days,
+		Key: piv.Key{
+			PINPolicy:   pin,
+			TouchPolicy: touch,
+		},
+	}
+
+	switch keyType {
+	case "rsa2048":
+		req.Algorithm = piv.AlgorithmRSA2048
+		req.CommonName = fmt.Sprintf("%s@%s", username, "insecure-rsa")
+
+	case "eccp256":
+		req.Algorithm = piv.AlgorithmEC256
+		req.CommonName = fmt.Sprintf("%s@%s", username, "insecure-ecdsa")
+
+	case "eccp384":
+		req.Algorithm = piv.AlgorithmEC384
+		req.CommonName = fmt.Sprintf("%s@%s", username, "insecure-ecdsa")
+
+	default:
+		return CertRequest{}, fmt.Errorf("unsupported key type: %s", keyType)
+	}
+
+	return req, nil
+}
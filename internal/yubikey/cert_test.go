@@ -247,3 +247,38 @@ func TestCertRequest_ValidationFields(t *testing.T) {
 		})
 	}
 }
+
+func TestNewInsecureCertRequest(t *testing.T) {
+	t.Run("RSA", func(t *testing.T) {
+		req, err := NewInsecureCertRequest("alice", "rsa2048", "cached", "once", 365)
+		require.NoError(t, err)
+
+		assert.Equal(t, "alice@insecure-rsa", req.CommonName)
+		assert.Equal(t, piv.AlgorithmRSA2048, req.Algorithm)
+		assert.Equal(t, piv.TouchPolicyCached, req.TouchPolicy)
+		assert.Equal(t, piv.PINPolicyOnce, req.PINPolicy)
+		assert.Equal(t, 365, req.Days)
+	})
+
+	t.Run("ECDSA", func(t *testing.T) {
+		req, err := NewInsecureCertRequest("alice", "eccp384", "never", "always", 1)
+		require.NoError(t, err)
+
+		assert.Equal(t, "alice@insecure-ecdsa", req.CommonName)
+		assert.Equal(t, piv.AlgorithmEC384, req.Algorithm)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := NewInsecureCertRequest("alice", "ed25519", "cached", "once", 1)
+		assert.Error(t, err)
+
+		_, err = NewInsecureCertRequest("alice", "eccp256", "sometimes", "once", 1)
+		assert.Error(t, err)
+
+		_, err = NewInsecureCertRequest("alice", "eccp256", "cached", "sometimes", 1)
+		assert.Error(t, err)
+
+		_, err = NewInsecureCertRequest("alice", "eccp256", "cached", "once", 0)
+		assert.Error(t, err)
+	})
+}
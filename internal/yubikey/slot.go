@@ -2,6 +2,8 @@ package yubikey
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/go-piv/piv-go/v2/piv"
 )
@@ -84,3 +86,13 @@ func SlotFromKeyID(keyID uint32) (Slot, error) {
 
 	return Slot{PIVSlot: pivSlot}, nil
 }
+
+// ParseSlot parses slot names written as "9a" or "0x9a"
+func ParseSlot(name string) (Slot, error) {
+	keyID, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(strings.TrimSpace(name)), "0x"), 16, 32)
+	if err != nil {
+		return Slot{}, fmt.Errorf("invalid slot: %s", name)
+	}
+
+	return SlotFromKeyID(uint32(keyID))
+}
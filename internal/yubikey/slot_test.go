@@ -137,3 +137,32 @@ func TestSlot_String(t *testing.T) {
 		})
 	}
 }
+
+func TestParseSlot(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected piv.Slot
+		wantErr  bool
+	}{
+		{name: "Plain", input: "9a", expected: piv.SlotAuthentication},
+		{name: "Prefixed", input: "0x9c", expected: piv.SlotSignature},
+		{name: "Uppercase", input: "0X9D", expected: piv.SlotKeyManagement},
+		{name: "Retired", input: "95", expected: SlotKeyRSA.PIVSlot},
+		{name: "Unknown", input: "01", wantErr: true},
+		{name: "Garbage", input: "slot", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slot, err := ParseSlot(tt.input)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, slot.PIVSlot)
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"sync"
 
 	"github.com/go-piv/piv-go/v2/piv"
 )
@@ -12,27 +13,32 @@ import (
 type Yubikey struct {
 	yk     *piv.YubiKey
 	Serial uint32
+
+	// name is read by the presence check of the agent while the card is reopened
+	nameLock sync.Mutex
+	name     string
 }
 
+// OpenBySerial opens the YubiKey with the serial. Cards that can not be read,
+// e.g. because they are held by another handle, are skipped.
 func OpenBySerial(serial uint32) (*Yubikey, error) {
-	cards, err := Cards()
+	readers, err := Readers()
 	if err != nil {
 		return nil, fmt.Errorf("failed to list cards: %w", err)
 	}
 
-	var card Card
-	for _, row := range cards {
-		if row.Serial == serial {
-			card = row
-			break
+	for _, name := range readers {
+		card, err := cardRead(name)
+		if err != nil {
+			continue
 		}
-	}
 
-	if card.Serial == 0 {
-		return nil, fmt.Errorf("yubikey with serial %d not found", serial)
+		if card.Serial == serial {
+			return Open(*card)
+		}
 	}
 
-	return Open(card)
+	return nil, fmt.Errorf("yubikey with serial %d not found", serial)
 }
 
 func Open(card Card) (*Yubikey, error) {
@@ -61,18 +67,35 @@ func Open(card Card) (*Yubikey, error) {
 
 	return &Yubikey{
 		yk:     yk,
+		name:   card.Name,
 		Serial: card.Serial,
 	}, nil
 }
 
+// Reader returns the name of the PC/SC reader of the card, it is empty until the card is opened
+func (y *Yubikey) Reader() string {
+	y.nameLock.Lock()
+	defer y.nameLock.Unlock()
+
+	return y.name
+}
+
 func (y *Yubikey) Close() error {
 	if y.yk != nil {
-		return y.yk.Close()
+		err := y.yk.Close()
+		y.yk = nil
+
+		return err
 	}
 
 	return nil
 }
 
+// Reopen opens the card again after it was closed or plugged in again
+func (y *Yubikey) Reopen() error {
+	return y.reOpen()
+}
+
 func (y *Yubikey) reOpen() error {
 	if y.yk != nil {
 		if _, err := y.yk.Serial(); err == nil {
@@ -96,6 +119,10 @@ func (y *Yubikey) reOpen() error {
 
 	y.yk = yk.yk
 
+	y.nameLock.Lock()
+	y.name = yk.name
+	y.nameLock.Unlock()
+
 	return nil
 }
 
@@ -228,6 +255,17 @@ func (y *Yubikey) PrivateKey(slot piv.Slot, public crypto.PublicKey, auth piv.Ke
 	return y.yk.PrivateKey(slot, public, auth)
 }
 
+// Version returns the firmware version of the YubiKey
+func (y *Yubikey) Version() string {
+	if y.yk == nil {
+		return ""
+	}
+
+	version := y.yk.Version()
+
+	return fmt.Sprintf("%d.%d.%d", version.Major, version.Minor, version.Patch)
+}
+
 func (y *Yubikey) Retries() (int, error) {
 	if err := y.reOpen(); err != nil {
 		return 0, err
@@ -29,6 +29,20 @@ func TestYubikey_Close(t *testing.T) {
 	})
 }
 
+func TestYubikey_Reader(t *testing.T) {
+	y := &Yubikey{Serial: 12345678}
+	assert.Empty(t, y.Reader())
+
+	y.name = "Yubico YubiKey OTP+FIDO+CCID 00 00"
+	assert.Equal(t, "Yubico YubiKey OTP+FIDO+CCID 00 00", y.Reader())
+}
+
+func TestYubikey_Reopen_NilYK(t *testing.T) {
+	y := &Yubikey{Serial: 12345678}
+	// With no hardware, the card is not found
+	assert.Error(t, y.Reopen())
+}
+
 func TestYubikey_ReOpen_NilYK_ZeroSerial(t *testing.T) {
 	y := &Yubikey{Serial: 0}
 	err := y.reOpen()